@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// netList is a set of networks that client addresses are matched against.
+// Single addresses are stored as full-length prefixes.
+type netList struct {
+	mu   sync.RWMutex
+	nets map[netip.Prefix]bool
+}
+
+var (
+	// deniedNets may not connect. When allowedNets is not empty, only
+	// clients in it may. Both start from DENIED_CIDRS and ALLOWED_CIDRS and
+	// are changed at runtime through /admin/deny and /admin/allow.
+	deniedNets  = &netList{nets: make(map[netip.Prefix]bool)}
+	allowedNets = &netList{nets: make(map[netip.Prefix]bool)}
+)
+
+func (l *netList) add(p netip.Prefix) {
+	l.mu.Lock()
+	l.nets[p] = true
+	l.mu.Unlock()
+}
+
+func (l *netList) remove(p netip.Prefix) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.nets[p] {
+		return false
+	}
+	delete(l.nets, p)
+	return true
+}
+
+func (l *netList) empty() bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.nets) == 0
+}
+
+func (l *netList) contains(addr netip.Addr) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for p := range l.nets {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// list returns the networks in CIDR notation, and single addresses bare.
+func (l *netList) list() []string {
+	l.mu.RLock()
+	nets := make([]string, 0, len(l.nets))
+	for p := range l.nets {
+		nets = append(nets, formatNet(p))
+	}
+	l.mu.RUnlock()
+
+	sort.Strings(nets)
+	return nets
+}
+
+// parseNet parses a CIDR or a single IP address.
+func parseNet(s string) (netip.Prefix, error) {
+	if p, err := netip.ParsePrefix(s); err == nil {
+		return p.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func formatNet(p netip.Prefix) string {
+	if p.IsSingleIP() {
+		return p.Addr().String()
+	}
+	return p.String()
+}
+
+// initAccessLists loads ALLOWED_CIDRS and DENIED_CIDRS.
+func initAccessLists(cfg *Config) error {
+	for _, l := range []struct {
+		list  *netList
+		items string
+	}{{allowedNets, cfg.AllowedCIDRs}, {deniedNets, cfg.DeniedCIDRs}} {
+		for _, item := range splitList(l.items) {
+			p, err := parseNet(item)
+			if err != nil {
+				return fmt.Errorf("invalid network %q (want a CIDR or an IP)", item)
+			}
+			l.list.add(p)
+		}
+	}
+	return nil
+}
+
+// clientAllowed reports whether a client at ip may connect: it is not
+// denied and, if there is an allow list, on it. Clients without an IP
+// address, such as unix socket peers, are local and always allowed.
+func clientAllowed(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return true
+	}
+	addr = addr.Unmap()
+	if deniedNets.contains(addr) {
+		return false
+	}
+	return allowedNets.empty() || allowedNets.contains(addr)
+}
+
+// restrictClients rejects requests from clients that clientAllowed refuses
+// before h (or a WebSocket upgrade) sees them.
+func restrictClients(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ip := clientIP(r); !clientAllowed(ip) {
+			debugLog("Rejected %s from %s: not allowed by access lists", r.URL.Path, ip)
+			writeError(w, forbidden.errorf("Forbidden"))
+			return
+		}
+		h(w, r)
+	}
+}
+
+// normalizeIP returns the canonical text form of ip, or "" if it is not an IP address.
+func normalizeIP(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	return parsed.String()
+}
+
+var (
+	// trustedProxies and trustUnixPeers are set once by initTrustedProxies.
+	trustedProxies []netip.Prefix
+	trustUnixPeers bool
+)
+
+// initTrustedProxies parses TRUSTED_PROXIES: CIDRs or single addresses, and
+// "unix" to trust every peer of a unix socket listener.
+func initTrustedProxies(cfg *Config) error {
+	for _, item := range splitList(cfg.TrustedProxies) {
+		if item == "unix" {
+			trustUnixPeers = true
+			continue
+		}
+		p, err := parseNet(item)
+		if err != nil {
+			return fmt.Errorf("invalid proxy %q (want a CIDR, an IP, or unix)", item)
+		}
+		trustedProxies = append(trustedProxies, p)
+	}
+	return nil
+}
+
+// trustedProxy reports whether ip is in TRUSTED_PROXIES.
+func trustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range trustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedClient returns the client a trusted proxy forwarded r for: the
+// rightmost address in Forwarded (or, without it, X-Forwarded-For) that is
+// not itself a trusted proxy. Hops left of it could be forged by the client
+// and are ignored. ok is false when the headers name no usable address.
+func forwardedClient(r *http.Request) (ip string, ok bool) {
+	hops := forwardedHops(r.Header.Values("Forwarded"))
+	if len(hops) == 0 {
+		for _, v := range r.Header.Values("X-Forwarded-For") {
+			hops = append(hops, strings.Split(v, ",")...)
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := normalizeIP(strings.TrimSpace(hops[i]))
+		if hop == "" {
+			// "unknown", an obfuscated identifier, or garbage: nothing
+			// further left can be trusted either.
+			return "", false
+		}
+		if i == 0 || !trustedProxy(hop) {
+			return hop, true
+		}
+	}
+	return "", false
+}
+
+// forwardedHops extracts the for= addresses of RFC 7239 Forwarded headers,
+// without quotes, brackets, or ports.
+func forwardedHops(values []string) []string {
+	var hops []string
+	for _, v := range values {
+		for _, element := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				k, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(k, "for") {
+					continue
+				}
+				val = strings.Trim(val, `"`)
+				if strings.HasPrefix(val, "[") {
+					// [v6] or [v6]:port
+					if end := strings.Index(val, "]"); end > 0 {
+						val = val[1:end]
+					}
+				} else if host, _, err := net.SplitHostPort(val); err == nil {
+					val = host
+				}
+				hops = append(hops, val)
+			}
+		}
+	}
+	return hops
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// requireAdmin wraps an admin handler with bearer-token authentication.
+// The admin API is disabled entirely when ADMIN_TOKEN is not configured.
+func (s *Server) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return requireBearer("ADMIN_TOKEN", s.config.AdminToken, next)
+}
+
+// requireBearer rejects requests whose bearer token does not match token, and
+// all requests when token (named by envName) is empty.
+func requireBearer(envName, token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			writeError(w, forbidden.errorf("Endpoint disabled (%s not set)", envName))
+			return
+		}
+
+		if !bearerMatches(r, token) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, unauthorized.errorf("Unauthorized"))
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// bearerMatches reports whether r carries "Authorization: Bearer <token>".
+func bearerMatches(r *http.Request, token string) bool {
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// handleAdminClients lists the connected WebSocket clients.
+func (s *Server) handleAdminClients(w http.ResponseWriter, r *http.Request) {
+	infos := s.listClients()
+	writeJSON(w, map[string]interface{}{
+		"count":   len(infos),
+		"clients": infos,
+	})
+}
+
+// handleAdminDisconnect force-closes a WebSocket client by connection ID.
+func (s *Server) handleAdminDisconnect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, methodNotAllowed.errorf("Method not allowed"))
+		return
+	}
+
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		writeError(w, badQuery.errorf("Invalid id"))
+		return
+	}
+
+	n := s.disconnectClients(func(c *client) bool { return c.id == id }, websocket.ClosePolicyViolation, "disconnected by operator")
+	if n == 0 {
+		writeError(w, notFound.errorf("Client not found"))
+		return
+	}
+	writeJSON(w, map[string]interface{}{"disconnected": n})
+}
+
+// handleAdminBroadcast reports broadcast channel depth and dropped frames.
+func (s *Server) handleAdminBroadcast(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.broadcastStats())
+}
+
+// handleAdminDeny manages the deny list: GET lists it, POST adds ?ip= (an
+// address or a CIDR), DELETE removes it.
+func (s *Server) handleAdminDeny(w http.ResponseWriter, r *http.Request) {
+	s.handleAdminNetList(w, r, deniedNets, "denied")
+}
+
+// handleAdminAllow manages the allow list as handleAdminDeny does the deny
+// list. Adding the first entry shuts out every client outside it.
+func (s *Server) handleAdminAllow(w http.ResponseWriter, r *http.Request) {
+	s.handleAdminNetList(w, r, allowedNets, "allowed")
+}
+
+// handleAdminNetList changes list, then closes the WebSocket connections of
+// clients that are no longer allowed.
+func (s *Server) handleAdminNetList(w http.ResponseWriter, r *http.Request, list *netList, name string) {
+	if r.Method == http.MethodGet {
+		writeJSON(w, map[string]interface{}{name: list.list()})
+		return
+	}
+
+	p, err := parseNet(r.URL.Query().Get("ip"))
+	if err != nil {
+		writeError(w, badQuery.errorf("Invalid ip"))
+		return
+	}
+	network := formatNet(p)
+
+	switch r.Method {
+	case http.MethodPost:
+		list.add(p)
+		infoLog("Added %s to %s list", network, name)
+	case http.MethodDelete:
+		if !list.remove(p) {
+			writeError(w, notFound.errorf("IP not %s", name))
+			return
+		}
+		infoLog("Removed %s from %s list", network, name)
+	default:
+		writeError(w, methodNotAllowed.errorf("Method not allowed"))
+		return
+	}
+	n := s.disconnectClients(func(c *client) bool { return !clientAllowed(c.ip) }, websocket.ClosePolicyViolation, "IP denied by operator")
+	if n > 0 {
+		infoLog("Closed %d connections no longer allowed", n)
+	}
+	writeJSON(w, map[string]interface{}{"ip": network, "disconnected": n})
+}
+
+// handleAdminPcap manages pcap replay: GET reports status, POST starts
+// ?path= (with optional speed= and rebase=), DELETE stops the running replay.
+// A replay runs under ctx, the server's lifetime, rather than the request's.
+func (s *Server) handleAdminPcap(ctx context.Context) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, map[string]interface{}{"status": s.pcapStatus()})
+		case http.MethodPost:
+			q := r.URL.Query()
+			path := q.Get("path")
+			if path == "" {
+				writeError(w, badQuery.errorf("Missing path"))
+				return
+			}
+			speed := 1.0
+			if v := q.Get("speed"); v != "" {
+				var err error
+				if speed, err = strconv.ParseFloat(v, 64); err != nil || speed < 0 {
+					writeError(w, badQuery.errorf("Invalid speed"))
+					return
+				}
+			}
+			rebase := q.Get("rebase") != "false"
+
+			// The replay outlives this request.
+			if _, err := s.startPcapReplay(ctx, path, speed, rebase); err != nil {
+				writeError(w, conflict.errorf("%v", err))
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+			writeJSON(w, map[string]interface{}{"status": s.pcapStatus()})
+		case http.MethodDelete:
+			if !s.stopPcapReplay() {
+				writeError(w, notFound.errorf("No replay running"))
+				return
+			}
+			writeJSON(w, map[string]interface{}{"stopped": true})
+		default:
+			writeError(w, methodNotAllowed.errorf("Method not allowed"))
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	aggregateDefaultLimit = 100
+	aggregateMaxLimit     = 10000
+	aggregateMaxExprLen   = 200
+)
+
+// aggregateReducers are the REDUCE functions /aggregate accepts; count takes
+// no field.
+var aggregateReducers = map[string]redis.SearchAggregator{
+	"count":          redis.SearchCount,
+	"count_distinct": redis.SearchCountDistinct,
+	"sum":            redis.SearchSum,
+	"min":            redis.SearchMin,
+	"max":            redis.SearchMax,
+	"avg":            redis.SearchAvg,
+	"stddev":         redis.SearchStdDev,
+}
+
+// aggregateFunctions are the APPLY functions an expression may call.
+var aggregateFunctions = map[string]bool{
+	"floor": true, "ceil": true, "abs": true, "sqrt": true,
+	"log": true, "log2": true, "exp": true,
+}
+
+var (
+	aggregateNameRe  = regexp.MustCompile(`^[a-z][a-z0-9_]{0,31}$`)
+	aggregateTokenRe = regexp.MustCompile(`^\s*(@[a-z][a-z0-9_]*|[a-z][a-z0-9_]*|[0-9]+(?:\.[0-9]+)?|[-+*/%^(),])`)
+)
+
+// aggregateFields are the idx:packets fields /aggregate can reference.
+func aggregateFields() map[string]bool {
+	fields := make(map[string]bool, len(packetIndexSchema))
+	for _, f := range packetIndexSchema {
+		if f.FieldType != redis.SearchFieldTypeGeo {
+			fields[f.As] = true
+		}
+	}
+	return fields
+}
+
+// checkApplyExpr validates an APPLY expression: @fields from known, numbers,
+// arithmetic operators, parentheses, and aggregateFunctions calls. It returns
+// the schema fields the expression reads, which must be loaded.
+func checkApplyExpr(expr string, known, schema map[string]bool) ([]string, error) {
+	if len(expr) > aggregateMaxExprLen {
+		return nil, errors.New("expression too long")
+	}
+	var refs []string
+	depth := 0
+	rest := expr
+	for strings.TrimSpace(rest) != "" {
+		m := aggregateTokenRe.FindStringSubmatch(rest)
+		if m == nil {
+			return nil, fmt.Errorf("unexpected %q", strings.TrimSpace(rest))
+		}
+		tok := m[1]
+		rest = rest[len(m[0]):]
+		switch {
+		case tok[0] == '@':
+			if !known[tok[1:]] {
+				return nil, fmt.Errorf("unknown field %s", tok)
+			}
+			if schema[tok[1:]] {
+				refs = append(refs, tok[1:])
+			}
+		case tok[0] >= 'a' && tok[0] <= 'z':
+			if !aggregateFunctions[tok] || !strings.HasPrefix(strings.TrimSpace(rest), "(") {
+				return nil, fmt.Errorf("unknown function %s", tok)
+			}
+		case tok == "(":
+			depth++
+		case tok == ")":
+			if depth--; depth < 0 {
+				return nil, errors.New("unbalanced parentheses")
+			}
+		}
+	}
+	if depth != 0 {
+		return nil, errors.New("unbalanced parentheses")
+	}
+	if len(refs) == 0 && !strings.Contains(expr, "@") {
+		return nil, errors.New("expression reads no field")
+	}
+	return refs, nil
+}
+
+// aggregateOptions turns the /aggregate parameters into FT.AGGREGATE
+// options:
+//
+//	apply=<name>:<expr>        computed field, e.g. minute:floor(@timestamp/60)*60
+//	groupby=<field>,...        group keys (index fields or apply names)
+//	reduce=<fn>[:<field>[:<as>]] e.g. count, sum:total_bytes:bytes
+//	sort=<field>[:asc|desc]    order of the result rows
+//
+// go-redis emits LOAD, APPLY, GROUPBY, SORTBY in that order, so applies are
+// computed per packet before grouping.
+func aggregateOptions(q url.Values) (*redis.FTAggregateOptions, error) {
+	schema := aggregateFields()
+	known := make(map[string]bool, len(schema))
+	for name := range schema {
+		known[name] = true
+	}
+	loaded := map[string]bool{}
+	opts := &redis.FTAggregateOptions{}
+
+	for _, v := range q["apply"] {
+		name, expr, ok := strings.Cut(v, ":")
+		if !ok || !aggregateNameRe.MatchString(name) {
+			return nil, fmt.Errorf("Invalid apply %q (want name:expression)", v)
+		}
+		if known[name] {
+			return nil, fmt.Errorf("Invalid apply: %s is already a field", name)
+		}
+		refs, err := checkApplyExpr(expr, known, schema)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid apply %s: %w", name, err)
+		}
+		for _, ref := range refs {
+			loaded[ref] = true
+		}
+		opts.Apply = append(opts.Apply, redis.FTAggregateApply{Field: expr, As: name})
+		known[name] = true
+	}
+
+	var group redis.FTAggregateGroupBy
+	grouped := map[string]bool{}
+	if v := q.Get("groupby"); v != "" {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimPrefix(strings.TrimSpace(name), "@")
+			if !known[name] {
+				return nil, fmt.Errorf("Invalid groupby: unknown field %s", name)
+			}
+			if schema[name] {
+				loaded[name] = true
+			}
+			group.Fields = append(group.Fields, "@"+name)
+			grouped[name] = true
+		}
+	}
+	for _, v := range q["reduce"] {
+		parts := strings.Split(v, ":")
+		fn, ok := aggregateReducers[parts[0]]
+		if !ok || len(parts) > 3 || (parts[0] == "count") != (len(parts) == 1) {
+			return nil, fmt.Errorf("Invalid reduce %q (want count or fn:field[:as])", v)
+		}
+		r := redis.FTAggregateReducer{Reducer: fn, As: parts[0]}
+		if len(parts) > 1 {
+			field := strings.TrimPrefix(parts[1], "@")
+			if !known[field] {
+				return nil, fmt.Errorf("Invalid reduce: unknown field %s", field)
+			}
+			if schema[field] {
+				loaded[field] = true
+			}
+			r.Args = []interface{}{"@" + field}
+			r.As = parts[0] + "_" + field
+		}
+		if len(parts) == 3 {
+			if !aggregateNameRe.MatchString(parts[2]) {
+				return nil, fmt.Errorf("Invalid reduce alias %q", parts[2])
+			}
+			r.As = parts[2]
+		}
+		group.Reduce = append(group.Reduce, r)
+		grouped[r.As] = true
+	}
+	if len(group.Fields) > 0 || len(group.Reduce) > 0 {
+		if len(group.Reduce) == 0 {
+			group.Reduce = []redis.FTAggregateReducer{{Reducer: redis.SearchCount, As: "count"}}
+			grouped["count"] = true
+		}
+		opts.GroupBy = []redis.FTAggregateGroupBy{group}
+		// After GROUPBY only the group keys and reducer outputs exist.
+		known = grouped
+	}
+
+	if v := q.Get("sort"); v != "" {
+		field, dir, _ := strings.Cut(v, ":")
+		field = strings.TrimPrefix(field, "@")
+		if !known[field] || (dir != "" && dir != "asc" && dir != "desc") {
+			return nil, fmt.Errorf("Invalid sort %q", v)
+		}
+		if opts.GroupBy == nil && schema[field] {
+			loaded[field] = true
+		}
+		opts.SortBy = []redis.FTAggregateSortBy{{FieldName: "@" + field, Asc: dir != "desc", Desc: dir == "desc"}}
+	}
+
+	names := make([]string, 0, len(loaded))
+	for name := range loaded {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		opts.Load = append(opts.Load, redis.FTAggregateLoad{Field: "@" + name})
+	}
+	return opts, nil
+}
+
+// handleAggregate runs FT.AGGREGATE over idx:packets with the /packets
+// filters and validated APPLY/GROUPBY/REDUCE/SORTBY steps.
+func (s *Server) handleAggregate(rdb redisClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if searchFallback.Load() {
+			writeError(w, notImplemented.errorf("Aggregate queries need RediSearch"))
+			return
+		}
+		tenant, ok := s.requestIndexTenant(w, r)
+		if !ok {
+			return
+		}
+
+		q := r.URL.Query()
+		query, from, to, err := packetFilter(q)
+		if err != nil {
+			writeError(w, badQuery.errorf("%v", err))
+			return
+		}
+		opts, err := aggregateOptions(q)
+		if err != nil {
+			writeError(w, badQuery.errorf("%v", err))
+			return
+		}
+		opts.Limit = aggregateDefaultLimit
+		if v := q.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				writeError(w, badQuery.errorf("Invalid limit"))
+				return
+			}
+			opts.Limit = min(n, aggregateMaxLimit)
+		}
+
+		ctx, cancel := s.queryContext(r)
+		defer cancel()
+		var result *redis.FTAggregateResult
+		err = redisDo(ctx, func(ctx context.Context) (err error) {
+			result, err = searchClient(rdb).FTAggregateWithArgs(ctx, s.config.packetIndexFor(tenant), query, opts).Result()
+			return err
+		})
+		var reply redis.Error
+		if errors.As(err, &reply) {
+			// Validation lets through expressions RediSearch can still reject,
+			// e.g. arithmetic on a TAG field.
+			writeError(w, badQuery.errorf("Aggregate query rejected: %v", reply))
+			return
+		}
+		if err != nil {
+			s.queryFailed(w, r, "Aggregate query", err)
+			return
+		}
+
+		rows := make([]map[string]interface{}, 0, len(result.Rows))
+		for _, row := range result.Rows {
+			out := make(map[string]interface{}, len(row.Fields))
+			for k, v := range row.Fields {
+				// RESP2 returns every value as a string; numbers go out as numbers.
+				if s, ok := v.(string); ok {
+					if f, err := strconv.ParseFloat(s, 64); err == nil {
+						out[k] = f
+						continue
+					}
+				}
+				out[k] = v
+			}
+			for _, k := range []string{"source_ip", "dest_ip"} {
+				if s, ok := out[k].(string); ok {
+					out[k] = anonymizeIP(s)
+				}
+			}
+			rows = append(rows, out)
+		}
+
+		response := map[string]interface{}{
+			"from":  from,
+			"to":    to,
+			"count": len(rows),
+			"rows":  rows,
+		}
+		s.attachAnnotations(ctx, rdb, response, tenant, from, to)
+		s.cacheQuery(r, response)
+		writeJSON(w, response)
+	}
+}
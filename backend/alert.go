@@ -0,0 +1,576 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// alertMaxWindow bounds aggregate windows; each rule keeps one bucket per second.
+	alertMaxWindow = time.Hour
+
+	alertHistoryKey = "alerts:history"
+)
+
+// alertRule is an alert definition as loaded from ALERT_RULES_FILE or the
+// admin API. Expr is a condition over window aggregates with an optional
+// hold time, e.g. "rate(bytes,10s) < 1e6 for 30s". Filter, in the filter
+// language, restricts which packets the rule counts. Notify names the
+// notifiers (webhook, slack, email) to use; empty means all of them.
+type alertRule struct {
+	Name        string   `json:"name"`
+	Expr        string   `json:"expr"`
+	Filter      string   `json:"filter,omitempty"`
+	Severity    string   `json:"severity,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Notify      []string `json:"notify,omitempty"`
+}
+
+// alertEvent is one alert status change; /alerts also uses it to describe
+// current alerts (At is then the time of the last change).
+type alertEvent struct {
+	Rule        string             `json:"rule"`
+	Status      string             `json:"status"`
+	Expr        string             `json:"expr"`
+	Severity    string             `json:"severity,omitempty"`
+	Description string             `json:"description,omitempty"`
+	Values      map[string]float64 `json:"values"`
+	ActiveSince time.Time          `json:"active_since"`
+	At          time.Time          `json:"at"`
+
+	// Notify is the rule's notifier routing.
+	Notify []string `json:"-"`
+}
+
+// alertFields are the per-message quantities aggregates can use.
+var alertFields = map[string]int{
+	"messages":      0,
+	"bytes":         1,
+	"total_bytes":   1,
+	"packets":       2,
+	"total_packets": 2,
+	"tcp_bytes":     3,
+	"tcp_packets":   4,
+	"udp_bytes":     5,
+	"udp_packets":   6,
+}
+
+const alertFieldCount = 7
+
+type alertValues [alertFieldCount]float64
+
+func alertPacketValues(p Packet) alertValues {
+	e := generateEdgeSummary(p)
+	return alertValues{
+		1,
+		float64(e.TotalBytes),
+		float64(e.TotalPackets),
+		float64(e.TCPBytesTotal),
+		float64(e.TCPPacketsTotal),
+		float64(e.UDPBytesTotal),
+		float64(e.UDPPacketsTotal),
+	}
+}
+
+// alertBucket holds one second of a rule's traffic.
+type alertBucket struct {
+	sec int64
+	sum alertValues
+	max alertValues
+}
+
+// alertWindow is a ring of per-second buckets covering a rule's longest window.
+type alertWindow struct {
+	buckets []alertBucket
+}
+
+func newAlertWindow(span time.Duration) *alertWindow {
+	return &alertWindow{buckets: make([]alertBucket, int(span/time.Second)+1)}
+}
+
+// add counts one message; sums are scaled by weight to undo sampling.
+func (w *alertWindow) add(sec int64, v *alertValues, weight float64) {
+	b := &w.buckets[sec%int64(len(w.buckets))]
+	if b.sec != sec {
+		*b = alertBucket{sec: sec}
+	}
+	for i := range v {
+		b.sum[i] += v[i] * weight
+		b.max[i] = max(b.max[i], v[i])
+	}
+}
+
+// totals sums the complete seconds in [now-d, now).
+func (w *alertWindow) totals(now int64, d time.Duration) (sum, peak alertValues) {
+	for sec := now - int64(d/time.Second); sec < now; sec++ {
+		b := &w.buckets[sec%int64(len(w.buckets))]
+		if b.sec != sec {
+			continue
+		}
+		for i := range sum {
+			sum[i] += b.sum[i]
+			peak[i] = max(peak[i], b.max[i])
+		}
+	}
+	return sum, peak
+}
+
+// alertEval is the evaluation context of one rule; aggregates record their
+// values so notifications can show them.
+type alertEval struct {
+	window *alertWindow
+	now    int64
+	values map[string]float64
+}
+
+// alertAggregates compute a value from a window's totals for field i.
+var alertAggregates = map[string]func(sum, peak alertValues, i int, d time.Duration) float64{
+	"rate": func(sum, _ alertValues, i int, d time.Duration) float64 { return sum[i] / d.Seconds() },
+	"sum":  func(sum, _ alertValues, i int, _ time.Duration) float64 { return sum[i] },
+	"max":  func(_, peak alertValues, i int, _ time.Duration) float64 { return peak[i] },
+	"avg": func(sum, _ alertValues, i int, _ time.Duration) float64 {
+		if sum[0] == 0 {
+			return 0
+		}
+		return sum[i] / sum[0]
+	},
+}
+
+// aggregate parses fn(field, window) after the function name.
+func (p *filterParser) aggregate(name filterToken) (filterNode, error) {
+	fn, ok := alertAggregates[name.text]
+	if !ok {
+		return filterNode{}, fmt.Errorf("unknown aggregate %q at offset %d (use rate, sum, avg, or max)", name.text, name.pos)
+	}
+	usage := fmt.Errorf("%s takes a field and a window, e.g. %s(bytes,10s)", name.text, name.text)
+	if !p.accept("(") {
+		return filterNode{}, usage
+	}
+	field := p.next()
+	index, ok := alertFields[field.text]
+	if field.kind != tokIdent || !p.accept(",") {
+		return filterNode{}, usage
+	}
+	if !ok {
+		return filterNode{}, fmt.Errorf("unknown field %q", field.text)
+	}
+	window := p.next()
+	if window.kind != tokNumber || !p.accept(")") {
+		return filterNode{}, usage
+	}
+	d, err := time.ParseDuration(window.text)
+	if err != nil || d < time.Second || d%time.Second != 0 || d > alertMaxWindow {
+		return filterNode{}, fmt.Errorf("invalid window %q (whole seconds up to %s)", window.text, alertMaxWindow)
+	}
+	p.span = max(p.span, d)
+
+	text := fmt.Sprintf("%s(%s,%s)", name.text, field.text, window.text)
+	return filterNode{kind: kindNum, num: func(r *filterRecord) float64 {
+		sum, peak := r.alert.window.totals(r.alert.now, d)
+		v := fn(sum, peak, index, d)
+		r.alert.values[text] = v
+		return v
+	}}, nil
+}
+
+// alertState is a compiled rule and its evaluation state.
+type alertState struct {
+	rule      alertRule
+	condition func(r *filterRecord) bool
+	hold      time.Duration
+	span      time.Duration
+	match     *filter
+	window    *alertWindow
+	loadedAt  time.Time
+
+	status      string
+	activeSince time.Time
+	changedAt   time.Time
+	values      map[string]float64
+}
+
+// compileAlertRule parses a rule's condition, hold time, and packet filter.
+func compileAlertRule(rule alertRule) (*alertState, error) {
+	if rule.Name == "" {
+		return nil, fmt.Errorf("missing name")
+	}
+	tokens, err := lexFilter(rule.Expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens, aggregates: true}
+	n, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if n.kind != kindBool {
+		return nil, fmt.Errorf("expr must be a condition, not a %s", n.kind)
+	}
+	if p.span == 0 {
+		return nil, fmt.Errorf("expr must use at least one aggregate, e.g. rate(bytes,10s)")
+	}
+
+	var hold time.Duration
+	if tok := p.peek(); tok.kind == tokIdent && tok.text == "for" {
+		p.next()
+		tok = p.next()
+		if hold, err = time.ParseDuration(tok.text); tok.kind != tokNumber || err != nil || hold < 0 {
+			return nil, fmt.Errorf("invalid duration %q after for", tok.text)
+		}
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at offset %d", tok.text, tok.pos)
+	}
+
+	st := &alertState{
+		rule:      rule,
+		condition: n.boolean,
+		hold:      hold,
+		span:      p.span,
+		window:    newAlertWindow(p.span),
+		loadedAt:  time.Now(),
+		status:    alertInactive,
+	}
+	if rule.Filter != "" {
+		if st.match, err = compileFilter(rule.Filter, true); err != nil {
+			return nil, fmt.Errorf("filter: %w", err)
+		}
+	}
+	for _, name := range rule.Notify {
+		if !hasNotifier(name) {
+			return nil, fmt.Errorf("notifier %q is not configured", name)
+		}
+	}
+	return st, nil
+}
+
+// initAlerts loads ALERT_RULES_FILE and starts evaluation.
+func (s *Server) initAlerts(ctx context.Context, rdb redisClient) error {
+	// Notifiers come first so rules can be checked against them.
+	if err := initNotifiers(ctx, s.config, rdb); err != nil {
+		return err
+	}
+
+	if s.config.AlertRulesFile != "" {
+		data, err := os.ReadFile(s.config.AlertRulesFile)
+		if err != nil {
+			return err
+		}
+		var rules []alertRule
+		if err := json.Unmarshal(data, &rules); err != nil {
+			return err
+		}
+		for _, rule := range rules {
+			st, err := compileAlertRule(rule)
+			if err != nil {
+				return fmt.Errorf("rule %q: %w", rule.Name, err)
+			}
+			s.alerts[rule.Name] = st
+		}
+		infoLog("Loaded %d alert rules from %s", len(rules), s.config.AlertRulesFile)
+	}
+
+	go s.runAlerts(ctx)
+	return nil
+}
+
+// observeAlerts adds fresh packets to the windows of the rules they match.
+// Packets are counted when they arrive, so a stalled feed shows up as a
+// falling rate even if late packets carry old timestamps.
+func (s *Server) observeAlerts(packets []Packet) {
+	s.alertMu.Lock()
+	defer s.alertMu.Unlock()
+	if len(s.alerts) == 0 {
+		return
+	}
+
+	now := time.Now().Unix()
+	weight := s.config.sampleWeight()
+	for i := range packets {
+		v := alertPacketValues(packets[i])
+		for _, st := range s.alerts {
+			if st.match == nil || st.match.matchPacket(&packets[i]) {
+				st.window.add(now, &v, weight)
+			}
+		}
+	}
+}
+
+func (s *Server) runAlerts(ctx context.Context) {
+	ticker := time.NewTicker(s.config.AlertEvalInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.evaluateAlerts(now)
+		}
+	}
+}
+
+// Alert statuses. A rule is pending while its condition holds for less than
+// its hold time, firing after that, and resolved once a firing condition
+// clears; a pending condition that clears goes back to inactive.
+const (
+	alertInactive = "inactive"
+	alertPending  = "pending"
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+)
+
+// evaluateAlerts checks every rule whose windows have filled since it was
+// loaded and moves it through the alert lifecycle.
+func (s *Server) evaluateAlerts(now time.Time) {
+	s.alertMu.Lock()
+	defer s.alertMu.Unlock()
+
+	for _, st := range s.alerts {
+		if now.Sub(st.loadedAt) < st.span {
+			continue
+		}
+		eval := &alertEval{window: st.window, now: now.Unix(), values: make(map[string]float64)}
+		active := st.condition(&filterRecord{alert: eval})
+		st.values = eval.values
+
+		switch {
+		case active && (st.status == alertInactive || st.status == alertResolved):
+			st.activeSince = now
+			if st.hold > 0 {
+				st.transition(s, alertPending, now)
+			} else {
+				st.transition(s, alertFiring, now)
+			}
+		case active && st.status == alertPending && now.Sub(st.activeSince) >= st.hold:
+			st.transition(s, alertFiring, now)
+		case !active:
+			st.clear(s, now)
+		}
+	}
+}
+
+// clear ends a pending or firing alert of hub.
+func (s *alertState) clear(hub *Server, now time.Time) {
+	switch s.status {
+	case alertPending:
+		s.transition(hub, alertInactive, now)
+	case alertFiring:
+		s.transition(hub, alertResolved, now)
+	}
+}
+
+// transition records a status change: it goes to hub's WebSocket clients,
+// the history, and (for firing and resolved) the notifiers.
+func (s *alertState) transition(hub *Server, status string, now time.Time) {
+	s.status = status
+	s.changedAt = now
+	if status == alertFiring {
+		reportAlertFired(now)
+	}
+	e := s.event()
+	hub.broadcastAlert(e)
+	notifyAlert(e)
+}
+
+func (s *alertState) event() alertEvent {
+	return alertEvent{
+		Rule:        s.rule.Name,
+		Status:      s.status,
+		Expr:        s.rule.Expr,
+		Severity:    s.rule.Severity,
+		Description: s.rule.Description,
+		Values:      s.values,
+		ActiveSince: s.activeSince,
+		At:          s.changedAt,
+		Notify:      s.rule.Notify,
+	}
+}
+
+// setAlertRule adds or replaces a rule; a replaced rule that was pending or
+// firing is cleared first.
+func (s *Server) setAlertRule(st *alertState) {
+	s.alertMu.Lock()
+	defer s.alertMu.Unlock()
+	if old, ok := s.alerts[st.rule.Name]; ok {
+		old.clear(s, time.Now())
+	}
+	s.alerts[st.rule.Name] = st
+}
+
+func (s *Server) deleteAlertRule(name string) bool {
+	s.alertMu.Lock()
+	defer s.alertMu.Unlock()
+	old, ok := s.alerts[name]
+	if !ok {
+		return false
+	}
+	old.clear(s, time.Now())
+	delete(s.alerts, name)
+	return true
+}
+
+// currentAlerts returns the pending and firing alerts, ordered by rule name.
+func (s *Server) currentAlerts() []alertEvent {
+	s.alertMu.Lock()
+	defer s.alertMu.Unlock()
+
+	events := []alertEvent{}
+	for _, st := range s.alerts {
+		if st.status == alertPending || st.status == alertFiring {
+			events = append(events, st.event())
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Rule < events[j].Rule })
+	return events
+}
+
+// alertRuleInfo is a rule with its current evaluation state.
+type alertRuleInfo struct {
+	alertRule
+	Status      string             `json:"status"`
+	ActiveSince *time.Time         `json:"active_since,omitempty"`
+	Values      map[string]float64 `json:"values,omitempty"`
+}
+
+func (s *Server) listAlertRules() []alertRuleInfo {
+	s.alertMu.Lock()
+	defer s.alertMu.Unlock()
+
+	infos := make([]alertRuleInfo, 0, len(s.alerts))
+	for _, st := range s.alerts {
+		info := alertRuleInfo{alertRule: st.rule, Status: st.status, Values: st.values}
+		if st.status == alertPending || st.status == alertFiring {
+			since := st.activeSince
+			info.ActiveSince = &since
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// storeAlertEvent prepends e to the alerts:history list, trimmed to
+// ALERT_HISTORY_SIZE entries.
+func storeAlertEvent(ctx context.Context, cfg *Config, rdb redisClient, e alertEvent) error {
+	if cfg.AlertHistorySize == 0 {
+		return nil
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	pipe := rdb.Pipeline()
+	pipe.LPush(ctx, alertHistoryKey, data)
+	pipe.LTrim(ctx, alertHistoryKey, 0, int64(cfg.AlertHistorySize-1))
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// handleAlerts lists the pending and firing alerts.
+func (s *Server) handleAlerts(w http.ResponseWriter, r *http.Request) {
+	if !s.requestAllTenants(w, r) {
+		return
+	}
+	current := s.currentAlerts()
+	writeJSON(w, map[string]interface{}{
+		"count":  len(current),
+		"alerts": current,
+	})
+}
+
+// handleAlertHistory returns stored alert transitions, newest first:
+// GET /alerts/history?rule=&limit=100
+func (s *Server) handleAlertHistory(rdb redisClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.requestAllTenants(w, r) {
+			return
+		}
+		if s.config.AlertHistorySize == 0 {
+			writeError(w, notFound.errorf("Endpoint disabled (ALERT_HISTORY_SIZE is 0)"))
+			return
+		}
+
+		limit := 100
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				writeError(w, badQuery.errorf("Invalid limit"))
+				return
+			}
+			limit = n
+		}
+		rule := r.URL.Query().Get("rule")
+
+		ctx, cancel := s.queryContext(r)
+		defer cancel()
+		var entries []string
+		err := redisDo(ctx, func(ctx context.Context) (err error) {
+			entries, err = rdb.LRange(ctx, alertHistoryKey, 0, -1).Result()
+			return err
+		})
+		if err != nil {
+			s.queryFailed(w, r, "Alert history query", err)
+			return
+		}
+		events := []alertEvent{}
+		for _, entry := range entries {
+			var e alertEvent
+			if err := json.Unmarshal([]byte(entry), &e); err != nil {
+				continue
+			}
+			if rule != "" && e.Rule != rule {
+				continue
+			}
+			events = append(events, e)
+			if len(events) == limit {
+				break
+			}
+		}
+		response := map[string]interface{}{
+			"count":  len(events),
+			"events": events,
+		}
+		s.cacheQuery(r, response)
+		writeJSON(w, response)
+	}
+}
+
+// handleAdminAlertRules manages alert rules: GET lists them with their state,
+// POST adds or replaces the rule in the JSON body, DELETE removes ?name=.
+// Rules changed here are not written back to ALERT_RULES_FILE.
+func (s *Server) handleAdminAlertRules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, map[string]interface{}{"rules": s.listAlertRules()})
+	case http.MethodPost:
+		var rule alertRule
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&rule); err != nil {
+			writeError(w, badQuery.errorf("Invalid JSON: %v", err))
+			return
+		}
+		st, err := compileAlertRule(rule)
+		if err != nil {
+			writeError(w, badQuery.errorf("Invalid rule: %v", err))
+			return
+		}
+		s.setAlertRule(st)
+		infoLog("Alert rule %q set: %s", rule.Name, rule.Expr)
+		writeJSON(w, rule)
+	case http.MethodDelete:
+		name := r.URL.Query().Get("name")
+		if !s.deleteAlertRule(name) {
+			writeError(w, notFound.errorf("Rule not found"))
+			return
+		}
+		infoLog("Alert rule %q deleted", name)
+		writeJSON(w, map[string]interface{}{"deleted": name})
+	default:
+		writeError(w, methodNotAllowed.errorf("Method not allowed"))
+	}
+}
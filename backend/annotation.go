@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// annotationsKey is the sorted set of a tenant's annotations, scored by
+	// time in unix milliseconds.
+	annotationsKey = "annotations"
+
+	annotationMaxBody    = 16 << 10
+	annotationMaxTitle   = 200
+	annotationMaxTags    = 20
+	annotationQueryLimit = 1000
+)
+
+// annotation is an operational event, such as a run starting or stopping or
+// a configuration change, that dashboards mark on their charts. End makes
+// it a region.
+type annotation struct {
+	ID     string     `json:"id"`
+	Time   time.Time  `json:"time"`
+	End    *time.Time `json:"end,omitempty"`
+	Title  string     `json:"title"`
+	Text   string     `json:"text,omitempty"`
+	Tags   []string   `json:"tags,omitempty"`
+	Tenant string     `json:"tenant,omitempty"`
+}
+
+func annotationsKeyFor(tenant string) string {
+	return tenantPrefix(tenant) + annotationsKey
+}
+
+// storeAnnotation adds a to its tenant's sorted set, trimmed to the newest
+// ANNOTATION_HISTORY_SIZE entries.
+func (s *Server) storeAnnotation(ctx context.Context, rdb redisClient, a annotation) error {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	key := annotationsKeyFor(a.Tenant)
+	return redisDo(ctx, func(ctx context.Context) error {
+		pipe := rdb.Pipeline()
+		pipe.ZAdd(ctx, key, redis.Z{Score: float64(a.Time.UnixMilli()), Member: data})
+		pipe.ZRemRangeByRank(ctx, key, 0, -int64(s.config.AnnotationHistorySize)-1)
+		_, err := pipe.Exec(ctx)
+		return err
+	})
+}
+
+// deleteAnnotation removes the tenant's annotation with id and reports
+// whether it existed.
+func deleteAnnotation(ctx context.Context, rdb redisClient, tenant, id string) (bool, error) {
+	key := annotationsKeyFor(tenant)
+	var members []string
+	err := redisDo(ctx, func(ctx context.Context) (err error) {
+		members, err = rdb.ZRange(ctx, key, 0, -1).Result()
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	for _, m := range members {
+		var a annotation
+		if json.Unmarshal([]byte(m), &a) != nil || a.ID != id {
+			continue
+		}
+		var removed int64
+		err := redisDo(ctx, func(ctx context.Context) (err error) {
+			removed, err = rdb.ZRem(ctx, key, m).Result()
+			return err
+		})
+		return removed > 0, err
+	}
+	return false, nil
+}
+
+// annotationsBetween returns the tenants' annotations starting within
+// from..to (unix seconds), oldest first, at most limit of them.
+func annotationsBetween(ctx context.Context, rdb redisClient, tenants []string, from, to int64, limit int) ([]annotation, error) {
+	out := []annotation{}
+	for _, t := range tenants {
+		var members []string
+		err := redisDo(ctx, func(ctx context.Context) (err error) {
+			members, err = rdb.ZRangeByScore(ctx, annotationsKeyFor(t), &redis.ZRangeBy{
+				Min:   strconv.FormatInt(from*1000, 10),
+				Max:   strconv.FormatInt(to*1000+999, 10),
+				Count: int64(limit),
+			}).Result()
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range members {
+			var a annotation
+			if json.Unmarshal([]byte(m), &a) == nil {
+				out = append(out, a)
+			}
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Time.Before(out[j].Time) })
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+// attachAnnotations adds the tenant's annotations starting within from..to
+// to a history query response. A failed read leaves them out rather than
+// failing the query.
+func (s *Server) attachAnnotations(ctx context.Context, rdb redisClient, response map[string]interface{}, tenant string, from, to int64) {
+	if s.config.AnnotationHistorySize == 0 {
+		return
+	}
+	list, err := annotationsBetween(ctx, rdb, []string{tenant}, from, to, annotationQueryLimit)
+	if err != nil {
+		debugLog("Annotations left out of the response: %v", err)
+		return
+	}
+	response["annotations"] = list
+}
+
+// broadcastAnnotation sends a new annotation to clients with annotations
+// enabled.
+func (s *Server) broadcastAnnotation(a annotation) {
+	s.publishFrame(frame{Type: "annotation", Annotation: &a})
+}
+
+// handleAnnotations lists stored annotations starting within ?from=&to=
+// (unix seconds; default the last day), optionally only those with ?tag=.
+func (s *Server) handleAnnotations(rdb redisClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.config.AnnotationHistorySize == 0 {
+			writeError(w, notFound.errorf("Endpoint disabled (ANNOTATION_HISTORY_SIZE is 0)"))
+			return
+		}
+		tenant, scoped, ok := s.requestTenant(w, r)
+		if !ok {
+			return
+		}
+		tenants := s.config.tenantNames()
+		if scoped {
+			tenants = []string{tenant}
+		}
+
+		q := r.URL.Query()
+		to := time.Now().Unix()
+		if v := q.Get("to"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				writeError(w, badQuery.errorf("Invalid to"))
+				return
+			}
+			to = n
+		}
+		from := to - int64((24 * time.Hour).Seconds())
+		if v := q.Get("from"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n > to {
+				writeError(w, badQuery.errorf("Invalid from"))
+				return
+			}
+			from = n
+		}
+
+		ctx, cancel := s.queryContext(r)
+		defer cancel()
+		list, err := annotationsBetween(ctx, rdb, tenants, from, to, annotationQueryLimit)
+		if err != nil {
+			s.queryFailed(w, r, "Annotation query", err)
+			return
+		}
+		if tag := q.Get("tag"); tag != "" {
+			tagged := []annotation{}
+			for _, a := range list {
+				for _, t := range a.Tags {
+					if t == tag {
+						tagged = append(tagged, a)
+						break
+					}
+				}
+			}
+			list = tagged
+		}
+
+		response := map[string]interface{}{
+			"from":        from,
+			"to":          to,
+			"count":       len(list),
+			"annotations": list,
+		}
+		s.cacheQuery(r, response)
+		writeJSON(w, response)
+	}
+}
+
+// handleAdminAnnotations adds the annotation in the JSON body (POST) or
+// deletes ?id= (DELETE) for the ?tenant= selected. New annotations are
+// broadcast; deletions are not.
+func (s *Server) handleAdminAnnotations(rdb redisClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.config.AnnotationHistorySize == 0 {
+			writeError(w, notFound.errorf("Endpoint disabled (ANNOTATION_HISTORY_SIZE is 0)"))
+			return
+		}
+		if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+			writeError(w, methodNotAllowed.errorf("Method not allowed"))
+			return
+		}
+		tenant, ok := s.requestIndexTenant(w, r)
+		if !ok {
+			return
+		}
+
+		if r.Method == http.MethodDelete {
+			id := r.URL.Query().Get("id")
+			found, err := deleteAnnotation(r.Context(), rdb, tenant, id)
+			if err != nil {
+				annotationFailed(w, err)
+				return
+			}
+			if !found {
+				writeError(w, notFound.errorf("Annotation not found"))
+				return
+			}
+			infoLog("Annotation %s deleted", id)
+			writeJSON(w, map[string]interface{}{"deleted": id})
+			return
+		}
+
+		var a annotation
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, annotationMaxBody)).Decode(&a); err != nil {
+			writeError(w, badQuery.errorf("Invalid JSON: %v", err))
+			return
+		}
+		if err := checkAnnotation(&a); err != nil {
+			writeError(w, badQuery.errorf("Invalid annotation: %v", err))
+			return
+		}
+		a.Tenant = tenant
+		b := make([]byte, 8)
+		rand.Read(b)
+		a.ID = hex.EncodeToString(b)
+
+		if err := s.storeAnnotation(r.Context(), rdb, a); err != nil {
+			annotationFailed(w, err)
+			return
+		}
+		s.broadcastAnnotation(a)
+		infoLog("Annotation %s added: %s", a.ID, a.Title)
+		writeJSON(w, a)
+	}
+}
+
+// checkAnnotation validates a posted annotation and defaults its time to now.
+func checkAnnotation(a *annotation) error {
+	a.Title = strings.TrimSpace(a.Title)
+	if a.Title == "" {
+		return errors.New("title is required")
+	}
+	if len(a.Title) > annotationMaxTitle {
+		return errors.New("title too long")
+	}
+	if len(a.Tags) > annotationMaxTags {
+		return errors.New("too many tags")
+	}
+	if a.Time.IsZero() {
+		a.Time = time.Now().UTC()
+	}
+	if a.End != nil && a.End.Before(a.Time) {
+		return errors.New("end is before time")
+	}
+	return nil
+}
+
+func annotationFailed(w http.ResponseWriter, err error) {
+	if errors.Is(err, errRedisUnavailable) {
+		writeError(w, unavailable.errorf("Redis unavailable"))
+		return
+	}
+	errorLog("Annotation update failed: %v", err)
+	writeError(w, upstreamFailed.errorf("Annotation update failed"))
+}
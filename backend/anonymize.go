@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/netip"
+)
+
+// IP anonymization modes (ANONYMIZE_IPS).
+const (
+	// anonymizeTruncate zeroes the host bits below ANONYMIZE_IPV4_PREFIX or
+	// ANONYMIZE_IPV6_PREFIX.
+	anonymizeTruncate = "truncate"
+	// anonymizeHMAC replaces each address by a keyed hash of it.
+	anonymizeHMAC = "hmac"
+)
+
+// anonSecret keys the hashes of addresses (hmac mode) and of packet keys, and
+// seals export cursors. It is ANONYMIZE_KEY, or random per process when the
+// mode does not need a stable key.
+var anonSecret []byte
+
+// anonMode is ANONYMIZE_IPS, and anonIPv4Prefix and anonIPv6Prefix the
+// prefix lengths truncate mode keeps; set once by initAnonymize.
+var (
+	anonMode       string
+	anonIPv4Prefix int
+	anonIPv6Prefix int
+)
+
+// initAnonymize checks the ANONYMIZE_* settings.
+func initAnonymize(cfg *Config) error {
+	switch cfg.AnonymizeIPs {
+	case "":
+		return nil
+	case anonymizeTruncate:
+		if cfg.AnonymizeIPv4Prefix > 32 || cfg.AnonymizeIPv6Prefix > 128 {
+			return fmt.Errorf("prefix lengths must be at most 32 (IPv4) and 128 (IPv6)")
+		}
+	case anonymizeHMAC:
+		if len(cfg.AnonymizeKey) < 16 {
+			return fmt.Errorf("hmac needs ANONYMIZE_KEY of at least 16 characters")
+		}
+	default:
+		return fmt.Errorf("unknown mode %q (use truncate or hmac)", cfg.AnonymizeIPs)
+	}
+
+	if cfg.AnonymizeKey != "" {
+		anonSecret = []byte(cfg.AnonymizeKey)
+	} else {
+		anonSecret = make([]byte, 32)
+		if _, err := rand.Read(anonSecret); err != nil {
+			return err
+		}
+	}
+	anonMode, anonIPv4Prefix, anonIPv6Prefix = cfg.AnonymizeIPs, cfg.AnonymizeIPv4Prefix, cfg.AnonymizeIPv6Prefix
+	infoLog("Anonymizing addresses (%s)", cfg.AnonymizeIPs)
+	return nil
+}
+
+// anonymizing reports whether ANONYMIZE_IPS is set.
+func anonymizing() bool {
+	return anonSecret != nil
+}
+
+// anonymizeIP masks or hashes one address. In truncate mode, values that are
+// not addresses (host names) are returned as they are.
+func anonymizeIP(s string) string {
+	if !anonymizing() || s == "" {
+		return s
+	}
+	if anonMode == anonymizeHMAC {
+		return "ip-" + anonDigest(s)[:16]
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return s
+	}
+	addr = addr.Unmap()
+	bits := anonIPv6Prefix
+	if addr.Is4() {
+		bits = anonIPv4Prefix
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return s
+	}
+	return prefix.Addr().String()
+}
+
+// anonDigest is the hex HMAC-SHA256 of s under anonSecret.
+func anonDigest(s string) string {
+	mac := hmac.New(sha256.New, anonSecret)
+	mac.Write([]byte(s))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// anonymizePacket masks the packet's addresses and replaces its Redis key,
+// which embeds them, by a hash that is just as unique.
+func anonymizePacket(p *Packet) {
+	p.Src = anonymizeIP(p.Src)
+	p.Dest = anonymizeIP(p.Dest)
+	if p.Key != "" {
+		p.Key = "anon:" + anonDigest(p.Key)[:32]
+	}
+}
+
+// anonymizePackets returns anonymized copies of packets (the packets
+// themselves when ANONYMIZE_IPS is not set).
+func anonymizePackets(packets []Packet) []Packet {
+	if !anonymizing() {
+		return packets
+	}
+	out := make([]Packet, len(packets))
+	for i := range packets {
+		out[i] = packets[i]
+		anonymizePacket(&out[i])
+	}
+	return out
+}
+
+// anonymizeProcessor anonymizes packets at the end of the pipeline, so
+// filters, enrichment, and transforms still see the real addresses.
+type anonymizeProcessor struct{}
+
+func (anonymizeProcessor) Name() string        { return "anonymize" }
+func (anonymizeProcessor) Stage() processStage { return stageTransform }
+func (anonymizeProcessor) Process(_ *Server, packets []Packet) []Packet {
+	return anonymizePackets(packets)
+}
+
+// Preview leaves addresses as they are: /ingest stores packets in Redis,
+// which stays private, and the poller anonymizes them when it reads them back.
+func (anonymizeProcessor) Preview(packets []Packet) []Packet { return packets }
+
+// sealCursor encrypts an export cursor, whose position names a raw packet
+// key, so clients of an anonymized export cannot read the addresses in it.
+func sealCursor(plain []byte) []byte {
+	gcm := cursorAEAD()
+	nonce := make([]byte, gcm.NonceSize())
+	rand.Read(nonce)
+	return gcm.Seal(nonce, nonce, plain, nil)
+}
+
+// openCursor reverses sealCursor.
+func openCursor(sealed []byte) ([]byte, error) {
+	gcm := cursorAEAD()
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("cursor too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+}
+
+func cursorAEAD() cipher.AEAD {
+	key := sha256.Sum256(append([]byte("export-cursor:"), anonSecret...))
+	block, _ := aes.NewCipher(key[:])
+	gcm, _ := cipher.NewGCM(block)
+	return gcm
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// errorKind is a class of API error: the status it is answered with and the
+// code clients switch on.
+type errorKind struct {
+	status int
+	code   string
+}
+
+// The kinds of API error. A new failure should reuse the closest kind:
+// clients depend on the set of codes, not on messages.
+var (
+	badQuery         = errorKind{http.StatusBadRequest, "bad_query"}
+	unauthorized     = errorKind{http.StatusUnauthorized, "unauthorized"}
+	forbidden        = errorKind{http.StatusForbidden, "forbidden"}
+	notFound         = errorKind{http.StatusNotFound, "not_found"}
+	methodNotAllowed = errorKind{http.StatusMethodNotAllowed, "method_not_allowed"}
+	conflict         = errorKind{http.StatusConflict, "conflict"}
+	tooLarge         = errorKind{http.StatusRequestEntityTooLarge, "too_large"}
+	rateLimited      = errorKind{http.StatusTooManyRequests, "rate_limited"}
+	internalError    = errorKind{http.StatusInternalServerError, "internal"}
+	notImplemented   = errorKind{http.StatusNotImplemented, "not_implemented"}
+	upstreamFailed   = errorKind{http.StatusBadGateway, "upstream_failed"}
+	unavailable      = errorKind{http.StatusServiceUnavailable, "unavailable"}
+	timedOut         = errorKind{http.StatusGatewayTimeout, "timeout"}
+)
+
+// apiError is an error of some kind with a message for people.
+type apiError struct {
+	kind    errorKind
+	message string
+}
+
+func (e *apiError) Error() string { return e.message }
+
+// errorf returns an apiError of kind k with a formatted message.
+func (k errorKind) errorf(format string, args ...interface{}) error {
+	return &apiError{kind: k, message: fmt.Sprintf(format, args...)}
+}
+
+// writeError answers the request with err as an ErrorResponse: the kind and
+// message of an apiError, or an internal error with err's message. The
+// request ID is the one withRequestID answered with, and the field names are
+// those of the API version withAPIVersion picked.
+func writeError(w http.ResponseWriter, err error) {
+	var e *apiError
+	if !errors.As(err, &e) {
+		e = &apiError{kind: internalError, message: err.Error()}
+	}
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.kind.status)
+	json.NewEncoder(w).Encode(responseAPIVersion(w).translate(ErrorResponse{
+		Code:      e.kind.code,
+		Message:   e.message,
+		RequestID: h.Get(requestIDHeader),
+	}))
+}
+
+// handleNotFound answers routes a listener does not serve.
+func handleNotFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, notFound.errorf("Not found"))
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"unicode"
+)
+
+// apiVersionHeader selects the API version of a request's JSON, and names
+// the version a response is written in.
+const apiVersionHeader = "X-API-Version"
+
+// apiVersion is a named set of outbound JSON field names: the native
+// snake_case names converted to a case, and renames that take precedence.
+type apiVersion struct {
+	name    string
+	camel   bool
+	renames map[string]string
+}
+
+// apiVersions are the API_VERSIONS by name.
+var apiVersions = map[string]*apiVersion{}
+
+type apiVersionKey struct{}
+
+func initAPIVersions(cfg *Config) error {
+	versions, err := parseAPIVersions(cfg.APIVersions)
+	if err != nil {
+		return err
+	}
+	apiVersions = versions
+	for name := range versions {
+		infoLog("API version %s enabled", name)
+	}
+	return nil
+}
+
+// parseAPIVersions parses API_VERSIONS: entries separated by ";", each a
+// list of space-separated key=value settings, like LISTENERS.
+func parseAPIVersions(s string) (map[string]*apiVersion, error) {
+	versions := make(map[string]*apiVersion)
+	for _, entry := range strings.Split(s, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		v := &apiVersion{renames: make(map[string]string)}
+		for _, kv := range strings.Fields(entry) {
+			k, val, ok := strings.Cut(kv, "=")
+			if !ok || val == "" {
+				return nil, fmt.Errorf("API version setting %q is not key=value", kv)
+			}
+			switch k {
+			case "name":
+				v.name = val
+			case "case":
+				if val != "camel" && val != "snake" {
+					return nil, fmt.Errorf("unknown case %q (use camel or snake)", val)
+				}
+				v.camel = val == "camel"
+			case "rename":
+				for _, pair := range strings.Split(val, ",") {
+					from, to, ok := strings.Cut(pair, ":")
+					if !ok || from == "" || to == "" {
+						return nil, fmt.Errorf("rename %q is not field:name", pair)
+					}
+					v.renames[from] = to
+				}
+			default:
+				return nil, fmt.Errorf("unknown API version setting %q", k)
+			}
+		}
+		if v.name == "" {
+			return nil, fmt.Errorf("API version %q has no name", strings.TrimSpace(entry))
+		}
+		if versions[v.name] != nil {
+			return nil, fmt.Errorf("API version %s is defined twice", v.name)
+		}
+		versions[v.name] = v
+	}
+	return versions, nil
+}
+
+// withAPIVersion picks the request's API version from X-API-Version or
+// ?api_version= (for browsers opening a WebSocket) and stores it in the
+// request context. It answers with the version in X-API-Version, where
+// writeJSON and writeError find it. Requests without one get the native
+// names; an unknown version is a bad query.
+func withAPIVersion(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(apiVersions) == 0 {
+			next(w, r)
+			return
+		}
+		w.Header().Add("Vary", apiVersionHeader)
+		name := r.Header.Get(apiVersionHeader)
+		if name == "" {
+			name = r.URL.Query().Get("api_version")
+		}
+		if name == "" {
+			next(w, r)
+			return
+		}
+		v := apiVersions[name]
+		if v == nil {
+			writeError(w, badQuery.errorf("Unknown API version %q", name))
+			return
+		}
+		w.Header().Set(apiVersionHeader, v.name)
+		next(w, r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, v)))
+	}
+}
+
+// requestAPIVersion returns the API version of the request ctx belongs to,
+// or nil for the native names.
+func requestAPIVersion(ctx context.Context) *apiVersion {
+	v, _ := ctx.Value(apiVersionKey{}).(*apiVersion)
+	return v
+}
+
+// responseAPIVersion returns the API version withAPIVersion answered with.
+func responseAPIVersion(w http.ResponseWriter) *apiVersion {
+	return apiVersions[w.Header().Get(apiVersionHeader)]
+}
+
+// jsonFormat is the wire format of JSON frames in version v: formatJSON for
+// the native names, or formatJSON@name, which marshalFrame translates. The
+// frame cache keys on it, so each version is translated once per frame.
+func jsonFormat(v *apiVersion) string {
+	if v == nil {
+		return formatJSON
+	}
+	return formatJSON + "@" + v.name
+}
+
+// field returns the name of the native field name in version v.
+func (v *apiVersion) field(name string) string {
+	if to, ok := v.renames[name]; ok {
+		return to
+	}
+	if v.camel {
+		return camelCase(name)
+	}
+	return snakeCase(name)
+}
+
+func camelCase(s string) string {
+	var b strings.Builder
+	upper := false
+	for _, r := range s {
+		switch {
+		case r == '_':
+			upper = b.Len() > 0
+		case upper:
+			b.WriteRune(unicode.ToUpper(r))
+			upper = false
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func snakeCase(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// translate returns val with its field names in version v, ready for
+// encoding/json. Struct fields and the keys of plain map[string]interface{}
+// objects are field names; the keys of other maps, such as edges by
+// src:dest, are data and stay as they are. Values that marshal themselves
+// are kept whole.
+func (v *apiVersion) translate(val interface{}) interface{} {
+	if v == nil {
+		return val
+	}
+	return v.value(reflect.ValueOf(val))
+}
+
+var objectType = reflect.TypeOf(map[string]interface{}{})
+
+func (v *apiVersion) value(rv reflect.Value) interface{} {
+	if !rv.IsValid() {
+		return nil
+	}
+	t := rv.Type()
+	if t.Implements(jsonMarshalerType) || t.Implements(textMarshalerType) {
+		return rv.Interface()
+	}
+
+	switch rv.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if rv.IsNil() {
+			return nil
+		}
+		return v.value(rv.Elem())
+	case reflect.Struct:
+		fields := jsonFields(rv)
+		out := make(map[string]interface{}, len(fields))
+		for _, f := range fields {
+			out[v.field(f.name)] = v.value(f.value)
+		}
+		return out
+	case reflect.Map:
+		if rv.IsNil() || t.Key().Kind() != reflect.String {
+			return rv.Interface()
+		}
+		keys := t == objectType
+		out := make(map[string]interface{}, rv.Len())
+		for it := rv.MapRange(); it.Next(); {
+			k := it.Key().String()
+			if keys {
+				k = v.field(k)
+			}
+			out[k] = v.value(it.Value())
+		}
+		return out
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && (rv.IsNil() || t.Elem().Kind() == reflect.Uint8) {
+			return rv.Interface()
+		}
+		out := make([]interface{}, rv.Len())
+		for i := range out {
+			out[i] = v.value(rv.Index(i))
+		}
+		return out
+	}
+	return rv.Interface()
+}
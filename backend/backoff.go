@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// backoff is the retry policy for calls to external services: Redis,
+// notification and report webhooks, and sink writes. Delays start at base
+// and double per retry up to max, with jitter; a call is retried at most
+// retries times, and not once maxElapsed (if set) has passed since it
+// started. Reconnect loops use delay alone.
+type backoff struct {
+	base       time.Duration
+	max        time.Duration
+	maxElapsed time.Duration
+	retries    int
+}
+
+// retryBackoff is the policy of calls retried retries times from base, capped
+// by RETRY_MAX_DELAY and RETRY_MAX_ELAPSED.
+func (c *Config) retryBackoff(base time.Duration, retries int) backoff {
+	return backoff{base: base, max: c.RetryMaxDelay, maxElapsed: c.RetryMaxElapsed, retries: retries}
+}
+
+// redisBackoff retries Redis calls (redisDo).
+func (c *Config) redisBackoff() backoff {
+	return c.retryBackoff(c.RedisRetryBackoff, c.RedisRetries)
+}
+
+// notifyBackoff retries alert notifications and report webhook posts.
+func (c *Config) notifyBackoff() backoff {
+	return c.retryBackoff(c.RetryBackoff, c.NotifyRetries)
+}
+
+// sinkBackoff retries writes of external sinks.
+func (c *Config) sinkBackoff() backoff {
+	return c.retryBackoff(c.RetryBackoff, c.SinkRetries)
+}
+
+// delay is the wait before retry n (0 for the first): base doubled n times,
+// capped at max, of which the upper half is random so callers that failed
+// together do not retry together.
+func (b backoff) delay(n int) time.Duration {
+	d := b.max
+	if n < 32 && b.base<<n > 0 && b.base<<n < d {
+		d = b.base << n
+	}
+	half := d / 2
+	return half + rand.N(d-half+1)
+}
+
+// permanentError marks an error retrying cannot fix.
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// permanent wraps err so retry returns it at once.
+func permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err}
+}
+
+// retry calls fn until it succeeds, returns a permanent error, ctx ends, or
+// the policy gives up, and returns fn's last error. A permanent error is
+// returned unwrapped.
+func (b backoff) retry(ctx context.Context, what string, fn func(ctx context.Context) error) error {
+	start := time.Now()
+	for n := 0; ; n++ {
+		err := fn(ctx)
+		if err == nil {
+			return nil
+		}
+		var p permanentError
+		if errors.As(err, &p) {
+			return p.err
+		}
+		if ctx.Err() != nil || n >= b.retries {
+			return err
+		}
+		delay := b.delay(n)
+		if b.maxElapsed > 0 && time.Since(start)+delay > b.maxElapsed {
+			return err
+		}
+
+		debugLog("%s failed (attempt %d, retrying in %s): %v", what, n+1, delay.Round(time.Millisecond), err)
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+	}
+}
+
+// retryableStatus reports whether retrying can fix an HTTP error status:
+// 408, 429, or a 5xx.
+func retryableStatus(code int) bool {
+	return code == http.StatusRequestTimeout || code == http.StatusTooManyRequests || code >= 500
+}
+
+// httpStatusError describes a non-2xx response with the start of its body,
+// permanent unless retryableStatus.
+func httpStatusError(resp *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	err := fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	if retryableStatus(resp.StatusCode) {
+		return err
+	}
+	return permanent(err)
+}
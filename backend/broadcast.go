@@ -1,39 +1,279 @@
 package main
 
-import "encoding/json"
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"time"
+)
 
-// broadcastUpdates sends incremental edge updates to all WebSocket clients.
-func broadcastUpdates(updates map[string]PacketSummary) {
-	payload, err := json.Marshal(map[string]interface{}{
-		"type": "update",
-		"data": updates,
-	})
-	if err != nil {
-		errorLog("Error encoding broadcast payload: %v", err)
-		return
+// Wire formats a WebSocket client can receive frames in. JSON frames in an
+// API version have a format of their own; see jsonFormat.
+const (
+	formatJSON    = "json"
+	formatMsgpack = "msgpack"
+	formatCBOR    = "cbor"
+)
+
+// marshalFrame serializes a frame message in the given wire format.
+func marshalFrame(format string, msg interface{}) ([]byte, error) {
+	if format == formatMsgpack || format == formatCBOR {
+		// Encode into pooled scratch space and copy out the exact size: the
+		// payload itself is shared by every client's queue and cannot be pooled.
+		appendFrame := appendMsgpack
+		if format == formatCBOR {
+			appendFrame = appendCBOR
+		}
+		scratch := getBuffer(0)
+		b, err := appendFrame(scratch, msg)
+		if err != nil {
+			putBuffer(scratch)
+			return nil, err
+		}
+		payload := bytes.Clone(b)
+		putBuffer(b)
+		return payload, nil
+	}
+	if name, ok := strings.CutPrefix(format, formatJSON+"@"); ok {
+		return json.Marshal(apiVersions[name].translate(msg))
 	}
+	return json.Marshal(msg)
+}
+
+// frame is a message broadcast to WebSocket clients. Producers build it once
+// from decoded packets and must not modify it after publishFrame; the hub
+// serializes it at most once per wire format and client projection. Alert,
+// status, and annotation frames carry Alert, Status, or Annotation instead
+// of Data and only go to clients that asked for them.
+type frame struct {
+	// Seq numbers frames in the order the hub delivers them (see handleMessages).
+	Seq    uint64                   `json:"seq"`
+	Type   string                   `json:"type"`
+	Data   map[string]PacketSummary `json:"data,omitempty"`
+	Alert  *alertEvent              `json:"alert,omitempty"`
+	Status *feedStatus              `json:"status,omitempty"`
+
+	Annotation *annotation `json:"annotation,omitempty"`
+
+	// Sampled marks an update that also carries the edges of updates the hub
+	// held back under overload (see broadcastSampler).
+	Sampled bool `json:"sampled,omitempty"`
 
-	select {
-	case broadcast <- string(payload):
-	default:
-		errorLog("Broadcast channel full, dropping update")
+	// published is when publishFrame offered the frame, for the broadcast
+	// latency objective.
+	published time.Time
+}
+
+// projectedEdges holds projected summaries by edge key. Unlike a plain
+// map[string]interface{}, its keys are data, so API versions leave them be.
+type projectedEdges map[string]interface{}
+
+// snapshotFrame captures the complete materialized view. It carries the seq
+// of the last delivered frame, which the view already reflects.
+func (s *Server) snapshotFrame() frame {
+	return frame{Type: "snapshot", Data: s.latestSnapshot(), Seq: s.frameSeq.Load()}
+}
+
+// message builds the frame's wire message, keeping only the projected
+// summary fields and matching edges when p is non-nil. It returns nil for an
+// update that has no matching edges left.
+func (f frame) message(p *projection) map[string]interface{} {
+	if f.Alert != nil {
+		return map[string]interface{}{
+			"type":  f.Type,
+			"seq":   f.Seq,
+			"alert": f.Alert,
+		}
+	}
+	if f.Annotation != nil {
+		return map[string]interface{}{
+			"type":       f.Type,
+			"seq":        f.Seq,
+			"annotation": f.Annotation,
+		}
+	}
+	if f.Status != nil {
+		msg := map[string]interface{}{
+			"type":   f.Type,
+			"seq":    f.Seq,
+			"stale":  f.Status.Stale,
+			"age_ms": f.Status.AgeMS,
+		}
+		if f.Status.SeqMissing != nil {
+			msg["seq_missing"] = *f.Status.SeqMissing
+			msg["seq_duplicates"] = *f.Status.SeqDuplicates
+		}
+		return msg
 	}
+	if p == nil {
+		return f.dataMessage(f.Data)
+	}
+
+	data := make(projectedEdges, len(f.Data))
+	for key, summary := range f.Data {
+		if p.filter != nil && !p.filter.matchSummary(summary) {
+			continue
+		}
+		data[key] = p.apply(summary)
+	}
+	if len(data) == 0 && f.Type == "update" {
+		return nil
+	}
+	return f.dataMessage(data)
 }
 
-// broadcastSnapshot sends the complete materialized view when incremental updates are not enough.
-func broadcastSnapshot() {
-	payload, err := json.Marshal(map[string]interface{}{
-		"type": "snapshot",
-		"data": latestSnapshot(),
-	})
-	if err != nil {
-		errorLog("Error encoding snapshot payload: %v", err)
+// dataMessage is the wire message of an update or snapshot carrying data.
+func (f frame) dataMessage(data interface{}) map[string]interface{} {
+	msg := map[string]interface{}{
+		"type": f.Type,
+		"seq":  f.Seq,
+		"data": data,
+	}
+	if f.Sampled {
+		msg["sampled"] = true
+	}
+	return msg
+}
+
+// control reports whether f is an alert, status, or annotation frame, which
+// travels in the control lane ahead of data frames.
+func (f frame) control() bool {
+	return f.Alert != nil || f.Status != nil || f.Annotation != nil
+}
+
+// encode serializes the frame for one client; it returns nil when message does.
+func (f frame) encode(format string, p *projection) ([]byte, error) {
+	msg := f.message(p)
+	if msg == nil {
+		return nil, nil
+	}
+	return marshalFrame(format, msg)
+}
+
+// frameCache builds a frame's message once per distinct projection and
+// serializes each message once per wire format.
+type frameCache struct {
+	frame    frame
+	messages map[string]map[string]interface{}
+	encoded  map[string][]byte
+}
+
+func newFrameCache(f frame) *frameCache {
+	return &frameCache{
+		frame:    f,
+		messages: make(map[string]map[string]interface{}),
+		encoded:  make(map[string][]byte),
+	}
+}
+
+func (fc *frameCache) payload(format string, p *projection) ([]byte, error) {
+	key := ""
+	if p != nil {
+		key = p.key
+	}
+	if payload, ok := fc.encoded[format+"|"+key]; ok {
+		return payload, nil
+	}
+
+	msg, ok := fc.messages[key]
+	if !ok {
+		msg = fc.frame.message(p)
+		fc.messages[key] = msg
+	}
+	var payload []byte
+	if msg != nil {
+		var err error
+		if payload, err = marshalFrame(format, msg); err != nil {
+			return nil, err
+		}
+	}
+	fc.encoded[format+"|"+key] = payload
+	return payload, nil
+}
+
+// broadcastAlert sends an alert status change to clients with alerts enabled.
+func (s *Server) broadcastAlert(e alertEvent) {
+	s.publishFrame(frame{Type: "alert", Alert: &e})
+}
+
+// publishFrame offers a frame to the hub without ever blocking the caller.
+// Control frames go to the control lane, the others to the data lane. When
+// the lane is full, drop-newest discards f and drop-oldest discards the
+// lane's longest-queued frame to make room for f.
+func (s *Server) publishFrame(f frame) {
+	s.framesPublished.Add(1)
+	f.published = time.Now()
+	defer func() { s.observeQueue(len(s.broadcast)) }()
+	lane := s.broadcast
+	if f.control() {
+		lane = s.broadcastControl
+	}
+	if s.config.BroadcastOverflow != "drop-oldest" {
+		select {
+		case lane <- f:
+		default:
+			s.dropFrame(f)
+		}
 		return
 	}
 
-	select {
-	case broadcast <- string(payload):
-	default:
-		errorLog("Broadcast channel full, dropping snapshot")
+	for {
+		select {
+		case lane <- f:
+			return
+		default:
+		}
+		select {
+		case old := <-lane:
+			s.dropFrame(old)
+		default:
+		}
+	}
+}
+
+func (s *Server) dropFrame(f frame) {
+	s.framesDropped.Add(1)
+	slo.observeDroppedFrame()
+	if f.Data != nil {
+		s.framesLost.Store(true)
+	}
+	lane := "data"
+	if f.control() {
+		s.controlFramesDropped.Add(1)
+		lane = "control"
+	}
+	errorLog("Broadcast %s lane full, dropping %s (%s)", lane, f.Type, s.config.BroadcastOverflow)
+}
+
+// broadcastUpdates sends incremental edge updates to all WebSocket clients.
+func (s *Server) broadcastUpdates(updates map[string]PacketSummary) {
+	s.publishFrame(frame{Type: "update", Data: updates})
+}
+
+// broadcastSnapshot sends the complete materialized view when incremental updates are not enough.
+func (s *Server) broadcastSnapshot() {
+	s.publishFrame(s.snapshotFrame())
+}
+
+// broadcastStats describes the broadcast channel for the admin API.
+func (s *Server) broadcastStats() map[string]interface{} {
+	_, queue := s.lagStats()
+	return map[string]interface{}{
+		"buffer":    cap(s.broadcast),
+		"queued":    len(s.broadcast),
+		"occupancy": queue,
+		"overflow":  s.config.BroadcastOverflow,
+		"published": s.framesPublished.Load(),
+		"dropped":   s.framesDropped.Load(),
+		"control": map[string]interface{}{
+			"buffer":  cap(s.broadcastControl),
+			"queued":  len(s.broadcastControl),
+			"dropped": s.controlFramesDropped.Load(),
+		},
+		"sampling": s.samplingStats(),
+		"replay":   s.replayStats(),
+		"journal":  s.journal.stats(),
+		"tenants":  tenantHubStats(),
+		"qos":      qosStats(),
 	}
 }
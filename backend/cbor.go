@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CBOR major types (RFC 8949, section 3.1).
+const (
+	cborUint   = 0 << 5
+	cborNegint = 1 << 5
+	cborText   = 3 << 5
+	cborArray  = 4 << 5
+	cborMap    = 5 << 5
+
+	cborFalse   = 0xf4
+	cborTrue    = 0xf5
+	cborNull    = 0xf6
+	cborFloat64 = 0xfb
+)
+
+// appendCBOR appends the CBOR encoding of v to b. It covers the same values
+// as appendMsgpack and encodes them the same way: time.Time as an RFC 3339
+// text string and structs as maps keyed by their json field names. Only
+// definite lengths are used, so a minimal decoder needs no streaming support.
+func appendCBOR(b []byte, v interface{}) ([]byte, error) {
+	return appendCBORValue(b, reflect.ValueOf(v))
+}
+
+func appendCBORValue(b []byte, v reflect.Value) ([]byte, error) {
+	if !v.IsValid() {
+		return append(b, cborNull), nil
+	}
+	if v.Type() == timeType {
+		return appendCBORString(b, v.Interface().(time.Time).Format(time.RFC3339Nano)), nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return append(b, cborNull), nil
+		}
+		return appendCBORValue(b, v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			return append(b, cborTrue), nil
+		}
+		return append(b, cborFalse), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n := v.Int()
+		if n < 0 {
+			return appendCBORHead(b, cborNegint, uint64(-1-n)), nil
+		}
+		return appendCBORHead(b, cborUint, uint64(n)), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return appendCBORHead(b, cborUint, v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return binary.BigEndian.AppendUint64(append(b, cborFloat64), math.Float64bits(v.Float())), nil
+	case reflect.String:
+		return appendCBORString(b, v.String()), nil
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return append(b, cborNull), nil
+		}
+		b = appendCBORHead(b, cborArray, uint64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			var err error
+			if b, err = appendCBORValue(b, v.Index(i)); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("cbor: unsupported map key type %s", v.Type().Key())
+		}
+		if v.IsNil() {
+			return append(b, cborNull), nil
+		}
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		b = appendCBORHead(b, cborMap, uint64(len(keys)))
+		for _, k := range keys {
+			b = appendCBORString(b, k.String())
+			var err error
+			if b, err = appendCBORValue(b, v.MapIndex(k)); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case reflect.Struct:
+		fields := jsonFields(v)
+		b = appendCBORHead(b, cborMap, uint64(len(fields)))
+		for _, f := range fields {
+			b = appendCBORString(b, f.name)
+			var err error
+			if b, err = appendCBORValue(b, f.value); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("cbor: unsupported type %s", v.Type())
+}
+
+// appendCBORHead writes the initial byte of a data item of the given major
+// type with argument n, in the shortest form.
+func appendCBORHead(b []byte, major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return append(b, major|byte(n))
+	case n <= math.MaxUint8:
+		return append(b, major|24, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, major|25), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, major|26), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(b, major|27), n)
+	}
+}
+
+func appendCBORString(b []byte, s string) []byte {
+	return append(appendCBORHead(b, cborText, uint64(len(s))), s...)
+}
+
+// acceptsCBOR reports whether the request's Accept header lists
+// application/cbor.
+func acceptsCBOR(r *http.Request) bool {
+	for _, v := range r.Header.Values("Accept") {
+		for _, t := range strings.Split(v, ",") {
+			mt, _, _ := strings.Cut(t, ";")
+			if strings.EqualFold(strings.TrimSpace(mt), "application/cbor") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeCBOR is writeJSON for clients that negotiated application/cbor.
+func writeCBOR(w http.ResponseWriter, v interface{}) {
+	b, err := appendCBOR(nil, v)
+	if err != nil {
+		writeError(w, internalError.errorf("Failed to encode response"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/cbor")
+	w.Write(b)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+)
+
+// maxChannelNameLen bounds a channel name taken from the wire (a ZeroMQ topic).
+const maxChannelNameLen = 64
+
+// ingestChannel counts what one input channel delivered: a push input, a
+// ZeroMQ topic, or one tenant's polled Redis packets.
+type ingestChannel struct {
+	name         string
+	messages     atomic.Int64
+	packets      atomic.Int64
+	bytes        atomic.Int64
+	decodeErrors atomic.Int64
+	// schemaRejections counts payloads refused by PACKET_SCHEMA_FILE.
+	schemaRejections atomic.Int64
+	// lastMessage is the unix ms time of the last message (0 before the first).
+	lastMessage atomic.Int64
+}
+
+var (
+	ingestChannels   = make(map[string]*ingestChannel)
+	ingestChannelsMu sync.Mutex
+)
+
+// channelFor returns the stats of the named channel, creating them on first use.
+func channelFor(name string) *ingestChannel {
+	ingestChannelsMu.Lock()
+	defer ingestChannelsMu.Unlock()
+	ch := ingestChannels[name]
+	if ch == nil {
+		ch = &ingestChannel{name: name}
+		ingestChannels[name] = ch
+	}
+	return ch
+}
+
+// redisChannel names the channel of a tenant's polled packets.
+func redisChannel(tenant string) string {
+	if tenant == "" {
+		return "redis"
+	}
+	return "redis:" + tenant
+}
+
+// zmqChannel names the channel of a ZeroMQ message: its topic frame when the
+// message has one, "zmq" otherwise. Topics that are long or not printable
+// are not used as names.
+func zmqChannel(parts [][]byte) string {
+	if len(parts) < 2 || len(parts[0]) == 0 || len(parts[0]) > maxChannelNameLen {
+		return "zmq"
+	}
+	for _, r := range string(parts[0]) {
+		if !unicode.IsPrint(r) {
+			return "zmq"
+		}
+	}
+	return "zmq:" + string(parts[0])
+}
+
+// message records a message of size payload bytes.
+func (ch *ingestChannel) message(size int) {
+	ch.messages.Add(1)
+	ch.bytes.Add(int64(size))
+	ch.lastMessage.Store(time.Now().UnixMilli())
+}
+
+// decoded records packets decoded from the channel's messages.
+func (ch *ingestChannel) decoded(packets int) {
+	ch.packets.Add(int64(packets))
+}
+
+// decodeError records a message that could not be decoded.
+func (ch *ingestChannel) decodeError() {
+	ch.decodeErrors.Add(1)
+}
+
+// decodeFailed records a payload decodePackets refused: a schema rejection
+// when it did not match PACKET_SCHEMA_FILE, a decode error otherwise.
+func (ch *ingestChannel) decodeFailed(err error) {
+	var se *schemaError
+	if errors.As(err, &se) {
+		recordSchemaRejection(ch, "", 0, se)
+		return
+	}
+	ch.decodeError()
+}
+
+// recordPolled counts fresh polled packets against their tenant's channel.
+// Each packet hash is one message; the poller does not see payload bytes.
+func recordPolled(fresh []Packet) {
+	counts := make(map[string]int)
+	for _, p := range fresh {
+		counts[p.Tenant]++
+	}
+	now := time.Now().UnixMilli()
+	for tenant, n := range counts {
+		ch := channelFor(redisChannel(tenant))
+		ch.messages.Add(int64(n))
+		ch.packets.Add(int64(n))
+		ch.lastMessage.Store(now)
+	}
+}
+
+// ChannelStats is one channel in GET /admin/channels.
+type ChannelStats struct {
+	Channel      string `json:"channel"`
+	Messages     int64  `json:"messages"`
+	Packets      int64  `json:"packets"`
+	Bytes        int64  `json:"bytes"`
+	DecodeErrors int64  `json:"decode_errors"`
+	// SchemaRejections is omitted unless PACKET_SCHEMA_FILE is set.
+	SchemaRejections *int64     `json:"schema_rejections,omitempty"`
+	LastMessage      *time.Time `json:"last_message,omitempty"`
+	AgeMS            *int64     `json:"age_ms,omitempty"`
+}
+
+// listChannels returns every channel's stats, ordered by name.
+func listChannels() []ChannelStats {
+	ingestChannelsMu.Lock()
+	chans := make([]*ingestChannel, 0, len(ingestChannels))
+	for _, ch := range ingestChannels {
+		chans = append(chans, ch)
+	}
+	ingestChannelsMu.Unlock()
+
+	now := time.Now()
+	stats := make([]ChannelStats, 0, len(chans))
+	for _, ch := range chans {
+		s := ChannelStats{
+			Channel:      ch.name,
+			Messages:     ch.messages.Load(),
+			Packets:      ch.packets.Load(),
+			Bytes:        ch.bytes.Load(),
+			DecodeErrors: ch.decodeErrors.Load(),
+		}
+		if ingestSchema != nil {
+			n := ch.schemaRejections.Load()
+			s.SchemaRejections = &n
+		}
+		if ms := ch.lastMessage.Load(); ms > 0 {
+			last := time.UnixMilli(ms).UTC()
+			age := now.Sub(last).Milliseconds()
+			s.LastMessage, s.AgeMS = &last, &age
+		}
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Channel < stats[j].Channel })
+	return stats
+}
+
+// handleAdminChannels reports per-channel ingest counters.
+func handleAdminChannels(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, listChannels())
+}
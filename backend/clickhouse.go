@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const clickhouseTimeout = 30 * time.Second
+
+// clickhouseSink inserts packet rows through the ClickHouse HTTP interface as
+// JSONEachRow. With async inserts ClickHouse buffers small batches server-side
+// and merges them into larger parts.
+type clickhouseSink struct {
+	endpoint string
+	user     string
+	password string
+	table    string
+	create   bool
+	ttl      time.Duration
+	async    bool
+	client   *http.Client
+
+	mu          sync.Mutex
+	schemaReady bool
+}
+
+// clickhouseRow is one packet with its counters pre-summed for aggregation.
+type clickhouseRow struct {
+	Time       string `json:"time"`
+	Seq        int    `json:"seq"`
+	NodeID     int    `json:"node_id"`
+	Src        string `json:"src"`
+	Dest       string `json:"dest"`
+	TotalBytes int    `json:"total_bytes"`
+
+	UDPPackets []int `json:"udp_packets"`
+	UDPBytes   []int `json:"udp_bytes"`
+	TCPPackets []int `json:"tcp_packets"`
+	TCPBytes   []int `json:"tcp_bytes"`
+
+	TCPPacketsTotal int `json:"tcp_packets_total"`
+	TCPBytesTotal   int `json:"tcp_bytes_total"`
+	UDPPacketsTotal int `json:"udp_packets_total"`
+	UDPBytesTotal   int `json:"udp_bytes_total"`
+}
+
+func initClickHouseSink(cfg *Config) {
+	if cfg.ClickHouseURL == "" {
+		return
+	}
+
+	table := chQuoteIdent(cfg.ClickHouseTable)
+	if cfg.ClickHouseDatabase != "" {
+		table = chQuoteIdent(cfg.ClickHouseDatabase) + "." + table
+	}
+	s := &clickhouseSink{
+		endpoint: strings.TrimSuffix(cfg.ClickHouseURL, "/") + "/",
+		user:     cfg.ClickHouseUser,
+		password: cfg.ClickHousePassword,
+		table:    table,
+		create:   cfg.ClickHouseCreateTable,
+		ttl:      cfg.ClickHouseTTL,
+		async:    cfg.ClickHouseAsyncInsert,
+		client:   &http.Client{Timeout: clickhouseTimeout},
+	}
+	registerSink(s, cfg.ClickHouseBatchSize, cfg.ClickHouseBatchTimeout)
+}
+
+func (s *clickhouseSink) Name() string { return "clickhouse" }
+func (s *clickhouseSink) external()    {}
+
+func (s *clickhouseSink) Write(ctx context.Context, packets []Packet) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.ensureSchema(ctx); err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, p := range packets {
+		e := generateEdgeSummary(p)
+		row := clickhouseRow{
+			Time:       time.Unix(int64(p.Timestamp), 0).UTC().Format(time.DateTime),
+			Seq:        p.Seq,
+			NodeID:     p.NodeID,
+			Src:        p.Src,
+			Dest:       p.Dest,
+			TotalBytes: p.TotalBytes,
+
+			UDPPackets: nonNilInts(p.UDPPackets),
+			UDPBytes:   nonNilInts(p.UDPBytes),
+			TCPPackets: nonNilInts(p.TCPPackets),
+			TCPBytes:   nonNilInts(p.TCPBytes),
+
+			TCPPacketsTotal: e.TCPPacketsTotal,
+			TCPBytesTotal:   e.TCPBytesTotal,
+			UDPPacketsTotal: e.UDPPacketsTotal,
+			UDPBytesTotal:   e.UDPBytesTotal,
+		}
+		if err := enc.Encode(row); err != nil {
+			return err
+		}
+	}
+
+	params := url.Values{"query": {"INSERT INTO " + s.table + " FORMAT JSONEachRow"}}
+	if s.async {
+		params.Set("async_insert", "1")
+		params.Set("wait_for_async_insert", "1")
+	}
+	return s.do(ctx, params, &body)
+}
+
+func (s *clickhouseSink) ensureSchema(ctx context.Context) error {
+	if s.schemaReady || !s.create {
+		return nil
+	}
+
+	ddl := `CREATE TABLE IF NOT EXISTS ` + s.table + ` (
+	time              DateTime('UTC'),
+	seq               Int64,
+	node_id           Int64,
+	src               LowCardinality(String),
+	dest              LowCardinality(String),
+	total_bytes       Int64,
+	udp_packets       Array(Int64),
+	udp_bytes         Array(Int64),
+	tcp_packets       Array(Int64),
+	tcp_bytes         Array(Int64),
+	tcp_packets_total Int64,
+	tcp_bytes_total   Int64,
+	udp_packets_total Int64,
+	udp_bytes_total   Int64
+) ENGINE = MergeTree
+PARTITION BY toYYYYMMDD(time)
+ORDER BY (src, dest, time)`
+	if s.ttl > 0 {
+		ddl += fmt.Sprintf("\nTTL time + INTERVAL %d SECOND", int64(s.ttl.Seconds()))
+	}
+	if err := s.do(ctx, nil, strings.NewReader(ddl)); err != nil {
+		return err
+	}
+	s.schemaReady = true
+	return nil
+}
+
+// do POSTs body (a statement, or data for the statement in params) to ClickHouse.
+func (s *clickhouseSink) do(ctx context.Context, params url.Values, body io.Reader) error {
+	target := s.endpoint
+	if len(params) > 0 {
+		target += "?" + params.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, body)
+	if err != nil {
+		return err
+	}
+	if s.user != "" {
+		req.Header.Set("X-ClickHouse-User", s.user)
+		req.Header.Set("X-ClickHouse-Key", s.password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("clickhouse: %w", httpStatusError(resp))
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// chQuoteIdent backquotes a ClickHouse identifier.
+func chQuoteIdent(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return "`" + strings.ReplaceAll(s, "`", "\\`") + "`"
+}
+
+// nonNilInts encodes missing counters as [] rather than null.
+func nonNilInts(v []int) []int {
+	if v == nil {
+		return []int{}
+	}
+	return v
+}
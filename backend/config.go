@@ -7,6 +7,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"runtime"
 	"strconv"
 	"time"
 )
@@ -18,11 +19,406 @@ type Config struct {
 	RedisDB      int
 	ServerPort   string
 	PollInterval time.Duration
-}
 
-var config Config
+	// RedisProtocol is the RESP version (2 or 3) of the Redis clients.
+	// RediSearch commands always use RESP2 (see searchClient).
+	RedisProtocol int
+
+	// Listeners replaces SERVER_PORT with several listeners, each serving
+	// its own route groups with its own auth mode (see parseListeners).
+	Listeners string
+
+	// LongPollTimeout caps how long /latest/wait holds a request open.
+	LongPollTimeout time.Duration
+
+	// HTTPReadHeaderTimeout, HTTPReadTimeout, HTTPWriteTimeout, and
+	// HTTPIdleTimeout bound the phases of an HTTP connection, and
+	// HTTPMaxHeaderBytes the size of request headers (see newHTTPServer).
+	HTTPReadHeaderTimeout time.Duration
+	HTTPReadTimeout       time.Duration
+	HTTPWriteTimeout      time.Duration
+	HTTPIdleTimeout       time.Duration
+	HTTPMaxHeaderBytes    int
+
+	// StaleAfter is how long without messages before latest is reported stale.
+	StaleAfter time.Duration
+
+	// ReadyRequireTraffic keeps /readyz down until latest holds a packet.
+	ReadyRequireTraffic bool
+
+	// TimestampMaxFuture and TimestampMaxPast bound packet timestamps around
+	// server time (TimestampMaxPast 0 disables the past check). Packets outside
+	// are counted and logged, and dropped when TimestampQuarantine is set.
+	TimestampMaxFuture  time.Duration
+	TimestampMaxPast    time.Duration
+	TimestampQuarantine bool
+
+	// SeqTracking checks each publisher's seq numbers for gaps and duplicates.
+	SeqTracking bool
+
+	// WSAckWindow is the maximum unacknowledged bytes for clients that opt in
+	// to credit-based flow control (0 disables the mode).
+	WSAckWindow int64
+
+	// WSSendQueue is the number of frames buffered per WebSocket client.
+	WSSendQueue int
+
+	// WSPauseBacklog is the number of frames kept for a paused client that
+	// asked for a backlog (0 disables backlogs).
+	WSPauseBacklog int
+
+	// WSReplayFrames is the number of delivered frames kept for clients
+	// resuming a session (0 disables sessions); WSSessionTTL is how long a
+	// session can be resumed after its connection closes.
+	WSReplayFrames int
+	WSSessionTTL   time.Duration
+
+	// WSWriteTimeout bounds each write to a WebSocket client, on /ws and
+	// /replay; a client that does not take a frame in time is disconnected.
+	WSWriteTimeout time.Duration
+
+	// WSReadLimit is the largest message a WebSocket client may send, in
+	// bytes (0 for no limit). WSIdleTimeout is how long a client may go
+	// without sending anything, pongs included, before it is disconnected;
+	// the server pings it twice as often.
+	WSReadLimit   int
+	WSIdleTimeout time.Duration
+
+	// GeoIPFile enables GeoIP enrichment: a CSV of network,latitude,longitude
+	// (GeoLite2 City Blocks files work as they are).
+	GeoIPFile string
+
+	// SearchFallback is how packets are queried when Redis lacks the
+	// RediSearch module: "scan" (SCAN packet:*) or "zset" (packets:by_ts).
+	SearchFallback string
+
+	// SearchDisabled skips RediSearch entirely, as if Redis lacked it: no
+	// index is created and no FT.* command is sent.
+	SearchDisabled bool
+
+	// SearchIndex and PacketPrefix are the RediSearch index over packet
+	// hashes and the key prefix of those hashes, before any tenant prefix
+	// (checked by checkKeyLayout).
+	SearchIndex  string
+	PacketPrefix string
+
+	// UpdateStrategy combines packets of a pair that share a timestamp:
+	// "replace", "accumulate", or "merge-by-packet-id" (see state.go).
+	UpdateStrategy string
+
+	// RemoteWriteURL enables pushing /metrics to a Prometheus remote-write
+	// endpoint every RemoteWriteInterval, with optional basic auth and a
+	// tenant (X-Scope-OrgID) for Mimir/Cortex.
+	RemoteWriteURL      string
+	RemoteWriteInterval time.Duration
+	RemoteWriteUser     string
+	RemoteWritePassword string
+	RemoteWriteTenant   string
+	RemoteWriteJob      string
+
+	// StatsDAddr enables sending the core counters to a StatsD/DogStatsD
+	// agent (UDP host:port) every StatsDInterval. StatsDTags are DogStatsD
+	// tags ("env:prod,site:jlab"); leave empty for plain StatsD.
+	StatsDAddr     string
+	StatsDPrefix   string
+	StatsDInterval time.Duration
+	StatsDTags     string
+
+	// RedisRetries and RedisRetryBackoff retry failed Redis queries (the
+	// backoff doubles per attempt). After RedisBreakerFailures consecutive
+	// failed calls the circuit breaker skips Redis for RedisBreakerCooldown
+	// (0 failures disables the breaker).
+	RedisRetries         int
+	RedisRetryBackoff    time.Duration
+	RedisBreakerFailures int
+	RedisBreakerCooldown time.Duration
+
+	// NotifyRetries and SinkRetries retry failed alert notifications and
+	// report webhook posts, and failed sink writes, from RetryBackoff.
+	// RetryMaxDelay caps each retry delay (Redis's too) and RetryMaxElapsed
+	// the time spent retrying one call (see backoff.go).
+	NotifyRetries   int
+	SinkRetries     int
+	RetryBackoff    time.Duration
+	RetryMaxDelay   time.Duration
+	RetryMaxElapsed time.Duration
+
+	// QueryTimeout bounds a poll and each Redis-backed HTTP query, retries
+	// included.
+	QueryTimeout time.Duration
+
+	// SLOAvailability is the target share of HTTP requests answered without
+	// a 5xx, and SLOLatencyTarget the share of broadcast frames the hub must
+	// queue to clients within SLOLatency of their publication. Error budgets
+	// are spent over SLOWindow (see slo.go).
+	SLOAvailability  float64
+	SLOLatency       time.Duration
+	SLOLatencyTarget float64
+	SLOWindow        time.Duration
+
+	// ReconcileInterval is how often latest is checked against Redis
+	// (startReconciler); 0 disables it.
+	ReconcileInterval time.Duration
+
+	// ConsistencyInterval is how often stored packets are compared with the
+	// packets received (startConsistencyChecker); 0 disables it.
+	ConsistencyInterval time.Duration
+
+	// BroadcastBuffer is the size of the channel between producers and the
+	// WebSocket hub; BroadcastOverflow ("drop-newest" or "drop-oldest")
+	// decides which frame is lost when it is full.
+	BroadcastBuffer   int
+	BroadcastOverflow string
+	// BroadcastControlBuffer is the size of the control lane, which carries
+	// alert, status, and annotation frames ahead of data frames.
+	BroadcastControlBuffer int
+
+	// BroadcastSampleEvery, when above 1, makes the hub deliver one update in
+	// N while a queue is BroadcastSampleQueue full or the process uses
+	// BroadcastSampleCPU of GOMAXPROCS, until the load has stayed under both
+	// for BroadcastSampleRecovery.
+	BroadcastSampleEvery    int
+	BroadcastSampleQueue    float64
+	BroadcastSampleCPU      float64
+	BroadcastSampleRecovery time.Duration
+
+	// SampleRate is the fraction of packets kept (1 keeps all); set with
+	// SAMPLE_EVERY=N (1 in N) or SAMPLE_PROBABILITY=p.
+	SampleRate float64
+	// SampleProbability is SAMPLE_PROBABILITY as given; initSampling
+	// checks it and sets SampleRate.
+	SampleProbability string
+
+	// Filter is a filter expression every packet must match to be applied,
+	// broadcast, sent to sinks, or stored (empty keeps everything).
+	Filter string
+	// DropRules ("name:expr;...") drops packets matching any rule's filter
+	// expression everywhere, counting them per rule (see initDropRules).
+	DropRules string
+	// Transforms ("derive name = expr;set field = expr;strip field") change
+	// packets after filtering (see transform.go).
+	Transforms string
+	// AnonymizeIPs ("truncate" or "hmac") masks source and destination
+	// addresses before packets reach the view, clients, sinks, and query
+	// responses (see anonymize.go). AnonymizeKey keys hmac mode.
+	AnonymizeIPs        string
+	AnonymizeKey        string
+	AnonymizeIPv4Prefix int
+	AnonymizeIPv6Prefix int
+	// PacketSchemaFile is a JSON Schema every incoming packet must match;
+	// packets that do not are rejected before they are applied.
+	PacketSchemaFile string
+	// Processors names the optional packet processors to run (see
+	// optionalProcessors).
+	Processors string
+
+	// AlertRulesFile is a JSON array of alert rules loaded at startup.
+	AlertRulesFile    string
+	AlertEvalInterval time.Duration
+	// AlertHistorySize caps the alerts:history list (0 disables the history).
+	AlertHistorySize int
+	// AlertWebhookURL (JSON) and AlertSlackWebhookURL receive notifications.
+	AlertWebhookURL      string
+	AlertSlackWebhookURL string
+	// AlertSMTPAddr (host:port) enables email notifications to AlertSMTPTo.
+	AlertSMTPAddr     string
+	AlertSMTPUser     string
+	AlertSMTPPassword string
+	AlertSMTPFrom     string
+	AlertSMTPTo       string
+	// AlertNotifyInterval is the minimum time between firing notifications
+	// for one rule on one notifier.
+	AlertNotifyInterval time.Duration
+
+	// AnnotationHistorySize caps each tenant's annotations sorted set (0
+	// disables annotations).
+	AnnotationHistorySize int
+
+	// AdminToken is the bearer token required by /admin endpoints (empty disables them).
+	AdminToken string
+	// StateFile is the snapshot restored at startup and written by
+	// /admin/state/save; a .gob extension selects gob instead of JSON.
+	StateFile string
+
+	// TrustedProxies lists the proxies (CIDRs, IPs, or "unix" for unix
+	// socket peers) whose Forwarded and X-Forwarded-For headers name the
+	// client; see initTrustedProxies.
+	TrustedProxies string
+
+	// AllowedCIDRs and DeniedCIDRs seed the access lists checked before
+	// every data, metrics, ingest, and admin request; see clientAllowed.
+	AllowedCIDRs string
+	DeniedCIDRs  string
+
+	// DrainTimeout is how long POST /admin/drain, or SIGTERM, lets open
+	// sessions run before closing them.
+	DrainTimeout time.Duration
+	// ReusePort opens TCP listeners with SO_REUSEPORT, so a new process can
+	// bind the port while the old one drains.
+	ReusePort bool
+
+	// APIVersions are named sets of outbound JSON field names clients can
+	// pick with X-API-Version (see parseAPIVersions).
+	APIVersions string
+
+	// HTTP middleware settings; see Server.middleware.
+	AccessLog         bool
+	CORSOrigins       string
+	RateLimit         float64
+	RateLimitBurst    int
+	CompressResponses bool
 
-func initConfig() {
+	// NATSURL enables republishing broadcast frames to NATS (nats://[user:pass@]host:port).
+	NATSURL     string
+	NATSSubject string
+
+	// JournalDir enables the on-disk frame journal read by /replay. Segments
+	// are rotated at JournalSegmentMB and the oldest removed past JournalMaxMB.
+	JournalDir       string
+	JournalSegmentMB int
+	JournalMaxMB     int
+
+	// KafkaBrokers enables the Kafka sink (comma-separated bootstrap host:port list).
+	KafkaBrokers string
+	KafkaTopic   string
+	// KafkaPartition is the partition to produce to, or kafkaPartitionByKey.
+	KafkaPartition    int
+	KafkaAcks         int
+	KafkaPayload      string
+	KafkaBatchSize    int
+	KafkaBatchTimeout time.Duration
+
+	// RelayRedisAddr enables the relay sink to a secondary Redis.
+	RelayRedisAddr     string
+	RelayRedisPassword string
+	RelayRedisDB       int
+	RelayMode          string
+	RelayChannel       string
+	RelayTTL           time.Duration
+	RelaySources       string
+	RelayDests         string
+	RelayAggregate     bool
+	RelayBatchSize     int
+	RelayInterval      time.Duration
+
+	// PostgresURL enables the PostgreSQL/TimescaleDB archival sink.
+	PostgresURL          string
+	PostgresTable        string
+	PostgresCreateTable  bool
+	PostgresTimescale    bool
+	PostgresRetention    time.Duration
+	PostgresBatchSize    int
+	PostgresBatchTimeout time.Duration
+
+	// ClickHouseURL enables the ClickHouse sink (HTTP interface, e.g. http://host:8123).
+	ClickHouseURL          string
+	ClickHouseUser         string
+	ClickHousePassword     string
+	ClickHouseDatabase     string
+	ClickHouseTable        string
+	ClickHouseCreateTable  bool
+	ClickHouseTTL          time.Duration
+	ClickHouseAsyncInsert  bool
+	ClickHouseBatchSize    int
+	ClickHouseBatchTimeout time.Duration
+
+	// OpenSearchURL enables the OpenSearch/Elasticsearch sink.
+	OpenSearchURL          string
+	OpenSearchUser         string
+	OpenSearchPassword     string
+	OpenSearchIndex        string
+	OpenSearchTemplateName string
+	OpenSearchBatchSize    int
+	OpenSearchBatchTimeout time.Duration
+
+	// ParquetDir or S3Bucket enables the Parquet archival sink; closed files
+	// are uploaded to S3Bucket when it is set.
+	ParquetDir            string
+	ParquetRotateInterval time.Duration
+	ParquetMaxRows        int
+	ParquetRowGroupSize   int
+	ParquetFlushInterval  time.Duration
+	S3Endpoint            string
+	S3Region              string
+	S3Bucket              string
+	S3Prefix              string
+	S3AccessKey           string
+	S3SecretKey           string
+
+	// Rollups enables per-minute/per-hour rollup:* hashes and GET /rollups.
+	Rollups             bool
+	RollupMinuteTTL     time.Duration
+	RollupHourTTL       time.Duration
+	RollupLateness      time.Duration
+	RollupFlushInterval time.Duration
+
+	// Reports enables scheduled summaries ("hourly", "daily", or both).
+	Reports          string
+	ReportWebhookURL string
+	ReportTopN       int
+	ReportHistory    int
+
+	// DecodeWorkers is the number of goroutines decoding poll results and
+	// ZeroMQ payloads (1 decodes inline).
+	DecodeWorkers int
+
+	// ZMQEndpoint enables the ZeroMQ input (tcp://host:port to connect, tcp://*:port to bind).
+	ZMQEndpoint string
+	ZMQSocket   string
+
+	// UDPListen enables direct UDP ingestion of EJFAT LB data and sync packets.
+	UDPListen        string
+	UDPDest          string
+	UDPFlushInterval time.Duration
+
+	// PcapFile is replayed through the ingest path at startup when set.
+	PcapFile  string
+	PcapSpeed float64
+
+	// IngestToken is the bearer token for POST /ingest (empty disables it).
+	IngestToken string
+	IngestStore bool
+	IngestTTL   time.Duration
+
+	// Tenants lets experiments share the backend and Redis: each name is a
+	// prefix ("hallB" -> "hallB:") on its keys, indexes, and channels.
+	Tenants []string
+	// TenantTokens ("tenant:token,...") scopes API tokens to one tenant;
+	// when set, tenant-scoped endpoints require one of them or ADMIN_TOKEN.
+	TenantTokens string
+	// TenantMaxClients and TenantMaxBytesPerSec cap each tenant's WebSocket
+	// clients and the bytes the hub queues for them per second: "50" for
+	// every tenant, "hallB:50,..." per tenant, or both (0 = unlimited).
+	TenantMaxClients     string
+	TenantMaxBytesPerSec string
+	// TenantFilters ("tenant:expr;...") is the filter of a tenant's clients
+	// that do not set their own.
+	TenantFilters string
+
+	// QoSTokens ("class:token,...") lets a token claim a WebSocket QoS class
+	// (control-room, standard, best-effort); QoSSendQueue and
+	// QoSMaxBytesPerSec ("class:n,...") set each class's send queue and
+	// per-client bytes per second (0 = unlimited).
+	QoSTokens         string
+	QoSSendQueue      string
+	QoSMaxBytesPerSec string
+	// WSMaxClients caps WebSocket clients (0 = unlimited); a full server
+	// evicts a client of a lower QoS class to admit one of a higher class.
+	WSMaxClients int
+
+	// GRPCListen enables the TrafficIngest gRPC service (cleartext HTTP/2).
+	GRPCListen string
+
+	// HTTP3Listen serves the data routes over HTTP/3 on this UDP address,
+	// with the HTTP3_CERT_FILE/HTTP3_KEY_FILE certificate (see http3.go).
+	HTTP3Listen   string
+	HTTP3CertFile string
+	HTTP3KeyFile  string
+}
+
+// loadConfig reads the configuration from the environment. Invalid values
+// fall back to their defaults.
+func loadConfig() *Config {
 	pollInterval := time.Second
 	if v := os.Getenv("POLL_INTERVAL"); v != "" {
 		if d, err := time.ParseDuration(v); err == nil && d > 0 {
@@ -30,6 +426,84 @@ func initConfig() {
 		}
 	}
 
+	longPollTimeout := 30 * time.Second
+	if v := os.Getenv("LONG_POLL_TIMEOUT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			longPollTimeout = d
+		}
+	}
+
+	wsAckWindow := int64(1 << 20)
+	if v := os.Getenv("WS_ACK_WINDOW"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n >= 0 {
+			wsAckWindow = n
+		}
+	}
+
+	wsSendQueue := 64
+	if v := os.Getenv("WS_SEND_QUEUE"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			wsSendQueue = n
+		}
+	}
+
+	kafkaAcks := 1
+	switch v := os.Getenv("KAFKA_ACKS"); v {
+	case "all":
+		kafkaAcks = -1
+	case "":
+	default:
+		if n, err := strconv.Atoi(v); err == nil && n >= -1 && n <= 1 {
+			kafkaAcks = n
+		}
+	}
+
+	kafkaPartition := getEnvInt("KAFKA_PARTITION", 0)
+	if os.Getenv("KAFKA_PARTITION") == "key" {
+		kafkaPartition = kafkaPartitionByKey
+	}
+
+	var rateLimit float64
+	if v := os.Getenv("RATE_LIMIT"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil && f > 0 {
+			rateLimit = f
+		}
+	}
+
+	pcapSpeed := 1.0
+	if v := os.Getenv("PCAP_SPEED"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil && f >= 0 {
+			pcapSpeed = f
+		}
+	}
+
+	updateStrategy := getEnv("UPDATE_STRATEGY", strategyReplace)
+	switch updateStrategy {
+	case strategyReplace, strategyAccumulate, strategyMerge:
+	default:
+		updateStrategy = strategyReplace
+	}
+
+	redisProtocol := getEnvInt("REDIS_PROTOCOL", 2)
+	if redisProtocol != 3 {
+		redisProtocol = 2
+	}
+
+	searchFallback := getEnv("SEARCH_FALLBACK", fallbackScan)
+	if searchFallback != fallbackZSet {
+		searchFallback = fallbackScan
+	}
+
+	broadcastOverflow := getEnv("BROADCAST_OVERFLOW", "drop-newest")
+	if broadcastOverflow != "drop-oldest" {
+		broadcastOverflow = "drop-newest"
+	}
+
+	sampleRate := 1.0
+	if n := getEnvInt("SAMPLE_EVERY", 0); n > 1 {
+		sampleRate = 1 / float64(n)
+	}
+
 	redisDB := 0
 	if v := os.Getenv("REDIS_DB"); v != "" {
 		if n, err := strconv.Atoi(v); err == nil {
@@ -37,12 +511,246 @@ func initConfig() {
 		}
 	}
 
-	config = Config{
+	return &Config{
 		Debug:        os.Getenv("DEBUG") == "true" || os.Getenv("DEBUG") == "1",
 		RedisAddr:    getEnv("REDIS_ADDR", "localhost:6379"),
 		RedisDB:      redisDB,
 		ServerPort:   getEnv("SERVER_PORT", ":8080"),
 		PollInterval: pollInterval,
+
+		RedisProtocol: redisProtocol,
+
+		Listeners: os.Getenv("LISTENERS"),
+
+		HTTPReadHeaderTimeout: getEnvDuration("HTTP_READ_HEADER_TIMEOUT", 10*time.Second),
+		HTTPReadTimeout:       getEnvDuration("HTTP_READ_TIMEOUT", 30*time.Second),
+		HTTPWriteTimeout:      getEnvDuration("HTTP_WRITE_TIMEOUT", 60*time.Second),
+		HTTPIdleTimeout:       getEnvDuration("HTTP_IDLE_TIMEOUT", 120*time.Second),
+		HTTPMaxHeaderBytes:    getEnvInt("HTTP_MAX_HEADER_BYTES", 64<<10),
+
+		ReadyRequireTraffic: os.Getenv("READY_REQUIRE_TRAFFIC") == "true" || os.Getenv("READY_REQUIRE_TRAFFIC") == "1",
+
+		LongPollTimeout: longPollTimeout,
+		StaleAfter:      getEnvDuration("STALE_AFTER", 30*time.Second),
+		WSAckWindow:     wsAckWindow,
+		WSSendQueue:     wsSendQueue,
+		WSPauseBacklog:  getEnvInt("WS_PAUSE_BACKLOG", 256),
+		WSReplayFrames:  getEnvInt("WS_REPLAY_FRAMES", 500),
+		WSSessionTTL:    getEnvDuration("WS_SESSION_TTL", 5*time.Minute),
+		WSWriteTimeout:  getEnvDuration("WS_WRITE_TIMEOUT", 10*time.Second),
+		WSReadLimit:     getEnvInt("WS_READ_LIMIT", 65536),
+		WSIdleTimeout:   getEnvDuration("WS_IDLE_TIMEOUT", 60*time.Second),
+
+		TimestampMaxFuture:  getEnvDuration("TIMESTAMP_MAX_FUTURE", 5*time.Minute),
+		TimestampMaxPast:    getEnvDuration("TIMESTAMP_MAX_PAST", 0),
+		TimestampQuarantine: os.Getenv("TIMESTAMP_QUARANTINE") == "true" || os.Getenv("TIMESTAMP_QUARANTINE") == "1",
+		SeqTracking:         os.Getenv("SEQ_TRACKING") == "true" || os.Getenv("SEQ_TRACKING") == "1",
+
+		GeoIPFile:      os.Getenv("GEOIP_FILE"),
+		SearchFallback: searchFallback,
+		SearchDisabled: os.Getenv("SEARCH_DISABLED") == "true" || os.Getenv("SEARCH_DISABLED") == "1",
+		SearchIndex:    getEnv("SEARCH_INDEX", "idx:packets"),
+		PacketPrefix:   getEnv("PACKET_PREFIX", "packet:"),
+		UpdateStrategy: updateStrategy,
+
+		RedisRetries:         getEnvInt("REDIS_RETRIES", 2),
+		RedisRetryBackoff:    getEnvDuration("REDIS_RETRY_BACKOFF", 100*time.Millisecond),
+		RedisBreakerFailures: getEnvInt("REDIS_BREAKER_FAILURES", 5),
+		RedisBreakerCooldown: getEnvDuration("REDIS_BREAKER_COOLDOWN", 10*time.Second),
+		QueryTimeout:         getEnvDuration("QUERY_TIMEOUT", 30*time.Second),
+		SLOAvailability:      getEnvRatio("SLO_AVAILABILITY", 0.999),
+		SLOLatency:           getEnvDuration("SLO_LATENCY", 250*time.Millisecond),
+		SLOLatencyTarget:     getEnvRatio("SLO_LATENCY_TARGET", 0.99),
+		SLOWindow:            getEnvDuration("SLO_WINDOW", 24*time.Hour),
+		NotifyRetries:        getEnvInt("NOTIFY_RETRIES", 3),
+		SinkRetries:          getEnvInt("SINK_RETRIES", 2),
+		RetryBackoff:         getEnvDuration("RETRY_BACKOFF", 500*time.Millisecond),
+		RetryMaxDelay:        getEnvDuration("RETRY_MAX_DELAY", 10*time.Second),
+		RetryMaxElapsed:      getEnvDuration("RETRY_MAX_ELAPSED", 30*time.Second),
+		ReconcileInterval:    getEnvDuration("RECONCILE_INTERVAL", 0),
+		ConsistencyInterval:  getEnvDuration("CONSISTENCY_INTERVAL", 0),
+
+		RemoteWriteURL:      os.Getenv("REMOTE_WRITE_URL"),
+		RemoteWriteInterval: getEnvDuration("REMOTE_WRITE_INTERVAL", 15*time.Second),
+		RemoteWriteUser:     os.Getenv("REMOTE_WRITE_USER"),
+		RemoteWritePassword: os.Getenv("REMOTE_WRITE_PASSWORD"),
+		RemoteWriteTenant:   os.Getenv("REMOTE_WRITE_TENANT"),
+		RemoteWriteJob:      getEnv("REMOTE_WRITE_JOB", "traffic-backend"),
+
+		StatsDAddr:     os.Getenv("STATSD_ADDR"),
+		StatsDPrefix:   getEnv("STATSD_PREFIX", "traffic."),
+		StatsDInterval: getEnvDuration("STATSD_INTERVAL", 10*time.Second),
+		StatsDTags:     os.Getenv("STATSD_TAGS"),
+
+		BroadcastBuffer:   max(getEnvInt("BROADCAST_BUFFER", 100), 1),
+		BroadcastOverflow: broadcastOverflow,
+
+		BroadcastControlBuffer: max(getEnvInt("BROADCAST_CONTROL_BUFFER", 100), 1),
+
+		BroadcastSampleEvery:    getEnvInt("BROADCAST_SAMPLE_EVERY", 0),
+		BroadcastSampleQueue:    getEnvRatio("BROADCAST_SAMPLE_QUEUE", 0.75),
+		BroadcastSampleCPU:      getEnvRatio("BROADCAST_SAMPLE_CPU", 0.9),
+		BroadcastSampleRecovery: getEnvDuration("BROADCAST_SAMPLE_RECOVERY", 10*time.Second),
+
+		SampleRate:        sampleRate,
+		SampleProbability: os.Getenv("SAMPLE_PROBABILITY"),
+		Filter:            os.Getenv("FILTER"),
+		Processors:        os.Getenv("PROCESSORS"),
+
+		DropRules:  os.Getenv("DROP_RULES"),
+		Transforms: os.Getenv("TRANSFORMS"),
+
+		AnonymizeIPs:        os.Getenv("ANONYMIZE_IPS"),
+		AnonymizeKey:        os.Getenv("ANONYMIZE_KEY"),
+		AnonymizeIPv4Prefix: getEnvInt("ANONYMIZE_IPV4_PREFIX", 24),
+		AnonymizeIPv6Prefix: getEnvInt("ANONYMIZE_IPV6_PREFIX", 48),
+
+		PacketSchemaFile: os.Getenv("PACKET_SCHEMA_FILE"),
+
+		AlertRulesFile:    os.Getenv("ALERT_RULES_FILE"),
+		AlertEvalInterval: getEnvDuration("ALERT_EVAL_INTERVAL", 5*time.Second),
+		AlertHistorySize:  getEnvInt("ALERT_HISTORY_SIZE", 1000),
+		AlertWebhookURL:   os.Getenv("ALERT_WEBHOOK_URL"),
+
+		AlertSlackWebhookURL: os.Getenv("ALERT_SLACK_WEBHOOK_URL"),
+		AlertSMTPAddr:        os.Getenv("ALERT_SMTP_ADDR"),
+		AlertSMTPUser:        os.Getenv("ALERT_SMTP_USER"),
+		AlertSMTPPassword:    os.Getenv("ALERT_SMTP_PASSWORD"),
+		AlertSMTPFrom:        os.Getenv("ALERT_SMTP_FROM"),
+		AlertSMTPTo:          os.Getenv("ALERT_SMTP_TO"),
+		AlertNotifyInterval:  getEnvDuration("ALERT_NOTIFY_INTERVAL", 5*time.Minute),
+
+		AnnotationHistorySize: getEnvInt("ANNOTATION_HISTORY_SIZE", 10000),
+
+		AdminToken: os.Getenv("ADMIN_TOKEN"),
+		StateFile:  os.Getenv("STATE_FILE"),
+
+		TrustedProxies: os.Getenv("TRUSTED_PROXIES"),
+
+		AllowedCIDRs: os.Getenv("ALLOWED_CIDRS"),
+		DeniedCIDRs:  os.Getenv("DENIED_CIDRS"),
+
+		DrainTimeout: getEnvDuration("DRAIN_TIMEOUT", 5*time.Minute),
+		ReusePort:    os.Getenv("REUSE_PORT") == "true" || os.Getenv("REUSE_PORT") == "1",
+
+		APIVersions: os.Getenv("API_VERSIONS"),
+
+		AccessLog:         os.Getenv("ACCESS_LOG") == "true" || os.Getenv("ACCESS_LOG") == "1",
+		CORSOrigins:       os.Getenv("CORS_ORIGINS"),
+		RateLimit:         rateLimit,
+		RateLimitBurst:    max(getEnvInt("RATE_LIMIT_BURST", 20), 1),
+		CompressResponses: os.Getenv("COMPRESS_RESPONSES") == "true" || os.Getenv("COMPRESS_RESPONSES") == "1",
+
+		NATSURL:     os.Getenv("NATS_URL"),
+		NATSSubject: getEnv("NATS_SUBJECT", "traffic.frames"),
+
+		JournalDir:       os.Getenv("JOURNAL_DIR"),
+		JournalSegmentMB: getEnvInt("JOURNAL_SEGMENT_MB", 64),
+		JournalMaxMB:     getEnvInt("JOURNAL_MAX_MB", 1024),
+
+		KafkaBrokers:      os.Getenv("KAFKA_BROKERS"),
+		KafkaTopic:        getEnv("KAFKA_TOPIC", "traffic-packets"),
+		KafkaPartition:    kafkaPartition,
+		KafkaAcks:         kafkaAcks,
+		KafkaPayload:      getEnv("KAFKA_PAYLOAD", "packet"),
+		KafkaBatchSize:    getEnvInt("KAFKA_BATCH_SIZE", 500),
+		KafkaBatchTimeout: getEnvDuration("KAFKA_BATCH_TIMEOUT", time.Second),
+
+		RelayRedisAddr:     os.Getenv("RELAY_REDIS_ADDR"),
+		RelayRedisPassword: os.Getenv("RELAY_REDIS_PASSWORD"),
+		RelayRedisDB:       getEnvInt("RELAY_REDIS_DB", 0),
+		RelayMode:          getEnv("RELAY_MODE", "store"),
+		RelayChannel:       getEnv("RELAY_CHANNEL", "traffic.packets"),
+		RelayTTL:           getEnvDuration("RELAY_TTL", time.Hour),
+		RelaySources:       os.Getenv("RELAY_SOURCES"),
+		RelayDests:         os.Getenv("RELAY_DESTS"),
+		RelayAggregate:     os.Getenv("RELAY_AGGREGATE") == "true" || os.Getenv("RELAY_AGGREGATE") == "1",
+		RelayBatchSize:     getEnvInt("RELAY_BATCH_SIZE", 500),
+		RelayInterval:      getEnvDuration("RELAY_INTERVAL", time.Second),
+
+		PostgresURL:          os.Getenv("POSTGRES_URL"),
+		PostgresTable:        getEnv("POSTGRES_TABLE", "traffic_summaries"),
+		PostgresCreateTable:  os.Getenv("POSTGRES_CREATE_TABLE") != "false" && os.Getenv("POSTGRES_CREATE_TABLE") != "0",
+		PostgresTimescale:    os.Getenv("POSTGRES_TIMESCALE") != "false" && os.Getenv("POSTGRES_TIMESCALE") != "0",
+		PostgresRetention:    getEnvDuration("POSTGRES_RETENTION", 0),
+		PostgresBatchSize:    getEnvInt("POSTGRES_BATCH_SIZE", 1000),
+		PostgresBatchTimeout: getEnvDuration("POSTGRES_BATCH_TIMEOUT", 5*time.Second),
+
+		ClickHouseURL:          os.Getenv("CLICKHOUSE_URL"),
+		ClickHouseUser:         os.Getenv("CLICKHOUSE_USER"),
+		ClickHousePassword:     os.Getenv("CLICKHOUSE_PASSWORD"),
+		ClickHouseDatabase:     os.Getenv("CLICKHOUSE_DATABASE"),
+		ClickHouseTable:        getEnv("CLICKHOUSE_TABLE", "traffic_packets"),
+		ClickHouseCreateTable:  os.Getenv("CLICKHOUSE_CREATE_TABLE") != "false" && os.Getenv("CLICKHOUSE_CREATE_TABLE") != "0",
+		ClickHouseTTL:          getEnvDuration("CLICKHOUSE_TTL", 0),
+		ClickHouseAsyncInsert:  os.Getenv("CLICKHOUSE_ASYNC_INSERT") != "false" && os.Getenv("CLICKHOUSE_ASYNC_INSERT") != "0",
+		ClickHouseBatchSize:    getEnvInt("CLICKHOUSE_BATCH_SIZE", 5000),
+		ClickHouseBatchTimeout: getEnvDuration("CLICKHOUSE_BATCH_TIMEOUT", 2*time.Second),
+
+		OpenSearchURL:          os.Getenv("OPENSEARCH_URL"),
+		OpenSearchUser:         os.Getenv("OPENSEARCH_USER"),
+		OpenSearchPassword:     os.Getenv("OPENSEARCH_PASSWORD"),
+		OpenSearchIndex:        getEnv("OPENSEARCH_INDEX", "traffic-{yyyy}.{MM}.{dd}"),
+		OpenSearchTemplateName: getEnv("OPENSEARCH_TEMPLATE", "traffic"),
+		OpenSearchBatchSize:    getEnvInt("OPENSEARCH_BATCH_SIZE", 1000),
+		OpenSearchBatchTimeout: getEnvDuration("OPENSEARCH_BATCH_TIMEOUT", 2*time.Second),
+
+		ParquetDir:            os.Getenv("PARQUET_DIR"),
+		ParquetRotateInterval: getEnvDuration("PARQUET_ROTATE_INTERVAL", 15*time.Minute),
+		ParquetMaxRows:        getEnvInt("PARQUET_MAX_ROWS", 1000000),
+		ParquetRowGroupSize:   getEnvInt("PARQUET_ROW_GROUP_SIZE", 10000),
+		ParquetFlushInterval:  getEnvDuration("PARQUET_FLUSH_INTERVAL", 30*time.Second),
+		S3Endpoint:            getEnv("S3_ENDPOINT", "https://s3.amazonaws.com"),
+		S3Region:              getEnv("S3_REGION", "us-east-1"),
+		S3Bucket:              os.Getenv("S3_BUCKET"),
+		S3Prefix:              getEnv("S3_PREFIX", "traffic"),
+		S3AccessKey:           os.Getenv("S3_ACCESS_KEY"),
+		S3SecretKey:           os.Getenv("S3_SECRET_KEY"),
+
+		Rollups:             os.Getenv("ROLLUPS") == "true" || os.Getenv("ROLLUPS") == "1",
+		RollupMinuteTTL:     getEnvDuration("ROLLUP_MINUTE_TTL", 7*24*time.Hour),
+		RollupHourTTL:       getEnvDuration("ROLLUP_HOUR_TTL", 90*24*time.Hour),
+		RollupLateness:      getEnvDuration("ROLLUP_LATENESS", 5*time.Minute),
+		RollupFlushInterval: getEnvDuration("ROLLUP_FLUSH_INTERVAL", 10*time.Second),
+
+		Reports:          os.Getenv("REPORTS"),
+		ReportWebhookURL: os.Getenv("REPORT_WEBHOOK_URL"),
+		ReportTopN:       getEnvInt("REPORT_TOP_N", 10),
+		ReportHistory:    getEnvInt("REPORT_HISTORY", 720),
+
+		DecodeWorkers: getEnvInt("DECODE_WORKERS", runtime.NumCPU()),
+
+		ZMQEndpoint: os.Getenv("ZMQ_ENDPOINT"),
+		ZMQSocket:   getEnv("ZMQ_SOCKET", "sub"),
+
+		UDPListen:        os.Getenv("UDP_LISTEN"),
+		UDPDest:          os.Getenv("UDP_DEST"),
+		UDPFlushInterval: getEnvDuration("UDP_FLUSH_INTERVAL", time.Second),
+
+		PcapFile:  os.Getenv("PCAP_FILE"),
+		PcapSpeed: pcapSpeed,
+
+		IngestToken: os.Getenv("INGEST_TOKEN"),
+		IngestStore: os.Getenv("INGEST_STORE") == "true" || os.Getenv("INGEST_STORE") == "1",
+		IngestTTL:   getEnvDuration("INGEST_TTL", time.Hour),
+
+		Tenants:      splitList(os.Getenv("TENANTS")),
+		TenantTokens: os.Getenv("TENANT_TOKENS"),
+
+		TenantMaxClients:     os.Getenv("TENANT_MAX_CLIENTS"),
+		TenantMaxBytesPerSec: os.Getenv("TENANT_MAX_BYTES_PER_SEC"),
+		TenantFilters:        os.Getenv("TENANT_FILTERS"),
+
+		QoSTokens:         os.Getenv("QOS_TOKENS"),
+		QoSSendQueue:      os.Getenv("QOS_SEND_QUEUE"),
+		QoSMaxBytesPerSec: os.Getenv("QOS_MAX_BYTES_PER_SEC"),
+		WSMaxClients:      getEnvInt("WS_MAX_CLIENTS", 0),
+
+		GRPCListen: os.Getenv("GRPC_LISTEN"),
+
+		HTTP3Listen:   os.Getenv("HTTP3_LISTEN"),
+		HTTP3CertFile: os.Getenv("HTTP3_CERT_FILE"),
+		HTTP3KeyFile:  os.Getenv("HTTP3_KEY_FILE"),
 	}
 }
 
@@ -53,9 +761,44 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+// getEnvInt reads a non-negative integer, falling back to defaultValue when unset or invalid.
+func getEnvInt(key string, defaultValue int) int {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			return n
+		}
+	}
+	return defaultValue
+}
+
+// getEnvDuration reads a positive duration, falling back to defaultValue when unset or invalid.
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d
+		}
+	}
+	return defaultValue
+}
+
+// getEnvRatio reads a fraction strictly between 0 and 1, falling back to
+// defaultValue when unset or invalid.
+func getEnvRatio(key string, defaultValue float64) float64 {
+	if v := os.Getenv(key); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil && f > 0 && f < 1 {
+			return f
+		}
+	}
+	return defaultValue
+}
+
+// debugLogging enables debugLog; main sets it from DEBUG. Logging is
+// process-wide, unlike the configuration it comes from.
+var debugLogging bool
+
 // debugLog prints debug-level messages (only when DEBUG=true).
 func debugLog(format string, args ...interface{}) {
-	if config.Debug {
+	if debugLogging {
 		fmt.Printf("[DEBUG] "+format+"\n", args...)
 	}
 }
@@ -67,5 +810,6 @@ func infoLog(format string, args ...interface{}) {
 
 // errorLog prints error messages.
 func errorLog(format string, args ...interface{}) {
+	errorsLogged.Add(1)
 	fmt.Printf("[ERROR] "+format+"\n", args...)
 }
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// ledgerSeconds is how many seconds of packet timestamps the ledger
+	// keeps, below the newest it has seen.
+	ledgerSeconds = 600
+	// consistencyDefaultSpan is the number of seconds checked when
+	// /admin/consistency is given no from.
+	consistencyDefaultSpan = 10
+	// consistencyMaxDiffs bounds the discrepancies listed in one report.
+	consistencyMaxDiffs = 1000
+)
+
+// ledgerCounts are the messages (packet records), network packets, and
+// bytes of one pair in one second.
+type ledgerCounts struct {
+	Messages int `json:"messages"`
+	Packets  int `json:"packets"`
+	Bytes    int `json:"bytes"`
+}
+
+func (c *ledgerCounts) add(p Packet) {
+	e := generateEdgeSummary(p)
+	c.Messages++
+	c.Packets += e.TotalPackets
+	c.Bytes += e.TotalBytes
+}
+
+// ledger records, per packet timestamp and pair (viewKey), what reached the
+// view from any input, so it can be compared with what Redis stored.
+var ledger = struct {
+	sync.Mutex
+	seconds map[int]map[string]*ledgerCounts
+	newest  int
+}{seconds: make(map[int]map[string]*ledgerCounts)}
+
+var (
+	// consistencyChecks and consistencyDiffs count checks and the
+	// discrepancies they found.
+	consistencyChecks atomic.Int64
+	consistencyDiffs  atomic.Int64
+)
+
+// recordLedger adds fresh packets to the ledger and forgets seconds older
+// than ledgerSeconds.
+func recordLedger(fresh []Packet) {
+	if len(fresh) == 0 {
+		return
+	}
+	ledger.Lock()
+	defer ledger.Unlock()
+	for _, p := range fresh {
+		pairs := ledger.seconds[p.Timestamp]
+		if pairs == nil {
+			pairs = make(map[string]*ledgerCounts)
+			ledger.seconds[p.Timestamp] = pairs
+		}
+		c := pairs[viewKey(p)]
+		if c == nil {
+			c = &ledgerCounts{}
+			pairs[viewKey(p)] = c
+		}
+		c.add(p)
+		ledger.newest = max(ledger.newest, p.Timestamp)
+	}
+	for ts := range ledger.seconds {
+		if ts <= ledger.newest-ledgerSeconds {
+			delete(ledger.seconds, ts)
+		}
+	}
+}
+
+// ledgerRange copies the ledger's counts of the seconds from..to.
+func ledgerRange(from, to int) map[int]map[string]ledgerCounts {
+	ledger.Lock()
+	defer ledger.Unlock()
+	out := make(map[int]map[string]ledgerCounts)
+	for ts, pairs := range ledger.seconds {
+		if ts < from || ts > to {
+			continue
+		}
+		out[ts] = make(map[string]ledgerCounts, len(pairs))
+		for key, c := range pairs {
+			out[ts][key] = *c
+		}
+	}
+	return out
+}
+
+// consistencyDiff is one pair and second whose stored and received counts
+// differ; a side is nil when it has nothing for the pair.
+type consistencyDiff struct {
+	Timestamp int           `json:"timestamp"`
+	Pair      string        `json:"pair"`
+	Stored    *ledgerCounts `json:"stored"`
+	Received  *ledgerCounts `json:"received"`
+}
+
+// consistencyReport is the /admin/consistency response.
+type consistencyReport struct {
+	From          int               `json:"from"`
+	To            int               `json:"to"`
+	Stored        ledgerCounts      `json:"stored"`
+	Received      ledgerCounts      `json:"received"`
+	Mismatches    int               `json:"mismatches"`
+	Discrepancies []consistencyDiff `json:"discrepancies"`
+	Truncated     bool              `json:"truncated,omitempty"`
+}
+
+// checkConsistency compares the packet hashes stored in Redis with
+// timestamps from..to against the ledger of what the backend received for
+// those seconds.
+func checkConsistency(ctx context.Context, cfg *Config, rdb redisClient, from, to int) (consistencyReport, error) {
+	r := consistencyReport{From: from, To: to, Discrepancies: []consistencyDiff{}}
+
+	docs, err := getPacketsSince(ctx, cfg, rdb, from)
+	if err != nil {
+		return r, err
+	}
+	packets := decodeDocuments(cfg, docs)
+	cfg.assignTenants(packets)
+	stored := make(map[int]map[string]ledgerCounts)
+	for _, p := range packets {
+		if p.Timestamp > to || p.Src == "" || p.Dest == "" {
+			continue
+		}
+		if stored[p.Timestamp] == nil {
+			stored[p.Timestamp] = make(map[string]ledgerCounts)
+		}
+		c := stored[p.Timestamp][viewKey(p)]
+		c.add(p)
+		stored[p.Timestamp][viewKey(p)] = c
+	}
+	releasePackets(packets)
+	received := ledgerRange(from, to)
+
+	diff := func(ts int, pair string, s, rc *ledgerCounts) {
+		r.Mismatches++
+		if len(r.Discrepancies) == consistencyMaxDiffs {
+			r.Truncated = true
+			return
+		}
+		r.Discrepancies = append(r.Discrepancies, consistencyDiff{Timestamp: ts, Pair: pair, Stored: s, Received: rc})
+	}
+	for ts, pairs := range stored {
+		for pair, s := range pairs {
+			r.Stored.Messages += s.Messages
+			r.Stored.Packets += s.Packets
+			r.Stored.Bytes += s.Bytes
+			if rc, ok := received[ts][pair]; !ok {
+				diff(ts, pair, &s, nil)
+			} else if rc != s {
+				diff(ts, pair, &s, &rc)
+			}
+		}
+	}
+	for ts, pairs := range received {
+		for pair, rc := range pairs {
+			r.Received.Messages += rc.Messages
+			r.Received.Packets += rc.Packets
+			r.Received.Bytes += rc.Bytes
+			if _, ok := stored[ts][pair]; !ok {
+				diff(ts, pair, nil, &rc)
+			}
+		}
+	}
+	sort.Slice(r.Discrepancies, func(i, j int) bool {
+		a, b := r.Discrepancies[i], r.Discrepancies[j]
+		if a.Timestamp != b.Timestamp {
+			return a.Timestamp < b.Timestamp
+		}
+		return a.Pair < b.Pair
+	})
+
+	consistencyChecks.Add(1)
+	consistencyDiffs.Add(int64(r.Mismatches))
+	return r, nil
+}
+
+// settledTimestamp is the newest second the poller will not read again, so
+// its stored and received counts are final.
+func (s *Server) settledTimestamp() int {
+	return s.pollSinceTimestamp() - 1
+}
+
+// handleAdminConsistency runs checkConsistency over ?from=&to= (unix
+// seconds; default the last 10 settled seconds).
+func (s *Server) handleAdminConsistency(rdb redisClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		to := s.settledTimestamp()
+		if v := q.Get("to"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				writeError(w, badQuery.errorf("Invalid to"))
+				return
+			}
+			to = n
+		}
+		from := to - consistencyDefaultSpan + 1
+		if v := q.Get("from"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n > to || to-n >= ledgerSeconds {
+				writeError(w, badQuery.errorf("Invalid from (at most 600 seconds before to)"))
+				return
+			}
+			from = n
+		}
+
+		report, err := checkConsistency(r.Context(), s.config, rdb, from, to)
+		if errors.Is(err, errRedisUnavailable) {
+			writeError(w, unavailable.errorf("Redis unavailable"))
+			return
+		}
+		if err != nil {
+			errorLog("Consistency check failed: %v", err)
+			writeError(w, upstreamFailed.errorf("Consistency check failed"))
+			return
+		}
+		writeJSON(w, report)
+	}
+}
+
+// startConsistencyChecker checks the seconds settled since its previous run
+// every CONSISTENCY_INTERVAL (0 disables it) and logs discrepancies.
+func (s *Server) startConsistencyChecker(ctx context.Context, rdb redisClient) {
+	if s.config.ConsistencyInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.config.ConsistencyInterval)
+	defer ticker.Stop()
+
+	infoLog("Checking stored against received packets every %s", s.config.ConsistencyInterval)
+
+	checked := s.settledTimestamp()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		to := s.settledTimestamp()
+		if to <= checked {
+			continue
+		}
+		from := max(checked+1, to-ledgerSeconds+1)
+		report, err := checkConsistency(ctx, s.config, rdb, from, to)
+		if err != nil {
+			debugLog("Consistency check skipped: %v", err)
+			continue
+		}
+		checked = to
+		if report.Mismatches > 0 {
+			infoLog("Consistency check %d..%d: %d pair-seconds differ (stored %d messages/%d packets, received %d/%d)",
+				from, to, report.Mismatches, report.Stored.Messages, report.Stored.Packets, report.Received.Messages, report.Received.Packets)
+		} else {
+			debugLog("Consistency check %d..%d: stored and received agree", from, to)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "time"
+
+// processCPUTime is unavailable here, so BROADCAST_SAMPLE_CPU never triggers
+// overload sampling.
+func processCPUTime() (time.Duration, bool) {
+	return 0, false
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// decodeChunk is the number of Redis documents one decode job converts.
+	decodeChunk = 256
+
+	// decodeWindow bounds the payloads each stream may have in flight per
+	// worker; a reader that gets this far ahead of its merge stage blocks.
+	decodeWindow = 4
+)
+
+// decodeJobs feeds the shared decode workers. It is nil when decoding runs
+// inline on the caller's goroutine (DECODE_WORKERS <= 1).
+var decodeJobs chan func()
+
+// errDecodePanicked is the result of a streamed payload whose decode job
+// panicked.
+var errDecodePanicked = errors.New("decoder panicked")
+
+// initDecoders starts DECODE_WORKERS goroutines that decode poll results and
+// streamed payloads. Callers get results back in input order. A worker that
+// panics is restarted by supervise, which counts the panic under "decode
+// worker"; the job it was running still completes, with no packets.
+func initDecoders(ctx context.Context, cfg *Config) {
+	n := cfg.DecodeWorkers
+	if n <= 1 {
+		debugLog("Decoding inline (DECODE_WORKERS=%d)", n)
+		return
+	}
+
+	decodeJobs = make(chan func(), n*decodeWindow)
+	for range n {
+		// Workers keep draining jobs after ctx ends: callers still
+		// waiting on a result are shutting down too.
+		go supervise(ctx, "decode worker", func(context.Context) {
+			for job := range decodeJobs {
+				job()
+			}
+		}, nil)
+	}
+	infoLog("Decoding on %d workers", n)
+}
+
+// decodeDocuments converts documents to packets, in chunks on the worker
+// pool when there are enough of them. Undecodable documents are skipped. The
+// result is a pooled slice (see releasePackets).
+func decodeDocuments(cfg *Config, docs []redis.Document) []Packet {
+	if decodeJobs == nil || len(docs) <= decodeChunk {
+		return docsToPackets(cfg, docs)
+	}
+
+	chunks := make([][]Packet, (len(docs)+decodeChunk-1)/decodeChunk)
+	var wg sync.WaitGroup
+	for i := range chunks {
+		part := docs[i*decodeChunk : min((i+1)*decodeChunk, len(docs))]
+		wg.Add(1)
+		decodeJobs <- func() {
+			defer wg.Done()
+			chunks[i] = docsToPackets(cfg, part)
+		}
+	}
+	wg.Wait()
+
+	packets := getPackets()
+	for _, chunk := range chunks {
+		packets = append(packets, chunk...)
+		releasePackets(chunk)
+	}
+	return packets
+}
+
+func docsToPackets(cfg *Config, docs []redis.Document) []Packet {
+	packets := getPackets()
+	for _, doc := range docs {
+		packet, err := docToPacket(cfg, doc)
+		if err != nil {
+			channelFor(redisChannel(cfg.tenantOfKey(doc.ID))).decodeError()
+			debugLog("Skipping document: %v", err)
+			continue
+		}
+		if !acceptPacketSchema(channelFor(redisChannel(packet.Tenant)), packet) {
+			continue
+		}
+		packets = append(packets, packet)
+	}
+	return packets
+}
+
+// decodeResult is one decoded payload.
+type decodeResult struct {
+	packets []Packet
+	err     error
+}
+
+// decodeStream decodes the payloads of one ordered source (such as a ZeroMQ
+// peer) on the worker pool. Results are merged back into submission order and
+// handed to deliver on the stream's own goroutine, so each source's messages
+// are still applied in the order they arrived.
+type decodeStream struct {
+	deliver func(packets []Packet, err error)
+	order   chan chan decodeResult
+	done    chan struct{}
+}
+
+func newDecodeStream(deliver func(packets []Packet, err error)) *decodeStream {
+	s := &decodeStream{deliver: deliver, done: make(chan struct{})}
+	if decodeJobs == nil {
+		close(s.done)
+		return s
+	}
+
+	s.order = make(chan chan decodeResult, cap(decodeJobs))
+	go s.merge()
+	return s
+}
+
+// submit queues a payload for decoding. It blocks while the stream has a
+// full window of payloads in flight. The stream owns payload from then on and
+// returns it to bufferPool once it is decoded.
+func (s *decodeStream) submit(payload []byte) {
+	if s.order == nil {
+		packets, err := decodePackets(payload)
+		putBuffer(payload)
+		s.deliver(packets, err)
+		return
+	}
+
+	result := make(chan decodeResult, 1)
+	s.order <- result
+	decodeJobs <- func() {
+		// Deferred so merge gets a result even if decoding panics.
+		r := decodeResult{err: errDecodePanicked}
+		defer func() { result <- r }()
+		r.packets, r.err = decodePackets(payload)
+		putBuffer(payload)
+	}
+}
+
+// merge delivers results in submission order, waiting on each in turn.
+func (s *decodeStream) merge() {
+	defer close(s.done)
+	for result := range s.order {
+		r := <-result
+		s.deliver(r.packets, r.err)
+	}
+}
+
+// close stops the stream after delivering everything already submitted.
+func (s *decodeStream) close() {
+	if s.order != nil {
+		close(s.order)
+	}
+	<-s.done
+}
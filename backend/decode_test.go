@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestDecodeWorkersSurvivePanics checks that a decode job that panics is
+// counted and that the workers keep running jobs afterwards.
+func TestDecodeWorkersSurvivePanics(t *testing.T) {
+	saved := decodeJobs
+	defer func() { decodeJobs = saved }()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := loadConfig()
+	cfg.DecodeWorkers = 2
+	initDecoders(ctx, cfg)
+
+	panicsMu.Lock()
+	before := panics["decode worker"]
+	panicsMu.Unlock()
+
+	for range cfg.DecodeWorkers {
+		decodeJobs <- func() { panic("bad payload") }
+	}
+	ran := make(chan struct{})
+	decodeJobs <- func() { close(ran) }
+	select {
+	case <-ran:
+	case <-time.After(10 * time.Second):
+		t.Fatal("no decode worker ran a job after the panics")
+	}
+
+	panicsMu.Lock()
+	defer panicsMu.Unlock()
+	if got := panics["decode worker"] - before; got != int64(cfg.DecodeWorkers) {
+		t.Fatalf("%d panics counted, want %d", got, cfg.DecodeWorkers)
+	}
+}
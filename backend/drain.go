@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// drainReason is the close reason WebSocket clients get at the drain
+// deadline, with CloseGoingAway so they reconnect, to another instance.
+const drainReason = "server draining"
+
+// drainState is a Server's drain. draining is set from POST /admin/drain
+// until DELETE: long-lived sessions (WebSocket upgrades, /stream, /replay,
+// /export) are refused and keep-alive connections closed, while open
+// sessions keep receiving frames until they leave or the deadline passes.
+type drainState struct {
+	draining atomic.Bool
+
+	mu       sync.Mutex
+	deadline time.Time
+	timer    *time.Timer
+	// expiredCh is closed when the deadline passes. It is replaced only by
+	// the DELETE after that, so sessions can hold on to it.
+	expiredCh chan struct{}
+	// servers are the running listeners' servers; serveListeners sets them
+	// once, before any request or signal can start a drain.
+	servers []*http.Server
+}
+
+func newDrainState() *drainState {
+	return &drainState{expiredCh: make(chan struct{})}
+}
+
+// setServers records the listeners' servers, whose keep-alives a drain
+// turns off.
+func (d *drainState) setServers(servers []*http.Server) {
+	d.mu.Lock()
+	d.servers = servers
+	d.mu.Unlock()
+}
+
+// drainStatus is the /admin/drain response.
+type drainStatus struct {
+	Draining bool       `json:"draining"`
+	Deadline *time.Time `json:"deadline,omitempty"`
+	Expired  bool       `json:"expired"`
+	Clients  int        `json:"clients"`
+	Streams  int        `json:"streams"`
+}
+
+func (s *Server) currentDrainStatus() drainStatus {
+	d := s.drain
+	d.mu.Lock()
+	st := drainStatus{Draining: d.draining.Load()}
+	if st.Draining {
+		deadline := d.deadline
+		st.Deadline = &deadline
+		st.Expired = d.expiredLocked()
+	}
+	d.mu.Unlock()
+
+	s.clientsMu.Lock()
+	st.Clients = len(s.clients)
+	s.clientsMu.Unlock()
+	s.streamsMu.Lock()
+	st.Streams = len(s.streams)
+	s.streamsMu.Unlock()
+	return st
+}
+
+// startDrain starts draining, or moves the deadline of a drain that has not
+// expired yet.
+func (s *Server) startDrain(timeout time.Duration) {
+	d := s.drain
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.expiredLocked() {
+		return
+	}
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	d.deadline = time.Now().Add(timeout)
+	d.timer = time.AfterFunc(timeout, s.expireDrain)
+	if !d.draining.Swap(true) {
+		for _, hs := range d.servers {
+			hs.SetKeepAlivesEnabled(false)
+		}
+	}
+	infoLog("Draining: refusing new sessions, closing the remaining ones at %s", d.deadline.Format(time.RFC3339))
+}
+
+// stopDrain accepts new sessions again. It reports false if the server was
+// not draining.
+func (s *Server) stopDrain() bool {
+	d := s.drain
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.draining.Swap(false) {
+		return false
+	}
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	if d.expiredLocked() {
+		d.expiredCh = make(chan struct{})
+	}
+	for _, hs := range d.servers {
+		hs.SetKeepAlivesEnabled(true)
+	}
+	infoLog("Drain cancelled, accepting new sessions")
+	return true
+}
+
+// expireDrain ends the sessions still open at the drain deadline.
+func (s *Server) expireDrain() {
+	d := s.drain
+	d.mu.Lock()
+	if !d.draining.Load() || d.expiredLocked() {
+		d.mu.Unlock()
+		return
+	}
+	close(d.expiredCh)
+	d.mu.Unlock()
+
+	n := s.disconnectClients(func(c *client) bool { return true }, websocket.CloseGoingAway, drainReason)
+	infoLog("Drain deadline passed: closed %d WebSocket connections", n)
+}
+
+func (d *drainState) expiredLocked() bool {
+	select {
+	case <-d.expiredCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// expired returns a channel that is closed when the drain deadline passes.
+func (d *drainState) expired() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.expiredCh
+}
+
+// drainContext returns a copy of ctx that is also cancelled at the drain
+// deadline.
+func (s *Server) drainContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	expired := s.drain.expired()
+	go func() {
+		select {
+		case <-expired:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// shutdownOnSIGTERM returns a channel that is closed once a SIGTERM has
+// drained the server. The listeners are closed at once, so new connections
+// go to a process sharing the port (REUSE_PORT) or to other instances, and
+// the open sessions run until they end or DRAIN_TIMEOUT passes. stop is
+// called at the end of the drain to cancel the work still in flight.
+func (s *Server) shutdownOnSIGTERM(stop context.CancelFunc) <-chan struct{} {
+	done := make(chan struct{})
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		signal.Stop(sigs)
+		infoLog("SIGTERM received, shutting down")
+		s.startDrain(s.config.DrainTimeout)
+		expired := s.drain.expired()
+
+		// Shutdown closes the listeners and waits for the requests in
+		// flight; WebSocket connections are hijacked and waited for below.
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			select {
+			case <-expired:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		var wg sync.WaitGroup
+		for _, hs := range s.drain.servers {
+			wg.Add(1)
+			go func(hs *http.Server) {
+				defer wg.Done()
+				hs.Shutdown(ctx)
+			}(hs)
+		}
+		wg.Wait()
+
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for s.currentDrainStatus().Clients > 0 {
+			select {
+			case <-expired:
+				// Give the close frames sent at the deadline a moment.
+				time.Sleep(time.Second)
+				stop()
+				close(done)
+				return
+			case <-ticker.C:
+			}
+		}
+		infoLog("All sessions closed")
+		stop()
+		close(done)
+	}()
+	return done
+}
+
+// shutdownFlushTimeout bounds how long main waits for workers to flush
+// after ctx is cancelled, and each sink's final write.
+const shutdownFlushTimeout = 10 * time.Second
+
+// workers counts the goroutines that flush buffered output when ctx is
+// cancelled; main waits for them before exiting.
+var workers sync.WaitGroup
+
+// waitWorkers waits up to timeout for workers and reports whether they all
+// finished.
+func waitWorkers(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// refuseDraining answers 503 and reports true while the server drains, for
+// handlers that open long-lived sessions.
+func (s *Server) refuseDraining(w http.ResponseWriter) bool {
+	if !s.drain.draining.Load() {
+		return false
+	}
+	w.Header().Set("Connection", "close")
+	w.Header().Set("Retry-After", "1")
+	writeError(w, unavailable.errorf("Server is draining"))
+	return true
+}
+
+// handleAdminDrain manages draining: GET reports it, POST starts it with
+// ?timeout= (default DRAIN_TIMEOUT) until the remaining sessions are closed,
+// DELETE cancels it.
+func (s *Server) handleAdminDrain(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		timeout := s.config.DrainTimeout
+		if v := r.URL.Query().Get("timeout"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				writeError(w, badQuery.errorf("Invalid timeout"))
+				return
+			}
+			timeout = d
+		}
+		s.startDrain(timeout)
+	case http.MethodDelete:
+		if !s.stopDrain() {
+			writeError(w, conflict.errorf("Not draining"))
+			return
+		}
+	default:
+		writeError(w, methodNotAllowed.errorf("Method not allowed"))
+		return
+	}
+	writeJSON(w, s.currentDrainStatus())
+}
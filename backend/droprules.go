@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// dropRule is one DROP_RULES entry: packets matching filter are dropped for
+// everyone, and counted under the rule's name.
+type dropRule struct {
+	name    string
+	filter  *filter
+	dropped atomic.Int64
+}
+
+// dropRules are checked in order; the first match drops a packet.
+var dropRules []*dropRule
+
+// initDropRules parses DROP_RULES: "name:expr" entries separated by ";",
+// where expr is a filter expression that may use packet-only fields.
+func initDropRules(cfg *Config) error {
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(cfg.DropRules, ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		name, expr, ok := strings.Cut(entry, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.TrimSpace(expr) == "" {
+			return fmt.Errorf("invalid entry %q (want name:expr)", entry)
+		}
+		if seen[name] {
+			return fmt.Errorf("duplicate rule %q", name)
+		}
+		seen[name] = true
+		f, err := compileFilter(strings.TrimSpace(expr), true)
+		if err != nil {
+			return fmt.Errorf("rule %s: %w", name, err)
+		}
+		dropRules = append(dropRules, &dropRule{name: name, filter: f})
+		infoLog("Drop rule %s: %s", name, f.source)
+	}
+	return nil
+}
+
+// matchDropRule returns the first rule p matches, or nil.
+func matchDropRule(p *Packet) *dropRule {
+	for _, rule := range dropRules {
+		if rule.filter.matchPacket(p) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// dropRulesProcessor removes packets matched by a DROP_RULES rule.
+type dropRulesProcessor struct{}
+
+func (dropRulesProcessor) Name() string        { return "drop-rules" }
+func (dropRulesProcessor) Stage() processStage { return stageFilter }
+
+// Process drops matching packets and counts the ones s has not counted
+// before. Callers hold s.applyMu.
+func (dropRulesProcessor) Process(s *Server, packets []Packet) []Packet {
+	return applyDropRules(packets, s.dropRulesSeen)
+}
+
+func (dropRulesProcessor) Preview(packets []Packet) []Packet {
+	return applyDropRules(packets, nil)
+}
+
+// applyDropRules drops the packets a rule matches. With seen set, it counts
+// each drop against its rule unless seen already holds the packet's key.
+func applyDropRules(packets []Packet, seen seenSet) []Packet {
+	if len(dropRules) == 0 {
+		return packets
+	}
+	kept := packets[:0:0]
+	for i := range packets {
+		rule := matchDropRule(&packets[i])
+		if rule == nil {
+			kept = append(kept, packets[i])
+			continue
+		}
+		if seen != nil && firstDrop(seen, packets[i]) {
+			rule.dropped.Add(1)
+		}
+	}
+	return kept
+}
+
+// firstDrop reports whether p is dropped for the first time; packets
+// without a key (push inputs) always are.
+func firstDrop(seen seenSet, p Packet) bool {
+	return p.Key == "" || seen.add(p.Key, p.Timestamp)
+}
+
+// DropRuleStats is one rule in GET /admin/drop-rules.
+type DropRuleStats struct {
+	Name    string `json:"name"`
+	Filter  string `json:"filter"`
+	Dropped int64  `json:"dropped"`
+}
+
+func listDropRules() []DropRuleStats {
+	stats := make([]DropRuleStats, len(dropRules))
+	for i, rule := range dropRules {
+		stats[i] = DropRuleStats{Name: rule.name, Filter: rule.filter.source, Dropped: rule.dropped.Load()}
+	}
+	return stats
+}
+
+// handleAdminDropRules lists the DROP_RULES rules and the packets each dropped.
+func handleAdminDropRules(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, listDropRules())
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	exportChunkDefault = 1000
+	exportChunkMax     = 10000
+
+	// exportCursorIdle is how long RediSearch keeps an export's cursor
+	// between reads. A reader slower than that costs a restart of the query
+	// from the last exported packet, not the export.
+	exportCursorIdle = time.Minute
+)
+
+// exportLoad lists the hash fields an export loads: the key (for ordering and
+// resuming) and everything docToPacket reads.
+var exportLoad = []string{
+	"@__key", "@timestamp", "@seq", "@node_id", "@source_ip", "@dest_ip", "@total_bytes",
+	"@src_port", "@dst_port", "@protocol", "@location", "@annotation", "@tags",
+	"@udp_packets", "@udp_bytes", "@tcp_packets", "@tcp_bytes",
+}
+
+// exportPosition is what a ?cursor= token holds: the last packet exported,
+// by timestamp and key, and the end of the export window.
+type exportPosition struct {
+	TS  int64  `json:"ts"`
+	Key string `json:"key"`
+	To  int64  `json:"to"`
+}
+
+// token encodes the position; it is sealed when anonymizing, since the key
+// names the packet's addresses.
+func (p exportPosition) token() string {
+	b, _ := json.Marshal(p)
+	if anonymizing() {
+		b = sealCursor(b)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func parseExportCursor(token string) (*exportPosition, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+	if anonymizing() {
+		if b, err = openCursor(b); err != nil {
+			return nil, err
+		}
+	}
+	var p exportPosition
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, err
+	}
+	if p.Key == "" || p.TS > p.To {
+		return nil, errors.New("bad position")
+	}
+	return &p, nil
+}
+
+// after reports whether pk sorts after the position in export order.
+func (p *exportPosition) after(pk Packet) bool {
+	if p == nil {
+		return true
+	}
+	ts := int64(pk.Timestamp)
+	return ts > p.TS || ts == p.TS && pk.Key > p.Key
+}
+
+// packetExport reads one export query chunk by chunk through a RediSearch
+// cursor. go-redis does not parse cursor replies, so the commands are sent
+// raw.
+type packetExport struct {
+	cfg    *Config
+	rdb    redisClient
+	index  string
+	chunk  int
+	cursor int64
+}
+
+// start runs the export query and returns its first chunk of packets.
+func (e *packetExport) start(ctx context.Context, query string) ([]Packet, error) {
+	args := []interface{}{"FT.AGGREGATE", e.index, query, "LOAD", len(exportLoad)}
+	for _, f := range exportLoad {
+		args = append(args, f)
+	}
+	args = append(args,
+		"SORTBY", 4, "@timestamp", "ASC", "@__key", "ASC",
+		"WITHCURSOR", "COUNT", e.chunk, "MAXIDLE", exportCursorIdle.Milliseconds())
+	return e.do(ctx, args...)
+}
+
+// next returns the following chunk, or nil once the cursor is exhausted.
+func (e *packetExport) next(ctx context.Context) ([]Packet, error) {
+	if e.cursor == 0 {
+		return nil, nil
+	}
+	return e.do(ctx, "FT.CURSOR", "READ", e.index, e.cursor, "COUNT", e.chunk)
+}
+
+// done reports whether RediSearch has no more rows for the export.
+func (e *packetExport) done() bool {
+	return e.cursor == 0
+}
+
+// close releases an unfinished cursor.
+func (e *packetExport) close(ctx context.Context) {
+	if e.cursor == 0 {
+		return
+	}
+	cursor := e.cursor
+	e.cursor = 0
+	_ = redisDo(ctx, func(ctx context.Context) error {
+		return e.rdb.Do(ctx, "FT.CURSOR", "DEL", e.index, cursor).Err()
+	})
+}
+
+// do sends a cursor command and decodes its [[total, row...], cursor] reply.
+func (e *packetExport) do(ctx context.Context, args ...interface{}) ([]Packet, error) {
+	var reply []interface{}
+	err := redisDo(ctx, func(ctx context.Context) (err error) {
+		reply, err = e.rdb.Do(ctx, args...).Slice()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) != 2 {
+		return nil, fmt.Errorf("unexpected cursor reply of %d elements", len(reply))
+	}
+	results, _ := reply[0].([]interface{})
+	cursor, ok := reply[1].(int64)
+	if !ok || len(results) == 0 {
+		return nil, errors.New("unexpected cursor reply")
+	}
+	e.cursor = cursor
+
+	packets := make([]Packet, 0, len(results)-1)
+	for _, row := range results[1:] {
+		values, _ := row.([]interface{})
+		doc := redis.Document{Fields: make(map[string]string, len(values)/2)}
+		for i := 0; i+1 < len(values); i += 2 {
+			k, _ := values[i].(string)
+			v, _ := values[i+1].(string)
+			if k == "__key" {
+				doc.ID = v
+				continue
+			}
+			doc.Fields[k] = v
+		}
+		if p, err := docToPacket(e.cfg, doc); err == nil {
+			packets = append(packets, p)
+		}
+	}
+	return packets, nil
+}
+
+// isCursorGone reports whether err says RediSearch dropped the cursor,
+// which it does after exportCursorIdle without a read.
+func isCursorGone(err error) bool {
+	return err != nil && strings.Contains(strings.ToLower(err.Error()), "cursor not found")
+}
+
+// exportChunk is one NDJSON line of an export.
+type exportChunk struct {
+	Count   int      `json:"count"`
+	Packets []Packet `json:"packets"`
+	Cursor  string   `json:"cursor,omitempty"`
+	Done    bool     `json:"done,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// handleExport streams every stored packet matching the /packets filters,
+// oldest first, as newline-delimited JSON chunks of ?chunk= packets. The
+// export is never held in memory: each chunk is read from a RediSearch
+// cursor and flushed before the next is read. Every chunk line carries a
+// cursor token; ?cursor= with it (and the same filters) resumes after that
+// chunk, so a long export survives a dropped connection.
+func (s *Server) handleExport(rdb redisClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if searchFallback.Load() {
+			writeError(w, notImplemented.errorf("Packet queries need RediSearch"))
+			return
+		}
+		if s.refuseDraining(w) {
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeError(w, internalError.errorf("Streaming unsupported"))
+			return
+		}
+		tenant, ok := s.requestIndexTenant(w, r)
+		if !ok {
+			return
+		}
+
+		q := r.URL.Query()
+		chunk := exportChunkDefault
+		if v := q.Get("chunk"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				writeError(w, badQuery.errorf("Invalid chunk"))
+				return
+			}
+			chunk = min(n, exportChunkMax)
+		}
+		var pos *exportPosition
+		if v := q.Get("cursor"); v != "" {
+			p, err := parseExportCursor(v)
+			if err != nil {
+				writeError(w, badQuery.errorf("Invalid cursor"))
+				return
+			}
+			pos = p
+		}
+
+		// queryFrom builds the query for the rest of the export: from the
+		// position's second on when resuming, the requested window otherwise.
+		queryFrom := func(pos *exportPosition) (string, int64, error) {
+			if pos != nil {
+				q.Del("timestamp_min")
+				q.Del("timestamp_max")
+				q.Set("from", strconv.FormatInt(pos.TS, 10))
+				q.Set("to", strconv.FormatInt(pos.To, 10))
+			}
+			query, _, to, err := packetFilter(q)
+			return query, to, err
+		}
+		query, to, err := queryFrom(pos)
+		if err != nil {
+			writeError(w, badQuery.errorf("%v", err))
+			return
+		}
+
+		export := &packetExport{cfg: s.config, rdb: searchClient(rdb), index: s.config.packetIndexFor(tenant), chunk: chunk}
+		defer export.close(context.WithoutCancel(r.Context()))
+		// Each cursor read gets QUERY_TIMEOUT; the export as a whole runs
+		// until it is done, the client goes away, or the drain deadline.
+		ctx, cancel := s.queryContext(r)
+		packets, err := export.start(ctx, query)
+		cancel()
+		if err != nil {
+			s.queryFailed(w, r, "Export query", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		enc := json.NewEncoder(w)
+		version := requestAPIVersion(r.Context())
+
+		exported := 0
+		expired := s.drain.expired()
+		for {
+			// A resumed or restarted query starts at the position's second;
+			// drop what was already exported.
+			kept := packets[:0]
+			for _, p := range packets {
+				if pos.after(p) {
+					kept = append(kept, p)
+				}
+			}
+			line := exportChunk{Count: len(kept), Packets: anonymizePackets(kept), Done: export.done()}
+			if len(kept) > 0 {
+				last := kept[len(kept)-1]
+				pos = &exportPosition{TS: int64(last.Timestamp), Key: last.Key, To: to}
+			}
+			if len(kept) > 0 || line.Done {
+				if pos != nil && !line.Done {
+					line.Cursor = pos.token()
+				}
+				holdOpen(s.config, w)
+				if err := enc.Encode(version.translate(line)); err != nil {
+					return
+				}
+				flusher.Flush()
+				exported += len(kept)
+			}
+			if line.Done {
+				debugLog("Export of %s finished: %d packets", tenant, exported)
+				return
+			}
+			select {
+			case <-expired:
+				// The last cursor resumes the export on another instance.
+				line := exportChunk{Packets: []Packet{}, Error: "Server is draining"}
+				if pos != nil {
+					line.Cursor = pos.token()
+				}
+				enc.Encode(line)
+				return
+			default:
+			}
+
+			ctx, cancel := s.queryContext(r)
+			packets, err = export.next(ctx)
+			if isCursorGone(err) && pos != nil {
+				debugLog("Export cursor expired, restarting after %s", pos.Key)
+				if query, _, err = queryFrom(pos); err == nil {
+					packets, err = export.start(ctx, query)
+				}
+			}
+			cancel()
+			if err != nil {
+				if r.Context().Err() != nil {
+					return
+				}
+				errorLog("Export query failed after %d packets: %v", exported, err)
+				line := exportChunk{Packets: []Packet{}, Error: "Export query failed"}
+				if pos != nil {
+					line.Cursor = pos.token()
+				}
+				enc.Encode(line)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// A filter is a boolean expression over packet fields, compiled once and
+// evaluated per packet or summary:
+//
+//	total_bytes > 1500 && (dest_ip == "10.0.0.2" || cidr(source_ip, "129.57.0.0/16"))
+//
+// Operands are field names, numbers, and quoted strings; operators are
+// + - * / on numbers, == != < <= > >= && || ! and parentheses.
+// cidr(field, "prefix") tests address membership.
+type filter struct {
+	source string
+	eval   func(r *filterRecord) bool
+}
+
+// filterRecord is what a filter is evaluated against. Client filters see only
+// the summary; the global filter also sees the packet. Alert conditions see
+// only window aggregates (alert.go).
+type filterRecord struct {
+	summary PacketSummary
+	packet  *Packet
+	alert   *alertEval
+}
+
+// filterField reads one field; packetOnly fields need filterRecord.packet.
+type filterField struct {
+	str        func(r *filterRecord) string
+	num        func(r *filterRecord) float64
+	packetOnly bool
+}
+
+// filterFields maps field names (summary names and traffic message names) to
+// accessors. Counter arrays evaluate to their sums.
+var filterFields = func() map[string]filterField {
+	str := func(f func(s PacketSummary) string) filterField {
+		return filterField{str: func(r *filterRecord) string { return f(r.summary) }}
+	}
+	num := func(f func(s PacketSummary) int) filterField {
+		return filterField{num: func(r *filterRecord) float64 { return float64(f(r.summary)) }}
+	}
+	fields := map[string]filterField{
+		"src":               str(func(s PacketSummary) string { return s.Src }),
+		"dest":              str(func(s PacketSummary) string { return s.Dest }),
+		"tenant":            str(func(s PacketSummary) string { return s.Tenant }),
+		"timestamp":         num(func(s PacketSummary) int { return s.Timestamp }),
+		"tcp_packets_total": num(func(s PacketSummary) int { return s.TCPPacketsTotal }),
+		"tcp_bytes_total":   num(func(s PacketSummary) int { return s.TCPBytesTotal }),
+		"udp_packets_total": num(func(s PacketSummary) int { return s.UDPPacketsTotal }),
+		"udp_bytes_total":   num(func(s PacketSummary) int { return s.UDPBytesTotal }),
+		"total_packets":     num(func(s PacketSummary) int { return s.TotalPackets }),
+		"total_bytes":       num(func(s PacketSummary) int { return s.TotalBytes }),
+		"seq": {packetOnly: true, num: func(r *filterRecord) float64 {
+			return float64(r.packet.Seq)
+		}},
+		"node_id": {packetOnly: true, num: func(r *filterRecord) float64 {
+			return float64(r.packet.NodeID)
+		}},
+		"src_port": {packetOnly: true, num: func(r *filterRecord) float64 {
+			return float64(r.packet.SrcPort)
+		}},
+		"dst_port": {packetOnly: true, num: func(r *filterRecord) float64 {
+			return float64(r.packet.DstPort)
+		}},
+		"protocol": {packetOnly: true, str: func(r *filterRecord) string {
+			return r.packet.Protocol
+		}},
+		"annotation": {packetOnly: true, str: func(r *filterRecord) string {
+			return r.packet.Annotation
+		}},
+	}
+	for alias, name := range map[string]string{
+		"source_ip":   "src",
+		"dest_ip":     "dest",
+		"tcp_packets": "tcp_packets_total",
+		"tcp_bytes":   "tcp_bytes_total",
+		"udp_packets": "udp_packets_total",
+		"udp_bytes":   "udp_bytes_total",
+	} {
+		fields[alias] = fields[name]
+	}
+	return fields
+}()
+
+// globalFilter drops non-matching packets before they are applied, broadcast,
+// sent to sinks, or stored by /ingest (nil keeps everything).
+var globalFilter *filter
+
+func initGlobalFilter(cfg *Config) error {
+	if cfg.Filter == "" {
+		return nil
+	}
+	f, err := compileFilter(cfg.Filter, true)
+	if err != nil {
+		return err
+	}
+	globalFilter = f
+	infoLog("Global filter: %s", f.source)
+	return nil
+}
+
+// filterPackets returns the packets that pass the global filter.
+func filterPackets(packets []Packet) []Packet {
+	if globalFilter == nil {
+		return packets
+	}
+	kept := packets[:0:0]
+	for i := range packets {
+		if globalFilter.matchPacket(&packets[i]) {
+			kept = append(kept, packets[i])
+		}
+	}
+	return kept
+}
+
+func (f *filter) matchPacket(p *Packet) bool {
+	return f.eval(&filterRecord{summary: generateEdgeSummary(*p), packet: p})
+}
+
+func (f *filter) matchSummary(s PacketSummary) bool {
+	return f.eval(&filterRecord{summary: s})
+}
+
+// compileFilter parses source; packet-only fields are allowed when
+// withPacket is set.
+func compileFilter(source string, withPacket bool) (*filter, error) {
+	tokens, err := lexFilter(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens, withPacket: withPacket}
+	n, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	if n.kind != kindBool {
+		return nil, fmt.Errorf("filter must be a condition, not a %s", n.kind)
+	}
+	return &filter{source: source, eval: n.boolean}, nil
+}
+
+// andFilters returns a filter matching what both a and b match.
+func andFilters(a, b *filter) *filter {
+	return &filter{
+		source: "(" + a.source + ") && (" + b.source + ")",
+		eval:   func(r *filterRecord) bool { return a.eval(r) && b.eval(r) },
+	}
+}
+
+// compileExpr parses source as an expression of any kind, for transforms
+// (transform.go); packet-only fields are allowed when withPacket is set.
+func compileExpr(source string, withPacket bool) (filterNode, error) {
+	tokens, err := lexFilter(source)
+	if err != nil {
+		return filterNode{}, err
+	}
+	p := &filterParser{tokens: tokens, withPacket: withPacket}
+	return p.expression()
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokOp
+)
+
+type filterToken struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func lexFilter(src string) ([]filterToken, error) {
+	var tokens []filterToken
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '_' || unicode.IsLetter(rune(c)):
+			j := i
+			for j < len(src) && (src[j] == '_' || unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j]))) {
+				j++
+			}
+			tokens = append(tokens, filterToken{tokIdent, src[i:j], i})
+			i = j
+		case unicode.IsDigit(rune(c)) || c == '.' && i+1 < len(src) && unicode.IsDigit(rune(src[i+1])):
+			j := i
+			for j < len(src) && (unicode.IsDigit(rune(src[j])) || strings.IndexByte(".eE", src[j]) >= 0 ||
+				(src[j] == '+' || src[j] == '-') && (src[j-1] == 'e' || src[j-1] == 'E')) {
+				j++
+			}
+			// A trailing unit makes a duration such as 10s or 1h30m.
+			for j < len(src) && (unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j]))) {
+				j++
+			}
+			tokens = append(tokens, filterToken{tokNumber, src[i:j], i})
+			i = j
+		case c == '"' || c == '\'':
+			j := i + 1
+			var b strings.Builder
+			for ; j < len(src) && src[j] != c; j++ {
+				if src[j] == '\\' && j+1 < len(src) {
+					j++
+				}
+				b.WriteByte(src[j])
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("unterminated string at offset %d", i)
+			}
+			tokens = append(tokens, filterToken{tokString, b.String(), i})
+			i = j + 1
+		default:
+			op := ""
+			for _, candidate := range []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", ",", "+", "-", "*", "/"} {
+				if strings.HasPrefix(src[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q at offset %d", c, i)
+			}
+			tokens = append(tokens, filterToken{tokOp, op, i})
+			i += len(op)
+		}
+	}
+	return append(tokens, filterToken{tokEOF, "end of filter", len(src)}), nil
+}
+
+type valueKind int
+
+const (
+	kindNum valueKind = iota
+	kindStr
+	kindBool
+)
+
+func (k valueKind) String() string {
+	return [...]string{"number", "string", "condition"}[k]
+}
+
+// filterNode is a compiled, statically typed subexpression.
+type filterNode struct {
+	kind    valueKind
+	num     func(r *filterRecord) float64
+	str     func(r *filterRecord) string
+	boolean func(r *filterRecord) bool
+}
+
+type filterParser struct {
+	tokens     []filterToken
+	pos        int
+	withPacket bool
+
+	// aggregates switches fields off and window aggregates on (alert
+	// conditions); span is the longest window used.
+	aggregates bool
+	span       time.Duration
+}
+
+func (p *filterParser) peek() filterToken { return p.tokens[p.pos] }
+
+func (p *filterParser) next() filterToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *filterParser) accept(op string) bool {
+	if tok := p.peek(); tok.kind == tokOp && tok.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// expression parses a whole expression, up to the end of the source.
+func (p *filterParser) expression() (filterNode, error) {
+	n, err := p.or()
+	if err != nil {
+		return n, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return n, fmt.Errorf("unexpected %q at offset %d", tok.text, tok.pos)
+	}
+	return n, nil
+}
+
+func (p *filterParser) or() (filterNode, error) {
+	left, err := p.and()
+	for err == nil && p.accept("||") {
+		var right filterNode
+		if right, err = p.and(); err != nil {
+			break
+		}
+		if left.kind != kindBool || right.kind != kindBool {
+			return left, fmt.Errorf("|| needs conditions on both sides")
+		}
+		l, r := left.boolean, right.boolean
+		left.boolean = func(rec *filterRecord) bool { return l(rec) || r(rec) }
+	}
+	return left, err
+}
+
+func (p *filterParser) and() (filterNode, error) {
+	left, err := p.not()
+	for err == nil && p.accept("&&") {
+		var right filterNode
+		if right, err = p.not(); err != nil {
+			break
+		}
+		if left.kind != kindBool || right.kind != kindBool {
+			return left, fmt.Errorf("&& needs conditions on both sides")
+		}
+		l, r := left.boolean, right.boolean
+		left.boolean = func(rec *filterRecord) bool { return l(rec) && r(rec) }
+	}
+	return left, err
+}
+
+func (p *filterParser) not() (filterNode, error) {
+	if !p.accept("!") {
+		return p.comparison()
+	}
+	n, err := p.not()
+	if err != nil {
+		return n, err
+	}
+	if n.kind != kindBool {
+		return n, fmt.Errorf("! needs a condition")
+	}
+	inner := n.boolean
+	return filterNode{kind: kindBool, boolean: func(r *filterRecord) bool { return !inner(r) }}, nil
+}
+
+// filterComparisons maps comparison operators to tests on a three-way compare.
+var filterComparisons = map[string]func(c int) bool{
+	"==": func(c int) bool { return c == 0 },
+	"!=": func(c int) bool { return c != 0 },
+	"<":  func(c int) bool { return c < 0 },
+	"<=": func(c int) bool { return c <= 0 },
+	">":  func(c int) bool { return c > 0 },
+	">=": func(c int) bool { return c >= 0 },
+}
+
+func (p *filterParser) comparison() (filterNode, error) {
+	left, err := p.additive()
+	if err != nil {
+		return left, err
+	}
+	tok := p.peek()
+	test, ok := filterComparisons[tok.text]
+	if tok.kind != tokOp || !ok {
+		return left, nil
+	}
+	p.next()
+	right, err := p.additive()
+	if err != nil {
+		return right, err
+	}
+	if left.kind != right.kind || left.kind == kindBool {
+		return filterNode{}, fmt.Errorf("cannot compare %s with %s at offset %d", left.kind, right.kind, tok.pos)
+	}
+
+	var cmp func(r *filterRecord) int
+	if left.kind == kindNum {
+		l, rt := left.num, right.num
+		cmp = func(r *filterRecord) int {
+			a, b := l(r), rt(r)
+			switch {
+			case a < b:
+				return -1
+			case a > b:
+				return 1
+			}
+			return 0
+		}
+	} else {
+		l, rt := left.str, right.str
+		cmp = func(r *filterRecord) int { return strings.Compare(l(r), rt(r)) }
+	}
+	return filterNode{kind: kindBool, boolean: func(r *filterRecord) bool { return test(cmp(r)) }}, nil
+}
+
+// filterArithmetic maps arithmetic operators to their functions. Division by
+// zero gives an infinity or NaN, which compares false with everything but !=.
+var filterArithmetic = map[string]func(a, b float64) float64{
+	"+": func(a, b float64) float64 { return a + b },
+	"-": func(a, b float64) float64 { return a - b },
+	"*": func(a, b float64) float64 { return a * b },
+	"/": func(a, b float64) float64 { return a / b },
+}
+
+func (p *filterParser) additive() (filterNode, error) {
+	return p.arithmetic(p.multiplicative, "+", "-")
+}
+
+func (p *filterParser) multiplicative() (filterNode, error) {
+	return p.arithmetic(p.unary, "*", "/")
+}
+
+// arithmetic parses operand (op operand)* for the given operators, left to
+// right; both sides must be numbers.
+func (p *filterParser) arithmetic(operand func() (filterNode, error), ops ...string) (filterNode, error) {
+	left, err := operand()
+	for err == nil {
+		tok := p.peek()
+		if tok.kind != tokOp || (tok.text != ops[0] && tok.text != ops[1]) {
+			break
+		}
+		p.next()
+		var right filterNode
+		if right, err = operand(); err != nil {
+			break
+		}
+		if left.kind != kindNum || right.kind != kindNum {
+			return left, fmt.Errorf("%s needs numbers on both sides at offset %d", tok.text, tok.pos)
+		}
+		l, r, op := left.num, right.num, filterArithmetic[tok.text]
+		left = filterNode{kind: kindNum, num: func(rec *filterRecord) float64 { return op(l(rec), r(rec)) }}
+	}
+	return left, err
+}
+
+func (p *filterParser) unary() (filterNode, error) {
+	tok := p.peek()
+	if !p.accept("-") {
+		return p.primary()
+	}
+	n, err := p.unary()
+	if err != nil {
+		return n, err
+	}
+	if n.kind != kindNum {
+		return n, fmt.Errorf("- needs a number at offset %d", tok.pos)
+	}
+	inner := n.num
+	return filterNode{kind: kindNum, num: func(r *filterRecord) float64 { return -inner(r) }}, nil
+}
+
+func (p *filterParser) primary() (filterNode, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokNumber:
+		v, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return filterNode{}, fmt.Errorf("invalid number %q at offset %d", tok.text, tok.pos)
+		}
+		return filterNode{kind: kindNum, num: func(*filterRecord) float64 { return v }}, nil
+	case tokString:
+		v := tok.text
+		return filterNode{kind: kindStr, str: func(*filterRecord) string { return v }}, nil
+	case tokIdent:
+		switch tok.text {
+		case "true", "false":
+			v := tok.text == "true"
+			return filterNode{kind: kindBool, boolean: func(*filterRecord) bool { return v }}, nil
+		case "cidr":
+			return p.cidr(tok)
+		}
+		if p.aggregates {
+			return p.aggregate(tok)
+		}
+		field, ok := filterFields[tok.text]
+		if !ok {
+			return filterNode{}, fmt.Errorf("unknown field %q", tok.text)
+		}
+		if field.packetOnly && !p.withPacket {
+			return filterNode{}, fmt.Errorf("field %q is not available in client filters", tok.text)
+		}
+		if field.str != nil {
+			return filterNode{kind: kindStr, str: field.str}, nil
+		}
+		return filterNode{kind: kindNum, num: field.num}, nil
+	case tokOp:
+		if tok.text == "(" {
+			n, err := p.or()
+			if err != nil {
+				return n, err
+			}
+			if !p.accept(")") {
+				return n, fmt.Errorf("missing ) at offset %d", p.peek().pos)
+			}
+			return n, nil
+		}
+	}
+	return filterNode{}, fmt.Errorf("unexpected %q at offset %d", tok.text, tok.pos)
+}
+
+// cidr parses cidr(field, "prefix") after the function name.
+func (p *filterParser) cidr(name filterToken) (filterNode, error) {
+	if !p.accept("(") {
+		return filterNode{}, fmt.Errorf("expected ( after cidr at offset %d", name.pos)
+	}
+	addr, err := p.primary()
+	if err != nil {
+		return addr, err
+	}
+	if addr.kind != kindStr || !p.accept(",") {
+		return filterNode{}, fmt.Errorf("cidr takes an address field and a quoted prefix")
+	}
+	tok := p.next()
+	if tok.kind != tokString || !p.accept(")") {
+		return filterNode{}, fmt.Errorf("cidr takes an address field and a quoted prefix")
+	}
+	prefix, err := netip.ParsePrefix(tok.text)
+	if err != nil {
+		return filterNode{}, fmt.Errorf("invalid prefix %q", tok.text)
+	}
+	prefix = prefix.Masked()
+
+	value := addr.str
+	return filterNode{kind: kindBool, boolean: func(r *filterRecord) bool {
+		ip, err := netip.ParseAddr(value(r))
+		return err == nil && prefix.Contains(ip.Unmap())
+	}}, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// geoTable maps network prefixes to coordinates for GeoIP enrichment.
+type geoTable struct {
+	points map[netip.Prefix]string
+	// bits4 and bits6 list the prefix lengths present, longest first, so a
+	// lookup tries at most one map probe per length.
+	bits4, bits6 []int
+}
+
+// geoIP is nil unless GEOIP_FILE is set.
+var geoIP *geoTable
+
+// initGeoIP loads GEOIP_FILE and registers the sink that writes source
+// locations onto packet hashes the poller reads.
+func initGeoIP(cfg *Config, rdb redisClient) error {
+	if cfg.GeoIPFile == "" {
+		return nil
+	}
+	f, err := os.Open(cfg.GeoIPFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	t, err := loadGeoTable(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", cfg.GeoIPFile, err)
+	}
+	geoIP = t
+	infoLog("Loaded %d GeoIP networks from %s", len(t.points), cfg.GeoIPFile)
+
+	registerSink(&geoSink{cfg: cfg, rdb: rdb}, 1000, time.Second)
+	return nil
+}
+
+// loadGeoTable reads network,latitude,longitude rows. A header row naming
+// those columns selects them by name, so GeoLite2 City Blocks CSV files
+// load as they are; without one the first three columns are used.
+func loadGeoTable(r io.Reader) (*geoTable, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+
+	t := &geoTable{points: make(map[netip.Prefix]string)}
+	netCol, latCol, lonCol := 0, 1, 2
+	seen4, seen6 := map[int]bool{}, map[int]bool{}
+	for line := 1; ; line++ {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if line == 1 {
+			cols := make(map[string]int, len(row))
+			for i, name := range row {
+				cols[strings.TrimSpace(strings.ToLower(name))] = i
+			}
+			n, okN := cols["network"]
+			lat, okLat := cols["latitude"]
+			lon, okLon := cols["longitude"]
+			if okN && okLat && okLon {
+				netCol, latCol, lonCol = n, lat, lon
+				continue
+			}
+		}
+		if len(row) <= max(netCol, latCol, lonCol) || row[latCol] == "" || row[lonCol] == "" {
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(row[netCol]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		lat, errLat := strconv.ParseFloat(strings.TrimSpace(row[latCol]), 64)
+		lon, errLon := strconv.ParseFloat(strings.TrimSpace(row[lonCol]), 64)
+		if errLat != nil || errLon != nil || lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+			return nil, fmt.Errorf("line %d: invalid coordinates %q,%q", line, row[latCol], row[lonCol])
+		}
+
+		prefix = prefix.Masked()
+		t.points[prefix] = geoPoint(lat, lon)
+		if prefix.Addr().Is4() {
+			seen4[prefix.Bits()] = true
+		} else {
+			seen6[prefix.Bits()] = true
+		}
+	}
+
+	for bits := range seen4 {
+		t.bits4 = append(t.bits4, bits)
+	}
+	for bits := range seen6 {
+		t.bits6 = append(t.bits6, bits)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(t.bits4)))
+	sort.Sort(sort.Reverse(sort.IntSlice(t.bits6)))
+	return t, nil
+}
+
+// geoPoint formats coordinates as RediSearch GEO values: "lon,lat".
+func geoPoint(lat, lon float64) string {
+	return strconv.FormatFloat(lon, 'f', -1, 64) + "," + strconv.FormatFloat(lat, 'f', -1, 64)
+}
+
+// lookup returns the GEO value of the longest prefix containing ip.
+func (t *geoTable) lookup(ip string) (string, bool) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return "", false
+	}
+	addr = addr.Unmap()
+	bits := t.bits6
+	if addr.Is4() {
+		bits = t.bits4
+	}
+	for _, n := range bits {
+		prefix, _ := addr.Prefix(n)
+		if point, ok := t.points[prefix]; ok {
+			return point, true
+		}
+	}
+	return "", false
+}
+
+// packetLocation is the source location stored with a packet: the one it
+// carries, else the GeoIP lookup of its source address.
+func packetLocation(p Packet) string {
+	if p.Location != "" || geoIP == nil {
+		return p.Location
+	}
+	point, _ := geoIP.lookup(p.Src)
+	return point
+}
+
+// setLocationScript adds the location to a packet hash only if the hash
+// still exists, so an expired or never-stored packet is not recreated as a
+// hash holding nothing but a location. It is sent with EVAL: EVALSHA's
+// NOSCRIPT fallback does not work inside a pipeline.
+const setLocationScript = `
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return redis.call("HSET", KEYS[1], "location", ARGV[1])
+end
+return 0`
+
+// geoSink writes source locations onto the packet:* hashes producers such as
+// the simulator store, so the location GEO field indexes them.
+type geoSink struct {
+	cfg *Config
+	rdb redisClient
+}
+
+func (s *geoSink) Name() string { return "geoip" }
+
+func (s *geoSink) Write(ctx context.Context, packets []Packet) error {
+	pipe := s.rdb.Pipeline()
+	n := 0
+	for _, p := range packets {
+		if !strings.HasPrefix(p.Key, s.cfg.packetPrefixFor(p.Tenant)) || p.Location != "" {
+			continue
+		}
+		if point := packetLocation(p); point != "" {
+			pipe.Eval(ctx, setLocationScript, []string{p.Key}, point)
+			n++
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// grafanaMaxPoints bounds the buckets of one series; the step grows to
+	// stay under it.
+	grafanaMaxPoints = 10000
+	// grafanaMaxSeries bounds the series of a by=pair target, keeping the
+	// pairs with the largest totals.
+	grafanaMaxSeries = 20
+	// grafanaMaxBody bounds the JSON request bodies.
+	grafanaMaxBody = 64 << 10
+)
+
+// grafanaRollupFields maps the metrics Grafana can chart to the rollup hash
+// field holding them.
+var grafanaRollupFields = map[string]string{
+	"messages":      "count",
+	"total_bytes":   "total_bytes",
+	"total_packets": "total_packets",
+	"tcp_bytes":     "tcp_bytes",
+	"tcp_packets":   "tcp_packets",
+	"udp_bytes":     "udp_bytes",
+	"udp_packets":   "udp_packets",
+}
+
+// grafanaPacketReducers are the metrics FT.AGGREGATE can compute from
+// idx:packets, which indexes no per-protocol counters.
+var grafanaPacketReducers = map[string]redis.FTAggregateReducer{
+	"messages":    {Reducer: redis.SearchCount, As: "value"},
+	"total_bytes": {Reducer: redis.SearchSum, Args: []interface{}{"@total_bytes"}, As: "value"},
+}
+
+// grafanaRange is the dashboard time range of a query or annotation request.
+type grafanaRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// grafanaTarget is one query of a panel: "<metric>[?<filters>]".
+type grafanaTarget struct {
+	Target string `json:"target"`
+	RefID  string `json:"refId"`
+	Type   string `json:"type"`
+	Hide   bool   `json:"hide"`
+}
+
+// grafanaQueryRequest is the body of POST /grafana/query.
+type grafanaQueryRequest struct {
+	Range         grafanaRange    `json:"range"`
+	IntervalMs    int64           `json:"intervalMs"`
+	MaxDataPoints int64           `json:"maxDataPoints"`
+	Targets       []grafanaTarget `json:"targets"`
+}
+
+// grafanaSeries is one time series: buckets (unix seconds) to values.
+type grafanaSeries struct {
+	name   string
+	values map[int64]float64
+	total  float64
+}
+
+// handleGrafanaRoot answers the datasource's connection test.
+func handleGrafanaRoot(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/grafana/" {
+		handleNotFound(w, r)
+		return
+	}
+	fmt.Fprint(w, "OK")
+}
+
+// handleGrafanaSearch lists the metrics a target can name, filtered by the
+// request's target substring.
+func (s *Server) handleGrafanaSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, methodNotAllowed.errorf("Method not allowed"))
+		return
+	}
+	var req struct {
+		Target string `json:"target"`
+	}
+	// The body is optional; some clients send none.
+	_ = json.NewDecoder(http.MaxBytesReader(w, r.Body, grafanaMaxBody)).Decode(&req)
+
+	metrics := []string{}
+	for name := range grafanaRollupFields {
+		if _, ok := grafanaPacketReducers[name]; !ok && !s.config.Rollups {
+			continue
+		}
+		if strings.Contains(name, req.Target) {
+			metrics = append(metrics, name)
+		}
+	}
+	sort.Strings(metrics)
+	writeJSON(w, metrics)
+}
+
+// handleGrafanaQuery returns one time series per target, or per pair with
+// by=pair, bucketed by the panel's interval (see planGrafanaTarget). Every
+// target is validated before any is run.
+func (s *Server) handleGrafanaQuery(rdb redisClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, methodNotAllowed.errorf("Method not allowed"))
+			return
+		}
+		if searchFallback.Load() {
+			writeError(w, notImplemented.errorf("Grafana queries need RediSearch"))
+			return
+		}
+		tenant, ok := s.requestIndexTenant(w, r)
+		if !ok {
+			return
+		}
+		var req grafanaQueryRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, grafanaMaxBody)).Decode(&req); err != nil {
+			writeError(w, badQuery.errorf("Invalid JSON: %v", err))
+			return
+		}
+		from, to := req.Range.From.Unix(), req.Range.To.Unix()
+		if req.Range.From.IsZero() || req.Range.To.IsZero() || from > to {
+			writeError(w, badQuery.errorf("Invalid range"))
+			return
+		}
+
+		step := max(req.IntervalMs/1000, 1)
+		if req.MaxDataPoints > 0 {
+			step = max(step, (to-from)/req.MaxDataPoints+1)
+		}
+		step = max(step, (to-from)/grafanaMaxPoints+1)
+
+		var plans []grafanaPlan
+		var refs []grafanaTarget
+		for _, t := range req.Targets {
+			if t.Hide || t.Target == "" {
+				continue
+			}
+			plan, err := s.config.planGrafanaTarget(t.Target, from, to, step)
+			if err != nil {
+				writeError(w, badQuery.errorf("%v", err))
+				return
+			}
+			plans = append(plans, plan)
+			refs = append(refs, t)
+		}
+
+		ctx, cancel := s.queryContext(r)
+		defer cancel()
+		results := []interface{}{}
+		for i, plan := range plans {
+			series, err := plan.series(ctx, rdb, tenant)
+			if err != nil {
+				s.queryFailed(w, r, "Grafana query", err)
+				return
+			}
+			if refs[i].Type == "table" {
+				results = append(results, grafanaTable(series, from, to, plan.step))
+				continue
+			}
+			for _, s := range series {
+				results = append(results, map[string]interface{}{
+					"target":     s.name,
+					"refId":      refs[i].RefID,
+					"datapoints": s.datapoints(from, to, plan.step),
+				})
+			}
+		}
+		writeJSON(w, results)
+	}
+}
+
+// grafanaPlan is a validated target: the metric, its RediSearch query, and
+// the bucket step. res is the rollup resolution in seconds that answers it,
+// or 0 for FT.AGGREGATE over idx:packets.
+type grafanaPlan struct {
+	cfg    *Config
+	metric string
+	query  string
+	byPair bool
+	step   int64
+	res    int64
+}
+
+// planGrafanaTarget parses "<metric>[?<filters>]": the /packets filters,
+// plus by=pair for one series per pair. Rollups answer targets they can
+// (ROLLUPS set, steps of a minute or more or metrics idx:packets lacks,
+// src_ip and dst_ip filters only), with the step rounded up to their
+// resolution.
+func (c *Config) planGrafanaTarget(target string, from, to, step int64) (grafanaPlan, error) {
+	metric, raw, _ := strings.Cut(strings.TrimSpace(target), "?")
+	params, err := url.ParseQuery(raw)
+	if err != nil {
+		return grafanaPlan{}, fmt.Errorf("Invalid target %q", target)
+	}
+	if _, ok := grafanaRollupFields[metric]; !ok {
+		return grafanaPlan{}, fmt.Errorf("Invalid target %q: unknown metric %s", target, metric)
+	}
+	plan := grafanaPlan{cfg: c, metric: metric, step: step}
+	switch params.Get("by") {
+	case "":
+	case "pair":
+		plan.byPair = true
+	default:
+		return grafanaPlan{}, fmt.Errorf("Invalid target %q: by must be pair", target)
+	}
+	params.Del("by")
+
+	rollupFilters := true
+	for name := range params {
+		if name != "src_ip" && name != "dst_ip" {
+			rollupFilters = false
+		}
+	}
+	_, packetMetric := grafanaPacketReducers[metric]
+	if c.Rollups && rollupFilters && (step >= 60 || !packetMetric) {
+		plan.res = 60
+		resolution := "1m"
+		if step >= 3600 {
+			plan.res, resolution = 3600, "1h"
+		}
+		plan.step = (step + plan.res - 1) / plan.res * plan.res
+		plan.query = fmt.Sprintf("@resolution:{%s} @bucket:[%d %d]", resolution, from-from%plan.res, to)
+		if src := params.Get("src_ip"); src != "" {
+			plan.query += " @source_ip:{" + escapeTagValue(src) + "}"
+		}
+		if dest := params.Get("dst_ip"); dest != "" {
+			plan.query += " @dest_ip:{" + escapeTagValue(dest) + "}"
+		}
+		return plan, nil
+	}
+	if !packetMetric {
+		return grafanaPlan{}, fmt.Errorf("Invalid target %q: %s needs ROLLUPS and src_ip/dst_ip filters only", target, metric)
+	}
+
+	params.Set("from", strconv.FormatInt(from, 10))
+	params.Set("to", strconv.FormatInt(to, 10))
+	if plan.query, _, _, err = packetFilter(params); err != nil {
+		return grafanaPlan{}, fmt.Errorf("Invalid target %q: %w", target, err)
+	}
+	return plan, nil
+}
+
+// series runs the plan against the tenant's index.
+func (p grafanaPlan) series(ctx context.Context, rdb redisClient, tenant string) ([]*grafanaSeries, error) {
+	if p.res > 0 {
+		return p.rollupSeries(ctx, rdb, tenant)
+	}
+	return p.packetSeries(ctx, rdb, tenant)
+}
+
+// packetSeries aggregates idx:packets into step-second buckets.
+func (p grafanaPlan) packetSeries(ctx context.Context, rdb redisClient, tenant string) ([]*grafanaSeries, error) {
+	reducer := grafanaPacketReducers[p.metric]
+	group := redis.FTAggregateGroupBy{Fields: []interface{}{"@bucket"}, Reduce: []redis.FTAggregateReducer{reducer}}
+	load := []redis.FTAggregateLoad{{Field: "@timestamp"}}
+	if reducer.Args != nil {
+		load = append(load, redis.FTAggregateLoad{Field: "@total_bytes"})
+	}
+	if p.byPair {
+		group.Fields = append(group.Fields, "@src_ip", "@dst_ip")
+		load = append(load, redis.FTAggregateLoad{Field: "@src_ip"}, redis.FTAggregateLoad{Field: "@dst_ip"})
+	}
+	opts := &redis.FTAggregateOptions{
+		Load:    load,
+		Apply:   []redis.FTAggregateApply{{Field: fmt.Sprintf("floor(@timestamp/%d)*%d", p.step, p.step), As: "bucket"}},
+		GroupBy: []redis.FTAggregateGroupBy{group},
+		Limit:   aggregateMaxLimit,
+	}
+
+	var result *redis.FTAggregateResult
+	err := redisDo(ctx, func(ctx context.Context) (err error) {
+		result, err = searchClient(rdb).FTAggregateWithArgs(ctx, p.cfg.packetIndexFor(tenant), p.query, opts).Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	series := newGrafanaSeriesSet(p.metric, p.byPair)
+	for _, row := range result.Rows {
+		bucket, _ := strconv.ParseFloat(fmt.Sprint(row.Fields["bucket"]), 64)
+		value, _ := strconv.ParseFloat(fmt.Sprint(row.Fields["value"]), 64)
+		// Packet hashes hold real addresses; rollups were anonymized when built.
+		series.add(anonymizeIP(fmt.Sprint(row.Fields["src_ip"])), anonymizeIP(fmt.Sprint(row.Fields["dst_ip"])), int64(bucket), value)
+	}
+	return series.list(), nil
+}
+
+// rollupSeries sums rollups into step-second buckets.
+func (p grafanaPlan) rollupSeries(ctx context.Context, rdb redisClient, tenant string) ([]*grafanaSeries, error) {
+	field := grafanaRollupFields[p.metric]
+	series := newGrafanaSeriesSet(p.metric, p.byPair)
+	for offset := 0; ; offset += searchLimit {
+		var result redis.FTSearchResult
+		err := redisDo(ctx, func(ctx context.Context) (err error) {
+			result, err = searchClient(rdb).FTSearchWithArgs(ctx, rollupIndexFor(tenant), p.query, &redis.FTSearchOptions{
+				LimitOffset: offset,
+				Limit:       searchLimit,
+			}).Result()
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, doc := range result.Docs {
+			bucket, _ := strconv.ParseInt(doc.Fields["bucket"], 10, 64)
+			value, _ := strconv.ParseFloat(doc.Fields[field], 64)
+			series.add(doc.Fields["source_ip"], doc.Fields["dest_ip"], bucket-bucket%p.step, value)
+		}
+		if len(result.Docs) < searchLimit {
+			break
+		}
+	}
+	return series.list(), nil
+}
+
+// grafanaSeriesSet collects the series of one target: a single series named
+// after the metric, or one per src:dest pair.
+type grafanaSeriesSet struct {
+	metric string
+	byPair bool
+	series map[string]*grafanaSeries
+}
+
+func newGrafanaSeriesSet(metric string, byPair bool) *grafanaSeriesSet {
+	return &grafanaSeriesSet{metric: metric, byPair: byPair, series: make(map[string]*grafanaSeries)}
+}
+
+func (s *grafanaSeriesSet) add(src, dest string, bucket int64, value float64) {
+	name := s.metric
+	if s.byPair {
+		name += " " + src + ":" + dest
+	}
+	series := s.series[name]
+	if series == nil {
+		series = &grafanaSeries{name: name, values: make(map[int64]float64)}
+		s.series[name] = series
+	}
+	series.values[bucket] += value
+	series.total += value
+}
+
+// list returns the series by name; by pair, only the grafanaMaxSeries with
+// the largest totals. A target without data still gets its series.
+func (s *grafanaSeriesSet) list() []*grafanaSeries {
+	if len(s.series) == 0 && !s.byPair {
+		return []*grafanaSeries{{name: s.metric, values: map[int64]float64{}}}
+	}
+	list := make([]*grafanaSeries, 0, len(s.series))
+	for _, series := range s.series {
+		list = append(list, series)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].total != list[j].total {
+			return list[i].total > list[j].total
+		}
+		return list[i].name < list[j].name
+	})
+	if len(list) > grafanaMaxSeries {
+		list = list[:grafanaMaxSeries]
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	return list
+}
+
+// datapoints returns [value, unix ms] pairs for every bucket from from to
+// to, with zero for buckets without traffic.
+func (s *grafanaSeries) datapoints(from, to, step int64) [][2]float64 {
+	points := make([][2]float64, 0, (to-from)/step+1)
+	for bucket := from - from%step; bucket <= to; bucket += step {
+		points = append(points, [2]float64{s.values[bucket], float64(bucket * 1000)})
+	}
+	return points
+}
+
+// grafanaTable renders a target's series as one table of time, series, and
+// value rows, skipping empty buckets.
+func grafanaTable(series []*grafanaSeries, from, to, step int64) map[string]interface{} {
+	rows := [][]interface{}{}
+	for bucket := from - from%step; bucket <= to; bucket += step {
+		for _, s := range series {
+			if v, ok := s.values[bucket]; ok {
+				rows = append(rows, []interface{}{bucket * 1000, s.name, v})
+			}
+		}
+	}
+	return map[string]interface{}{
+		"type": "table",
+		"columns": []map[string]string{
+			{"text": "Time", "type": "time"},
+			{"text": "Series", "type": "string"},
+			{"text": "Value", "type": "number"},
+		},
+		"rows": rows,
+	}
+}
+
+// handleGrafanaAnnotations returns the operator annotations and stored
+// alert transitions in the range. The annotation's query, if any, selects
+// operator annotations with that tag and alerts of that rule.
+func (s *Server) handleGrafanaAnnotations(rdb redisClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, methodNotAllowed.errorf("Method not allowed"))
+			return
+		}
+		tenant, scoped, ok := s.requestTenant(w, r)
+		if !ok {
+			return
+		}
+		var req struct {
+			Range      grafanaRange           `json:"range"`
+			Annotation map[string]interface{} `json:"annotation"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, grafanaMaxBody)).Decode(&req); err != nil {
+			writeError(w, badQuery.errorf("Invalid JSON: %v", err))
+			return
+		}
+		query, _ := req.Annotation["query"].(string)
+		to := req.Range.To
+		if to.IsZero() {
+			to = time.Now()
+		}
+		ctx, cancel := s.queryContext(r)
+		defer cancel()
+		annotations := []map[string]interface{}{}
+
+		if s.config.AnnotationHistorySize > 0 {
+			tenants := s.config.tenantNames()
+			if scoped {
+				tenants = []string{tenant}
+			}
+			list, err := annotationsBetween(ctx, rdb, tenants, req.Range.From.Unix(), to.Unix(), annotationQueryLimit)
+			if err != nil {
+				s.queryFailed(w, r, "Grafana annotation query", err)
+				return
+			}
+			for _, a := range list {
+				if query != "" && !slices.Contains(a.Tags, query) {
+					continue
+				}
+				out := map[string]interface{}{
+					"annotation": req.Annotation,
+					"time":       a.Time.UnixMilli(),
+					"title":      a.Title,
+					"text":       a.Text,
+					"tags":       a.Tags,
+				}
+				if a.End != nil {
+					out["timeEnd"] = a.End.UnixMilli()
+					out["isRegion"] = true
+				}
+				annotations = append(annotations, out)
+			}
+		}
+
+		// Alert history spans every tenant; scoped requests get only their
+		// tenant's annotations, as /alerts/history refuses them.
+		if s.config.AlertHistorySize > 0 && !scoped {
+			var entries []string
+			err := redisDo(ctx, func(ctx context.Context) (err error) {
+				entries, err = rdb.LRange(ctx, alertHistoryKey, 0, -1).Result()
+				return err
+			})
+			if err != nil {
+				s.queryFailed(w, r, "Grafana annotation query", err)
+				return
+			}
+			for _, entry := range entries {
+				var e alertEvent
+				if err := json.Unmarshal([]byte(entry), &e); err != nil {
+					continue
+				}
+				if query != "" && e.Rule != query {
+					continue
+				}
+				if e.At.Before(req.Range.From) || e.At.After(to) {
+					continue
+				}
+				text := e.Expr
+				if e.Description != "" {
+					text = e.Description + " (" + e.Expr + ")"
+				}
+				tags := []string{"alert", e.Rule, e.Status}
+				if e.Severity != "" {
+					tags = append(tags, e.Severity)
+				}
+				annotations = append(annotations, map[string]interface{}{
+					"annotation": req.Annotation,
+					"time":       e.At.UnixMilli(),
+					"title":      e.Rule + " " + e.Status,
+					"text":       text,
+					"tags":       tags,
+				})
+			}
+		}
+		writeJSON(w, annotations)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gRPC status codes used by the ingestion service.
+const (
+	grpcOK              = 0
+	grpcInvalidArgument = 3
+	grpcUnimplemented   = 12
+	grpcInternal        = 13
+	grpcUnauthenticated = 16
+
+	grpcPublishTrafficPath = "/traffic.TrafficIngest/PublishTraffic"
+	grpcMaxMessage         = 4 << 20
+)
+
+// initGRPCServer serves the TrafficIngest service (proto/traffic.proto) over
+// cleartext HTTP/2 on its own listener until ctx ends, which also ends the
+// streams still open.
+func (s *Server) initGRPCServer(ctx context.Context) {
+	if s.config.GRPCListen == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(grpcPublishTrafficPath, s.handlePublishTraffic)
+
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	// Publish calls are client streams that stay open as long as the
+	// publisher has traffic, so only the header and idle limits apply.
+	gs := &http.Server{
+		Addr:              s.config.GRPCListen,
+		Handler:           withRequestID(mux.ServeHTTP),
+		Protocols:         &protocols,
+		ReadHeaderTimeout: s.config.HTTPReadHeaderTimeout,
+		IdleTimeout:       s.config.HTTPIdleTimeout,
+		MaxHeaderBytes:    s.config.HTTPMaxHeaderBytes,
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+	}
+	go func() {
+		<-ctx.Done()
+		gs.Close()
+	}()
+
+	go func() {
+		infoLog("gRPC ingestion service listening on %s", s.config.GRPCListen)
+		if err := gs.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errorLog("gRPC server error: %v", err)
+		}
+	}()
+}
+
+// handlePublishTraffic implements the client-streaming PublishTraffic RPC.
+// Messages are ingested one at a time as they are read.
+func (s *Server) handlePublishTraffic(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/grpc")
+
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		writeGRPCStatus(w, grpcUnimplemented, "expected a gRPC request")
+		return
+	}
+	if s.config.IngestToken == "" {
+		writeGRPCStatus(w, grpcUnauthenticated, "ingestion disabled (INGEST_TOKEN not set)")
+		return
+	}
+	if !bearerMatches(r, s.config.IngestToken) {
+		writeGRPCStatus(w, grpcUnauthenticated, "invalid bearer token")
+		return
+	}
+
+	var accepted, rejected int64
+	for {
+		msg, err := readGRPCMessage(r.Body)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeGRPCStatus(w, grpcInvalidArgument, err.Error())
+			return
+		}
+
+		ch := channelFor("grpc")
+		ch.message(len(msg))
+		packets, err := decodeTrafficMessage(msg)
+		if err != nil {
+			ch.decodeError()
+			writeGRPCStatus(w, grpcInvalidArgument, err.Error())
+			return
+		}
+
+		valid := packets[:0]
+		for _, p := range packets {
+			if validatePacket(s.config, p) != nil || !acceptPacketSchema(ch, p) {
+				rejected++
+				continue
+			}
+			valid = append(valid, p)
+		}
+		ch.decoded(len(valid))
+		s.ingestPackets("grpc", valid)
+		accepted += int64(len(valid))
+	}
+
+	// PublishAck{accepted = 1, rejected = 2}
+	var ack []byte
+	ack = protoAppendVarint(ack, 1, uint64(accepted))
+	ack = protoAppendVarint(ack, 2, uint64(rejected))
+
+	frame := make([]byte, 5, 5+len(ack))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(ack)))
+	if _, err := w.Write(append(frame, ack...)); err != nil {
+		return
+	}
+	writeGRPCStatus(w, grpcOK, "")
+}
+
+// writeGRPCStatus sends the grpc-status trailers that end every response.
+// Failures are logged with the x-request-id withRequestID answered with.
+func writeGRPCStatus(w http.ResponseWriter, code int, message string) {
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", message)
+	}
+	if code != grpcOK {
+		debugLog("gRPC request %s failed (status %d): %s", w.Header().Get(requestIDHeader), code, message)
+	}
+}
+
+// readGRPCMessage reads one length-prefixed gRPC message.
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.New("truncated message header")
+		}
+		return nil, err
+	}
+	if header[0] != 0 {
+		return nil, errors.New("compressed messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > grpcMaxMessage {
+		return nil, fmt.Errorf("message of %d bytes exceeds limit", size)
+	}
+
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, errors.New("truncated message")
+	}
+	return msg, nil
+}
+
+// decodeTrafficMessage decodes a TrafficMessage protobuf into packets.
+func decodeTrafficMessage(b []byte) ([]Packet, error) {
+	var packets []Packet
+	err := protoFields(b, func(field int, wire int, v uint64, data []byte) error {
+		if field != 1 || wire != 2 {
+			return nil
+		}
+		p, err := decodeTrafficPacket(data)
+		if err != nil {
+			return err
+		}
+		packets = append(packets, p)
+		return nil
+	})
+	return packets, err
+}
+
+func decodeTrafficPacket(b []byte) (Packet, error) {
+	var p Packet
+	err := protoFields(b, func(field int, wire int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			p.Timestamp = int(v)
+		case 2:
+			p.Seq = int(v)
+		case 3:
+			p.NodeID = int(v)
+		case 4:
+			p.Src = string(data)
+		case 5:
+			p.Dest = string(data)
+		case 6:
+			p.TotalBytes = int(v)
+		case 7:
+			return protoAppendRepeated(&p.UDPPackets, wire, v, data)
+		case 8:
+			return protoAppendRepeated(&p.UDPBytes, wire, v, data)
+		case 9:
+			return protoAppendRepeated(&p.TCPPackets, wire, v, data)
+		case 10:
+			return protoAppendRepeated(&p.TCPBytes, wire, v, data)
+		case 11:
+			p.Key = string(data)
+		}
+		return nil
+	})
+	return p, err
+}
+
+// protoFields walks the fields of a protobuf message, passing varint values
+// and length-delimited payloads to fn. Fixed-width fields are skipped.
+func protoFields(b []byte, fn func(field, wire int, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errors.New("malformed protobuf tag")
+		}
+		b = b[n:]
+		field, wire := int(tag>>3), int(tag&7)
+
+		var v uint64
+		var data []byte
+		switch wire {
+		case 0:
+			v, n = binary.Uvarint(b)
+			if n <= 0 {
+				return errors.New("malformed protobuf varint")
+			}
+			b = b[n:]
+		case 1, 5:
+			size := 8
+			if wire == 5 {
+				size = 4
+			}
+			if len(b) < size {
+				return errors.New("truncated protobuf field")
+			}
+			b = b[size:]
+			continue
+		case 2:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < size {
+				return errors.New("truncated protobuf field")
+			}
+			data = b[n : n+int(size)]
+			b = b[n+int(size):]
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", wire)
+		}
+
+		if err := fn(field, wire, v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// protoAppendRepeated appends a repeated int64 field in packed or unpacked form.
+func protoAppendRepeated(dst *[]int, wire int, v uint64, data []byte) error {
+	if wire == 0 {
+		*dst = append(*dst, int(int64(v)))
+		return nil
+	}
+	for len(data) > 0 {
+		x, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("malformed packed varint")
+		}
+		*dst = append(*dst, int(int64(x)))
+		data = data[n:]
+	}
+	return nil
+}
+
+func protoAppendVarint(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3)
+	return binary.AppendUvarint(b, v)
+}
+
+// protoAppendBytes appends a length-delimited field (bytes, string, or message).
+func protoAppendBytes(b []byte, field int, data []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// protoAppendFixed64 appends a fixed64 field, such as a double's bits.
+func protoAppendFixed64(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|1)
+	return binary.LittleEndian.AppendUint64(b, v)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDecodeTrafficMessage(t *testing.T) {
+	packet := []byte{
+		0x08, 0x64, // timestamp: 100
+		0x10, 0x07, // seq: 7
+		0x22, 0x01, 'a', // source_ip
+		0x2a, 0x01, 'b', // dest_ip
+		0x4a, 0x02, 0x01, 0x02, // tcp_packets, packed: [1, 2]
+		0x50, 0xac, 0x02, // tcp_bytes, unpacked: 300
+		0x50, 0x05, // tcp_bytes, unpacked: 5
+		0x5a, 0x01, 'k', // key
+		0x65, 0x00, 0x00, 0x00, 0x00, // unknown fixed32, skipped
+	}
+	msg := append([]byte{0x0a, byte(len(packet))}, packet...)
+	msg = append(msg, 0x0a, 0x02, 0x08, 0x65) // a second packet at 101
+
+	packets, err := decodeTrafficMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Packet{
+		{Timestamp: 100, Seq: 7, Src: "a", Dest: "b", TCPPackets: []int{1, 2}, TCPBytes: []int{300, 5}, Key: "k"},
+		{Timestamp: 101},
+	}
+	if !reflect.DeepEqual(packets, want) {
+		t.Fatalf("decoded %+v\nwant %+v", packets, want)
+	}
+
+	for _, bad := range [][]byte{
+		{0x0a, 0x05, 0x08},             // length past the end
+		{0x0a, 0x02, 0x08, 0x80},       // unterminated varint
+		{0x0a, 0x02, 0x0b, 0x00},       // start-group wire type
+		{0x0a, 0x03, 0x4a, 0x01, 0x80}, // bad packed varint
+	} {
+		if _, err := decodeTrafficMessage(bad); err == nil {
+			t.Errorf("decoded malformed message % x", bad)
+		}
+	}
+}
+
+func TestReadGRPCMessage(t *testing.T) {
+	r := bytes.NewReader([]byte{0, 0, 0, 0, 2, 0xaa, 0xbb, 0, 0, 0, 0, 0})
+	for _, want := range [][]byte{{0xaa, 0xbb}, {}} {
+		msg, err := readGRPCMessage(r)
+		if err != nil || !bytes.Equal(msg, want) {
+			t.Fatalf("got % x (%v), want % x", msg, err, want)
+		}
+	}
+	if _, err := readGRPCMessage(r); err != io.EOF {
+		t.Fatalf("at the end of the stream: %v, want EOF", err)
+	}
+
+	for name, frame := range map[string][]byte{
+		"compressed": {1, 0, 0, 0, 1, 0},
+		"oversized":  binary.BigEndian.AppendUint32([]byte{0}, grpcMaxMessage+1),
+		"truncated":  {0, 0, 0, 0, 4, 0xaa},
+		"header":     {0, 0, 0},
+	} {
+		if _, err := readGRPCMessage(bytes.NewReader(frame)); err == nil || err == io.EOF {
+			t.Errorf("%s frame: %v, want an error", name, err)
+		}
+	}
+}
+
+// freeTCPAddr returns a loopback TCP address that was free a moment ago.
+func freeTCPAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// encodeTestPacket is the TrafficPacket protobuf of p.
+func encodeTestPacket(p Packet) []byte {
+	var b []byte
+	b = protoAppendVarint(b, 1, uint64(p.Timestamp))
+	b = protoAppendVarint(b, 3, uint64(p.NodeID))
+	b = protoAppendBytes(b, 4, []byte(p.Src))
+	b = protoAppendBytes(b, 5, []byte(p.Dest))
+	b = protoAppendVarint(b, 6, uint64(p.TotalBytes))
+	for field, values := range map[int][]int{7: p.UDPPackets, 8: p.UDPBytes, 9: p.TCPPackets, 10: p.TCPBytes} {
+		var packed []byte
+		for _, v := range values {
+			packed = binary.AppendUvarint(packed, uint64(v))
+		}
+		b = protoAppendBytes(b, field, packed)
+	}
+	return b
+}
+
+// TestGRPCPublishTraffic streams two messages to PublishTraffic over
+// cleartext HTTP/2 and checks the ack, the trailers, and the ingested view.
+func TestGRPCPublishTraffic(t *testing.T) {
+	addr := freeTCPAddr(t)
+	s := startServer(t, "GRPC_LISTEN="+addr)
+
+	ts := int(time.Now().Unix())
+	var body []byte
+	for _, msg := range [][]Packet{
+		{testPacket("10.0.0.1", "10.0.0.2", ts, 1, 100), {Timestamp: ts, Src: "bad"}},
+		{testPacket("10.0.0.3", "10.0.0.4", ts, 1, 200)},
+	} {
+		var m []byte
+		for _, p := range msg {
+			m = protoAppendBytes(m, 1, encodeTestPacket(p))
+		}
+		body = append(binary.BigEndian.AppendUint32(append(body, 0), uint32(len(m))), m...)
+	}
+
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: &protocols}, Timeout: 5 * time.Second}
+	var resp *http.Response
+	// The listener starts in the background; give it a moment.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(100 * time.Millisecond) {
+		req, err := http.NewRequest(http.MethodPost, "http://"+addr+grpcPublishTrafficPath, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("Authorization", "Bearer "+testIngestToken)
+		if resp, err = client.Do(req); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("PublishTraffic: %v", err)
+		}
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 || resp.Header.Get("Content-Type") != "application/grpc" {
+		t.Fatalf("response over %s with content type %q", resp.Proto, resp.Header.Get("Content-Type"))
+	}
+
+	ack, err := readGRPCMessage(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	if status := resp.Trailer.Get("Grpc-Status"); status != "0" {
+		t.Fatalf("grpc-status %q (%s)", status, resp.Trailer.Get("Grpc-Message"))
+	}
+	counts := make(map[int]uint64)
+	if err := protoFields(ack, func(field, wire int, v uint64, data []byte) error {
+		counts[field] = v
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if counts[1] != 2 || counts[2] != 1 {
+		t.Fatalf("PublishAck accepted=%d rejected=%d, want 2 and 1", counts[1], counts[2])
+	}
+
+	httpResp, err := http.Get(s.URL + "/latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpResp.Body.Close()
+	var latest struct {
+		Data map[string]PacketSummary `json:"data"`
+	}
+	if err := json.NewDecoder(httpResp.Body).Decode(&latest); err != nil {
+		t.Fatal(err)
+	}
+	if latest.Data["10.0.0.3:10.0.0.4"].TCPBytesTotal != 200 || latest.Data["10.0.0.1:10.0.0.2"].TCPBytesTotal != 100 {
+		t.Fatalf("/latest after PublishTraffic: %v", latest.Data)
+	}
+}
+
+func TestGRPCPublishTrafficRejectsBadToken(t *testing.T) {
+	s := newServer(loadConfig())
+	s.config.IngestToken = testIngestToken
+	req := httptest.NewRequest(http.MethodPost, grpcPublishTrafficPath, nil)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Authorization", "Bearer wrong")
+	rec := httptest.NewRecorder()
+	s.handlePublishTraffic(rec, req)
+	if got := rec.Header().Get(http.TrailerPrefix + "Grpc-Status"); got != "16" {
+		t.Fatalf("grpc-status %q, want 16 (unauthenticated)", got)
+	}
+}
@@ -2,29 +2,196 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 )
 
+// maxIngestBody bounds the size of one /ingest request.
+const maxIngestBody = 10 << 20
+
+// writeJSON encodes v as the JSON response body.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(responseAPIVersion(w).translate(v)); err != nil {
+		writeError(w, internalError.errorf("Failed to encode response"))
+	}
+}
+
 // handleRoot is a basic health check endpoint.
 func handleRoot(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "Hello, World!")
 }
 
 // handleLatest returns a JSON snapshot of the latest packets (latest state for each src:dest pair).
-func handleLatest(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+// Clients sending Accept: application/cbor get it CBOR-encoded instead.
+func (s *Server) handleLatest(w http.ResponseWriter, r *http.Request) {
+	tenant, scoped, ok := s.requestTenant(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Add("Vary", "Accept")
 
-	snapshot := latestSnapshot()
+	snapshot := s.latestSnapshot()
+	if scoped {
+		snapshot = tenantSnapshot(snapshot, tenant)
+	}
+	status := s.currentFeedStatus()
 
 	response := map[string]interface{}{
-		"type": "snapshot",
-		"data": snapshot,
+		"type":   "snapshot",
+		"data":   snapshot,
+		"stale":  status.Stale,
+		"age_ms": status.AgeMS,
 	}
 
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		http.Error(w, "Failed to encode latest", http.StatusInternalServerError)
+	if acceptsCBOR(r) {
+		writeCBOR(w, response)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(responseAPIVersion(w).translate(response)); err != nil {
+		writeError(w, internalError.errorf("Failed to encode latest"))
+		return
+	}
+}
+
+// handleLatestWait long-polls for the next change of the latest timestamp.
+// Clients pass the timestamp they last saw as ?since=; if the watermark has
+// already moved the snapshot is returned immediately, otherwise the request is
+// held until it changes or the timeout elapses (204 No Content).
+func (s *Server) handleLatestWait(w http.ResponseWriter, r *http.Request) {
+	tenant, scoped, ok := s.requestTenant(w, r)
+	if !ok {
+		return
+	}
+	timeout := s.config.LongPollTimeout
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			writeError(w, badQuery.errorf("Invalid timeout"))
+			return
+		}
+		if d < timeout {
+			timeout = d
+		}
+	}
+
+	current, changed := s.watchStartingTimestamp()
+	if v := r.URL.Query().Get("since"); v != "" {
+		since, err := strconv.Atoi(v)
+		if err != nil {
+			writeError(w, badQuery.errorf("Invalid since"))
+			return
+		}
+		if since != current {
+			s.writeLatestWait(w, current, tenant, scoped)
+			return
+		}
+	}
+
+	holdOpen(s.config, w)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-changed:
+		holdOpen(s.config, w)
+		current, _ = s.watchStartingTimestamp()
+		s.writeLatestWait(w, current, tenant, scoped)
+	case <-timer.C:
+		holdOpen(s.config, w)
+		w.WriteHeader(http.StatusNoContent)
+	case <-r.Context().Done():
+	}
+}
+
+func (s *Server) writeLatestWait(w http.ResponseWriter, timestamp int, tenant string, scoped bool) {
+	w.Header().Set("Content-Type", "application/json")
+
+	snapshot := s.latestSnapshot()
+	if scoped {
+		snapshot = tenantSnapshot(snapshot, tenant)
+	}
+	status := s.currentFeedStatus()
+	response := map[string]interface{}{
+		"type":      "snapshot",
+		"timestamp": timestamp,
+		"data":      snapshot,
+		"stale":     status.Stale,
+		"age_ms":    status.AgeMS,
+	}
+
+	if err := json.NewEncoder(w).Encode(responseAPIVersion(w).translate(response)); err != nil {
+		writeError(w, internalError.errorf("Failed to encode latest"))
+	}
+}
+
+// handleIngest accepts a traffic message (one packet or an array) from
+// producers that cannot reach Redis, applies it to the view and broadcasts it,
+// and stores it to Redis when INGEST_STORE is enabled.
+func (s *Server) handleIngest(rdb redisClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, methodNotAllowed.errorf("Method not allowed"))
+			return
+		}
+
+		buf := bytes.NewBuffer(getBuffer(0))
+		_, err := buf.ReadFrom(http.MaxBytesReader(w, r.Body, maxIngestBody))
+		defer func() { putBuffer(buf.Bytes()) }()
+		if err != nil {
+			writeError(w, tooLarge.errorf("Failed to read body"))
+			return
+		}
+		ch := channelFor("http")
+		ch.message(buf.Len())
+		packets, err := decodePackets(buf.Bytes())
+		if err != nil {
+			ch.decodeFailed(err)
+			writeError(w, badQuery.errorf("Invalid traffic message: %v", err))
+			return
+		}
+		defer releasePackets(packets)
+		// A tenant token, or else ?tenant=, labels every packet of the message.
+		tenant, scoped, ok := s.ingestTenant(w, r)
+		if !ok {
+			return
+		}
+		for i := range packets {
+			if scoped {
+				packets[i].Tenant = tenant
+			}
+		}
+		for i, p := range packets {
+			if err := validatePacket(s.config, p); err != nil {
+				writeError(w, badQuery.errorf("Packet %d: %v", i, err))
+				return
+			}
+		}
+
+		s.config.assignTenants(packets)
+		if s.config.IngestStore {
+			for i := range packets {
+				// Keying by the Redis hash lets the poller recognize these packets.
+				packets[i].Key = s.config.packetKey(packets[i])
+			}
+			if err := storePackets(r.Context(), s.config, rdb, previewPackets(s, packets), s.config.IngestTTL); err != nil {
+				errorLog("Failed to store ingested packets: %v", err)
+				writeError(w, upstreamFailed.errorf("Failed to store packets"))
+				return
+			}
+		}
+
+		ch.decoded(len(packets))
+		updates := s.ingestPackets("http", packets)
+		writeJSON(w, map[string]interface{}{
+			"accepted": len(packets),
+			"updates":  updates,
+			"stored":   s.config.IngestStore,
+		})
+	}
 }
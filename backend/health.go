@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// readyCheckTimeout bounds the Redis calls of one /readyz request.
+const readyCheckTimeout = 2 * time.Second
+
+// Health states reported by /readyz, from best to worst.
+const (
+	healthOK       = "ok"
+	healthDegraded = "degraded"
+	healthDown     = "down"
+)
+
+// healthReport is the /readyz response. Reasons explain every check that did
+// not pass, so an idle DAQ ("no messages") is told apart from a broken backend.
+type healthReport struct {
+	Status   string   `json:"status"`
+	Reasons  []string `json:"reasons"`
+	Redis    bool     `json:"redis"`
+	Setup    bool     `json:"setup"`
+	Traffic  bool     `json:"traffic"`
+	Index    bool     `json:"index"`
+	Stale    bool     `json:"stale"`
+	AgeMS    *int64   `json:"age_ms"`
+	Breaker  string   `json:"breaker"`
+	Search   string   `json:"search"`
+	Draining bool     `json:"draining"`
+}
+
+// degrade lowers the report's status to at least status and records why.
+func (h *healthReport) degrade(status, reason string) {
+	if status == healthDown || h.Status == healthOK {
+		h.Status = status
+	}
+	h.Reasons = append(h.Reasons, reason)
+}
+
+// checkHealth grades the backend: down when Redis is unreachable, its setup
+// (startRedis) has not finished, (with READY_REQUIRE_TRAFFIC) no packet
+// has reached latest yet, or the server is draining; degraded when the search index is
+// missing or no message arrived for STALE_AFTER.
+func (s *Server) checkHealth(ctx context.Context, rdb redisClient) healthReport {
+	ctx, cancel := context.WithTimeout(ctx, readyCheckTimeout)
+	defer cancel()
+
+	h := healthReport{Status: healthOK, Reasons: []string{}}
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		h.degrade(healthDown, fmt.Sprintf("redis unreachable: %v", err))
+	} else {
+		h.Redis = true
+		h.Setup = redisReady.Load()
+		if !h.Setup {
+			h.degrade(healthDown, "redis setup not finished")
+		}
+		// Without RediSearch there is no index to check (see searchMode).
+		if !searchFallback.Load() {
+			h.Index = true
+			for _, tenant := range s.config.tenantNames() {
+				index := s.config.packetIndexFor(tenant)
+				if _, err := searchClient(rdb).FTInfo(ctx, index).Result(); err != nil {
+					h.degrade(healthDegraded, fmt.Sprintf("search index %s unavailable: %v", index, err))
+					h.Index = false
+				}
+			}
+		}
+	}
+
+	h.Search = s.config.searchMode()
+	h.Breaker = redisBreaker.current()
+	if h.Breaker != breakerClosed {
+		h.degrade(healthDegraded, "redis circuit breaker "+h.Breaker)
+	}
+
+	// Packets seeded from Redis or restored from STATE_FILE count as traffic.
+	h.Traffic = s.lastMessageAt.Load() != 0 || s.hasLatestPackets()
+	if s.config.ReadyRequireTraffic && !h.Traffic {
+		h.degrade(healthDown, "waiting for the first message")
+	}
+
+	if s.drain.draining.Load() {
+		h.Draining = true
+		h.degrade(healthDown, "draining")
+	}
+
+	status := s.currentFeedStatus()
+	h.Stale, h.AgeMS = status.Stale, status.AgeMS
+	if status.Stale {
+		h.degrade(healthDegraded, fmt.Sprintf("no messages for %s", s.config.StaleAfter))
+	}
+	return h
+}
+
+// handleReadyz reports the graded health state. Degraded still answers 200
+// so load balancers keep routing to an idle but working backend; down
+// answers 503.
+func (s *Server) handleReadyz(rdb redisClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h := s.checkHealth(r.Context(), rdb)
+		if h.Status == healthDown {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		writeJSON(w, h)
+	}
+}
+
+// handleHealthz is the liveness check: it answers 200 while the process
+// serves HTTP, whatever the state of Redis.
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]interface{}{
+		"status":   healthOK,
+		"uptime_s": int64(time.Since(s.startedAt).Seconds()),
+	})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// initHTTP3Server serves the data routes over HTTP/3 (QUIC) on HTTP3_LISTEN,
+// next to the TCP listeners, until ctx ends. QUIC always runs TLS, so the
+// certificate is loaded here and a bad one stops startup. WebSocket upgrades
+// need the TCP listeners: /ws and /replay cannot be upgraded over HTTP/3.
+func (s *Server) initHTTP3Server(ctx context.Context) error {
+	if s.config.HTTP3Listen == "" {
+		return nil
+	}
+	if s.config.HTTP3CertFile == "" || s.config.HTTP3KeyFile == "" {
+		return errors.New("HTTP3_LISTEN needs HTTP3_CERT_FILE and HTTP3_KEY_FILE")
+	}
+	cert, err := tls.LoadX509KeyPair(s.config.HTTP3CertFile, s.config.HTTP3KeyFile)
+	if err != nil {
+		return fmt.Errorf("load certificate: %w", err)
+	}
+
+	l := listenerSpec{addr: s.config.HTTP3Listen, groups: []string{routesData}, auth: authToken}
+	h3 := &http3.Server{
+		Addr:           s.config.HTTP3Listen,
+		Handler:        s.mux(l),
+		TLSConfig:      http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}),
+		IdleTimeout:    s.config.HTTPIdleTimeout,
+		MaxHeaderBytes: s.config.HTTPMaxHeaderBytes,
+	}
+	go func() {
+		<-ctx.Done()
+		h3.Close()
+	}()
+
+	go func() {
+		infoLog("HTTP/3 listening on %s (udp, routes: %s)", s.config.HTTP3Listen, routesData)
+		if err := h3.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errorLog("HTTP/3 server error: %v", err)
+		}
+	}()
+	return nil
+}
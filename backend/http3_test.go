@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 and its key
+// to dir and returns their paths.
+func writeTestCert(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// freeUDPAddr returns a loopback UDP address that was free a moment ago.
+func freeUDPAddr(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
+
+func TestHTTP3ServesDataRoutes(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir())
+	addr := freeUDPAddr(t)
+	s := startServer(t, "HTTP3_LISTEN="+addr, "HTTP3_CERT_FILE="+certFile, "HTTP3_KEY_FILE="+keyFile)
+	ts := int(time.Now().Unix())
+	ingest(t, s, testPacket("10.0.0.1", "10.0.0.2", ts, 1, 100))
+
+	tr := &http3.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	defer tr.Close()
+	client := &http.Client{Transport: tr, Timeout: 5 * time.Second}
+	get := func(path string) *http.Response {
+		t.Helper()
+		var resp *http.Response
+		var err error
+		// The listener starts in the background; give it a moment.
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+			if resp, err = client.Get("https://" + addr + path); err == nil {
+				return resp
+			}
+		}
+		t.Fatalf("GET %s over HTTP/3: %v", path, err)
+		return nil
+	}
+
+	resp := get("/latest")
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 3 {
+		t.Fatalf("GET /latest: %s over %s", resp.Status, resp.Proto)
+	}
+	var latest struct {
+		Data map[string]PacketSummary `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&latest); err != nil {
+		t.Fatal(err)
+	}
+	if got := latest.Data["10.0.0.1:10.0.0.2"].TCPBytesTotal; got != 100 {
+		t.Fatalf("/latest over HTTP/3: tcp_bytes_total = %d, want 100", got)
+	}
+
+	// Only the data group is served; the admin routes stay on TCP.
+	admin := get("/admin/clients")
+	admin.Body.Close()
+	if admin.StatusCode != http.StatusNotFound {
+		t.Fatalf("GET /admin/clients over HTTP/3: %s, want 404", admin.Status)
+	}
+}
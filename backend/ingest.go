@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// publishChanges hands fresh packets to sinks and alert rules and broadcasts
+// the view change.
+func (s *Server) publishChanges(updates map[string]PacketSummary, fresh []Packet, pruned bool) {
+	s.packetsReceived.Add(int64(len(fresh)))
+	recordLedger(fresh)
+	dispatchToSinks(fresh)
+	s.observeAlerts(fresh)
+	s.observeTraffic(fresh)
+	s.observeLag(fresh)
+	if pruned {
+		s.broadcastSnapshot()
+		return
+	}
+	if len(updates) > 0 {
+		s.broadcastUpdates(updates)
+	}
+}
+
+// ingestPackets applies packets delivered by a push input (rather than read
+// from Redis) and publishes the resulting changes like a poll would. It
+// returns the number of pairs updated in the view.
+func (s *Server) ingestPackets(source string, packets []Packet) int {
+	if len(packets) == 0 {
+		return 0
+	}
+
+	updates, fresh, pruned := s.applyLocked(packets)
+
+	s.lastPushAt.Store(time.Now().Unix())
+	s.publishChanges(updates, fresh, pruned)
+	debugLog("Ingest (%s): %d packets, %d updates", source, len(packets), len(updates))
+	return len(updates)
+}
+
+// validatePacket checks the fields the materialized view keys on.
+func validatePacket(cfg *Config, p Packet) error {
+	switch {
+	case p.Src == "":
+		return fmt.Errorf("missing source_ip")
+	case p.Dest == "":
+		return fmt.Errorf("missing dest_ip")
+	case p.Timestamp <= 0:
+		return fmt.Errorf("missing timestamp")
+	case p.Tenant != "" && !cfg.knownTenant(p.Tenant):
+		return fmt.Errorf("unknown tenant %s", p.Tenant)
+	}
+	return nil
+}
+
+// pushedRecently reports whether a push input delivered packets within the safety window.
+func (s *Server) pushedRecently() bool {
+	return time.Now().Unix()-s.lastPushAt.Load() <= safetyWindow
+}
+
+// decodePackets parses a traffic message payload: a single packet object or
+// an array of them. With PACKET_SCHEMA_FILE set, a payload that does not
+// match the schema fails with a *schemaError. The slice comes from
+// packetPool; callers that know when they are done with it may hand it back
+// with releasePackets.
+func decodePackets(payload []byte) ([]Packet, error) {
+	if ingestSchema != nil {
+		if err := checkPayloadSchema(payload); err != nil {
+			return nil, err
+		}
+	}
+	for _, c := range payload {
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case '[':
+			packets := getPackets()
+			if err := json.Unmarshal(payload, &packets); err != nil {
+				releasePackets(packets)
+				return nil, err
+			}
+			return packets, nil
+		default:
+			var packet Packet
+			if err := json.Unmarshal(payload, &packet); err != nil {
+				return nil, err
+			}
+			return append(getPackets(), packet), nil
+		}
+	}
+	return nil, fmt.Errorf("empty payload")
+}
@@ -0,0 +1,740 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	journalQueueSize     = 1024
+	journalFlushInterval = time.Second
+
+	// journalMaxGap caps the pause between two replayed frames, so a replay
+	// across a period the backend was down does not stall.
+	journalMaxGap = 10 * time.Second
+
+	journalPrefix = "journal-"
+	journalExt    = ".ndjson"
+
+	// clientReplayRetry is how often a replay to a /ws client retries a
+	// frame while the client's queue is full or its ack window is used up.
+	clientReplayRetry = 50 * time.Millisecond
+)
+
+// errClientGone ends a replay to a /ws client that disconnected.
+var errClientGone = errors.New("client disconnected")
+
+// journalRecord is one line of a journal segment: a broadcast frame as JSON
+// and the time, in unix milliseconds, the hub delivered it.
+type journalRecord struct {
+	At    int64           `json:"at"`
+	Frame json.RawMessage `json:"frame"`
+}
+
+// journalSegment is a segment file, named after the time of its first record.
+type journalSegment struct {
+	path  string
+	start int64
+	size  int64
+}
+
+// frameJournal appends every frame srv broadcasts to size-capped segment
+// files in JOURNAL_DIR. Each segment starts with a snapshot of the view, so a
+// replay can begin in any segment.
+type frameJournal struct {
+	srv         *Server
+	dir         string
+	segmentSize int64
+	maxSize     int64
+	queue       chan journalRecord
+	written     atomic.Int64
+	dropped     atomic.Int64
+
+	// The current segment; only used by run.
+	f    *os.File
+	w    *bufio.Writer
+	size int64
+}
+
+// initJournal journals the Server's broadcast frames to JOURNAL_DIR, if set.
+func (s *Server) initJournal(ctx context.Context) error {
+	cfg := s.config
+	if cfg.JournalDir == "" {
+		return nil
+	}
+	if cfg.JournalSegmentMB < 1 || cfg.JournalMaxMB < cfg.JournalSegmentMB {
+		return fmt.Errorf("JOURNAL_MAX_MB (%d) must be at least JOURNAL_SEGMENT_MB (%d), which must be positive",
+			cfg.JournalMaxMB, cfg.JournalSegmentMB)
+	}
+	if err := os.MkdirAll(cfg.JournalDir, 0o755); err != nil {
+		return err
+	}
+
+	s.journal = &frameJournal{
+		srv:         s,
+		dir:         cfg.JournalDir,
+		segmentSize: int64(cfg.JournalSegmentMB) << 20,
+		maxSize:     int64(cfg.JournalMaxMB) << 20,
+		queue:       make(chan journalRecord, journalQueueSize),
+	}
+	go s.journal.run(ctx)
+	infoLog("Journaling frames to %s (segments of %d MB, at most %d MB)",
+		cfg.JournalDir, cfg.JournalSegmentMB, cfg.JournalMaxMB)
+	return nil
+}
+
+// append queues a frame without blocking the hub; frames are dropped while
+// the queue is full.
+func (j *frameJournal) append(payload []byte) {
+	select {
+	case j.queue <- journalRecord{At: time.Now().UnixMilli(), Frame: payload}:
+	default:
+		j.dropped.Add(1)
+	}
+}
+
+func (j *frameJournal) run(ctx context.Context) {
+	ticker := time.NewTicker(journalFlushInterval)
+	defer ticker.Stop()
+	defer j.closeSegment()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case rec := <-j.queue:
+			if err := j.write(rec); err != nil {
+				errorLog("Journal write failed: %v", err)
+				j.dropped.Add(1)
+				j.closeSegment()
+			}
+		case <-ticker.C:
+			// Flushed once a second so replays see recent frames.
+			if j.w != nil {
+				if err := j.w.Flush(); err != nil {
+					errorLog("Journal flush failed: %v", err)
+					j.closeSegment()
+				}
+			}
+		}
+	}
+}
+
+func (j *frameJournal) write(rec journalRecord) error {
+	if j.f == nil || j.size >= j.segmentSize {
+		if err := j.rotate(rec.At); err != nil {
+			return err
+		}
+	}
+	if err := j.writeRecord(rec); err != nil {
+		return err
+	}
+	j.written.Add(1)
+	return nil
+}
+
+func (j *frameJournal) writeRecord(rec journalRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	n, err := j.w.Write(append(line, '\n'))
+	j.size += int64(n)
+	return err
+}
+
+// rotate starts a new segment with a snapshot of the current view and drops
+// the oldest segments beyond JOURNAL_MAX_MB. The snapshot is taken when the
+// segment opens, so it can be slightly ahead of frames still queued.
+func (j *frameJournal) rotate(at int64) error {
+	j.closeSegment()
+
+	path := filepath.Join(j.dir, journalPrefix+strconv.FormatInt(at, 10)+journalExt)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	j.f, j.w, j.size = f, bufio.NewWriter(f), 0
+
+	snapshot, err := j.srv.snapshotFrame().encode(formatJSON, nil)
+	if err != nil {
+		return err
+	}
+	if err := j.writeRecord(journalRecord{At: at, Frame: snapshot}); err != nil {
+		return err
+	}
+	j.prune()
+	return nil
+}
+
+func (j *frameJournal) closeSegment() {
+	if j.f == nil {
+		return
+	}
+	if err := j.w.Flush(); err != nil {
+		errorLog("Journal flush failed: %v", err)
+	}
+	j.f.Close()
+	j.f, j.w = nil, nil
+}
+
+// prune deletes the oldest segments until the journal fits in maxSize. The
+// current segment is never deleted.
+func (j *frameJournal) prune() {
+	segments, err := journalSegments(j.dir)
+	if err != nil {
+		errorLog("Journal prune failed: %v", err)
+		return
+	}
+	var total int64
+	for _, s := range segments {
+		total += s.size
+	}
+	for _, s := range segments[:max(len(segments)-1, 0)] {
+		if total <= j.maxSize {
+			break
+		}
+		if err := os.Remove(s.path); err != nil {
+			errorLog("Journal prune failed: %v", err)
+			return
+		}
+		total -= s.size
+		debugLog("Removed journal segment %s", s.path)
+	}
+}
+
+// journalSegments lists the segment files in dir, oldest first.
+func journalSegments(dir string) ([]journalSegment, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []journalSegment
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, journalPrefix) || !strings.HasSuffix(name, journalExt) {
+			continue
+		}
+		start, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, journalPrefix), journalExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		segments = append(segments, journalSegment{path: filepath.Join(dir, name), start: start, size: info.Size()})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].start < segments[j].start })
+	return segments, nil
+}
+
+// stats describes the journal for the admin API; nil when there is none.
+func (j *frameJournal) stats() map[string]interface{} {
+	if j == nil {
+		return nil
+	}
+	stats := map[string]interface{}{
+		"dir":     j.dir,
+		"written": j.written.Load(),
+		"dropped": j.dropped.Load(),
+		"queued":  len(j.queue),
+	}
+	if segments, err := journalSegments(j.dir); err == nil && len(segments) > 0 {
+		var size int64
+		for _, s := range segments {
+			size += s.size
+		}
+		stats["segments"] = len(segments)
+		stats["bytes"] = size
+		stats["oldest"] = time.UnixMilli(segments[0].start).UTC()
+	}
+	return stats
+}
+
+// replay sends the journaled frames delivered between from and to
+// (unix milliseconds; to 0 means the end of the journal). Frames before from
+// are folded into one snapshot of the view at from, sent first. speed scales
+// the original pacing; 0 sends as fast as possible.
+func (j *frameJournal) replay(ctx context.Context, from, to int64, speed float64, send func([]byte) error) error {
+	segments, err := journalSegments(j.dir)
+	if err != nil {
+		return err
+	}
+	first := 0
+	for i, s := range segments {
+		if s.start <= from {
+			first = i
+		}
+	}
+
+	// The view folded from the frames before from.
+	var edges map[string]json.RawMessage
+	var seq uint64
+	folding := true
+	var last int64
+
+	// sendFolded sends the folded view once, when the first frame at or
+	// after from comes up or the replay ends before one does.
+	sendFolded := func() error {
+		if !folding {
+			return nil
+		}
+		folding = false
+		if edges == nil {
+			return nil
+		}
+		payload, err := json.Marshal(map[string]interface{}{"type": "snapshot", "seq": seq, "data": edges})
+		if err != nil {
+			return err
+		}
+		return send(payload)
+	}
+
+	handle := func(rec journalRecord) (bool, error) {
+		if to > 0 && rec.At > to {
+			return false, nil
+		}
+		if rec.At < from {
+			var f struct {
+				Type string                     `json:"type"`
+				Seq  uint64                     `json:"seq"`
+				Data map[string]json.RawMessage `json:"data"`
+			}
+			if err := json.Unmarshal(rec.Frame, &f); err != nil {
+				return true, nil
+			}
+			switch f.Type {
+			case "snapshot":
+				edges, seq = f.Data, f.Seq
+			case "update":
+				if edges == nil {
+					edges = make(map[string]json.RawMessage)
+				}
+				for key, summary := range f.Data {
+					edges[key] = summary
+				}
+				seq = f.Seq
+			}
+			return true, nil
+		}
+
+		if folding {
+			if err := sendFolded(); err != nil {
+				return false, err
+			}
+		} else if speed > 0 {
+			wait := min(time.Duration(float64(time.Duration(rec.At-last)*time.Millisecond)/speed), journalMaxGap)
+			if wait > 0 {
+				t := time.NewTimer(wait)
+				select {
+				case <-ctx.Done():
+					t.Stop()
+					return false, ctx.Err()
+				case <-t.C:
+				}
+			}
+		}
+		last = rec.At
+		return true, send(rec.Frame)
+	}
+
+	for _, s := range segments[first:] {
+		more, err := replaySegment(s.path, handle)
+		if err != nil {
+			return err
+		}
+		if !more {
+			break
+		}
+	}
+	return sendFolded()
+}
+
+// replaySegment calls handle for each record in the segment at path until it
+// returns false. A partly written last line is ignored.
+func replaySegment(path string, handle func(journalRecord) (bool, error)) (bool, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		// Pruned since it was listed.
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		var rec journalRecord
+		if json.Unmarshal(line, &rec) != nil {
+			continue
+		}
+		if more, err := handle(rec); err != nil || !more {
+			return false, err
+		}
+	}
+}
+
+// parseJournalTime reads a replay bound given as unix seconds or RFC 3339
+// and returns it in unix milliseconds.
+func parseJournalTime(v string) (int64, error) {
+	if secs, err := strconv.ParseFloat(v, 64); err == nil {
+		return int64(secs * 1000), nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return 0, err
+	}
+	return t.UnixMilli(), nil
+}
+
+// handleReplay streams journaled frames over a WebSocket, starting with a
+// snapshot of the view at ?from= (default the oldest segment) and paced by
+// ?speed=, so a dashboard can
+// show an incident again. The connection is closed at the end of the journal
+// or at ?to=.
+func (s *Server) handleReplay(w http.ResponseWriter, r *http.Request) {
+	if s.journal == nil {
+		writeError(w, notFound.errorf("Endpoint disabled (JOURNAL_DIR not set)"))
+		return
+	}
+	if s.refuseDraining(w) {
+		return
+	}
+	ip := clientIP(r)
+	tenant, scoped, ok := s.requestTenant(w, r)
+	if !ok {
+		return
+	}
+
+	q := r.URL.Query()
+	var from, to int64
+	var err error
+	if v := q.Get("from"); v != "" {
+		if from, err = parseJournalTime(v); err != nil {
+			writeError(w, badQuery.errorf("Invalid from"))
+			return
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if to, err = parseJournalTime(v); err != nil || to < from {
+			writeError(w, badQuery.errorf("Invalid to"))
+			return
+		}
+	}
+	speed := 1.0
+	if v := q.Get("speed"); v != "" {
+		if speed, err = strconv.ParseFloat(v, 64); err != nil || speed < 0 {
+			writeError(w, badQuery.errorf("Invalid speed"))
+			return
+		}
+	}
+
+	conn, err := upgrader.Upgrade(w, r, requestIDResponseHeader(r))
+	if err != nil {
+		errorLog("Error upgrading to WebSocket: %v", err)
+		return
+	}
+	defer conn.Close()
+	guardReads(s.config, conn)
+
+	// Reading detects the client going away; replays take no commands.
+	ctx, cancel := s.drainContext(r.Context())
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				if reason := readFailure(err); reason != "" {
+					infoLog("Ending journal replay to %s (req=%s): %s", ip, requestID(r.Context()), reason)
+				}
+				return
+			}
+			extendReadDeadline(s.config, conn)
+		}
+	}()
+	go keepAlive(ctx, s.config, conn)
+
+	infoLog("Replaying journal to %s (req=%s, from=%d, to=%d, speed=%g)", ip, requestID(r.Context()), from, to, speed)
+	sent := 0
+	err = s.journal.replay(ctx, from, to, speed, func(payload []byte) error {
+		if scoped {
+			if payload = tenantFramePayload(payload, tenant); payload == nil {
+				return nil
+			}
+		}
+		sent++
+		conn.SetWriteDeadline(time.Now().Add(s.config.WSWriteTimeout))
+		return conn.WriteMessage(websocket.TextMessage, payload)
+	})
+	if err != nil && ctx.Err() == nil {
+		errorLog("Journal replay to %s (req=%s) failed: %v", ip, requestID(r.Context()), err)
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "replay failed"), time.Now().Add(time.Second))
+		return
+	}
+	select {
+	case <-s.drain.expired():
+		debugLog("Journal replay to %s stopped after %d frames: %s", ip, sent, drainReason)
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, drainReason), time.Now().Add(time.Second))
+		return
+	default:
+	}
+	debugLog("Journal replay to %s ended after %d frames", ip, sent)
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, "end of journal"), time.Now().Add(time.Second))
+}
+
+// tenantFramePayload keeps only tenant's edges of a journaled frame, whose
+// data keys carry the tenant prefix, and tenant's annotations. It returns nil
+// for anything else: an update with none of tenant's edges, other tenants'
+// annotations, frames without data (alerts and status span every tenant),
+// and frames it cannot read.
+func tenantFramePayload(payload []byte, tenant string) []byte {
+	var f map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &f); err != nil {
+		return nil
+	}
+	if f["annotation"] != nil {
+		var a annotation
+		if json.Unmarshal(f["annotation"], &a) != nil || a.Tenant != tenant {
+			return nil
+		}
+		return payload
+	}
+	if f["data"] == nil {
+		return nil
+	}
+	var edges map[string]json.RawMessage
+	if err := json.Unmarshal(f["data"], &edges); err != nil {
+		return nil
+	}
+	prefix := tenantPrefix(tenant)
+	kept := make(map[string]json.RawMessage)
+	for key, e := range edges {
+		if strings.HasPrefix(key, prefix) {
+			kept[key] = e
+		}
+	}
+	if len(kept) == 0 && f["type"] != nil && string(f["type"]) != `"snapshot"` {
+		return nil
+	}
+	data, err := json.Marshal(kept)
+	if err != nil {
+		return nil
+	}
+	f["data"] = data
+	out, err := json.Marshal(f)
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+// replayBound reads a bound of a replay command: unix seconds as a number,
+// or a string parseJournalTime accepts. It returns 0 when the bound is unset.
+func replayBound(raw json.RawMessage) (int64, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return 0, nil
+	}
+	var v string
+	if json.Unmarshal(raw, &v) == nil {
+		return parseJournalTime(v)
+	}
+	var secs float64
+	if err := json.Unmarshal(raw, &secs); err != nil {
+		return 0, err
+	}
+	return int64(secs * 1000), nil
+}
+
+// startReplay plays the journal back on a /ws client's own socket, like
+// /replay does on a connection of its own. Broadcasts skip the client until
+// the replay ends or is stopped; it then gets a fresh snapshot.
+func (c *client) startReplay(cm clientMessage) error {
+	if c.srv.journal == nil {
+		return errors.New("replay needs JOURNAL_DIR")
+	}
+	from, err := replayBound(cm.From)
+	if err != nil {
+		return errors.New("invalid replay from")
+	}
+	to, err := replayBound(cm.To)
+	if err != nil || (to > 0 && to < from) {
+		return errors.New("invalid replay to")
+	}
+	speed := 1.0
+	if cm.Speed != nil {
+		if *cm.Speed < 0 {
+			return errors.New("invalid replay speed")
+		}
+		speed = *cm.Speed
+	}
+
+	ctx, cancel := context.WithCancel(c.ctx)
+	if !c.replayStop.CompareAndSwap(nil, &cancel) {
+		cancel()
+		return errors.New("replay already running")
+	}
+	infoLog("Replaying journal to WebSocket client %s (from=%d, to=%d, speed=%g)", c.remoteAddr, from, to, speed)
+	go c.runReplay(ctx, from, to, speed)
+	return nil
+}
+
+// cancelReplay stops the client's replay and reports whether one was running.
+func (c *client) cancelReplay() bool {
+	cancel := c.replayStop.Load()
+	if cancel == nil {
+		return false
+	}
+	(*cancel)()
+	return true
+}
+
+func (c *client) runReplay(ctx context.Context, from, to int64, speed float64) {
+	start := map[string]interface{}{"type": "replay", "state": "start", "speed": speed}
+	if from > 0 {
+		start["from"] = time.UnixMilli(from).UTC()
+	}
+	if to > 0 {
+		start["to"] = time.UnixMilli(to).UTC()
+	}
+	defer func() {
+		if cancel := c.replayStop.Swap(nil); cancel != nil {
+			(*cancel)()
+		}
+	}()
+
+	sent := 0
+	err := c.sendReplayMessage(ctx, start)
+	if err == nil {
+		err = c.srv.journal.replay(ctx, from, to, speed, func(raw []byte) error {
+			payload, err := c.replayPayload(raw)
+			if err != nil || payload == nil {
+				return nil
+			}
+			if err := c.sendReplayFrame(ctx, payload); err != nil {
+				return err
+			}
+			sent++
+			return nil
+		})
+	}
+	if errors.Is(err, errClientGone) {
+		return
+	}
+	if err != nil && ctx.Err() == nil {
+		errorLog("Journal replay to %s failed: %v", c.remoteAddr, err)
+	}
+
+	// The end frame is sent even when the replay was stopped, so the client
+	// knows live frames follow, unless the connection itself has ended.
+	end := map[string]interface{}{"type": "replay", "state": "end", "frames": sent, "stopped": ctx.Err() != nil}
+	if err != nil && ctx.Err() == nil {
+		end["error"] = "replay failed"
+	}
+	if c.sendReplayMessage(c.ctx, end) != nil {
+		return
+	}
+
+	// Resume the live feed with a snapshot. Holding clientsMu keeps the hub
+	// from queueing an update ahead of it.
+	c.srv.clientsMu.Lock()
+	defer c.srv.clientsMu.Unlock()
+	if cancel := c.replayStop.Swap(nil); cancel != nil {
+		(*cancel)()
+	}
+	if _, ok := c.srv.clients[c]; !ok {
+		return
+	}
+	payload, err := c.srv.snapshotFrame().encode(c.format, c.projection.Load())
+	if err != nil || !c.enqueue(payload) {
+		c.resync.Store(true)
+		return
+	}
+	c.resync.Store(false)
+	debugLog("Journal replay to %s ended after %d frames; resuming live feed", c.remoteAddr, sent)
+}
+
+// replayPayload re-encodes a journaled frame in the client's wire format and
+// projection. It returns nil for side frames the client does not want and
+// for updates its filter leaves empty.
+func (c *client) replayPayload(raw []byte) ([]byte, error) {
+	var f frame
+	if err := json.Unmarshal(raw, &f); err != nil {
+		return nil, err
+	}
+	switch {
+	case f.Alert != nil || f.Annotation != nil:
+		if !c.wants(f) {
+			return nil, nil
+		}
+		return f.encode(c.format, nil)
+	case f.Type == "status":
+		// Status frames are journaled flattened, not as a frame's Status.
+		if !c.status {
+			return nil, nil
+		}
+		var msg map[string]interface{}
+		if err := json.Unmarshal(raw, &msg); err != nil {
+			return nil, err
+		}
+		return marshalFrame(c.format, msg)
+	}
+	return f.encode(c.format, c.projection.Load())
+}
+
+func (c *client) sendReplayMessage(ctx context.Context, msg map[string]interface{}) error {
+	payload, err := marshalFrame(c.format, msg)
+	if err != nil {
+		return err
+	}
+	return c.sendReplayFrame(ctx, payload)
+}
+
+// sendReplayFrame queues a replayed frame, waiting while the client is
+// stalled, over its tenant's quota, or has a full queue, where a broadcast
+// would be skipped. The frame is queued under clientsMu, so it is never sent
+// on the channel removeClient closes.
+func (c *client) sendReplayFrame(ctx context.Context, payload []byte) error {
+	for {
+		c.srv.clientsMu.Lock()
+		_, ok := c.srv.clients[c]
+		queued := ok && !c.stalled() && c.allow(len(payload)) && c.enqueue(payload)
+		c.srv.clientsMu.Unlock()
+		if !ok {
+			return errClientGone
+		}
+		if queued {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(clientReplayRetry):
+		}
+	}
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/netip"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// jsonSchema is a compiled JSON Schema (draft 2020-12 subset). It supports
+// type, enum, const, properties, required, additionalProperties, items,
+// minItems, maxItems, minimum, maximum, exclusiveMinimum, exclusiveMaximum,
+// multipleOf, minLength, maxLength, pattern, the ipv4 and ipv6 formats,
+// allOf, anyOf, oneOf, and not. Other keywords, such as $schema, title, and
+// description, are ignored, as the specification asks of unknown keywords;
+// $ref is refused so a schema that relies on it is not silently weakened.
+type jsonSchema struct {
+	// reject is set by the schema false.
+	reject bool
+
+	types    []string
+	enum     []interface{}
+	constant *interface{}
+
+	properties   map[string]*jsonSchema
+	required     []string
+	additional   *jsonSchema
+	noAdditional bool
+
+	items    *jsonSchema
+	minItems *int
+	maxItems *int
+
+	minimum          *float64
+	maximum          *float64
+	exclusiveMinimum *float64
+	exclusiveMaximum *float64
+	multipleOf       *float64
+
+	minLength *int
+	maxLength *int
+	pattern   *regexp.Regexp
+	format    string
+
+	allOf []*jsonSchema
+	anyOf []*jsonSchema
+	oneOf []*jsonSchema
+	not   *jsonSchema
+}
+
+// jsonSchemaTypes are the values of "type".
+var jsonSchemaTypes = map[string]bool{
+	"null": true, "boolean": true, "object": true, "array": true,
+	"number": true, "integer": true, "string": true,
+}
+
+// compileJSONSchema parses a schema document.
+func compileJSONSchema(data []byte) (*jsonSchema, error) {
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return compileSchemaNode(doc, "#")
+}
+
+func compileSchemaNode(node interface{}, at string) (*jsonSchema, error) {
+	switch v := node.(type) {
+	case bool:
+		return &jsonSchema{reject: !v}, nil
+	case map[string]interface{}:
+		return compileSchemaObject(v, at)
+	}
+	return nil, fmt.Errorf("%s: a schema must be an object or a boolean", at)
+}
+
+func compileSchemaObject(obj map[string]interface{}, at string) (*jsonSchema, error) {
+	s := &jsonSchema{}
+	sub := func(key string) (*jsonSchema, error) {
+		return compileSchemaNode(obj[key], at+"/"+key)
+	}
+	list := func(key string) ([]*jsonSchema, error) {
+		arr, ok := obj[key].([]interface{})
+		if !ok || len(arr) == 0 {
+			return nil, fmt.Errorf("%s/%s: must be a non-empty array of schemas", at, key)
+		}
+		out := make([]*jsonSchema, len(arr))
+		for i, n := range arr {
+			c, err := compileSchemaNode(n, fmt.Sprintf("%s/%s/%d", at, key, i))
+			if err != nil {
+				return nil, err
+			}
+			out[i] = c
+		}
+		return out, nil
+	}
+	number := func(key string) (*float64, error) {
+		n, ok := obj[key].(json.Number)
+		if !ok {
+			return nil, fmt.Errorf("%s/%s: must be a number", at, key)
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("%s/%s: %v", at, key, err)
+		}
+		return &f, nil
+	}
+	count := func(key string) (*int, error) {
+		n, ok := obj[key].(json.Number)
+		if !ok {
+			return nil, fmt.Errorf("%s/%s: must be a non-negative integer", at, key)
+		}
+		i, err := strconv.Atoi(n.String())
+		if err != nil || i < 0 {
+			return nil, fmt.Errorf("%s/%s: must be a non-negative integer", at, key)
+		}
+		return &i, nil
+	}
+
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var err error
+	for _, key := range keys {
+		value := obj[key]
+		switch key {
+		case "$ref", "$dynamicRef":
+			return nil, fmt.Errorf("%s/%s: references are not supported; inline the schema", at, key)
+		case "type":
+			switch t := value.(type) {
+			case string:
+				s.types = []string{t}
+			case []interface{}:
+				for _, e := range t {
+					name, _ := e.(string)
+					s.types = append(s.types, name)
+				}
+			}
+			if len(s.types) == 0 {
+				return nil, fmt.Errorf("%s/type: must be a type name or an array of them", at)
+			}
+			for _, t := range s.types {
+				if !jsonSchemaTypes[t] {
+					return nil, fmt.Errorf("%s/type: unknown type %q", at, t)
+				}
+			}
+		case "enum":
+			arr, ok := value.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s/enum: must be an array", at)
+			}
+			s.enum = arr
+		case "const":
+			c := value
+			s.constant = &c
+		case "properties":
+			props, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s/properties: must be an object", at)
+			}
+			s.properties = make(map[string]*jsonSchema, len(props))
+			for name, n := range props {
+				if s.properties[name], err = compileSchemaNode(n, at+"/properties/"+name); err != nil {
+					return nil, err
+				}
+			}
+		case "required":
+			arr, ok := value.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s/required: must be an array of names", at)
+			}
+			for _, e := range arr {
+				name, ok := e.(string)
+				if !ok {
+					return nil, fmt.Errorf("%s/required: must be an array of names", at)
+				}
+				s.required = append(s.required, name)
+			}
+		case "additionalProperties":
+			if s.additional, err = sub(key); err != nil {
+				return nil, err
+			}
+			s.noAdditional = s.additional.reject
+		case "items":
+			if s.items, err = sub(key); err != nil {
+				return nil, err
+			}
+		case "minItems":
+			s.minItems, err = count(key)
+		case "maxItems":
+			s.maxItems, err = count(key)
+		case "minLength":
+			s.minLength, err = count(key)
+		case "maxLength":
+			s.maxLength, err = count(key)
+		case "minimum":
+			s.minimum, err = number(key)
+		case "maximum":
+			s.maximum, err = number(key)
+		case "exclusiveMinimum":
+			s.exclusiveMinimum, err = number(key)
+		case "exclusiveMaximum":
+			s.exclusiveMaximum, err = number(key)
+		case "multipleOf":
+			if s.multipleOf, err = number(key); err == nil && *s.multipleOf <= 0 {
+				err = fmt.Errorf("%s/multipleOf: must be greater than 0", at)
+			}
+		case "pattern":
+			p, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s/pattern: must be a string", at)
+			}
+			if s.pattern, err = regexp.Compile(p); err != nil {
+				return nil, fmt.Errorf("%s/pattern: %v", at, err)
+			}
+		case "format":
+			s.format, _ = value.(string)
+		case "allOf":
+			s.allOf, err = list(key)
+		case "anyOf":
+			s.anyOf, err = list(key)
+		case "oneOf":
+			s.oneOf, err = list(key)
+		case "not":
+			s.not, err = sub(key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// validate checks a value decoded with json.Decoder.UseNumber. The error
+// names the JSON pointer of the first violation.
+func (s *jsonSchema) validate(v interface{}) error {
+	return s.check(v, "")
+}
+
+func (s *jsonSchema) check(v interface{}, at string) error {
+	fail := func(format string, args ...interface{}) error {
+		where := at
+		if where == "" {
+			where = "/"
+		}
+		return fmt.Errorf("%s: %s", where, fmt.Sprintf(format, args...))
+	}
+
+	if s.reject {
+		return fail("not allowed")
+	}
+	if len(s.types) > 0 && !hasJSONType(v, s.types) {
+		return fail("expected %s, got %s", strings.Join(s.types, " or "), jsonTypeOf(v))
+	}
+	if s.enum != nil {
+		found := false
+		for _, e := range s.enum {
+			if jsonEqual(v, e) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fail("not one of the allowed values")
+		}
+	}
+	if s.constant != nil && !jsonEqual(v, *s.constant) {
+		return fail("must be %v", *s.constant)
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, name := range s.required {
+			if _, ok := v[name]; !ok {
+				return fail("missing required property %q", name)
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			path := at + "/" + escapeJSONPointer(name)
+			if p, ok := s.properties[name]; ok {
+				if err := p.check(v[name], path); err != nil {
+					return err
+				}
+				continue
+			}
+			if s.noAdditional {
+				return fail("unexpected property %q", name)
+			}
+			if s.additional != nil {
+				if err := s.additional.check(v[name], path); err != nil {
+					return err
+				}
+			}
+		}
+	case []interface{}:
+		if s.minItems != nil && len(v) < *s.minItems {
+			return fail("%d items, at least %d required", len(v), *s.minItems)
+		}
+		if s.maxItems != nil && len(v) > *s.maxItems {
+			return fail("%d items, at most %d allowed", len(v), *s.maxItems)
+		}
+		if s.items != nil {
+			for i, e := range v {
+				if err := s.items.check(e, at+"/"+strconv.Itoa(i)); err != nil {
+					return err
+				}
+			}
+		}
+	case json.Number:
+		f, _ := v.Float64()
+		switch {
+		case s.minimum != nil && f < *s.minimum:
+			return fail("%v is less than %v", v, *s.minimum)
+		case s.maximum != nil && f > *s.maximum:
+			return fail("%v is greater than %v", v, *s.maximum)
+		case s.exclusiveMinimum != nil && f <= *s.exclusiveMinimum:
+			return fail("%v must be greater than %v", v, *s.exclusiveMinimum)
+		case s.exclusiveMaximum != nil && f >= *s.exclusiveMaximum:
+			return fail("%v must be less than %v", v, *s.exclusiveMaximum)
+		}
+		if s.multipleOf != nil {
+			if q := f / *s.multipleOf; math.Abs(q-math.Round(q)) > 1e-9 {
+				return fail("%v is not a multiple of %v", v, *s.multipleOf)
+			}
+		}
+	case string:
+		n := len([]rune(v))
+		if s.minLength != nil && n < *s.minLength {
+			return fail("shorter than %d characters", *s.minLength)
+		}
+		if s.maxLength != nil && n > *s.maxLength {
+			return fail("longer than %d characters", *s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			return fail("does not match %q", s.pattern.String())
+		}
+		switch s.format {
+		case "ipv4":
+			if a, err := netip.ParseAddr(v); err != nil || !a.Is4() {
+				return fail("%q is not an IPv4 address", v)
+			}
+		case "ipv6":
+			if a, err := netip.ParseAddr(v); err != nil || !a.Is6() {
+				return fail("%q is not an IPv6 address", v)
+			}
+		}
+	}
+
+	for _, sub := range s.allOf {
+		if err := sub.check(v, at); err != nil {
+			return err
+		}
+	}
+	if s.anyOf != nil {
+		ok := false
+		for _, sub := range s.anyOf {
+			if sub.check(v, at) == nil {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fail("matches none of anyOf")
+		}
+	}
+	if s.oneOf != nil {
+		matched := 0
+		for _, sub := range s.oneOf {
+			if sub.check(v, at) == nil {
+				matched++
+			}
+		}
+		if matched != 1 {
+			return fail("matches %d of oneOf, exactly 1 required", matched)
+		}
+	}
+	if s.not != nil && s.not.check(v, at) == nil {
+		return fail("matches a schema under not")
+	}
+	return nil
+}
+
+// jsonTypeOf names the JSON type of a decoded value; whole numbers are
+// "integer".
+func jsonTypeOf(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case json.Number:
+		if f, err := v.Float64(); err == nil && f == math.Trunc(f) {
+			return "integer"
+		}
+		return "number"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func hasJSONType(v interface{}, types []string) bool {
+	actual := jsonTypeOf(v)
+	for _, t := range types {
+		if t == actual || t == "number" && actual == "integer" {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonEqual compares decoded values, numbers by value.
+func jsonEqual(a, b interface{}) bool {
+	switch a := a.(type) {
+	case json.Number:
+		bn, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		af, _ := a.Float64()
+		bf, _ := bn.Float64()
+		return af == bf
+	case []interface{}:
+		bs, ok := b.([]interface{})
+		if !ok || len(a) != len(bs) {
+			return false
+		}
+		for i := range a {
+			if !jsonEqual(a[i], bs[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		bm, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(bm) {
+			return false
+		}
+		for k, v := range a {
+			if w, ok := bm[k]; !ok || !jsonEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
+
+// escapeJSONPointer escapes a property name for a JSON pointer (RFC 6901).
+func escapeJSONPointer(name string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(name)
+}
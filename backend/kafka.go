@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kafka wire protocol API keys and versions used by the producer.
+const (
+	kafkaAPIProduce  = 0
+	kafkaAPIMetadata = 3
+
+	kafkaProduceVersion  = 3
+	kafkaMetadataVersion = 0
+
+	kafkaClientID    = "traffic-backend"
+	kafkaDialTimeout = 5 * time.Second
+
+	// kafkaMaxResponse bounds a response frame; the producer only reads
+	// Metadata and Produce responses, which are far smaller.
+	kafkaMaxResponse = 16 << 20
+
+	// kafkaPartitionByKey, as KAFKA_PARTITION=key, spreads records over the
+	// topic's partitions by the murmur2 hash of their key.
+	kafkaPartitionByKey = -1
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// kafkaSink produces packets (or their summaries) to a topic using the Kafka
+// binary protocol directly: Metadata v0 to find the partition leaders and
+// Produce v3 with v2 record batches. Records go to KAFKA_PARTITION, or with
+// KAFKA_PARTITION=key to the partition the Java client's default partitioner
+// picks for their key.
+type kafkaSink struct {
+	brokers   []string
+	topic     string
+	partition int32
+	acks      int16
+	timeout   time.Duration
+	summaries bool
+
+	mu         sync.Mutex
+	partitions int32                 // partitions of the topic, from Metadata
+	leaders    map[int32]string      // partition leader addresses, from Metadata
+	conns      map[string]*kafkaConn // connections to leaders, by address
+}
+
+func initKafkaSink(cfg *Config) {
+	if cfg.KafkaBrokers == "" {
+		return
+	}
+
+	s := &kafkaSink{
+		brokers:   strings.Split(cfg.KafkaBrokers, ","),
+		topic:     cfg.KafkaTopic,
+		partition: int32(cfg.KafkaPartition),
+		acks:      int16(cfg.KafkaAcks),
+		timeout:   10 * time.Second,
+		summaries: cfg.KafkaPayload == "summary",
+	}
+	registerSink(s, cfg.KafkaBatchSize, cfg.KafkaBatchTimeout)
+}
+
+func (s *kafkaSink) Name() string { return "kafka" }
+func (s *kafkaSink) external()    {}
+
+// Write produces one record batch per partition. On failure the metadata and
+// connections are dropped and looked up again by the next Write; batches
+// already acknowledged are sent again when the sink retries.
+func (s *kafkaSink) Write(ctx context.Context, packets []Packet) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.produceAll(ctx, packets); err != nil {
+		for _, c := range s.conns {
+			c.Close()
+		}
+		s.conns = nil
+		s.leaders = nil
+		return err
+	}
+	return nil
+}
+
+func (s *kafkaSink) produceAll(ctx context.Context, packets []Packet) error {
+	if s.leaders == nil {
+		if err := s.lookupLeaders(ctx); err != nil {
+			return err
+		}
+	}
+
+	byPartition := make(map[int32][]Packet)
+	var order []int32
+	for _, p := range packets {
+		partition := s.partitionFor(viewKey(p))
+		if _, ok := byPartition[partition]; !ok {
+			order = append(order, partition)
+		}
+		byPartition[partition] = append(byPartition[partition], p)
+	}
+
+	for _, partition := range order {
+		batch, err := s.recordBatch(byPartition[partition], time.Now().UnixMilli())
+		if err != nil {
+			return err
+		}
+		c, err := s.leaderConn(ctx, partition)
+		if err != nil {
+			return err
+		}
+		if err := s.produce(c, partition, batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// partitionFor picks the partition of a record with this key. Keyed
+// partitioning matches the Java client: murmur2 of the key, made positive,
+// modulo the partition count.
+func (s *kafkaSink) partitionFor(key string) int32 {
+	if s.partition != kafkaPartitionByKey {
+		return s.partition
+	}
+	return int32(uint32(kafkaMurmur2([]byte(key)))&0x7fffffff) % s.partitions
+}
+
+// leaderConn returns the connection to the leader of partition, dialing it
+// if needed.
+func (s *kafkaSink) leaderConn(ctx context.Context, partition int32) (*kafkaConn, error) {
+	addr, ok := s.leaders[partition]
+	if !ok {
+		return nil, fmt.Errorf("no kafka leader for %s/%d", s.topic, partition)
+	}
+	if c := s.conns[addr]; c != nil {
+		return c, nil
+	}
+	dialer := net.Dialer{Timeout: kafkaDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &kafkaConn{Conn: conn, timeout: s.timeout + kafkaDialTimeout}
+	if s.conns == nil {
+		s.conns = make(map[string]*kafkaConn)
+	}
+	s.conns[addr] = c
+	return c, nil
+}
+
+// recordBatch encodes packets as a v2 (magic 2) record batch stamped now, in
+// Unix milliseconds.
+func (s *kafkaSink) recordBatch(packets []Packet, now int64) ([]byte, error) {
+	var records bytes.Buffer
+	for i, p := range packets {
+		var value interface{} = p
+		if s.summaries {
+			value = generateEdgeSummary(p)
+		}
+		payload, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		key := viewKey(p)
+
+		var rec []byte
+		rec = append(rec, 0)              // attributes
+		rec = binary.AppendVarint(rec, 0) // timestamp delta
+		rec = binary.AppendVarint(rec, int64(i))
+		rec = binary.AppendVarint(rec, int64(len(key)))
+		rec = append(rec, key...)
+		rec = binary.AppendVarint(rec, int64(len(payload)))
+		rec = append(rec, payload...)
+		rec = binary.AppendVarint(rec, 0) // headers
+
+		records.Write(binary.AppendVarint(nil, int64(len(rec))))
+		records.Write(rec)
+	}
+
+	// Everything after the CRC field is covered by the CRC.
+	var body kafkaEncoder
+	body.int16(0) // attributes: no compression
+	body.int32(int32(len(packets) - 1))
+	body.int64(now)
+	body.int64(now)
+	body.int64(-1) // producer id
+	body.int16(-1) // producer epoch
+	body.int32(-1) // base sequence
+	body.int32(int32(len(packets)))
+	body.buf.Write(records.Bytes())
+
+	var batch kafkaEncoder
+	batch.int64(0)                                 // base offset
+	batch.int32(int32(4 + 1 + 4 + body.buf.Len())) // batch length
+	batch.int32(-1)                                // partition leader epoch
+	batch.int8(2)                                  // magic
+	batch.int32(int32(crc32.Checksum(body.buf.Bytes(), crc32c)))
+	batch.buf.Write(body.buf.Bytes())
+	return batch.buf.Bytes(), nil
+}
+
+func (s *kafkaSink) produce(c *kafkaConn, partition int32, batch []byte) error {
+	if err := c.send(kafkaAPIProduce, kafkaProduceVersion, kafkaProduceRequest(s.topic, partition, s.acks, s.timeout, batch)); err != nil {
+		return err
+	}
+	if s.acks == 0 {
+		return nil
+	}
+	resp, err := c.receive()
+	if err != nil {
+		return err
+	}
+	return parseKafkaProduceResponse(resp, s.topic, partition)
+}
+
+// kafkaProduceRequest encodes a Produce v3 request body with one batch for
+// one partition.
+func kafkaProduceRequest(topic string, partition int32, acks int16, timeout time.Duration, batch []byte) []byte {
+	var req kafkaEncoder
+	req.int16(-1) // transactional id
+	req.int16(acks)
+	req.int32(int32(timeout.Milliseconds()))
+	req.int32(1)
+	req.string(topic)
+	req.int32(1)
+	req.int32(partition)
+	req.bytes(batch)
+	return req.buf.Bytes()
+}
+
+// parseKafkaProduceResponse returns the first partition error in a Produce
+// v3 response body.
+func parseKafkaProduceResponse(resp []byte, topic string, partition int32) error {
+	d := kafkaDecoder{buf: resp}
+	for topics := d.int32(); topics > 0 && d.err == nil; topics-- {
+		d.string()
+		for parts := d.int32(); parts > 0 && d.err == nil; parts-- {
+			d.int32()
+			if code := d.int16(); code != 0 && d.err == nil {
+				return fmt.Errorf("produce to %s/%d: kafka error code %d", topic, partition, code)
+			}
+			d.int64()
+			d.int64()
+		}
+	}
+	return d.err
+}
+
+// lookupLeaders asks the bootstrap brokers, in turn, for the topic's
+// partitions and their leaders.
+func (s *kafkaSink) lookupLeaders(ctx context.Context) error {
+	var lastErr error
+	for _, broker := range s.brokers {
+		broker = strings.TrimSpace(broker)
+		partitions, leaders, err := s.metadata(ctx, broker)
+		if err == nil && partitions == 0 {
+			err = fmt.Errorf("broker %s has no partitions for %s", broker, s.topic)
+		}
+		if _, ok := leaders[s.partition]; err == nil && s.partition != kafkaPartitionByKey && !ok {
+			err = fmt.Errorf("broker %s has no leader for %s/%d", broker, s.topic, s.partition)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		s.partitions, s.leaders = partitions, leaders
+		return nil
+	}
+	return fmt.Errorf("no kafka broker could resolve %s: %w", s.topic, lastErr)
+}
+
+func (s *kafkaSink) metadata(ctx context.Context, broker string) (int32, map[int32]string, error) {
+	dialer := net.Dialer{Timeout: kafkaDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", broker)
+	if err != nil {
+		return 0, nil, err
+	}
+	c := &kafkaConn{Conn: conn, timeout: s.timeout + kafkaDialTimeout}
+	defer c.Close()
+
+	var req kafkaEncoder
+	req.int32(1)
+	req.string(s.topic)
+	if err := c.send(kafkaAPIMetadata, kafkaMetadataVersion, req.buf.Bytes()); err != nil {
+		return 0, nil, err
+	}
+	resp, err := c.receive()
+	if err != nil {
+		return 0, nil, err
+	}
+	return parseKafkaMetadata(resp, s.topic)
+}
+
+// parseKafkaMetadata reads a Metadata v0 response body and returns how many
+// partitions topic has and the address of each partition's leader.
+// Partitions without a live leader are left out.
+func parseKafkaMetadata(resp []byte, topic string) (int32, map[int32]string, error) {
+	d := kafkaDecoder{buf: resp}
+	brokers := make(map[int32]string)
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		id := d.int32()
+		host := d.string()
+		port := d.int32()
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+
+	var partitions int32
+	leaders := make(map[int32]string)
+	for topics := d.int32(); topics > 0 && d.err == nil; topics-- {
+		topicErr := d.int16()
+		name := d.string()
+		for parts := d.int32(); parts > 0 && d.err == nil; parts-- {
+			d.int16()
+			partition := d.int32()
+			leader := d.int32()
+			for replicas := d.int32(); replicas > 0 && d.err == nil; replicas-- {
+				d.int32()
+			}
+			for isr := d.int32(); isr > 0 && d.err == nil; isr-- {
+				d.int32()
+			}
+			if name != topic || topicErr != 0 {
+				continue
+			}
+			partitions++
+			if addr, ok := brokers[leader]; ok {
+				leaders[partition] = addr
+			}
+		}
+	}
+	if d.err != nil {
+		return 0, nil, d.err
+	}
+	return partitions, leaders, nil
+}
+
+// kafkaConn is a connection to one broker with its own correlation IDs.
+type kafkaConn struct {
+	net.Conn
+	timeout       time.Duration
+	correlationID int32
+}
+
+// send writes one size-prefixed request with a v1 request header.
+func (c *kafkaConn) send(apiKey, apiVersion int16, body []byte) error {
+	c.correlationID++
+
+	var req kafkaEncoder
+	req.int16(apiKey)
+	req.int16(apiVersion)
+	req.int32(c.correlationID)
+	req.string(kafkaClientID)
+	req.buf.Write(body)
+
+	msg := binary.BigEndian.AppendUint32(nil, uint32(req.buf.Len()))
+	msg = append(msg, req.buf.Bytes()...)
+
+	_ = c.SetDeadline(time.Now().Add(c.timeout))
+	_, err := c.Write(msg)
+	return err
+}
+
+// receive reads one response and returns it without the correlation ID.
+func (c *kafkaConn) receive() ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(c, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > kafkaMaxResponse {
+		return nil, fmt.Errorf("kafka response of %d bytes exceeds %d", n, kafkaMaxResponse)
+	}
+	if n < 4 {
+		return nil, errors.New("short kafka response")
+	}
+	resp := make([]byte, n)
+	if _, err := io.ReadFull(c, resp); err != nil {
+		return nil, err
+	}
+	if id := int32(binary.BigEndian.Uint32(resp)); id != c.correlationID {
+		return nil, fmt.Errorf("kafka correlation id mismatch: got %d, want %d", id, c.correlationID)
+	}
+	return resp[4:], nil
+}
+
+// kafkaMurmur2 is the murmur2 hash the Java client partitions keys with.
+func kafkaMurmur2(data []byte) int32 {
+	const (
+		seed = 0x9747b28c
+		m    = 0x5bd1e995
+		r    = 24
+	)
+	h := uint32(seed) ^ uint32(len(data))
+	n := len(data) &^ 3
+	for i := 0; i < n; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+	switch len(data) & 3 {
+	case 3:
+		h ^= uint32(data[n+2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(data[n+1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(data[n])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
+
+// kafkaEncoder appends big-endian Kafka primitives.
+type kafkaEncoder struct {
+	buf bytes.Buffer
+}
+
+func (e *kafkaEncoder) int8(v int8)   { e.buf.WriteByte(byte(v)) }
+func (e *kafkaEncoder) int16(v int16) { e.buf.Write(binary.BigEndian.AppendUint16(nil, uint16(v))) }
+func (e *kafkaEncoder) int32(v int32) { e.buf.Write(binary.BigEndian.AppendUint32(nil, uint32(v))) }
+func (e *kafkaEncoder) int64(v int64) { e.buf.Write(binary.BigEndian.AppendUint64(nil, uint64(v))) }
+
+func (e *kafkaEncoder) string(v string) {
+	e.int16(int16(len(v)))
+	e.buf.WriteString(v)
+}
+
+func (e *kafkaEncoder) bytes(v []byte) {
+	e.int32(int32(len(v)))
+	e.buf.Write(v)
+}
+
+// kafkaDecoder reads big-endian Kafka primitives; the first error sticks.
+type kafkaDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *kafkaDecoder) take(n int) []byte {
+	if d.err != nil {
+		return make([]byte, n)
+	}
+	if n < 0 || len(d.buf) < n {
+		d.err = errors.New("truncated kafka response")
+		return make([]byte, max(n, 0))
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *kafkaDecoder) int16() int16 { return int16(binary.BigEndian.Uint16(d.take(2))) }
+func (d *kafkaDecoder) int32() int32 { return int32(binary.BigEndian.Uint32(d.take(4))) }
+func (d *kafkaDecoder) int64() int64 { return int64(binary.BigEndian.Uint64(d.take(8))) }
+
+func (d *kafkaDecoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.take(int(n)))
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestKafkaMurmur2 checks the hash against the Java client's test vectors,
+// so keyed records land on the partition a Java producer would pick.
+func TestKafkaMurmur2(t *testing.T) {
+	for key, want := range map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	} {
+		if got := kafkaMurmur2([]byte(key)); got != want {
+			t.Errorf("murmur2(%q) = %d, want %d", key, got, want)
+		}
+	}
+}
+
+func TestKafkaProduceRequest(t *testing.T) {
+	got := kafkaProduceRequest("t", 2, 1, 1500*time.Millisecond, []byte{0xaa, 0xbb})
+	want := []byte{
+		0xff, 0xff, // transactional id: null
+		0x00, 0x01, // acks
+		0x00, 0x00, 0x05, 0xdc, // timeout: 1500ms
+		0x00, 0x00, 0x00, 0x01, // topics
+		0x00, 0x01, 't',
+		0x00, 0x00, 0x00, 0x01, // partitions
+		0x00, 0x00, 0x00, 0x02, // partition
+		0x00, 0x00, 0x00, 0x02, 0xaa, 0xbb, // record batch
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("produce request\n got % x\nwant % x", got, want)
+	}
+}
+
+func TestParseKafkaProduceResponse(t *testing.T) {
+	resp := []byte{
+		0x00, 0x00, 0x00, 0x01, // topics
+		0x00, 0x01, 't',
+		0x00, 0x00, 0x00, 0x01, // partitions
+		0x00, 0x00, 0x00, 0x02, // partition
+		0x00, 0x06, // error: NOT_LEADER_FOR_PARTITION
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // base offset
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // log append time
+		0x00, 0x00, 0x00, 0x00, // throttle time
+	}
+	if err := parseKafkaProduceResponse(resp, "t", 2); err == nil {
+		t.Fatal("error code 6 was not reported")
+	}
+	resp[16] = 0
+	if err := parseKafkaProduceResponse(resp, "t", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := parseKafkaProduceResponse(resp[:20], "t", 2); err == nil {
+		t.Fatal("a truncated response was accepted")
+	}
+}
+
+func TestParseKafkaMetadata(t *testing.T) {
+	resp := []byte{
+		0x00, 0x00, 0x00, 0x02, // brokers
+		0x00, 0x00, 0x00, 0x01, 0x00, 0x02, 'k', '1', 0x00, 0x00, 0x23, 0x84, // 1 k1:9092
+		0x00, 0x00, 0x00, 0x02, 0x00, 0x02, 'k', '2', 0x00, 0x00, 0x23, 0x85, // 2 k2:9093
+		0x00, 0x00, 0x00, 0x02, // topics
+		0x00, 0x00, 0x00, 0x05, 'o', 't', 'h', 'e', 'r', // other topic
+		0x00, 0x00, 0x00, 0x01,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x01, 't', // topic t
+		0x00, 0x00, 0x00, 0x03, // partitions
+		// partition 0, leader 1, replicas [1], isr [1]
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+		0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01,
+		// partition 1, leader 2, replicas [2], isr [2]
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x02,
+		0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x02,
+		// partition 2, LEADER_NOT_AVAILABLE, leader -1
+		0x00, 0x05, 0x00, 0x00, 0x00, 0x02, 0xff, 0xff, 0xff, 0xff,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	}
+	partitions, leaders, err := parseKafkaMetadata(resp, "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if partitions != 3 || len(leaders) != 2 || leaders[0] != "k1:9092" || leaders[1] != "k2:9093" {
+		t.Fatalf("got %d partitions with leaders %v, want 3 with 0=k1:9092 1=k2:9093", partitions, leaders)
+	}
+	if _, _, err := parseKafkaMetadata(resp[:len(resp)-3], "t"); err == nil {
+		t.Fatal("a truncated response was accepted")
+	}
+}
+
+// testRecord is one record decoded from a v2 record batch.
+type testRecord struct {
+	offsetDelta int64
+	key, value  string
+}
+
+// decodeTestBatch decodes a v2 record batch as the broker would, checking
+// the header and CRC.
+func decodeTestBatch(t *testing.T, batch []byte) (now int64, records []testRecord) {
+	t.Helper()
+	d := kafkaDecoder{buf: batch}
+	if base := d.int64(); base != 0 {
+		t.Fatalf("base offset %d", base)
+	}
+	if n := d.int32(); int(n) != len(d.buf) {
+		t.Fatalf("batch length %d, %d bytes follow", n, len(d.buf))
+	}
+	if epoch := d.int32(); epoch != -1 {
+		t.Fatalf("partition leader epoch %d", epoch)
+	}
+	if magic := d.take(1)[0]; magic != 2 {
+		t.Fatalf("magic %d", magic)
+	}
+	if crc := uint32(d.int32()); crc != crc32.Checksum(d.buf, crc32c) {
+		t.Fatalf("crc %08x does not match the batch", crc)
+	}
+	if attrs := d.int16(); attrs != 0 {
+		t.Fatalf("attributes %d", attrs)
+	}
+	lastOffsetDelta := d.int32()
+	now = d.int64()
+	if maxTs := d.int64(); maxTs != now {
+		t.Fatalf("max timestamp %d, first %d", maxTs, now)
+	}
+	if id, epoch, seq := d.int64(), d.int16(), d.int32(); id != -1 || epoch != -1 || seq != -1 {
+		t.Fatalf("producer %d/%d/%d, want -1/-1/-1", id, epoch, seq)
+	}
+	count := d.int32()
+	if d.err != nil {
+		t.Fatal(d.err)
+	}
+	if count != lastOffsetDelta+1 {
+		t.Fatalf("%d records with last offset delta %d", count, lastOffsetDelta)
+	}
+
+	varint := func() int64 {
+		v, n := binary.Varint(d.buf)
+		if n <= 0 {
+			t.Fatal("bad varint")
+		}
+		d.buf = d.buf[n:]
+		return v
+	}
+	for i := int32(0); i < count; i++ {
+		size := varint()
+		rest := len(d.buf)
+		if attrs := d.take(1)[0]; attrs != 0 {
+			t.Fatalf("record attributes %d", attrs)
+		}
+		if delta := varint(); delta != 0 {
+			t.Fatalf("timestamp delta %d", delta)
+		}
+		var r testRecord
+		r.offsetDelta = varint()
+		r.key = string(d.take(int(varint())))
+		r.value = string(d.take(int(varint())))
+		if headers := varint(); headers != 0 {
+			t.Fatalf("%d headers", headers)
+		}
+		if int64(rest-len(d.buf)) != size {
+			t.Fatalf("record length %d, read %d", size, rest-len(d.buf))
+		}
+		records = append(records, r)
+	}
+	if d.err != nil || len(d.buf) != 0 {
+		t.Fatalf("%d trailing bytes (%v)", len(d.buf), d.err)
+	}
+	return now, records
+}
+
+func TestKafkaRecordBatch(t *testing.T) {
+	packets := []Packet{
+		testPacket("10.0.0.1", "10.0.0.2", 100, 1, 10),
+		testPacket("10.0.0.3", "10.0.0.4", 101, 2, 20),
+	}
+	s := &kafkaSink{}
+	batch, err := s.recordBatch(packets, 1700000000123)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The fixed header up to the CRC.
+	wantHead := []byte{
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // base offset
+		0x00, 0x00, byte((len(batch) - 12) >> 8), byte(len(batch) - 12), // batch length
+		0xff, 0xff, 0xff, 0xff, // partition leader epoch
+		0x02, // magic
+	}
+	if !bytes.Equal(batch[:17], wantHead) {
+		t.Fatalf("batch header\n got % x\nwant % x", batch[:17], wantHead)
+	}
+
+	now, records := decodeTestBatch(t, batch)
+	if now != 1700000000123 {
+		t.Errorf("batch timestamp %d", now)
+	}
+	if len(records) != 2 {
+		t.Fatalf("%d records, want 2", len(records))
+	}
+	for i, r := range records {
+		var p Packet
+		if err := json.Unmarshal([]byte(r.value), &p); err != nil {
+			t.Fatal(err)
+		}
+		if r.offsetDelta != int64(i) || r.key != viewKey(packets[i]) || p.Src != packets[i].Src || p.Timestamp != packets[i].Timestamp {
+			t.Errorf("record %d: delta %d key %q packet %+v", i, r.offsetDelta, r.key, p)
+		}
+	}
+}
+
+// fakeKafkaBroker answers Metadata v0 with itself leading every partition of
+// the topic, and records the keys each Produce v3 request carries.
+type fakeKafkaBroker struct {
+	t          *testing.T
+	l          net.Listener
+	partitions int32
+
+	mu       sync.Mutex
+	produced map[int32][]string
+}
+
+func newFakeKafkaBroker(t *testing.T, partitions int32) *fakeKafkaBroker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeKafkaBroker{t: t, l: l, partitions: partitions, produced: make(map[int32][]string)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return b
+}
+
+func (b *fakeKafkaBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		req := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return
+		}
+		d := kafkaDecoder{buf: req}
+		apiKey, version, id := d.int16(), d.int16(), d.int32()
+		if client := d.string(); client != kafkaClientID {
+			b.t.Errorf("client id %q", client)
+		}
+
+		var resp kafkaEncoder
+		resp.int32(id)
+		switch {
+		case apiKey == kafkaAPIMetadata && version == kafkaMetadataVersion:
+			host, port, _ := net.SplitHostPort(b.l.Addr().String())
+			n, _ := strconv.Atoi(port)
+			resp.int32(1)
+			resp.int32(7)
+			resp.string(host)
+			resp.int32(int32(n))
+			resp.int32(1)
+			resp.int16(0)
+			resp.string("t")
+			resp.int32(b.partitions)
+			for p := int32(0); p < b.partitions; p++ {
+				resp.int16(0)
+				resp.int32(p)
+				resp.int32(7)
+				resp.int32(0)
+				resp.int32(0)
+			}
+		case apiKey == kafkaAPIProduce && version == kafkaProduceVersion:
+			d.int16() // transactional id
+			d.int16() // acks
+			d.int32() // timeout
+			d.int32() // topics
+			topic := d.string()
+			d.int32() // partitions
+			partition := d.int32()
+			batch := d.take(int(d.int32()))
+			if d.err != nil {
+				b.t.Errorf("produce request: %v", d.err)
+				return
+			}
+			_, records := decodeTestBatch(b.t, batch)
+			b.mu.Lock()
+			for _, r := range records {
+				b.produced[partition] = append(b.produced[partition], r.key)
+			}
+			b.mu.Unlock()
+
+			resp.int32(1)
+			resp.string(topic)
+			resp.int32(1)
+			resp.int32(partition)
+			resp.int16(0)
+			resp.int64(0)
+			resp.int64(-1)
+			resp.int32(0)
+		default:
+			b.t.Errorf("unexpected request: api %d v%d", apiKey, version)
+			return
+		}
+		frame := binary.BigEndian.AppendUint32(nil, uint32(resp.buf.Len()))
+		if _, err := conn.Write(append(frame, resp.buf.Bytes()...)); err != nil {
+			return
+		}
+	}
+}
+
+func TestKafkaSinkPartitionsByKey(t *testing.T) {
+	b := newFakeKafkaBroker(t, 3)
+	s := &kafkaSink{
+		brokers:   []string{b.l.Addr().String()},
+		topic:     "t",
+		partition: kafkaPartitionByKey,
+		acks:      1,
+		timeout:   time.Second,
+	}
+	defer func() {
+		for _, c := range s.conns {
+			c.Close()
+		}
+	}()
+
+	var packets []Packet
+	for i := 1; i <= 12; i++ {
+		packets = append(packets, testPacket("10.0.0."+strconv.Itoa(i), "10.0.1.1", 100, 1, i))
+	}
+	if err := s.Write(context.Background(), packets); err != nil {
+		t.Fatal(err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	total := 0
+	for partition, keys := range b.produced {
+		for _, key := range keys {
+			if want := int32(uint32(kafkaMurmur2([]byte(key)))&0x7fffffff) % 3; partition != want {
+				t.Errorf("%s went to partition %d, want %d", key, partition, want)
+			}
+		}
+		total += len(keys)
+	}
+	if total != len(packets) || len(b.produced) < 2 {
+		t.Fatalf("produced %v, want %d records over several partitions", b.produced, len(packets))
+	}
+}
+
+func TestKafkaSinkFixedPartition(t *testing.T) {
+	b := newFakeKafkaBroker(t, 3)
+	s := &kafkaSink{brokers: []string{b.l.Addr().String()}, topic: "t", partition: 2, acks: 1, timeout: time.Second}
+	defer func() {
+		for _, c := range s.conns {
+			c.Close()
+		}
+	}()
+	packets := []Packet{testPacket("10.0.0.1", "10.0.0.2", 100, 1, 1), testPacket("10.0.0.3", "10.0.0.4", 100, 1, 1)}
+	if err := s.Write(context.Background(), packets); err != nil {
+		t.Fatal(err)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.produced) != 1 || len(b.produced[2]) != 2 {
+		t.Fatalf("produced %v, want both records on partition 2", b.produced)
+	}
+
+	s.partition = 5
+	s.leaders = nil
+	if err := s.lookupLeaders(context.Background()); err == nil {
+		t.Fatal("a partition the topic lacks was accepted")
+	}
+}
+
+func TestKafkaReceiveRejectsOversizedFrame(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go server.Write([]byte{0xff, 0xff, 0xff, 0xff})
+
+	c := &kafkaConn{Conn: client, timeout: time.Second}
+	if _, err := c.receive(); err == nil {
+		t.Fatal("a 4 GiB response frame was accepted")
+	}
+}
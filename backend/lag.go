@@ -0,0 +1,116 @@
+package main
+
+import "time"
+
+// lagWindow is the span ingest lag and broadcast queue occupancy are
+// summarized over, the same as the rates in /latest/summary.
+const lagWindow = summaryRateWindow
+
+// lagBucket holds one second of ingest lag and broadcast queue samples.
+type lagBucket struct {
+	sec int64
+
+	// packets fresh packets arrived lagSum seconds behind their timestamps
+	// in total, lagMax at most.
+	packets int64
+	lagSum  float64
+	lagMax  float64
+
+	// queueSamples lengths of the broadcast channel were taken, after each
+	// publish; queuePeak is the longest.
+	queueSamples int64
+	queueSum     int64
+	queuePeak    int
+}
+
+// lagBucketAt returns the bucket of second sec, emptied if it held an older
+// second. The caller holds lagMu.
+func (s *Server) lagBucketAt(sec int64) *lagBucket {
+	b := &s.lag[sec%int64(len(s.lag))]
+	if b.sec != sec {
+		*b = lagBucket{sec: sec}
+	}
+	return b
+}
+
+// observeLag records how far behind their timestamps fresh packets are
+// processed. Timestamps are whole seconds, and so is the lag; packets from
+// the future count as no lag.
+func (s *Server) observeLag(packets []Packet) {
+	if len(packets) == 0 {
+		return
+	}
+	now := time.Now()
+
+	s.lagMu.Lock()
+	defer s.lagMu.Unlock()
+	b := s.lagBucketAt(now.Unix())
+	for _, p := range packets {
+		lag := max(now.Sub(time.Unix(int64(p.Timestamp), 0)).Seconds(), 0)
+		b.packets++
+		b.lagSum += lag
+		b.lagMax = max(b.lagMax, lag)
+	}
+}
+
+// observeQueue records the broadcast channel's length after a publish.
+func (s *Server) observeQueue(n int) {
+	s.lagMu.Lock()
+	defer s.lagMu.Unlock()
+	b := s.lagBucketAt(time.Now().Unix())
+	b.queueSamples++
+	b.queueSum += int64(n)
+	b.queuePeak = max(b.queuePeak, n)
+}
+
+// ingestLag is the ingest lag over lagWindow; Mean and Max are nil without
+// fresh packets in it.
+type ingestLag struct {
+	Window  string   `json:"window"`
+	Packets int64    `json:"packets"`
+	Mean    *float64 `json:"mean_seconds"`
+	Max     *float64 `json:"max_seconds"`
+}
+
+// queueOccupancy describes the broadcast channel: its length now, and its
+// average and peak length after the publishes in lagWindow.
+type queueOccupancy struct {
+	Window   string  `json:"window"`
+	Length   int     `json:"length"`
+	Capacity int     `json:"capacity"`
+	Average  float64 `json:"average"`
+	Peak     int     `json:"peak"`
+}
+
+// lagStats sums the complete seconds of lagWindow and the current one.
+func (s *Server) lagStats() (ingestLag, queueOccupancy) {
+	now := time.Now().Unix()
+	lag := ingestLag{Window: lagWindow.String()}
+	queue := queueOccupancy{Window: lagWindow.String(), Length: len(s.broadcast), Capacity: cap(s.broadcast)}
+
+	s.lagMu.Lock()
+	var lagSum, lagMax float64
+	var samples, queueSum int64
+	for sec := now - int64(lagWindow/time.Second); sec <= now; sec++ {
+		b := &s.lag[sec%int64(len(s.lag))]
+		if b.sec != sec {
+			continue
+		}
+		lag.Packets += b.packets
+		lagSum += b.lagSum
+		lagMax = max(lagMax, b.lagMax)
+		samples += b.queueSamples
+		queueSum += b.queueSum
+		queue.Peak = max(queue.Peak, b.queuePeak)
+	}
+	s.lagMu.Unlock()
+
+	if lag.Packets > 0 {
+		mean := lagSum / float64(lag.Packets)
+		lag.Mean, lag.Max = &mean, &lagMax
+	}
+	if samples > 0 {
+		queue.Average = float64(queueSum) / float64(samples)
+	}
+	return lag, queue
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencyBounds are the upper bounds, in milliseconds, of latency
+// histograms; a last bucket holds the rest.
+var latencyBounds = [...]float64{0.1, 0.25, 0.5, 1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000}
+
+// latencyHistogram counts durations by latencyBounds.
+type latencyHistogram [len(latencyBounds) + 1]int64
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	ms := float64(d) / float64(time.Millisecond)
+	i := 0
+	for i < len(latencyBounds) && ms > latencyBounds[i] {
+		i++
+	}
+	h[i]++
+}
+
+func (h *latencyHistogram) add(o *latencyHistogram) {
+	for i := range h {
+		h[i] += o[i]
+	}
+}
+
+// quantile estimates quantile q in milliseconds, interpolating within the
+// bucket it falls in like PromQL's histogram_quantile. Durations over the
+// last bound report that bound. It returns nil for an empty histogram.
+func (h *latencyHistogram) quantile(q float64) *float64 {
+	var total int64
+	for _, n := range h {
+		total += n
+	}
+	if total == 0 {
+		return nil
+	}
+	rank := q * float64(total)
+	var seen int64
+	for i, n := range h[:len(latencyBounds)] {
+		if float64(seen+n) >= rank {
+			lower := 0.0
+			if i > 0 {
+				lower = latencyBounds[i-1]
+			}
+			v := lower + (latencyBounds[i]-lower)*(rank-float64(seen))/float64(n)
+			return &v
+		}
+		seen += n
+	}
+	v := latencyBounds[len(latencyBounds)-1]
+	return &v
+}
+
+// latencyRecentWindow is the span latency percentiles are computed over.
+const latencyRecentWindow = 5 * time.Minute
+
+// latencyRecorder keeps the latencies of one route or operation: totals
+// since startup, and per-minute histograms for the last
+// latencyRecentWindow.
+type latencyRecorder struct {
+	count   int64
+	sum     time.Duration
+	minutes [int(latencyRecentWindow/time.Minute) + 1]struct {
+		min int64
+		h   latencyHistogram
+	}
+}
+
+func (r *latencyRecorder) observe(d time.Duration) {
+	r.count++
+	r.sum += d
+	m := time.Now().Unix() / 60
+	b := &r.minutes[m%int64(len(r.minutes))]
+	if b.min != m {
+		b.min, b.h = m, latencyHistogram{}
+	}
+	b.h.observe(d)
+}
+
+// latencySummary describes a recorder for /stats and /metrics. Percentiles
+// are over latencyRecentWindow and null without samples in it.
+type latencySummary struct {
+	Count  int64    `json:"count"`
+	SumSec float64  `json:"sum_seconds"`
+	P50    *float64 `json:"p50_ms"`
+	P95    *float64 `json:"p95_ms"`
+	P99    *float64 `json:"p99_ms"`
+}
+
+func (r *latencyRecorder) summary() latencySummary {
+	now := time.Now().Unix() / 60
+	var h latencyHistogram
+	for m := now - int64(latencyRecentWindow/time.Minute) + 1; m <= now; m++ {
+		if b := &r.minutes[m%int64(len(r.minutes))]; b.min == m {
+			h.add(&b.h)
+		}
+	}
+	return latencySummary{
+		Count:  r.count,
+		SumSec: r.sum.Seconds(),
+		P50:    h.quantile(0.5),
+		P95:    h.quantile(0.95),
+		P99:    h.quantile(0.99),
+	}
+}
+
+// untimedRoutes hold a connection open for as long as the client wants, so
+// their duration says nothing about how fast the server is.
+var untimedRoutes = map[string]bool{"/ws": true, "/replay": true, "/stream": true, "/latest/wait": true}
+
+var (
+	// routeLatency records answered requests by route pattern; wsWriteLatency
+	// records each WebSocket write (a batch is one write).
+	routeLatency   = map[string]*latencyRecorder{}
+	wsWriteLatency latencyRecorder
+	latencyMu      sync.Mutex
+)
+
+// observeRouteLatency records how long a request to route took, unless the
+// route is untimed or the request became a WebSocket.
+func observeRouteLatency(route string, status int, d time.Duration) {
+	if route == "" || untimedRoutes[route] || status == http.StatusSwitchingProtocols {
+		return
+	}
+	latencyMu.Lock()
+	defer latencyMu.Unlock()
+	r := routeLatency[route]
+	if r == nil {
+		r = &latencyRecorder{}
+		routeLatency[route] = r
+	}
+	r.observe(d)
+}
+
+func observeWSWrite(d time.Duration) {
+	latencyMu.Lock()
+	wsWriteLatency.observe(d)
+	latencyMu.Unlock()
+}
+
+// routeLatencies returns the summary of every timed route, in route order.
+func routeLatencies() ([]string, []latencySummary) {
+	latencyMu.Lock()
+	defer latencyMu.Unlock()
+	routes := make([]string, 0, len(routeLatency))
+	for route := range routeLatency {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	summaries := make([]latencySummary, len(routes))
+	for i, route := range routes {
+		summaries[i] = routeLatency[route].summary()
+	}
+	return routes, summaries
+}
+
+func wsWriteLatencies() latencySummary {
+	latencyMu.Lock()
+	defer latencyMu.Unlock()
+	return wsWriteLatency.summary()
+}
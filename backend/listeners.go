@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Route groups a listener can serve. Routes without a group (/, /healthz,
+// /readyz) are served on every listener, and to every client, so probes work
+// anywhere.
+const (
+	routesData    = "data"
+	routesMetrics = "metrics"
+	routesIngest  = "ingest"
+	routesAdmin   = "admin"
+)
+
+var allRouteGroups = []string{routesData, routesMetrics, routesIngest, routesAdmin}
+
+// Listener auth modes. token applies ADMIN_TOKEN to admin routes and
+// INGEST_TOKEN (or tenant tokens) to ingest as usual; none trusts every
+// caller, for loopback or unix socket listeners; admin requires ADMIN_TOKEN
+// on every grouped route.
+const (
+	authToken = "token"
+	authNone  = "none"
+	authAdmin = "admin"
+)
+
+// route is an HTTP route in its group, registered without middleware:
+// listeners wrap it according to the group and their auth mode.
+type route struct {
+	group   string
+	pattern string
+	handler http.HandlerFunc
+}
+
+var routes []route
+
+// addRoute registers an HTTP route for the listeners that serve group.
+func addRoute(group, pattern string, handler http.HandlerFunc) {
+	routes = append(routes, route{group, pattern, handler})
+}
+
+// listenerSpec is one LISTENERS entry.
+type listenerSpec struct {
+	addr   string
+	groups []string
+	auth   string
+}
+
+// listeners are the HTTP listeners to open; set once by initListeners.
+var listeners []listenerSpec
+
+// initListeners parses LISTENERS, or serves every route on SERVER_PORT when
+// it is not set.
+func initListeners(cfg *Config) error {
+	if strings.TrimSpace(cfg.Listeners) == "" {
+		listeners = []listenerSpec{{addr: cfg.ServerPort, groups: allRouteGroups, auth: authToken}}
+		return nil
+	}
+	specs, err := parseListeners(cfg.Listeners)
+	if err != nil {
+		return err
+	}
+	listeners = specs
+	return nil
+}
+
+// parseListeners reads ';'-separated listeners of space-separated key=value
+// settings: addr (required; as SERVER_PORT), routes (comma-separated groups
+// or "all"; default all), and auth (token, none, or admin; default token).
+//
+//	addr=:8080 routes=data,ingest; addr=127.0.0.1:9090 routes=admin,metrics auth=none
+func parseListeners(s string) ([]listenerSpec, error) {
+	var specs []listenerSpec
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(s, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		spec := listenerSpec{groups: allRouteGroups, auth: authToken}
+		for _, kv := range strings.Fields(entry) {
+			k, v, ok := strings.Cut(kv, "=")
+			if !ok || v == "" {
+				return nil, fmt.Errorf("listener setting %q is not key=value", kv)
+			}
+			switch k {
+			case "addr":
+				spec.addr = v
+			case "routes":
+				if v == "all" {
+					spec.groups = allRouteGroups
+					continue
+				}
+				spec.groups = nil
+				for _, g := range strings.Split(v, ",") {
+					if !slices.Contains(allRouteGroups, g) {
+						return nil, fmt.Errorf("unknown route group %q (use %s, or all)", g, strings.Join(allRouteGroups, ", "))
+					}
+					spec.groups = append(spec.groups, g)
+				}
+			case "auth":
+				if v != authToken && v != authNone && v != authAdmin {
+					return nil, fmt.Errorf("unknown auth mode %q (use token, none, or admin)", v)
+				}
+				spec.auth = v
+			default:
+				return nil, fmt.Errorf("unknown listener setting %q", k)
+			}
+		}
+		if spec.addr == "" {
+			return nil, fmt.Errorf("listener %q has no addr", strings.TrimSpace(entry))
+		}
+		if seen[spec.addr] {
+			return nil, fmt.Errorf("duplicate listener addr %q", spec.addr)
+		}
+		seen[spec.addr] = true
+		specs = append(specs, spec)
+	}
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("no listeners")
+	}
+	return specs, nil
+}
+
+// mux builds l's handler from the routes of its groups, each wrapped in the
+// middleware for its group and the listener's auth mode.
+func (s *Server) mux(l listenerSpec) *http.ServeMux {
+	mux := http.NewServeMux()
+	for _, rt := range routes {
+		if rt.group != "" && !slices.Contains(l.groups, rt.group) {
+			// Without this the catch-all "/" would answer.
+			mux.HandleFunc(rt.pattern, handleNotFound)
+			continue
+		}
+		mux.HandleFunc(rt.pattern, chain(rt.handler, s.middleware(l, rt.group)...))
+	}
+	return mux
+}
+
+// private reports whether only local processes can reach the listener.
+func (l listenerSpec) private() bool {
+	if strings.HasPrefix(l.addr, "unix://") {
+		return true
+	}
+	host, _, err := net.SplitHostPort(l.addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return host == "localhost" || ip != nil && ip.IsLoopback()
+}
+
+// serveListeners opens every listener, then serves them until one fails or
+// a SIGTERM has drained them. Requests run under ctx; stop cancels it when
+// the drain is over.
+func (s *Server) serveListeners(ctx context.Context, stop context.CancelFunc) error {
+	lns := make([]net.Listener, 0, len(listeners))
+	for _, l := range listeners {
+		ln, err := listenHTTP(s.config, l.addr)
+		if err != nil {
+			for _, open := range lns {
+				open.Close()
+			}
+			return fmt.Errorf("listen on %s: %w", l.addr, err)
+		}
+		lns = append(lns, ln)
+	}
+
+	servers := make([]*http.Server, len(listeners))
+	for i, l := range listeners {
+		servers[i] = newHTTPServer(ctx, s.config, s.mux(l))
+	}
+	s.drain.setServers(servers)
+	stopped := s.shutdownOnSIGTERM(stop)
+
+	errs := make(chan error, len(listeners))
+	for i, l := range listeners {
+		if len(listeners) > 1 {
+			infoLog("Listening on %s (routes: %s, auth: %s)", l.addr, strings.Join(l.groups, ","), l.auth)
+		}
+		if l.auth == authNone && !l.private() && (slices.Contains(l.groups, routesAdmin) || slices.Contains(l.groups, routesIngest)) {
+			errorLog("Listener %s serves admin or ingest routes without auth and is not loopback or a unix socket", l.addr)
+		}
+		go func(ln net.Listener, hs *http.Server) {
+			errs <- hs.Serve(ln)
+		}(lns[i], servers[i])
+	}
+	if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	<-stopped
+	return nil
+}
+
+// newHTTPServer returns a server for handler with the HTTP_* timeouts and
+// header limit, so a client that sends or reads slowly cannot hold a
+// connection open for free. Requests run under ctx.
+func newHTTPServer(ctx context.Context, cfg *Config, handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+		ReadHeaderTimeout: cfg.HTTPReadHeaderTimeout,
+		ReadTimeout:       cfg.HTTPReadTimeout,
+		WriteTimeout:      cfg.HTTPWriteTimeout,
+		IdleTimeout:       cfg.HTTPIdleTimeout,
+		MaxHeaderBytes:    cfg.HTTPMaxHeaderBytes,
+	}
+}
+
+// holdOpen lets a response outlive HTTP_READ_TIMEOUT and HTTP_WRITE_TIMEOUT:
+// it lifts the read deadline, which would otherwise cancel the request
+// context once it passed, and gives the response another HTTP_WRITE_TIMEOUT.
+// Streams call it before each write, so only a client that stops reading is
+// cut off.
+func holdOpen(cfg *Config, w http.ResponseWriter) {
+	rc := http.NewResponseController(w)
+	_ = rc.SetReadDeadline(time.Time{})
+	_ = rc.SetWriteDeadline(time.Now().Add(cfg.HTTPWriteTimeout))
+}
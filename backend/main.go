@@ -2,7 +2,7 @@ package main
 
 import (
 	"context"
-	"net/http"
+	"strings"
 
 	"github.com/redis/go-redis/v9"
 )
@@ -10,34 +10,197 @@ import (
 // main initializes the application: connects to Redis, starts the polling goroutine,
 // and launches the HTTP server with WebSocket support.
 func main() {
-	initConfig()
+	cfg := loadConfig()
+	debugLogging = cfg.Debug
+	if err := initTenants(cfg); err != nil {
+		errorLog("Invalid TENANTS: %v", err)
+		return
+	}
+	if err := initQoS(cfg); err != nil {
+		errorLog("Invalid QoS settings: %v", err)
+		return
+	}
+	if err := initListeners(cfg); err != nil {
+		errorLog("Invalid LISTENERS: %v", err)
+		return
+	}
+	if err := initTrustedProxies(cfg); err != nil {
+		errorLog("Invalid TRUSTED_PROXIES: %v", err)
+		return
+	}
+	if err := initAccessLists(cfg); err != nil {
+		errorLog("Invalid access lists: %v", err)
+		return
+	}
+	if err := cfg.checkKeyLayout(); err != nil {
+		errorLog("Invalid key layout: %v", err)
+		return
+	}
+	if err := initGlobalFilter(cfg); err != nil {
+		errorLog("Invalid FILTER: %v", err)
+		return
+	}
+	if err := initDropRules(cfg); err != nil {
+		errorLog("Invalid DROP_RULES: %v", err)
+		return
+	}
+	if err := initTransforms(cfg); err != nil {
+		errorLog("Invalid TRANSFORMS: %v", err)
+		return
+	}
+	if err := initAnonymize(cfg); err != nil {
+		errorLog("Invalid ANONYMIZE_IPS: %v", err)
+		return
+	}
+	if err := initPacketSchema(cfg); err != nil {
+		errorLog("Invalid PACKET_SCHEMA_FILE: %v", err)
+		return
+	}
+	if err := initSampling(cfg); err != nil {
+		errorLog("Invalid SAMPLE_PROBABILITY: %v", err)
+		return
+	}
+	initCORS(cfg)
+	if err := initAPIVersions(cfg); err != nil {
+		errorLog("Invalid API_VERSIONS: %v", err)
+		return
+	}
+	if err := initProcessors(cfg); err != nil {
+		errorLog("Invalid PROCESSORS: %v", err)
+		return
+	}
+	initSLO(cfg)
+	initRedisBreaker(cfg)
+	s := newServer(cfg)
 
-	ctx := context.Background()
+	// ctx is the server's lifetime: it is cancelled once a SIGTERM has
+	// drained the server, which stops the pollers and inputs and ends the
+	// requests and WebSocket sessions still open.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	initDecoders(ctx, cfg)
 
+	// Nothing below waits for Redis; startRedis connects in the background.
 	rdb := redis.NewClient(&redis.Options{
-		Addr:     config.RedisAddr,
+		Addr:     cfg.RedisAddr,
 		Password: "",
-		DB:       config.RedisDB,
-		Protocol: 2,
+		DB:       cfg.RedisDB,
+		Protocol: cfg.RedisProtocol,
 	})
 
-	if err := rdb.Ping(ctx).Err(); err != nil {
-		errorLog("Failed to connect to Redis at %s: %v", config.RedisAddr, err)
-	} else {
-		infoLog("Connected to Redis at %s (db=%d)", config.RedisAddr, config.RedisDB)
+	if err := s.initStateFile(); err != nil {
+		errorLog("Failed to restore STATE_FILE: %v", err)
+		return
+	}
+
+	initNATSBridge(ctx, cfg)
+	if err := s.initJournal(ctx); err != nil {
+		errorLog("Invalid JOURNAL_DIR: %v", err)
+		return
+	}
+	initKafkaSink(cfg)
+	initRelaySink(cfg)
+	initPostgresSink(cfg)
+	initParquetSink(ctx, cfg)
+	initClickHouseSink(cfg)
+	initOpenSearchSink(cfg)
+	initRollups(ctx, cfg, rdb)
+	if err := initGeoIP(cfg, rdb); err != nil {
+		errorLog("Invalid GEOIP_FILE: %v", err)
+		return
+	}
+	if err := initReports(ctx, cfg, rdb); err != nil {
+		errorLog("Invalid REPORTS: %v", err)
+		return
+	}
+	startSinks(ctx, cfg)
+	if err := s.initAlerts(ctx, rdb); err != nil {
+		errorLog("Alerting setup failed: %v", err)
+		return
+	}
+	s.initZMQInput(ctx)
+	if err := s.initUDPInput(ctx); err != nil {
+		errorLog("Invalid UDP_LISTEN: %v", err)
+		return
+	}
+	s.initGRPCServer(ctx)
+	s.initRemoteWrite(ctx)
+	s.initStatsD(ctx)
+	if cfg.PcapFile != "" {
+		if _, err := s.startPcapReplay(ctx, cfg.PcapFile, cfg.PcapSpeed, true); err != nil {
+			errorLog("Failed to replay PCAP_FILE %s: %v", cfg.PcapFile, err)
+		}
 	}
 
-	initializeLatestData(ctx, rdb)
+	// A panic in these restarts them rather than leaving the server up
+	// with a dead feed.
+	go supervise(ctx, "Redis setup", func(ctx context.Context) { s.startRedis(ctx, rdb) }, nil)
+	// A restarted hub lost the frame it was delivering; resync every client.
+	go supervise(ctx, "broadcast hub", s.handleMessages, func() { s.framesLost.Store(true) })
+	go supervise(ctx, "feed status watcher", s.watchFeedStatus, nil)
 
-	go startRedisPoller(ctx, rdb)
-	go handleMessages()
+	addRoute(routesData, "/ws", s.handleWebSocket)
+	addRoute(routesData, "/replay", s.handleReplay)
+	addRoute(routesData, "/stream", s.handleStream)
+	addRoute("", "/", handleRoot)
+	addRoute(routesData, "/latest", s.handleLatest)
+	addRoute(routesData, "/latest/wait", s.handleLatestWait)
+	addRoute(routesData, "/latest/summary", s.handleLatestSummary)
+	addRoute(routesData, "/schema", handleSchema)
+	addRoute(routesData, "/at", s.handleAt(rdb))
+	addRoute(routesMetrics, "/metrics", s.handleMetrics)
+	addRoute(routesMetrics, "/stats", s.handleStats)
+	addRoute("", "/healthz", s.handleHealthz)
+	addRoute("", "/readyz", s.handleReadyz(rdb))
+	addRoute(routesData, "/packets", s.handlePackets(rdb))
+	addRoute(routesData, "/export", s.handleExport(rdb))
+	addRoute(routesData, "/aggregate", s.handleAggregate(rdb))
+	addRoute(routesData, "/rollups", s.handleRollups(rdb))
+	addRoute(routesData, "/alerts", s.handleAlerts)
+	addRoute(routesData, "/alerts/history", s.handleAlertHistory(rdb))
+	addRoute(routesData, "/reports", s.handleReports(rdb))
+	addRoute(routesData, "/annotations", s.handleAnnotations(rdb))
+	addRoute(routesData, "/grafana/", handleGrafanaRoot)
+	addRoute(routesData, "/grafana/search", s.handleGrafanaSearch)
+	addRoute(routesData, "/grafana/query", s.handleGrafanaQuery(rdb))
+	addRoute(routesData, "/grafana/annotations", s.handleGrafanaAnnotations(rdb))
+	addRoute(routesIngest, "/ingest", s.handleIngest(rdb))
+	addRoute(routesAdmin, "/admin/clients", s.handleAdminClients)
+	addRoute(routesAdmin, "/admin/clients/disconnect", s.handleAdminDisconnect)
+	addRoute(routesAdmin, "/admin/deny", s.handleAdminDeny)
+	addRoute(routesAdmin, "/admin/allow", s.handleAdminAllow)
+	addRoute(routesAdmin, "/admin/drain", s.handleAdminDrain)
+	addRoute(routesAdmin, "/admin/broadcast", s.handleAdminBroadcast)
+	addRoute(routesAdmin, "/admin/channels", handleAdminChannels)
+	addRoute(routesAdmin, "/admin/consistency", s.handleAdminConsistency(rdb))
+	addRoute(routesAdmin, "/admin/skew", s.handleAdminSkew)
+	addRoute(routesAdmin, "/admin/validation", s.handleAdminValidation)
+	addRoute(routesAdmin, "/admin/drop-rules", handleAdminDropRules)
+	addRoute(routesAdmin, "/admin/sequences", s.handleAdminSequences)
+	addRoute(routesAdmin, "/admin/pcap", s.handleAdminPcap(ctx))
+	addRoute(routesAdmin, "/admin/alerts/rules", s.handleAdminAlertRules)
+	addRoute(routesAdmin, "/admin/annotations", s.handleAdminAnnotations(rdb))
+	addRoute(routesAdmin, "/admin/latest/rebuild", s.handleAdminRebuildLatest(rdb))
+	addRoute(routesAdmin, "/admin/state", s.handleAdminState)
+	addRoute(routesAdmin, "/admin/state/save", s.handleAdminStateFile(true))
+	addRoute(routesAdmin, "/admin/state/load", s.handleAdminStateFile(false))
 
-	http.HandleFunc("/ws", handleWebSocket)
-	http.HandleFunc("/", handleRoot)
-	http.HandleFunc("/latest", handleLatest)
+	// After the routes: the HTTP/3 listener builds its mux from them.
+	if err := s.initHTTP3Server(ctx); err != nil {
+		errorLog("Invalid HTTP3_LISTEN: %v", err)
+		return
+	}
 
-	infoLog("Starting server on %s (Debug: %v, Poll: %s)", config.ServerPort, config.Debug, config.PollInterval)
-	if err := http.ListenAndServe(config.ServerPort, nil); err != nil {
+	addrs := make([]string, len(listeners))
+	for i, l := range listeners {
+		addrs[i] = l.addr
+	}
+	infoLog("Starting server on %s (Debug: %v, Poll: %s)", strings.Join(addrs, ", "), cfg.Debug, cfg.PollInterval)
+	if err := s.serveListeners(ctx, cancel); err != nil {
 		errorLog("HTTP server error: %v", err)
 	}
+	cancel()
+	if !waitWorkers(shutdownFlushTimeout) {
+		errorLog("Sinks still flushing after %s; exiting", shutdownFlushTimeout)
+	}
 }
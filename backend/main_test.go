@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"backend/testsupport"
+)
+
+// serverBinary is the backend built once for the integration tests.
+var serverBinary string
+
+func TestMain(m *testing.M) {
+	dir, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	serverBinary, err = testsupport.BuildServer(dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	os.RemoveAll(filepath.Dir(serverBinary))
+	os.Exit(code)
+}
+
+// testIngestToken is the INGEST_TOKEN of servers started by startServer.
+const testIngestToken = "test-ingest"
+
+// startServer runs the backend against a new Redis double with env on top
+// of INGEST_TOKEN, and stops it when the test ends, logging its output if
+// the test failed.
+func startServer(t *testing.T, env ...string) *testsupport.Server {
+	t.Helper()
+	s, err := testsupport.StartServer(serverBinary, append([]string{"INGEST_TOKEN=" + testIngestToken}, env...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := s.Close(); err != nil {
+			t.Error(err)
+		}
+		if t.Failed() {
+			t.Logf("server output:\n%s", s.Logs())
+		}
+	})
+	return s
+}
+
+// dialWS connects to path on s and closes the connection when the test ends.
+func dialWS(t *testing.T, s *testsupport.Server, path string) *testsupport.WSClient {
+	t.Helper()
+	c, err := testsupport.DialWS(s.WSURL(path), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// expectFrame is WSClient.Expect, failing the test on timeout.
+func expectFrame(t *testing.T, c *testsupport.WSClient, typ string) testsupport.Frame {
+	t.Helper()
+	f, err := c.Expect(typ, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// ingest posts packets to /ingest.
+func ingest(t *testing.T, s *testsupport.Server, packets ...Packet) {
+	t.Helper()
+	body, err := json.Marshal(packets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodPost, s.URL+"/ingest", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testIngestToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		t.Fatalf("POST /ingest: HTTP %d", resp.StatusCode)
+	}
+}
+
+// getJSON decodes the JSON response to GET path, which must have status
+// want.
+func getJSON(t *testing.T, s *testsupport.Server, path string, header http.Header, want int, v interface{}) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, s.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != want {
+		t.Fatalf("GET %s: HTTP %d, want %d", path, resp.StatusCode, want)
+	}
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+	}
+}
+
+// testPacket is a packet of pair src->dest at ts from node, carrying
+// tcpBytes in one TCP bucket.
+func testPacket(src, dest string, ts, node, tcpBytes int) Packet {
+	return Packet{
+		Timestamp:  ts,
+		NodeID:     node,
+		Src:        src,
+		Dest:       dest,
+		TotalBytes: tcpBytes,
+		TCPPackets: []int{1},
+		TCPBytes:   []int{tcpBytes},
+		UDPPackets: []int{0},
+		UDPBytes:   []int{0},
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// errorsLogged counts errorLog calls, exported by /metrics and StatsD. Like
+// logging, it is process-wide; the Server keeps its other core counters.
+var errorsLogged atomic.Int64
+
+// metric is one sample of a metric exported by /metrics and the remote-write
+// exporter. Labels are name/value pairs.
+type metric struct {
+	name    string
+	help    string
+	counter bool
+	labels  [][2]string
+	value   float64
+}
+
+// collectMetrics gathers the current value of every exported metric. Rates
+// are window aggregates over summaryRateWindow, like /latest/summary.
+func (s *Server) collectMetrics() []metric {
+	pairs, packets, bytes := s.latestTotals("", false)
+	status := s.currentFeedStatus()
+
+	messageRate, packetRate, byteRate := s.trafficRates()
+
+	s.clientsMu.Lock()
+	clientCount := len(s.clients)
+	s.clientsMu.Unlock()
+
+	stale, age := 0.0, -1.0
+	if status.Stale {
+		stale = 1
+	}
+	if status.AgeMS != nil {
+		age = float64(*status.AgeMS) / 1000
+	}
+
+	breakerOpen := 0.0
+	if redisBreaker.current() != breakerClosed {
+		breakerOpen = 1
+	}
+
+	sampling := 0.0
+	if s.sampler.active.Load() {
+		sampling = 1
+	}
+
+	metrics := []metric{
+		{name: "traffic_messages_per_second", help: "Packet records received per second over the last 10s.", value: messageRate},
+		{name: "traffic_packets_per_second", help: "Network packets counted per second over the last 10s.", value: packetRate},
+		{name: "traffic_bytes_per_second", help: "Network bytes counted per second over the last 10s.", value: byteRate},
+		{name: "traffic_pairs", help: "src:dest pairs in the latest view.", value: float64(pairs)},
+		{name: "traffic_view_packets", help: "Network packets summed over the latest view.", value: float64(packets)},
+		{name: "traffic_view_bytes", help: "Network bytes summed over the latest view.", value: float64(bytes)},
+		{name: "traffic_packets_received_total", help: "Packets new to the view, from any input.", counter: true, value: float64(s.packetsReceived.Load())},
+		{name: "traffic_frames_sent_total", help: "Frames written to WebSocket clients.", counter: true, value: float64(s.framesSent.Load())},
+		{name: "traffic_errors_total", help: "Errors logged.", counter: true, value: float64(errorsLogged.Load())},
+		{name: "traffic_websocket_clients", help: "Connected WebSocket clients.", value: float64(clientCount)},
+		{name: "traffic_websocket_closed_total", help: "WebSocket connections the server closed for a client's reads.", counter: true, labels: [][2]string{{"reason", "idle"}}, value: float64(wsClosedIdle.Load())},
+		{name: "traffic_websocket_closed_total", help: "WebSocket connections the server closed for a client's reads.", counter: true, labels: [][2]string{{"reason", "too_large"}}, value: float64(wsClosedTooLarge.Load())},
+		{name: "traffic_broadcast_frames_published_total", help: "Frames offered to the broadcast channel.", counter: true, value: float64(s.framesPublished.Load())},
+		{name: "traffic_broadcast_frames_dropped_total", help: "Frames dropped by the broadcast overflow policy.", counter: true, value: float64(s.framesDropped.Load())},
+		{name: "traffic_broadcast_control_frames_dropped_total", help: "Alert, status, and annotation frames dropped by the broadcast overflow policy.", counter: true, value: float64(s.controlFramesDropped.Load())},
+		{name: "traffic_broadcast_frames_sampled_total", help: "Update frames folded into a later one while the hub was overloaded.", counter: true, value: float64(s.framesSampled.Load())},
+		{name: "traffic_broadcast_sampling", help: "1 while the hub sends only 1 in BROADCAST_SAMPLE_EVERY updates.", value: sampling},
+		{name: "traffic_feed_stale", help: "1 when no message arrived for STALE_AFTER.", value: stale},
+		{name: "traffic_feed_age_seconds", help: "Seconds since the last new message (-1 before the first).", value: age},
+		{name: "traffic_redis_breaker_open", help: "1 while the Redis circuit breaker skips Redis calls.", value: breakerOpen},
+		{name: "traffic_consistency_checks_total", help: "Comparisons of stored against received packets.", counter: true, value: float64(consistencyChecks.Load())},
+		{name: "traffic_consistency_mismatches_total", help: "Pair-seconds whose stored and received packets differed.", counter: true, value: float64(consistencyDiffs.Load())},
+		{name: "traffic_reconcile_runs_total", help: "Reconciliation passes of latest against Redis.", counter: true, value: float64(reconcileRuns.Load())},
+		{name: "traffic_reconcile_missed_packets_total", help: "Packets found by reconciliation that the poller missed.", counter: true, value: float64(reconcileMissed.Load())},
+		{name: "traffic_reconcile_pair_updates_total", help: "Pairs in latest changed by reconciliation.", counter: true, value: float64(reconcileUpdates.Load())},
+		{name: "traffic_reconcile_watermark_rewinds_total", help: "Reconciliation passes that moved the watermark back to Redis.", counter: true, value: float64(reconcileRewinds.Load())},
+	}
+
+	metrics = append(metrics,
+		metric{name: "traffic_http_requests_total", help: "HTTP requests answered, probes excluded.", counter: true, value: float64(sloRequests.Load())},
+		metric{name: "traffic_http_requests_failed_total", help: "HTTP requests answered with a 5xx, probes excluded.", counter: true, value: float64(sloRequestsFailed.Load())},
+	)
+	report := slo.report()
+	for _, o := range report.SLOs {
+		labels := [][2]string{{"slo", o.Name}}
+		metrics = append(metrics,
+			metric{name: "traffic_slo_target", help: "Target share of good events of each objective.", labels: labels, value: o.Target},
+			metric{name: "traffic_slo_error_budget_remaining", help: "Share of the SLO_WINDOW error budget left (negative once overspent).", labels: labels, value: o.BudgetRemaining},
+		)
+		for _, w := range sloWindows {
+			metrics = append(metrics, metric{
+				name: "traffic_slo_burn_rate", help: "Error budget burn rate per window (1 spends the budget exactly over SLO_WINDOW).",
+				labels: [][2]string{{"slo", o.Name}, {"window", w.name}}, value: o.BurnRates[w.name],
+			})
+		}
+	}
+	for _, q := range [][2]string{{"p50", "0.5"}, {"p95", "0.95"}, {"p99", "0.99"}} {
+		if v := report.LatencyMS[sloWindows[0].name][q[0]]; v != nil {
+			metrics = append(metrics, metric{
+				name: "traffic_broadcast_latency_seconds", help: "Broadcast latency percentiles over the last 5 minutes.",
+				labels: [][2]string{{"quantile", q[1]}}, value: *v / 1000,
+			})
+		}
+	}
+
+	lag, queue := s.lagStats()
+	if lag.Mean != nil {
+		metrics = append(metrics,
+			metric{name: "traffic_ingest_lag_seconds", help: "Mean delay of fresh packets behind their timestamps over the last 10s.", value: *lag.Mean},
+			metric{name: "traffic_ingest_lag_max_seconds", help: "Longest delay of a fresh packet behind its timestamp over the last 10s.", value: *lag.Max},
+		)
+	}
+	metrics = append(metrics,
+		metric{name: "traffic_broadcast_queue_length", help: "Frames waiting in the broadcast channel.", value: float64(queue.Length)},
+		metric{name: "traffic_broadcast_queue_capacity", help: "Size of the broadcast channel (BROADCAST_BUFFER).", value: float64(queue.Capacity)},
+		metric{name: "traffic_broadcast_queue_peak", help: "Longest broadcast channel after a publish over the last 10s.", value: float64(queue.Peak)},
+	)
+
+	routes, summaries := routeLatencies()
+	metrics = appendLatencyMetrics(metrics, "traffic_http_request_duration_seconds", "HTTP request latency by route pattern", "route", routes, summaries)
+	metrics = appendLatencyMetrics(metrics, "traffic_websocket_write_duration_seconds", "WebSocket write latency", "", nil, []latencySummary{wsWriteLatencies()})
+
+	wheres, counts := panicCounts()
+	for i, where := range wheres {
+		metrics = append(metrics, metric{
+			name: "traffic_panics_total", help: "Panics recovered, by HTTP handlers (where=\"http\") or a supervised goroutine.", counter: true,
+			labels: [][2]string{{"where", where}}, value: float64(counts[i]),
+		})
+	}
+
+	for _, rule := range s.listAlertRules() {
+		firing := 0.0
+		if rule.Status == alertFiring {
+			firing = 1
+		}
+		metrics = append(metrics, metric{
+			name: "traffic_alert_firing", help: "1 while the alert rule is firing.",
+			labels: [][2]string{{"rule", rule.Name}}, value: firing,
+		})
+		for aggregate, v := range rule.Values {
+			metrics = append(metrics, metric{
+				name: "traffic_alert_value", help: "Last value of each aggregate in an alert rule.",
+				labels: [][2]string{{"rule", rule.Name}, {"aggregate", aggregate}}, value: v,
+			})
+		}
+	}
+
+	for _, rule := range listDropRules() {
+		metrics = append(metrics, metric{name: "traffic_drop_rule_packets_total", help: "Packets dropped by each DROP_RULES rule.", counter: true, labels: [][2]string{{"rule", rule.Name}}, value: float64(rule.Dropped)})
+	}
+
+	for _, ch := range listChannels() {
+		labels := [][2]string{{"channel", ch.Channel}}
+		last := 0.0
+		if ch.LastMessage != nil {
+			last = float64(ch.LastMessage.UnixMilli()) / 1000
+		}
+		metrics = append(metrics,
+			metric{name: "traffic_channel_messages_total", help: "Messages received per input channel.", counter: true, labels: labels, value: float64(ch.Messages)},
+			metric{name: "traffic_channel_packets_total", help: "Packets decoded per input channel.", counter: true, labels: labels, value: float64(ch.Packets)},
+			metric{name: "traffic_channel_bytes_total", help: "Payload bytes received per input channel.", counter: true, labels: labels, value: float64(ch.Bytes)},
+			metric{name: "traffic_channel_decode_errors_total", help: "Messages that failed to decode per input channel.", counter: true, labels: labels, value: float64(ch.DecodeErrors)},
+		)
+		if ch.SchemaRejections != nil {
+			metrics = append(metrics, metric{name: "traffic_channel_schema_rejections_total", help: "Payloads that did not match PACKET_SCHEMA_FILE per input channel.", counter: true, labels: labels, value: float64(*ch.SchemaRejections)})
+		}
+		metrics = append(metrics,
+			metric{name: "traffic_channel_last_message_timestamp_seconds", help: "Unix time of the last message per input channel (0 before the first).", labels: labels, value: last},
+		)
+	}
+
+	for _, h := range tenantHubs {
+		labels := [][2]string{{"tenant", h.name}}
+		metrics = append(metrics,
+			metric{name: "traffic_tenant_websocket_clients", help: "Connected WebSocket clients per tenant.", labels: labels, value: float64(h.clients.Load())},
+			metric{name: "traffic_tenant_clients_rejected_total", help: "WebSocket connections refused by TENANT_MAX_CLIENTS.", counter: true, labels: labels, value: float64(h.rejected.Load())},
+			metric{name: "traffic_tenant_bytes_queued_total", help: "Bytes queued for a tenant's WebSocket clients.", counter: true, labels: labels, value: float64(h.bytesQueued.Load())},
+			metric{name: "traffic_tenant_frames_throttled_total", help: "Frames skipped by TENANT_MAX_BYTES_PER_SEC.", counter: true, labels: labels, value: float64(h.throttled.Load())},
+		)
+	}
+
+	for _, q := range qosClasses {
+		labels := [][2]string{{"class", q.name}}
+		metrics = append(metrics,
+			metric{name: "traffic_qos_websocket_clients", help: "Connected WebSocket clients per QoS class.", labels: labels, value: float64(q.clients.Load())},
+			metric{name: "traffic_qos_clients_rejected_total", help: "WebSocket connections refused by WS_MAX_CLIENTS.", counter: true, labels: labels, value: float64(q.rejected.Load())},
+			metric{name: "traffic_qos_clients_evicted_total", help: "WebSocket clients closed to admit a client of a higher QoS class.", counter: true, labels: labels, value: float64(q.evicted.Load())},
+			metric{name: "traffic_qos_frames_throttled_total", help: "Frames skipped by QOS_MAX_BYTES_PER_SEC.", counter: true, labels: labels, value: float64(q.throttled.Load())},
+		)
+	}
+
+	sort.SliceStable(metrics, func(i, j int) bool { return metrics[i].name < metrics[j].name })
+	return metrics
+}
+
+// appendLatencyMetrics exports latency summaries as a Prometheus summary:
+// name{quantile} over the last 5 minutes, name_sum, and name_count. With
+// label set, summaries[i] is labeled with values[i].
+func appendLatencyMetrics(metrics []metric, name, help, label string, values []string, summaries []latencySummary) []metric {
+	labelsOf := func(i int, extra ...[2]string) [][2]string {
+		if label == "" {
+			return extra
+		}
+		return append([][2]string{{label, values[i]}}, extra...)
+	}
+	for i, s := range summaries {
+		for _, q := range []struct {
+			name  string
+			value *float64
+		}{{"0.5", s.P50}, {"0.95", s.P95}, {"0.99", s.P99}} {
+			if q.value != nil {
+				metrics = append(metrics, metric{name: name, help: help + ", percentiles over the last 5 minutes.", labels: labelsOf(i, [2]string{"quantile", q.name}), value: *q.value / 1000})
+			}
+		}
+	}
+	for i, s := range summaries {
+		metrics = append(metrics, metric{name: name + "_sum", help: help + ", seconds in total.", counter: true, labels: labelsOf(i), value: s.SumSec})
+	}
+	for i, s := range summaries {
+		metrics = append(metrics, metric{name: name + "_count", help: help + ", observations.", counter: true, labels: labelsOf(i), value: float64(s.Count)})
+	}
+	return metrics
+}
+
+// handleMetrics serves the metrics in the Prometheus text exposition format.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	prev := ""
+	for _, m := range s.collectMetrics() {
+		if m.name != prev {
+			kind := "gauge"
+			if m.counter {
+				kind = "counter"
+			}
+			fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, kind)
+			prev = m.name
+		}
+		b.WriteString(m.name)
+		if len(m.labels) > 0 {
+			b.WriteByte('{')
+			for i, l := range m.labels {
+				if i > 0 {
+					b.WriteByte(',')
+				}
+				fmt.Fprintf(&b, "%s=%s", l[0], strconv.Quote(l[1]))
+			}
+			b.WriteByte('}')
+		}
+		fmt.Fprintf(&b, " %s\n", strconv.FormatFloat(m.value, 'g', -1, 64))
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprint(w, b.String())
+}
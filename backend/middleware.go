@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// middleware wraps a handler with one cross-cutting concern: auth, access
+// lists, CORS, request IDs, API versions, logging, SLO accounting, panic
+// recovery, rate limiting, compression.
+type middleware func(http.HandlerFunc) http.HandlerFunc
+
+// chain wraps h in mws, the first outermost.
+func chain(h http.HandlerFunc, mws ...middleware) http.HandlerFunc {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// middleware returns the stack a route of group gets on the listener,
+// outermost first. Routes without a group get only request IDs, logging,
+// panic recovery, CORS, and API versions; probes do not count toward the
+// availability objective.
+func (s *Server) middleware(l listenerSpec, group string) []middleware {
+	if group == "" {
+		return []middleware{withRequestID, s.logRequests, recoverPanics, allowCORS, withAPIVersion}
+	}
+	mws := []middleware{withRequestID, s.logRequests, observeRequests, recoverPanics, allowCORS, withAPIVersion, restrictClients}
+	if group == routesData {
+		mws = append(mws, s.limitRate)
+	}
+	switch {
+	case l.auth == authNone:
+	case l.auth == authAdmin || group == routesAdmin:
+		mws = append(mws, s.requireAdmin)
+	case group == routesIngest:
+		mws = append(mws, s.requireIngest)
+	}
+	if group == routesData || group == routesMetrics {
+		mws = append(mws, s.compressResponses)
+	}
+	return mws
+}
+
+// statusRecorder captures the status and size of a response for the access
+// log. It passes Flush and Hijack through, so streaming responses and
+// WebSocket upgrades work behind it, and unwraps for ResponseController.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusRecorder) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+func (w *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not support hijacking")
+	}
+	w.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+// logRequests writes one line per request with ACCESS_LOG. WebSocket
+// connections and streams are logged when they end, with status 101 for
+// upgrades.
+func (s *Server) logRequests(next http.HandlerFunc) http.HandlerFunc {
+	if !s.config.AccessLog {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next(rec, r)
+		infoLog("%s %s %s %d %dB %s req=%s", clientIP(r), r.Method, loggedURI(r.URL), rec.status, rec.bytes, time.Since(start).Round(time.Microsecond), requestID(r.Context()))
+	}
+}
+
+// loggedURI is u's request URI with the value of a ?token= (requestToken)
+// redacted, so tokens do not end up in the access log.
+func loggedURI(u *url.URL) string {
+	q := u.Query()
+	if !q.Has("token") {
+		return u.RequestURI()
+	}
+	q.Set("token", "REDACTED")
+	redacted := *u
+	redacted.RawQuery = q.Encode()
+	return redacted.RequestURI()
+}
+
+// corsOrigins are the CORS_ORIGINS; "*" allows any origin.
+var corsOrigins []string
+
+func initCORS(cfg *Config) {
+	corsOrigins = splitList(cfg.CORSOrigins)
+	if len(corsOrigins) > 0 {
+		// Browsers do not apply CORS to WebSocket; check the origin instead.
+		upgrader.CheckOrigin = func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			return origin == "" || originAllowed(origin)
+		}
+	}
+}
+
+func originAllowed(origin string) bool {
+	return slices.Contains(corsOrigins, "*") || slices.Contains(corsOrigins, origin)
+}
+
+// allowCORS lets browser pages on CORS_ORIGINS call the API, answering
+// preflight requests itself so they need no token.
+func allowCORS(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || len(corsOrigins) == 0 {
+			next(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		if !originAllowed(origin) {
+			next(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, "+apiVersionHeader)
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// rateBucket is a client's token bucket.
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+const rateBucketsMax = 10000
+
+// allowRate takes a token from ip's bucket, which refills at RATE_LIMIT per
+// second up to RATE_LIMIT_BURST. When it is empty, it returns how long
+// until the next token.
+func (s *Server) allowRate(ip string, now time.Time) (bool, time.Duration) {
+	s.rateBucketsMu.Lock()
+	defer s.rateBucketsMu.Unlock()
+
+	b, ok := s.rateBuckets[ip]
+	if !ok {
+		if len(s.rateBuckets) >= rateBucketsMax {
+			// Drop the buckets that have refilled; they hold no state.
+			full := float64(s.config.RateLimitBurst) / s.config.RateLimit
+			for k, old := range s.rateBuckets {
+				if now.Sub(old.last).Seconds() >= full {
+					delete(s.rateBuckets, k)
+				}
+			}
+		}
+		b = &rateBucket{tokens: float64(s.config.RateLimitBurst), last: now}
+		s.rateBuckets[ip] = b
+	}
+	b.tokens = math.Min(float64(s.config.RateLimitBurst), b.tokens+now.Sub(b.last).Seconds()*s.config.RateLimit)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / s.config.RateLimit * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// limitRate answers 429 to clients over RATE_LIMIT requests per second.
+func (s *Server) limitRate(next http.HandlerFunc) http.HandlerFunc {
+	if s.config.RateLimit <= 0 {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		if ok, wait := s.allowRate(ip, time.Now()); !ok {
+			debugLog("Rate limited %s %s", ip, r.URL.Path)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, rateLimited.errorf("Too many requests"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// gzipWriter compresses a response once its status allows a body.
+type gzipWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+	encode      bool
+}
+
+func (w *gzipWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	h := w.Header()
+	if code >= http.StatusOK && code != http.StatusNoContent && code != http.StatusNotModified && h.Get("Content-Encoding") == "" {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", "gzip")
+		w.encode = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *gzipWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.encode {
+		return w.ResponseWriter.Write(b)
+	}
+	if w.gz == nil {
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	return w.gz.Write(b)
+}
+
+func (w *gzipWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+func (w *gzipWriter) Flush() {
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// close ends the gzip stream; an encoded response without a body still
+// gets an empty one.
+func (w *gzipWriter) close() {
+	if w.encode && w.gz == nil {
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	if w.gz != nil {
+		w.gz.Close()
+	}
+}
+
+// compressResponses gzips responses for clients that accept it, with
+// COMPRESS_RESPONSES. WebSocket upgrades pass through; /stream and /export
+// flush the compressor with every chunk.
+func (s *Server) compressResponses(next http.HandlerFunc) http.HandlerFunc {
+	if !s.config.CompressResponses {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if websocket.IsWebSocketUpgrade(r) {
+			next(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			next(w, r)
+			return
+		}
+		gw := &gzipWriter{ResponseWriter: w}
+		defer gw.close()
+		next(gw, r)
+	}
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for _, enc := range strings.Split(v, ",") {
+			name, params, _ := strings.Cut(enc, ";")
+			if strings.TrimSpace(name) == "gzip" && strings.ReplaceAll(params, " ", "") != "q=0" {
+				return true
+			}
+		}
+	}
+	return false
+}
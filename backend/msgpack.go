@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// appendMsgpack appends the MessagePack encoding of v to b. It covers the
+// values frames are built from: maps with string keys, slices, strings,
+// numbers, bools, nil, time.Time (as an RFC 3339 string, like encoding/json),
+// and structs, whose fields are named and skipped by their json tags.
+func appendMsgpack(b []byte, v interface{}) ([]byte, error) {
+	return appendMsgpackValue(b, reflect.ValueOf(v))
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func appendMsgpackValue(b []byte, v reflect.Value) ([]byte, error) {
+	if !v.IsValid() {
+		return append(b, 0xc0), nil
+	}
+	if v.Type() == timeType {
+		return appendMsgpackString(b, v.Interface().(time.Time).Format(time.RFC3339Nano)), nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return append(b, 0xc0), nil
+		}
+		return appendMsgpackValue(b, v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			return append(b, 0xc3), nil
+		}
+		return append(b, 0xc2), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return appendMsgpackInt(b, v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return appendMsgpackUint(b, v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return binary.BigEndian.AppendUint64(append(b, 0xcb), math.Float64bits(v.Float())), nil
+	case reflect.String:
+		return appendMsgpackString(b, v.String()), nil
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return append(b, 0xc0), nil
+		}
+		b = appendMsgpackHeader(b, v.Len(), 0x90, 0xdc)
+		for i := 0; i < v.Len(); i++ {
+			var err error
+			if b, err = appendMsgpackValue(b, v.Index(i)); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("msgpack: unsupported map key type %s", v.Type().Key())
+		}
+		if v.IsNil() {
+			return append(b, 0xc0), nil
+		}
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		b = appendMsgpackHeader(b, len(keys), 0x80, 0xde)
+		for _, k := range keys {
+			b = appendMsgpackString(b, k.String())
+			var err error
+			if b, err = appendMsgpackValue(b, v.MapIndex(k)); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case reflect.Struct:
+		return appendMsgpackStruct(b, v)
+	}
+	return nil, fmt.Errorf("msgpack: unsupported type %s", v.Type())
+}
+
+// appendMsgpackStruct encodes a struct as a map keyed by json field names.
+func appendMsgpackStruct(b []byte, v reflect.Value) ([]byte, error) {
+	fields := jsonFields(v)
+	b = appendMsgpackHeader(b, len(fields), 0x80, 0xde)
+	for _, f := range fields {
+		b = appendMsgpackString(b, f.name)
+		var err error
+		if b, err = appendMsgpackValue(b, f.value); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// jsonField is a struct field as encoding/json would emit it.
+type jsonField struct {
+	name  string
+	value reflect.Value
+}
+
+// jsonFields lists the exported fields of struct v under their json names,
+// leaving out "-" fields and empty omitempty ones.
+func jsonFields(v reflect.Value) []jsonField {
+	var fields []jsonField
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(sf.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		fv := v.Field(i)
+		if strings.Contains(opts, "omitempty") && fv.IsZero() {
+			continue
+		}
+		fields = append(fields, jsonField{name, fv})
+	}
+	return fields
+}
+
+// appendMsgpackHeader writes an array or map header: fix is the fixarray or
+// fixmap prefix and wide the 16-bit form (the 32-bit form follows it).
+func appendMsgpackHeader(b []byte, n int, fix, wide byte) []byte {
+	switch {
+	case n < 16:
+		return append(b, fix|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, wide), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(b, wide+1), uint32(n))
+	}
+}
+
+func appendMsgpackString(b []byte, s string) []byte {
+	n := len(s)
+	switch {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+	}
+	return append(b, s...)
+}
+
+func appendMsgpackInt(b []byte, n int64) []byte {
+	switch {
+	case n >= 0:
+		return appendMsgpackUint(b, uint64(n))
+	case n >= -32:
+		return append(b, byte(n))
+	case n >= math.MinInt8:
+		return append(b, 0xd0, byte(n))
+	case n >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(b, 0xd1), uint16(n))
+	case n >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(b, 0xd2), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(n))
+	}
+}
+
+func appendMsgpackUint(b []byte, n uint64) []byte {
+	switch {
+	case n < 128:
+		return append(b, byte(n))
+	case n <= math.MaxUint8:
+		return append(b, 0xcc, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xcd), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, 0xce), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(b, 0xcf), n)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	natsDialTimeout = 5 * time.Second
+	natsMaxBackoff  = 30 * time.Second
+	natsQueueSize   = 256
+)
+
+// natsBridge republishes broadcast frames to a NATS subject using the NATS
+// text protocol, reconnecting in the background when the server goes away.
+// With TENANTS set each tenant's edges go to <subject>.<tenant> instead.
+type natsBridge struct {
+	url     *url.URL
+	subject string
+	tenants []string
+	queue   chan natsMessage
+}
+
+// natsMessage is one queued PUB.
+type natsMessage struct {
+	subject string
+	payload []byte
+}
+
+// nats is the configured bridge, or nil when NATS_URL is not set.
+var nats *natsBridge
+
+func initNATSBridge(ctx context.Context, cfg *Config) {
+	if cfg.NATSURL == "" {
+		return
+	}
+
+	u, err := url.Parse(cfg.NATSURL)
+	if err != nil || u.Host == "" {
+		errorLog("Invalid NATS_URL %q: %v", cfg.NATSURL, err)
+		return
+	}
+
+	nats = &natsBridge{
+		url:     u,
+		subject: cfg.NATSSubject,
+		tenants: cfg.Tenants,
+		queue:   make(chan natsMessage, natsQueueSize),
+	}
+	go nats.run(ctx)
+	infoLog("Republishing broadcast frames to NATS %s (subject=%s)", u.Host, nats.subject)
+}
+
+// publish queues a frame without blocking; frames are dropped while NATS is unreachable.
+func (b *natsBridge) publish(subject string, payload []byte) {
+	select {
+	case b.queue <- natsMessage{subject: subject, payload: payload}:
+	default:
+		debugLog("NATS queue full, dropping frame")
+	}
+}
+
+// publishFrame publishes msg to the bridge subject, or each tenant's part of
+// it to the tenant's subject.
+func (b *natsBridge) publishFrame(msg *frameCache) {
+	if len(b.tenants) == 0 {
+		if payload, err := msg.payload(formatJSON, nil); err == nil {
+			b.publish(b.subject, payload)
+		}
+		return
+	}
+	for _, t := range b.tenants {
+		// A nil payload means the frame has no edges of t.
+		if payload, err := msg.payload(formatJSON, tenantProjection(t)); err == nil && payload != nil {
+			b.publish(b.subject+"."+t, payload)
+		}
+	}
+}
+
+func (b *natsBridge) run(ctx context.Context) {
+	policy := backoff{base: time.Second, max: natsMaxBackoff}
+	for attempt := 0; ; attempt++ {
+		conn, r, err := b.connect()
+		if err != nil {
+			errorLog("NATS connect to %s failed: %v", b.url.Host, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(policy.delay(attempt)):
+			}
+			continue
+		}
+
+		// A lost connection is redialled at once, and backs off from the
+		// start if that fails.
+		attempt = -1
+		infoLog("Connected to NATS at %s", b.url.Host)
+		err = b.serve(ctx, conn, r)
+		conn.Close()
+		if ctx.Err() != nil {
+			return
+		}
+		errorLog("NATS connection lost: %v", err)
+	}
+}
+
+// connect dials the server and completes the INFO/CONNECT exchange.
+func (b *natsBridge) connect() (net.Conn, *bufio.Reader, error) {
+	conn, err := net.DialTimeout("tcp", b.url.Host, natsDialTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(natsDialTimeout))
+
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("read INFO: %w", err)
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return nil, nil, fmt.Errorf("unexpected greeting %q", strings.TrimSpace(line))
+	}
+
+	opts := map[string]interface{}{
+		"verbose":  false,
+		"pedantic": false,
+		"name":     "traffic-backend",
+		"lang":     "go",
+	}
+	if user := b.url.User; user != nil {
+		if pass, ok := user.Password(); ok {
+			opts["user"] = user.Username()
+			opts["pass"] = pass
+		} else {
+			opts["auth_token"] = user.Username()
+		}
+	}
+	connect, err := json.Marshal(opts)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	// PING after CONNECT so authentication errors surface before publishing.
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", connect); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	line, err = r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("read CONNECT reply: %w", err)
+	}
+	if !strings.HasPrefix(line, "PONG") {
+		conn.Close()
+		return nil, nil, fmt.Errorf("CONNECT rejected: %s", strings.TrimSpace(line))
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+	return conn, r, nil
+}
+
+// serve publishes queued frames and answers server PINGs until the connection fails.
+func (b *natsBridge) serve(ctx context.Context, conn net.Conn, r *bufio.Reader) error {
+	var writeMu sync.Mutex
+	w := bufio.NewWriter(conn)
+
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				readErr <- err
+				return
+			}
+			switch {
+			case strings.HasPrefix(line, "PING"):
+				writeMu.Lock()
+				_, err = w.WriteString("PONG\r\n")
+				if err == nil {
+					err = w.Flush()
+				}
+				writeMu.Unlock()
+				if err != nil {
+					readErr <- err
+					return
+				}
+			case strings.HasPrefix(line, "-ERR"):
+				errorLog("NATS server error: %s", strings.TrimSpace(line))
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-readErr:
+			return err
+		case m := <-b.queue:
+			writeMu.Lock()
+			fmt.Fprintf(w, "PUB %s %d\r\n", m.subject, len(m.payload))
+			w.Write(m.payload)
+			w.WriteString("\r\n")
+			err := w.Flush()
+			writeMu.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
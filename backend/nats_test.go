@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// acceptNATSClient plays a NATS server for the next client on l: it sends
+// INFO, answers the CONNECT and PING with reply, and returns the connection
+// with the decoded CONNECT options.
+func acceptNATSClient(t *testing.T, l *net.TCPListener, reply string) (net.Conn, *bufio.Reader, map[string]interface{}) {
+	t.Helper()
+	l.SetDeadline(time.Now().Add(5 * time.Second))
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, `INFO {"server_id":"test","max_payload":1048576}`+"\r\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	options, ok := strings.CutPrefix(line, "CONNECT ")
+	if !ok || !strings.HasSuffix(options, "\r\n") {
+		t.Fatalf("expected CONNECT, got %q", line)
+	}
+	var opts map[string]interface{}
+	if err := json.Unmarshal([]byte(options), &opts); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := r.ReadString('\n'); err != nil || line != "PING\r\n" {
+		t.Fatalf("expected PING after CONNECT, got %q (%v)", line, err)
+	}
+	if _, err := io.WriteString(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	return conn, r, opts
+}
+
+// expectNATSLine reads one line and fails unless it is want.
+func expectNATSLine(t *testing.T, r *bufio.Reader, want string) {
+	t.Helper()
+	line, err := r.ReadString('\n')
+	if err != nil || line != want {
+		t.Fatalf("got %q (%v), want %q", line, err, want)
+	}
+}
+
+func TestNATSBridge(t *testing.T) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	u, _ := url.Parse("nats://s3cret@" + l.Addr().String())
+	b := &natsBridge{url: u, subject: "traffic.frames", queue: make(chan natsMessage, natsQueueSize)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.run(ctx)
+
+	conn, r, opts := acceptNATSClient(t, l, "PONG\r\n")
+	if opts["auth_token"] != "s3cret" || opts["verbose"] != false || opts["pedantic"] != false || opts["name"] != "traffic-backend" {
+		t.Fatalf("CONNECT options %v", opts)
+	}
+
+	b.publish("lab.test", []byte("hello"))
+	expectNATSLine(t, r, "PUB lab.test 5\r\n")
+	expectNATSLine(t, r, "hello\r\n")
+
+	b.publishFrame(newFrameCache(frame{Type: "update", Data: map[string]PacketSummary{
+		"10.0.0.1:10.0.0.2": {Src: "10.0.0.1", Dest: "10.0.0.2", TCPBytesTotal: 100},
+	}}))
+	line, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "PUB traffic.frames ") {
+		t.Fatalf("expected PUB to the bridge subject, got %q (%v)", line, err)
+	}
+	payload, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var f frame
+	if err := json.Unmarshal([]byte(payload), &f); err != nil || f.Type != "update" || f.Data["10.0.0.1:10.0.0.2"].TCPBytesTotal != 100 {
+		t.Fatalf("published frame %q (%v)", payload, err)
+	}
+
+	// Server PINGs are answered so the server keeps the connection.
+	if _, err := io.WriteString(conn, "PING\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	expectNATSLine(t, r, "PONG\r\n")
+
+	// A lost connection is redialled at once.
+	conn.Close()
+	conn, r, _ = acceptNATSClient(t, l, "PONG\r\n")
+	defer conn.Close()
+	b.publish("lab.test", []byte("again"))
+	expectNATSLine(t, r, "PUB lab.test 5\r\n")
+	expectNATSLine(t, r, "again\r\n")
+}
+
+func TestNATSConnectRejected(t *testing.T) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	u, _ := url.Parse("nats://archiver:wrong@" + l.Addr().String())
+	b := &natsBridge{url: u}
+
+	done := make(chan error, 1)
+	go func() {
+		conn, _, err := b.connect()
+		if conn != nil {
+			conn.Close()
+		}
+		done <- err
+	}()
+	conn, _, opts := acceptNATSClient(t, l, "-ERR 'Authorization Violation'\r\n")
+	defer conn.Close()
+	if opts["user"] != "archiver" || opts["pass"] != "wrong" || opts["auth_token"] != nil {
+		t.Fatalf("CONNECT options %v", opts)
+	}
+	if err := <-done; err == nil || !strings.Contains(err.Error(), "Authorization Violation") {
+		t.Fatalf("connect: %v, want the server's error", err)
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	notifyQueueSize = 100
+	notifyTimeout   = 10 * time.Second
+)
+
+// notifier delivers alert events to one channel (webhook, Slack, email).
+// Notifiers run on a single goroutine behind a bounded queue, so a slow
+// endpoint never stalls alert evaluation.
+type notifier interface {
+	Name() string
+	Notify(ctx context.Context, e alertEvent) error
+}
+
+var (
+	notifiers   []notifier
+	notifyQueue = make(chan alertEvent, notifyQueueSize)
+)
+
+func initNotifiers(ctx context.Context, cfg *Config, rdb redisClient) error {
+	if cfg.AlertWebhookURL != "" {
+		notifiers = append(notifiers, &webhookNotifier{
+			url:    cfg.AlertWebhookURL,
+			client: &http.Client{Timeout: notifyTimeout},
+		})
+	}
+	if cfg.AlertSlackWebhookURL != "" {
+		notifiers = append(notifiers, &slackNotifier{
+			url:    cfg.AlertSlackWebhookURL,
+			client: &http.Client{Timeout: notifyTimeout},
+		})
+	}
+	if cfg.AlertSMTPAddr != "" {
+		host, _, err := net.SplitHostPort(cfg.AlertSMTPAddr)
+		if err != nil {
+			return fmt.Errorf("ALERT_SMTP_ADDR: %w", err)
+		}
+		if cfg.AlertSMTPFrom == "" || cfg.AlertSMTPTo == "" {
+			return fmt.Errorf("ALERT_SMTP_FROM and ALERT_SMTP_TO are required with ALERT_SMTP_ADDR")
+		}
+		notifiers = append(notifiers, &emailNotifier{
+			addr:     cfg.AlertSMTPAddr,
+			host:     host,
+			user:     cfg.AlertSMTPUser,
+			password: cfg.AlertSMTPPassword,
+			from:     cfg.AlertSMTPFrom,
+			to:       splitList(cfg.AlertSMTPTo),
+		})
+	}
+	for _, n := range notifiers {
+		infoLog("Registered %s notifier", n.Name())
+	}
+	go runNotifiers(ctx, cfg, rdb)
+	return nil
+}
+
+// hasNotifier reports whether a notifier called name is configured.
+func hasNotifier(name string) bool {
+	for _, n := range notifiers {
+		if n.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// notifyAlert queues an event for the history and notifiers without blocking.
+func notifyAlert(e alertEvent) {
+	infoLog("Alert %s: %s (%s)", e.Status, e.Rule, e.Expr)
+	select {
+	case notifyQueue <- e:
+	default:
+		errorLog("Notification queue full, dropped %s event for %s", e.Status, e.Rule)
+	}
+}
+
+// runNotifiers stores every event in the alert history and sends firing and
+// resolved events to the notifiers the rule routes to, subject to the rate limit.
+func runNotifiers(ctx context.Context, cfg *Config, rdb redisClient) {
+	limiter := notifyLimiter{interval: cfg.AlertNotifyInterval, sent: make(map[string]notifyLimit)}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-notifyQueue:
+			if err := storeAlertEvent(ctx, cfg, rdb, e); err != nil {
+				errorLog("Error storing alert event for %s: %v", e.Rule, err)
+			}
+			if e.Status != alertFiring && e.Status != alertResolved {
+				continue
+			}
+			for _, n := range notifiers {
+				if len(e.Notify) > 0 && !slices.Contains(e.Notify, n.Name()) {
+					continue
+				}
+				if !limiter.allow(n.Name(), e) {
+					debugLog("%s notification for %s (%s) suppressed by rate limit", n.Name(), e.Rule, e.Status)
+					continue
+				}
+				err := cfg.notifyBackoff().retry(ctx, n.Name()+" notification", func(ctx context.Context) error {
+					return n.Notify(ctx, e)
+				})
+				if err != nil {
+					errorLog("%s notifier failed for %s: %v", n.Name(), e.Rule, err)
+				}
+			}
+		}
+	}
+}
+
+// notifyLimit is the rate limit state of one notifier and rule.
+type notifyLimit struct {
+	last       time.Time
+	suppressed bool
+}
+
+// notifyLimiter sends at most one firing notification per notifier and rule
+// per interval. A resolved notification is sent only if its firing one was,
+// so a flapping rule produces one firing/resolved pair per interval.
+type notifyLimiter struct {
+	interval time.Duration
+	sent     map[string]notifyLimit
+}
+
+func (l *notifyLimiter) allow(notifier string, e alertEvent) bool {
+	key := notifier + "|" + e.Rule
+	state := l.sent[key]
+	if e.Status == alertResolved {
+		return !state.suppressed
+	}
+	if !state.last.IsZero() && e.At.Sub(state.last) < l.interval {
+		state.suppressed = true
+		l.sent[key] = state
+		return false
+	}
+	l.sent[key] = notifyLimit{last: e.At}
+	return true
+}
+
+// alertSubject is a one-line description of an event, e.g.
+// "[FIRING] feed-stalled (critical): rate(bytes,10s) < 1e6 for 30s".
+func alertSubject(e alertEvent) string {
+	subject := "[" + strings.ToUpper(e.Status) + "] " + e.Rule
+	if e.Severity != "" {
+		subject += " (" + e.Severity + ")"
+	}
+	return subject + ": " + e.Expr
+}
+
+// alertDetails lists an event's description, aggregate values, and times.
+func alertDetails(e alertEvent) []string {
+	var lines []string
+	if e.Description != "" {
+		lines = append(lines, e.Description)
+	}
+	names := make([]string, 0, len(e.Values))
+	for name := range e.Values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("%s = %g", name, e.Values[name]))
+	}
+	lines = append(lines,
+		"Active since: "+e.ActiveSince.UTC().Format(time.RFC3339),
+		"At: "+e.At.UTC().Format(time.RFC3339))
+	return lines
+}
+
+// webhookNotifier POSTs each event as JSON.
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (n *webhookNotifier) Name() string { return "webhook" }
+
+func (n *webhookNotifier) Notify(ctx context.Context, e alertEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return httpStatusError(resp)
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// slackNotifier posts events to a Slack incoming webhook.
+type slackNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (n *slackNotifier) Name() string { return "slack" }
+
+func (n *slackNotifier) Notify(ctx context.Context, e alertEvent) error {
+	icon := ":rotating_light:"
+	if e.Status == alertResolved {
+		icon = ":white_check_mark:"
+	}
+	text := icon + " *" + alertSubject(e) + "*\n" + strings.Join(alertDetails(e), "\n")
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return httpStatusError(resp)
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// emailNotifier sends plain-text mail over SMTP, upgrading to TLS when the
+// server offers STARTTLS. Credentials are only sent over TLS (or to localhost).
+type emailNotifier struct {
+	addr     string
+	host     string
+	user     string
+	password string
+	from     string
+	to       []string
+}
+
+func (n *emailNotifier) Name() string { return "email" }
+
+// Notify sends e. A 5xx reply is the server refusing the message, which
+// sending it again does not change.
+func (n *emailNotifier) Notify(ctx context.Context, e alertEvent) error {
+	err := n.send(ctx, e)
+	var reply *textproto.Error
+	if errors.As(err, &reply) && reply.Code >= 500 {
+		return permanent(err)
+	}
+	return err
+}
+
+func (n *emailNotifier) send(ctx context.Context, e alertEvent) error {
+	conn, err := (&net.Dialer{Timeout: notifyTimeout}).DialContext(ctx, "tcp", n.addr)
+	if err != nil {
+		return err
+	}
+	_ = conn.SetDeadline(time.Now().Add(notifyTimeout))
+	c, err := smtp.NewClient(conn, n.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: n.host}); err != nil {
+			return err
+		}
+	}
+	if n.user != "" {
+		if err := c.Auth(smtp.PlainAuth("", n.user, n.password, n.host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(n.from); err != nil {
+		return err
+	}
+	for _, to := range n.to {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(n.message(e)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	// The message is accepted; a retry would send it twice.
+	return permanent(c.Quit())
+}
+
+func (n *emailNotifier) message(e alertEvent) []byte {
+	var b strings.Builder
+	b.WriteString("From: " + n.from + "\r\n")
+	b.WriteString("To: " + strings.Join(n.to, ", ") + "\r\n")
+	b.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", alertSubject(e)) + "\r\n")
+	b.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	for _, line := range alertDetails(e) {
+		b.WriteString(line + "\r\n")
+	}
+	return []byte(b.String())
+}
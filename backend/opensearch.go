@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const opensearchTimeout = 30 * time.Second
+
+// opensearchSink indexes packet documents into OpenSearch or Elasticsearch
+// through the _bulk API. Index names are rendered per packet from a template
+// such as "traffic-{yyyy}.{MM}.{dd}".
+type opensearchSink struct {
+	cfg          *Config
+	endpoint     string
+	user         string
+	password     string
+	index        string
+	templateName string
+	template     bool
+	client       *http.Client
+
+	mu            sync.Mutex
+	templateReady bool
+}
+
+// opensearchDoc is a packet plus @timestamp and summed counters, so
+// Kibana/Dashboards can aggregate without scripted fields.
+type opensearchDoc struct {
+	Time       string `json:"@timestamp"`
+	Timestamp  int    `json:"timestamp"`
+	Seq        int    `json:"seq"`
+	NodeID     int    `json:"node_id"`
+	Src        string `json:"source_ip"`
+	Dest       string `json:"dest_ip"`
+	TotalBytes int    `json:"total_bytes"`
+
+	UDPPackets []int `json:"udp_packets"`
+	UDPBytes   []int `json:"udp_bytes"`
+	TCPPackets []int `json:"tcp_packets"`
+	TCPBytes   []int `json:"tcp_bytes"`
+
+	TCPPacketsTotal int `json:"tcp_packets_total"`
+	TCPBytesTotal   int `json:"tcp_bytes_total"`
+	UDPPacketsTotal int `json:"udp_packets_total"`
+	UDPBytesTotal   int `json:"udp_bytes_total"`
+	TotalPackets    int `json:"total_packets"`
+}
+
+func initOpenSearchSink(cfg *Config) {
+	if cfg.OpenSearchURL == "" {
+		return
+	}
+
+	s := &opensearchSink{
+		cfg:          cfg,
+		endpoint:     strings.TrimSuffix(cfg.OpenSearchURL, "/"),
+		user:         cfg.OpenSearchUser,
+		password:     cfg.OpenSearchPassword,
+		index:        cfg.OpenSearchIndex,
+		templateName: cfg.OpenSearchTemplateName,
+		template:     cfg.OpenSearchTemplateName != "",
+		client:       &http.Client{Timeout: opensearchTimeout},
+	}
+	registerSink(s, cfg.OpenSearchBatchSize, cfg.OpenSearchBatchTimeout)
+}
+
+func (s *opensearchSink) Name() string { return "opensearch" }
+func (s *opensearchSink) external()    {}
+
+func (s *opensearchSink) Write(ctx context.Context, packets []Packet) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.ensureTemplate(ctx); err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, p := range packets {
+		t := time.Unix(int64(p.Timestamp), 0).UTC()
+		action := map[string]map[string]string{
+			"index": {"_index": renderIndexName(s.index, t), "_id": s.cfg.packetKey(p)},
+		}
+		e := generateEdgeSummary(p)
+		doc := opensearchDoc{
+			Time:       t.Format(time.RFC3339),
+			Timestamp:  p.Timestamp,
+			Seq:        p.Seq,
+			NodeID:     p.NodeID,
+			Src:        p.Src,
+			Dest:       p.Dest,
+			TotalBytes: p.TotalBytes,
+
+			UDPPackets: nonNilInts(p.UDPPackets),
+			UDPBytes:   p.UDPBytes,
+			TCPPackets: nonNilInts(p.TCPPackets),
+			TCPBytes:   p.TCPBytes,
+
+			TCPPacketsTotal: e.TCPPacketsTotal,
+			TCPBytesTotal:   e.TCPBytesTotal,
+			UDPPacketsTotal: e.UDPPacketsTotal,
+			UDPBytesTotal:   e.UDPBytesTotal,
+			TotalPackets:    e.TotalPackets,
+		}
+		if err := enc.Encode(action); err != nil {
+			return err
+		}
+		if err := enc.Encode(doc); err != nil {
+			return err
+		}
+	}
+
+	resp, err := s.do(ctx, http.MethodPost, "/_bulk", "application/x-ndjson", &body)
+	if err != nil {
+		return err
+	}
+
+	// _bulk answers 200 even when individual documents fail.
+	var result struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Status int `json:"status"`
+			Error  struct {
+				Type   string `json:"type"`
+				Reason string `json:"reason"`
+			} `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(resp, &result); err != nil {
+		return fmt.Errorf("opensearch: invalid bulk response: %w", err)
+	}
+	if !result.Errors {
+		return nil
+	}
+	failed, reason := 0, ""
+	for _, item := range result.Items {
+		for _, r := range item {
+			if r.Status >= 300 {
+				failed++
+				if reason == "" {
+					reason = r.Error.Type + ": " + r.Error.Reason
+				}
+			}
+		}
+	}
+	// The batch went through; resending it would not change the verdict on
+	// the rejected documents.
+	return permanent(fmt.Errorf("opensearch: %d of %d documents rejected (%s)", failed, len(packets), reason))
+}
+
+// ensureTemplate installs an index template so every rendered index maps
+// @timestamp as a date and addresses as keywords.
+func (s *opensearchSink) ensureTemplate(ctx context.Context) error {
+	if s.templateReady || !s.template {
+		return nil
+	}
+
+	template := map[string]interface{}{
+		"index_patterns": []string{indexPattern(s.index)},
+		"template": map[string]interface{}{
+			"mappings": map[string]interface{}{
+				"properties": map[string]interface{}{
+					"@timestamp": map[string]string{"type": "date"},
+					"timestamp":  map[string]string{"type": "long"},
+					"source_ip":  map[string]string{"type": "keyword"},
+					"dest_ip":    map[string]string{"type": "keyword"},
+				},
+			},
+		},
+	}
+	body, err := json.Marshal(template)
+	if err != nil {
+		return err
+	}
+	if _, err := s.do(ctx, http.MethodPut, "/_index_template/"+s.templateName, "application/json", bytes.NewReader(body)); err != nil {
+		return err
+	}
+	s.templateReady = true
+	return nil
+}
+
+func (s *opensearchSink) do(ctx context.Context, method, path, contentType string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.endpoint+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if s.user != "" {
+		req.SetBasicAuth(s.user, s.password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		if len(data) > 1024 {
+			data = data[:1024]
+		}
+		err := fmt.Errorf("opensearch %s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(data)))
+		if !retryableStatus(resp.StatusCode) {
+			err = permanent(err)
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// indexNameTokens are the placeholders renderIndexName understands.
+var indexNameTokens = []struct{ token, layout string }{
+	{"{yyyy}", "2006"},
+	{"{MM}", "01"},
+	{"{dd}", "02"},
+	{"{HH}", "15"},
+}
+
+// renderIndexName fills date placeholders from the packet time (UTC).
+func renderIndexName(template string, t time.Time) string {
+	for _, tok := range indexNameTokens {
+		template = strings.ReplaceAll(template, tok.token, t.Format(tok.layout))
+	}
+	return template
+}
+
+// indexPattern turns an index name template into a wildcard pattern.
+func indexPattern(template string) string {
+	for _, tok := range indexNameTokens {
+		template = strings.ReplaceAll(template, tok.token, "*")
+	}
+	for strings.Contains(template, "**") {
+		template = strings.ReplaceAll(template, "**", "*")
+	}
+	return template
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// overloadCheckInterval is how often the hub measures its load while
+// BROADCAST_SAMPLE_EVERY is set, and the longest an update is held back.
+const overloadCheckInterval = time.Second
+
+// broadcastSampler thins update frames while the hub is overloaded: it
+// delivers one in BROADCAST_SAMPLE_EVERY and folds the others into it, so
+// clients get every edge's latest summary, only less often. Only the hub
+// goroutine calls admit and check.
+type broadcastSampler struct {
+	// active is set while the hub is overloaded; since is when it became so.
+	active atomic.Bool
+	since  atomic.Int64
+
+	// queue and cpu are the load last measured, as fractions.
+	queue atomic.Uint64
+	cpu   atomic.Uint64
+
+	// pending holds the edges of the folded updates, and folded how many.
+	pending map[string]PacketSummary
+	folded  int
+
+	// calm is when the load last dropped under the thresholds (zero while
+	// over them).
+	calm time.Time
+
+	// lastCPU and lastCheck are the process CPU time and wall time of the
+	// previous check.
+	lastCPU   time.Duration
+	lastCheck time.Time
+}
+
+// overloadSampling reports whether overload sampling is configured.
+func (c *Config) overloadSampling() bool {
+	return c.BroadcastSampleEvery > 1
+}
+
+// admit folds update f into the pending edges while hub is sampling and
+// reports whether to deliver it. When it does, f carries every pending edge
+// and is marked sampled.
+func (s *broadcastSampler) admit(hub *Server, f *frame) bool {
+	if s.pending == nil && !s.active.Load() {
+		return true
+	}
+	if s.pending == nil {
+		s.pending = make(map[string]PacketSummary, len(f.Data))
+	}
+	for key, summary := range f.Data {
+		s.pending[key] = summary
+	}
+	s.folded++
+	if s.active.Load() && s.folded < hub.config.BroadcastSampleEvery {
+		hub.framesSampled.Add(1)
+		return false
+	}
+	f.Data, f.Sampled = s.pending, true
+	s.pending, s.folded = nil, 0
+	return true
+}
+
+// discard forgets the pending edges, which a snapshot being delivered
+// already has.
+func (s *broadcastSampler) discard() {
+	s.pending, s.folded = nil, 0
+}
+
+// check measures the load, starts or stops sampling, and returns the pending
+// edges as an update to deliver, so none is held back for more than
+// overloadCheckInterval.
+func (s *broadcastSampler) check(hub *Server) (frame, bool) {
+	now := time.Now()
+	queue, cpu := s.measure(hub, now)
+	cfg := hub.config
+	over := queue >= cfg.BroadcastSampleQueue || cpu >= cfg.BroadcastSampleCPU
+
+	switch {
+	case over:
+		s.calm = time.Time{}
+		if !s.active.Load() {
+			s.active.Store(true)
+			s.since.Store(now.UnixMilli())
+			hub.samplingPeriods.Add(1)
+			errorLog("Broadcast overloaded (queues %.0f%% full, CPU %.0f%%): sending 1 in %d updates", queue*100, cpu*100, cfg.BroadcastSampleEvery)
+		}
+	case !s.active.Load():
+		// Under the thresholds and not sampling.
+	case s.calm.IsZero():
+		s.calm = now
+	case now.Sub(s.calm) >= cfg.BroadcastSampleRecovery:
+		s.active.Store(false)
+		infoLog("Broadcast load back to normal after %s: sending every update", now.Sub(time.UnixMilli(s.since.Load())).Round(time.Second))
+	}
+
+	if s.pending == nil {
+		return frame{}, false
+	}
+	f := frame{Type: "update", Data: s.pending, Sampled: true, published: now}
+	s.pending, s.folded = nil, 0
+	return f, true
+}
+
+// measure returns the fill of hub's broadcast channel or of its average
+// client send queue, whichever is higher, and the share of GOMAXPROCS the
+// process used since the previous check (0 where CPU time is unavailable).
+func (s *broadcastSampler) measure(hub *Server, now time.Time) (queue, cpu float64) {
+	queue = float64(len(hub.broadcast)) / float64(cap(hub.broadcast))
+
+	hub.clientsMu.Lock()
+	var fill float64
+	for c := range hub.clients {
+		fill += float64(len(c.send)) / float64(cap(c.send))
+	}
+	if len(hub.clients) > 0 {
+		queue = max(queue, fill/float64(len(hub.clients)))
+	}
+	hub.clientsMu.Unlock()
+
+	if used, ok := processCPUTime(); ok {
+		if !s.lastCheck.IsZero() {
+			wall := now.Sub(s.lastCheck) * time.Duration(runtime.GOMAXPROCS(0))
+			if wall > 0 {
+				cpu = float64(used-s.lastCPU) / float64(wall)
+			}
+		}
+		s.lastCPU, s.lastCheck = used, now
+	}
+
+	s.queue.Store(uint64(queue * 1000))
+	s.cpu.Store(uint64(cpu * 1000))
+	return queue, cpu
+}
+
+// samplingStats describes overload sampling for /admin/broadcast.
+func (s *Server) samplingStats() map[string]interface{} {
+	if !s.config.overloadSampling() {
+		return map[string]interface{}{"enabled": false}
+	}
+	stats := map[string]interface{}{
+		"enabled":   true,
+		"active":    s.sampler.active.Load(),
+		"every":     s.config.BroadcastSampleEvery,
+		"queue":     float64(s.sampler.queue.Load()) / 1000,
+		"cpu":       float64(s.sampler.cpu.Load()) / 1000,
+		"sampled":   s.framesSampled.Load(),
+		"periods":   s.samplingPeriods.Load(),
+		"max_queue": s.config.BroadcastSampleQueue,
+		"max_cpu":   s.config.BroadcastSampleCPU,
+	}
+	if s.sampler.active.Load() {
+		stats["since"] = time.UnixMilli(s.sampler.since.Load()).UTC()
+	}
+	return stats
+}
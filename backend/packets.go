@@ -0,0 +1,296 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	packetQueryDefaultLimit = 100
+	packetQueryMaxLimit     = 1000
+)
+
+// packetFilter builds the idx:packets query shared by /packets and
+// /aggregate: a timestamp range (from/to or timestamp_min/timestamp_max,
+// default the last hour) plus the optional address, port, protocol, near,
+// and <field>_min/<field>_max filters.
+func packetFilter(q url.Values) (query string, from, to int64, err error) {
+	to = time.Now().Unix()
+	if v := cmp.Or(q.Get("to"), q.Get("timestamp_max")); v != "" {
+		if to, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return "", 0, 0, errors.New("Invalid to")
+		}
+	}
+	from = to - int64(time.Hour.Seconds())
+	if v := cmp.Or(q.Get("from"), q.Get("timestamp_min")); v != "" {
+		if from, err = strconv.ParseInt(v, 10, 64); err != nil || from > to {
+			return "", 0, 0, errors.New("Invalid from")
+		}
+	}
+
+	query = fmt.Sprintf("@timestamp:[%d %d]", from, to)
+	if src := q.Get("src_ip"); src != "" {
+		query += " @src_ip:{" + escapeTagValue(src) + "}"
+	}
+	if dst := q.Get("dst_ip"); dst != "" {
+		query += " @dst_ip:{" + escapeTagValue(dst) + "}"
+	}
+	for _, name := range []string{"src_port", "dst_port"} {
+		v := q.Get(name)
+		if v == "" {
+			continue
+		}
+		port, err := strconv.Atoi(v)
+		if err != nil || port < 1 || port > 65535 {
+			return "", 0, 0, errors.New("Invalid " + name)
+		}
+		query += fmt.Sprintf(" @%s:[%d %d]", name, port, port)
+	}
+	if proto := q.Get("protocol"); proto != "" {
+		query += " @protocol:{" + escapeTagValue(proto) + "}"
+	}
+	if near := q.Get("near"); near != "" {
+		geo, err := parseNear(near)
+		if err != nil {
+			return "", 0, 0, fmt.Errorf("Invalid near: %w", err)
+		}
+		query += " " + geo
+	}
+	if text := q.Get("q"); text != "" {
+		terms, err := parseTextQuery(text)
+		if err != nil {
+			return "", 0, 0, fmt.Errorf("Invalid q: %w", err)
+		}
+		query += " @annotation|tags:(" + terms + ")"
+	}
+	ranges, err := numericRanges(q, packetIndexSchema, "timestamp")
+	if err != nil {
+		return "", 0, 0, err
+	}
+	return query + ranges, from, to, nil
+}
+
+// numericRanges turns <field>_min and <field>_max parameters into inclusive
+// RediSearch ranges for every NUMERIC field of schema except skip, whose
+// range the caller builds itself. Either bound may be left out.
+func numericRanges(q url.Values, schema []*redis.FieldSchema, skip string) (string, error) {
+	var query string
+	for _, f := range schema {
+		name := cmp.Or(f.As, f.FieldName)
+		if f.FieldType != redis.SearchFieldTypeNumeric || name == skip {
+			continue
+		}
+		lo, hi := q.Get(name+"_min"), q.Get(name+"_max")
+		if lo == "" && hi == "" {
+			continue
+		}
+		bound := func(v, inf string) (string, float64, error) {
+			if v == "" {
+				return inf, 0, nil
+			}
+			n, err := strconv.ParseFloat(v, 64)
+			if err != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+				return "", 0, fmt.Errorf("Invalid %s bound %q", name, v)
+			}
+			return strconv.FormatFloat(n, 'f', -1, 64), n, nil
+		}
+		lower, loN, err := bound(lo, "-inf")
+		if err != nil {
+			return "", err
+		}
+		upper, hiN, err := bound(hi, "+inf")
+		if err != nil {
+			return "", err
+		}
+		if lo != "" && hi != "" && loN > hiN {
+			return "", fmt.Errorf("Invalid %s range: %s_min is above %s_max", name, name, name)
+		}
+		query += fmt.Sprintf(" @%s:[%s %s]", name, lower, upper)
+	}
+	return query, nil
+}
+
+// parseSort reads sort=<field>[:asc|desc] for an FT.SEARCH endpoint. Only
+// fields the schema marks sortable are accepted, so RediSearch never sorts
+// an unsortable field by loading every document. Without a direction,
+// ascending is used; without the parameter, def.
+func parseSort(v string, schema []*redis.FieldSchema, def redis.FTSearchSortBy) ([]redis.FTSearchSortBy, error) {
+	if v == "" {
+		return []redis.FTSearchSortBy{def}, nil
+	}
+	field, dir, _ := strings.Cut(v, ":")
+	if dir != "" && dir != "asc" && dir != "desc" {
+		return nil, fmt.Errorf("Invalid sort direction %q (use asc or desc)", dir)
+	}
+	var sortable []string
+	for _, f := range schema {
+		name := cmp.Or(f.As, f.FieldName)
+		if !f.Sortable {
+			continue
+		}
+		if name == field {
+			return []redis.FTSearchSortBy{{FieldName: name, Asc: dir != "desc", Desc: dir == "desc"}}, nil
+		}
+		sortable = append(sortable, name)
+	}
+	return nil, fmt.Errorf("Invalid sort field %q (sortable: %s)", field, strings.Join(sortable, ", "))
+}
+
+// parseTextQuery turns q into RediSearch full-text terms. Words are matched
+// after RediSearch's tokenizing and stemming, all of them required; "a|b"
+// accepts either word and a trailing * matches a prefix. Everything else is
+// escaped, so q cannot inject query syntax.
+func parseTextQuery(q string) (string, error) {
+	var terms []string
+	for _, word := range strings.Fields(q) {
+		var alts []string
+		for _, alt := range strings.Split(word, "|") {
+			prefix := strings.HasSuffix(alt, "*")
+			alt = strings.TrimSuffix(alt, "*")
+			if alt == "" {
+				continue
+			}
+			if prefix && len([]rune(alt)) < 2 {
+				return "", fmt.Errorf("prefix %q is too short", alt+"*")
+			}
+			// Text terms take the same backslash escapes as tag values.
+			term := escapeTagValue(alt)
+			if prefix {
+				term += "*"
+			}
+			alts = append(alts, term)
+		}
+		switch len(alts) {
+		case 0:
+		case 1:
+			terms = append(terms, alts[0])
+		default:
+			terms = append(terms, "("+strings.Join(alts, "|")+")")
+		}
+	}
+	if len(terms) == 0 {
+		return "", errors.New("no words")
+	}
+	return strings.Join(terms, " "), nil
+}
+
+// parseNear turns near=<lat>,<lon>,<radius><unit> (unit m, km, mi, or ft;
+// km when omitted) into a RediSearch GEO filter on location.
+func parseNear(near string) (string, error) {
+	parts := strings.Split(near, ",")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("want lat,lon,radius")
+	}
+	lat, errLat := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	lon, errLon := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if errLat != nil || errLon != nil || lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return "", fmt.Errorf("bad coordinates")
+	}
+
+	radius := strings.TrimSpace(parts[2])
+	unit := "km"
+	for _, u := range []string{"km", "mi", "ft", "m"} {
+		if strings.HasSuffix(radius, u) {
+			radius, unit = strings.TrimSuffix(radius, u), u
+			break
+		}
+	}
+	r, err := strconv.ParseFloat(radius, 64)
+	if err != nil || r <= 0 {
+		return "", fmt.Errorf("bad radius")
+	}
+	return fmt.Sprintf("@location:[%s %s %s %s]",
+		strconv.FormatFloat(lon, 'f', -1, 64), strconv.FormatFloat(lat, 'f', -1, 64),
+		strconv.FormatFloat(r, 'f', -1, 64), unit), nil
+}
+
+// handlePackets searches stored packets by endpoint, newest first. It is the
+// raw-packet counterpart of /rollups for drilling into one address or port.
+func (s *Server) handlePackets(rdb redisClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if searchFallback.Load() {
+			writeError(w, notImplemented.errorf("Packet queries need RediSearch"))
+			return
+		}
+		tenant, ok := s.requestIndexTenant(w, r)
+		if !ok {
+			return
+		}
+
+		q := r.URL.Query()
+		query, from, to, err := packetFilter(q)
+		if err != nil {
+			writeError(w, badQuery.errorf("%v", err))
+			return
+		}
+		limit := packetQueryDefaultLimit
+		if v := q.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				writeError(w, badQuery.errorf("Invalid limit"))
+				return
+			}
+			limit = min(n, packetQueryMaxLimit)
+		}
+		offset := 0
+		if v := q.Get("offset"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				writeError(w, badQuery.errorf("Invalid offset"))
+				return
+			}
+			offset = n
+		}
+
+		sortBy, err := parseSort(q.Get("sort"), packetIndexSchema, redis.FTSearchSortBy{FieldName: "timestamp", Desc: true})
+		if err != nil {
+			writeError(w, badQuery.errorf("%v", err))
+			return
+		}
+
+		ctx, cancel := s.queryContext(r)
+		defer cancel()
+		var result redis.FTSearchResult
+		err = redisDo(ctx, func(ctx context.Context) (err error) {
+			result, err = searchClient(rdb).FTSearchWithArgs(ctx, s.config.packetIndexFor(tenant), query, &redis.FTSearchOptions{
+				LimitOffset: offset,
+				Limit:       limit,
+				SortBy:      sortBy,
+			}).Result()
+			return err
+		})
+		if err != nil {
+			s.queryFailed(w, r, "Packet query", err)
+			return
+		}
+
+		packets := make([]Packet, 0, len(result.Docs))
+		for _, doc := range result.Docs {
+			if p, err := docToPacket(s.config, doc); err == nil {
+				anonymizePacket(&p)
+				packets = append(packets, p)
+			}
+		}
+
+		response := map[string]interface{}{
+			"from":    from,
+			"to":      to,
+			"total":   result.Total,
+			"count":   len(packets),
+			"packets": packets,
+		}
+		s.attachAnnotations(ctx, rdb, response, tenant, from, to)
+		s.cacheQuery(r, response)
+		writeJSON(w, response)
+	}
+}
@@ -0,0 +1,590 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Parquet constants from parquet.thrift.
+const (
+	parquetMagic = "PAR1"
+
+	parquetInt64     = 2
+	parquetByteArray = 6
+
+	parquetRequired = 0
+	parquetRepeated = 2
+
+	parquetUTF8 = 0
+	parquetList = 3
+
+	parquetPlain = 0
+	parquetRLE   = 3
+	parquetGzip  = 2
+
+	parquetDataPage = 0
+)
+
+// parquetColumn is one leaf column of the packet schema.
+type parquetColumn struct {
+	name    string
+	str     func(p Packet) string
+	int64   func(p Packet) int64
+	list    func(p Packet) []int
+	isList  bool
+	isBytes bool
+}
+
+// parquetColumns mirrors Packet; counter arrays are stored as LIST<INT64>.
+var parquetColumns = []parquetColumn{
+	{name: "timestamp", int64: func(p Packet) int64 { return int64(p.Timestamp) }},
+	{name: "seq", int64: func(p Packet) int64 { return int64(p.Seq) }},
+	{name: "node_id", int64: func(p Packet) int64 { return int64(p.NodeID) }},
+	{name: "source_ip", isBytes: true, str: func(p Packet) string { return p.Src }},
+	{name: "dest_ip", isBytes: true, str: func(p Packet) string { return p.Dest }},
+	{name: "total_bytes", int64: func(p Packet) int64 { return int64(p.TotalBytes) }},
+	{name: "udp_packets", isList: true, list: func(p Packet) []int { return p.UDPPackets }},
+	{name: "udp_bytes", isList: true, list: func(p Packet) []int { return p.UDPBytes }},
+	{name: "tcp_packets", isList: true, list: func(p Packet) []int { return p.TCPPackets }},
+	{name: "tcp_bytes", isList: true, list: func(p Packet) []int { return p.TCPBytes }},
+}
+
+// parquetChunk records where a column chunk landed for the footer.
+type parquetChunk struct {
+	offset           int64
+	numValues        int64
+	uncompressedSize int64
+	compressedSize   int64
+}
+
+type parquetRowGroup struct {
+	numRows int64
+	chunks  []parquetChunk
+}
+
+// parquetFile writes packets as Parquet: one row group per Append, gzip
+// compressed PLAIN pages, and the footer on Close.
+type parquetFile struct {
+	f         *os.File
+	offset    int64
+	rowGroups []parquetRowGroup
+	numRows   int64
+}
+
+func createParquetFile(path string) (*parquetFile, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.WriteString(parquetMagic); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &parquetFile{f: f, offset: int64(len(parquetMagic))}, nil
+}
+
+// Append writes packets as a new row group.
+func (pf *parquetFile) Append(packets []Packet) error {
+	rg := parquetRowGroup{numRows: int64(len(packets))}
+	for _, col := range parquetColumns {
+		page, numValues, err := encodeParquetPage(col, packets)
+		if err != nil {
+			return err
+		}
+		chunk := parquetChunk{offset: pf.offset, numValues: numValues}
+		chunk.uncompressedSize, chunk.compressedSize = page.uncompressed, int64(len(page.data))
+		if _, err := pf.f.Write(page.data); err != nil {
+			return err
+		}
+		pf.offset += int64(len(page.data))
+		rg.chunks = append(rg.chunks, chunk)
+	}
+	pf.rowGroups = append(pf.rowGroups, rg)
+	pf.numRows += rg.numRows
+	return nil
+}
+
+// Close writes the footer and closes the file.
+func (pf *parquetFile) Close() error {
+	footer := pf.footer()
+	footer = binary.LittleEndian.AppendUint32(footer, uint32(len(footer)))
+	footer = append(footer, parquetMagic...)
+	if _, err := pf.f.Write(footer); err != nil {
+		pf.f.Close()
+		return err
+	}
+	return pf.f.Close()
+}
+
+type parquetPage struct {
+	data         []byte // page header + compressed body
+	uncompressed int64  // header + uncompressed body, as Parquet counts it
+}
+
+func encodeParquetPage(col parquetColumn, packets []Packet) (parquetPage, int64, error) {
+	var body []byte
+	numValues := int64(len(packets))
+
+	switch {
+	case col.isList:
+		var rep, def []byte
+		var values []byte
+		numValues = 0
+		for _, p := range packets {
+			items := col.list(p)
+			if len(items) == 0 {
+				rep, def = append(rep, 0), append(def, 0)
+				numValues++
+				continue
+			}
+			for i, v := range items {
+				level := byte(1)
+				if i == 0 {
+					level = 0
+				}
+				rep = append(rep, level)
+				def = append(def, 1)
+				values = binary.LittleEndian.AppendUint64(values, uint64(int64(v)))
+				numValues++
+			}
+		}
+		body = appendParquetLevels(body, rep)
+		body = appendParquetLevels(body, def)
+		body = append(body, values...)
+	case col.isBytes:
+		for _, p := range packets {
+			s := col.str(p)
+			body = binary.LittleEndian.AppendUint32(body, uint32(len(s)))
+			body = append(body, s...)
+		}
+	default:
+		for _, p := range packets {
+			body = binary.LittleEndian.AppendUint64(body, uint64(col.int64(p)))
+		}
+	}
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if _, err := zw.Write(body); err != nil {
+		return parquetPage{}, 0, err
+	}
+	if err := zw.Close(); err != nil {
+		return parquetPage{}, 0, err
+	}
+
+	var h thriftWriter
+	h.i32(1, parquetDataPage)
+	h.i32(2, int32(len(body)))
+	h.i32(3, int32(compressed.Len()))
+	h.structBegin(5)
+	h.i32(1, int32(numValues))
+	h.i32(2, parquetPlain)
+	h.i32(3, parquetRLE)
+	h.i32(4, parquetRLE)
+	h.structEnd()
+	h.stop()
+
+	page := parquetPage{
+		data:         append(h.buf, compressed.Bytes()...),
+		uncompressed: int64(len(h.buf) + len(body)),
+	}
+	return page, numValues, nil
+}
+
+// appendParquetLevels RLE-encodes 0/1 levels (bit width 1) with the 4-byte
+// length prefix used by v1 data pages.
+func appendParquetLevels(dst []byte, levels []byte) []byte {
+	var runs []byte
+	for i := 0; i < len(levels); {
+		j := i
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+		runs = binary.AppendUvarint(runs, uint64(j-i)<<1)
+		runs = append(runs, levels[i])
+		i = j
+	}
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(runs)))
+	return append(dst, runs...)
+}
+
+func (pf *parquetFile) footer() []byte {
+	var w thriftWriter
+	w.i32(1, 1) // version
+
+	// Schema: root, then one element per column (three for lists).
+	numElements := 1
+	for _, col := range parquetColumns {
+		numElements++
+		if col.isList {
+			numElements += 2
+		}
+	}
+	w.listBegin(2, thriftStruct, numElements)
+	w.elemBegin()
+	w.str(4, "schema")
+	w.i32(5, int32(len(parquetColumns)))
+	w.elemEnd()
+	for _, col := range parquetColumns {
+		switch {
+		case col.isList:
+			w.elemBegin()
+			w.i32(3, parquetRequired)
+			w.str(4, col.name)
+			w.i32(5, 1)
+			w.i32(6, parquetList)
+			w.elemEnd()
+			w.elemBegin()
+			w.i32(3, parquetRepeated)
+			w.str(4, "list")
+			w.i32(5, 1)
+			w.elemEnd()
+			w.elemBegin()
+			w.i32(1, parquetInt64)
+			w.i32(3, parquetRequired)
+			w.str(4, "element")
+			w.elemEnd()
+		case col.isBytes:
+			w.elemBegin()
+			w.i32(1, parquetByteArray)
+			w.i32(3, parquetRequired)
+			w.str(4, col.name)
+			w.i32(6, parquetUTF8)
+			w.elemEnd()
+		default:
+			w.elemBegin()
+			w.i32(1, parquetInt64)
+			w.i32(3, parquetRequired)
+			w.str(4, col.name)
+			w.elemEnd()
+		}
+	}
+
+	w.i64(3, pf.numRows)
+
+	w.listBegin(4, thriftStruct, len(pf.rowGroups))
+	for _, rg := range pf.rowGroups {
+		w.elemBegin()
+		var totalSize int64
+		w.listBegin(1, thriftStruct, len(rg.chunks))
+		for i, chunk := range rg.chunks {
+			col := parquetColumns[i]
+			totalSize += chunk.uncompressedSize
+
+			w.elemBegin()
+			w.i64(2, chunk.offset)
+			w.structBegin(3)
+			if col.isBytes {
+				w.i32(1, parquetByteArray)
+			} else {
+				w.i32(1, parquetInt64)
+			}
+			w.listBegin(2, thriftI32, 2)
+			w.listI32(parquetPlain)
+			w.listI32(parquetRLE)
+			path := []string{col.name}
+			if col.isList {
+				path = append(path, "list", "element")
+			}
+			w.listBegin(3, thriftBinary, len(path))
+			for _, p := range path {
+				w.listStr(p)
+			}
+			w.i32(4, parquetGzip)
+			w.i64(5, chunk.numValues)
+			w.i64(6, chunk.uncompressedSize)
+			w.i64(7, chunk.compressedSize)
+			w.i64(9, chunk.offset)
+			w.structEnd()
+			w.elemEnd()
+		}
+		w.i64(2, totalSize)
+		w.i64(3, rg.numRows)
+		w.elemEnd()
+	}
+
+	w.str(6, "ld2606 traffic backend")
+	w.stop()
+	return w.buf
+}
+
+// Thrift compact protocol field types.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes the subset of the Thrift compact protocol needed for
+// Parquet metadata.
+type thriftWriter struct {
+	buf    []byte
+	lastID int16
+	stack  []int16
+}
+
+func (w *thriftWriter) field(id int16, typ byte) {
+	if delta := id - w.lastID; delta > 0 && delta <= 15 {
+		w.buf = append(w.buf, byte(delta)<<4|typ)
+	} else {
+		w.buf = append(w.buf, typ)
+		w.buf = binary.AppendVarint(w.buf, int64(id))
+	}
+	w.lastID = id
+}
+
+func (w *thriftWriter) i32(id int16, v int32) {
+	w.field(id, thriftI32)
+	w.buf = binary.AppendVarint(w.buf, int64(v))
+}
+
+func (w *thriftWriter) i64(id int16, v int64) {
+	w.field(id, thriftI64)
+	w.buf = binary.AppendVarint(w.buf, v)
+}
+
+func (w *thriftWriter) str(id int16, s string) {
+	w.field(id, thriftBinary)
+	w.listStr(s)
+}
+
+func (w *thriftWriter) listBegin(id int16, elemType byte, n int) {
+	w.field(id, thriftList)
+	if n < 15 {
+		w.buf = append(w.buf, byte(n)<<4|elemType)
+	} else {
+		w.buf = append(w.buf, 0xf0|elemType)
+		w.buf = binary.AppendUvarint(w.buf, uint64(n))
+	}
+}
+
+func (w *thriftWriter) listI32(v int32) { w.buf = binary.AppendVarint(w.buf, int64(v)) }
+
+func (w *thriftWriter) listStr(s string) {
+	w.buf = binary.AppendUvarint(w.buf, uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *thriftWriter) structBegin(id int16) {
+	w.field(id, thriftStruct)
+	w.elemBegin()
+}
+
+func (w *thriftWriter) structEnd() { w.elemEnd() }
+
+// elemBegin starts a struct that is a list element (no field header).
+func (w *thriftWriter) elemBegin() {
+	w.stack = append(w.stack, w.lastID)
+	w.lastID = 0
+}
+
+func (w *thriftWriter) elemEnd() {
+	w.stop()
+	w.lastID = w.stack[len(w.stack)-1]
+	w.stack = w.stack[:len(w.stack)-1]
+}
+
+func (w *thriftWriter) stop() { w.buf = append(w.buf, 0) }
+
+// parquetSink archives raw packet records into hourly-partitioned Parquet
+// files. Each sink batch becomes a row group; files rotate on size, age, or
+// hour change and closed files are uploaded to S3 when a bucket is configured.
+type parquetSink struct {
+	dir      string
+	prefix   string
+	maxRows  int64
+	maxAge   time.Duration
+	uploader *s3Uploader
+	hostname string
+	kick     chan struct{}
+
+	mu      sync.Mutex
+	current *parquetFile
+	path    string
+	opened  time.Time
+	seq     int
+}
+
+func initParquetSink(ctx context.Context, cfg *Config) {
+	if cfg.ParquetDir == "" && cfg.S3Bucket == "" {
+		return
+	}
+
+	dir := cfg.ParquetDir
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "traffic-parquet")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		errorLog("Parquet sink disabled: %v", err)
+		return
+	}
+
+	s := &parquetSink{
+		dir:     dir,
+		prefix:  strings.Trim(cfg.S3Prefix, "/"),
+		maxRows: int64(cfg.ParquetMaxRows),
+		maxAge:  cfg.ParquetRotateInterval,
+		kick:    make(chan struct{}, 1),
+	}
+	s.hostname, _ = os.Hostname()
+	if s.hostname == "" {
+		s.hostname = "backend"
+	}
+	if cfg.S3Bucket != "" {
+		u, err := newS3Uploader(cfg.S3Endpoint, cfg.S3Region, cfg.S3Bucket, cfg.S3AccessKey, cfg.S3SecretKey)
+		if err != nil {
+			errorLog("Parquet sink disabled: %v", err)
+			return
+		}
+		s.uploader = u
+	}
+
+	registerSink(s, cfg.ParquetRowGroupSize, cfg.ParquetFlushInterval)
+	workers.Add(1)
+	go s.uploadLoop(ctx)
+}
+
+func (s *parquetSink) Name() string { return "parquet" }
+
+func (s *parquetSink) Write(ctx context.Context, packets []Packet) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.current != nil && s.due(time.Now()) {
+		s.rotate()
+	}
+	if s.current == nil {
+		if err := s.open(time.Now().UTC()); err != nil {
+			return err
+		}
+	}
+	if err := s.current.Append(packets); err != nil {
+		// A partial row group leaves the file unreadable; start over.
+		s.current.f.Close()
+		os.Remove(s.path)
+		s.current = nil
+		return err
+	}
+	if s.current.numRows >= s.maxRows {
+		s.rotate()
+	}
+	return nil
+}
+
+// due reports whether the open file has reached its age limit or hour.
+func (s *parquetSink) due(now time.Time) bool {
+	return now.Sub(s.opened) >= s.maxAge || !now.UTC().Truncate(time.Hour).Equal(s.opened.Truncate(time.Hour))
+}
+
+// uploadLoop closes idle files on schedule and uploads closed files, one at
+// a time; failed uploads stay on disk and are retried every minute.
+func (s *parquetSink) uploadLoop(ctx context.Context) {
+	defer workers.Done()
+	s.uploadPending(ctx)
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			s.mu.Lock()
+			if s.current != nil {
+				s.rotate()
+			}
+			s.mu.Unlock()
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			if s.current != nil && s.due(now) {
+				s.rotate()
+			}
+			s.mu.Unlock()
+		case <-s.kick:
+		}
+		s.uploadPending(ctx)
+	}
+}
+
+// open starts a new file; its name encodes the partition it uploads to.
+func (s *parquetSink) open(now time.Time) error {
+	s.seq++
+	name := fmt.Sprintf("%s_%s_%s-%s-%04d.parquet",
+		now.Format("2006-01-02"), now.Format("15"), s.hostname, now.Format("20060102T150405Z"), s.seq)
+	path := filepath.Join(s.dir, name+".tmp")
+	pf, err := createParquetFile(path)
+	if err != nil {
+		return err
+	}
+	s.current, s.path, s.opened = pf, path, now
+	debugLog("Parquet sink opened %s", path)
+	return nil
+}
+
+// rotate closes the current file and wakes the uploader. Callers hold s.mu.
+func (s *parquetSink) rotate() {
+	pf, path := s.current, s.path
+	s.current = nil
+	if err := pf.Close(); err != nil {
+		errorLog("Parquet sink failed to close %s: %v", path, err)
+		return
+	}
+	closed := strings.TrimSuffix(path, ".tmp")
+	if err := os.Rename(path, closed); err != nil {
+		errorLog("Parquet sink failed to rename %s: %v", path, err)
+		return
+	}
+	infoLog("Parquet sink closed %s (%d rows)", filepath.Base(closed), pf.numRows)
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+}
+
+// uploadPending uploads closed files left behind by failed uploads or a
+// previous run.
+func (s *parquetSink) uploadPending(ctx context.Context) {
+	if s.uploader == nil {
+		return
+	}
+	paths, _ := filepath.Glob(filepath.Join(s.dir, "*.parquet"))
+	for _, path := range paths {
+		s.upload(ctx, path)
+	}
+}
+
+// upload PUTs one closed file as {prefix}/date=YYYY-MM-DD/hour=HH/{name} and
+// removes it locally on success.
+func (s *parquetSink) upload(ctx context.Context, path string) {
+	name := filepath.Base(path)
+	parts := strings.SplitN(name, "_", 3)
+	if len(parts) != 3 {
+		errorLog("Parquet sink skipping unrecognized file %s", name)
+		return
+	}
+	key := fmt.Sprintf("date=%s/hour=%s/%s", parts[0], parts[1], parts[2])
+	if s.prefix != "" {
+		key = s.prefix + "/" + key
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		errorLog("Parquet sink failed to read %s: %v", name, err)
+		return
+	}
+	if err := s.uploader.put(ctx, key, data, "application/vnd.apache.parquet"); err != nil {
+		errorLog("Parquet upload of %s failed (will retry): %v", name, err)
+		return
+	}
+	os.Remove(path)
+	infoLog("Parquet sink uploaded s3://%s/%s", s.uploader.bucket, key)
+}
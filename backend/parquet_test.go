@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestThriftWriter(t *testing.T) {
+	var w thriftWriter
+	w.i32(1, 1)
+	w.i64(3, -2)
+	w.str(20, "ab")
+	w.structBegin(21)
+	w.i32(1, 300)
+	w.structEnd()
+	w.listBegin(22, thriftI32, 2)
+	w.listI32(0)
+	w.listI32(3)
+	w.stop()
+	want := []byte{
+		0x15, 0x02, // field 1 i32: 1
+		0x26, 0x03, // field 3 (delta 2) i64: -2
+		0x08, 0x28, 0x02, 'a', 'b', // field 20 (long form) binary
+		0x1c, 0x15, 0xd8, 0x04, 0x00, // field 21 struct { field 1 i32: 300 }
+		0x19, 0x25, 0x00, 0x06, // field 22 list<i32> [0, 3]
+		0x00,
+	}
+	if !bytes.Equal(w.buf, want) {
+		t.Fatalf("thrift\n got % x\nwant % x", w.buf, want)
+	}
+}
+
+func TestAppendParquetLevels(t *testing.T) {
+	got := appendParquetLevels(nil, []byte{0, 1, 1, 1, 0})
+	want := []byte{
+		0x06, 0x00, 0x00, 0x00, // length of the runs
+		0x02, 0x00, // 1 x 0
+		0x06, 0x01, // 3 x 1
+		0x02, 0x00, // 1 x 0
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("levels\n got % x\nwant % x", got, want)
+	}
+}
+
+// thriftReader decodes the Thrift compact protocol into maps keyed by field
+// ID, enough to read back the Parquet metadata parquetFile writes.
+type thriftReader struct {
+	t   *testing.T
+	buf []byte
+}
+
+func (r *thriftReader) byte() byte {
+	if len(r.buf) == 0 {
+		r.t.Fatal("thrift: unexpected end")
+	}
+	b := r.buf[0]
+	r.buf = r.buf[1:]
+	return b
+}
+
+func (r *thriftReader) varint() int64 {
+	v, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.t.Fatal("thrift: bad varint")
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.t.Fatal("thrift: bad varint")
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *thriftReader) value(typ byte) interface{} {
+	switch typ {
+	case thriftI32, thriftI64:
+		return r.varint()
+	case thriftBinary:
+		n := r.uvarint()
+		s := string(r.buf[:n])
+		r.buf = r.buf[n:]
+		return s
+	case thriftList:
+		h := r.byte()
+		n := uint64(h >> 4)
+		if n == 15 {
+			n = r.uvarint()
+		}
+		list := make([]interface{}, n)
+		for i := range list {
+			list[i] = r.value(h & 0x0f)
+		}
+		return list
+	case thriftStruct:
+		return r.structure()
+	}
+	r.t.Fatalf("thrift: unsupported type %d", typ)
+	return nil
+}
+
+func (r *thriftReader) structure() map[int16]interface{} {
+	fields := make(map[int16]interface{})
+	var last int16
+	for {
+		h := r.byte()
+		if h == 0 {
+			return fields
+		}
+		id := last + int16(h>>4)
+		if h>>4 == 0 {
+			id = int16(r.varint())
+		}
+		last = id
+		fields[id] = r.value(h & 0x0f)
+	}
+}
+
+// readTestLevels decodes 4-byte prefixed RLE levels of bit width 1.
+func readTestLevels(t *testing.T, body []byte) (levels []byte, rest []byte) {
+	t.Helper()
+	n := binary.LittleEndian.Uint32(body)
+	runs, rest := body[4:4+n], body[4+n:]
+	for len(runs) > 0 {
+		h, k := binary.Uvarint(runs)
+		if k <= 0 || h&1 != 0 {
+			t.Fatalf("unsupported level run % x", runs)
+		}
+		for i := uint64(0); i < h>>1; i++ {
+			levels = append(levels, runs[k])
+		}
+		runs = runs[k+1:]
+	}
+	return levels, rest
+}
+
+// readTestColumn reads one column chunk and returns its values per row.
+func readTestColumn(t *testing.T, file []byte, meta map[int16]interface{}, col parquetColumn, rows int) []interface{} {
+	t.Helper()
+	r := &thriftReader{t: t, buf: file[meta[9].(int64):]}
+	start := len(r.buf)
+	header := r.structure()
+	headerLen := start - len(r.buf)
+	compressed := r.buf[:header[3].(int64)]
+	if got := int64(headerLen + len(compressed)); got != meta[7].(int64) {
+		t.Fatalf("%s: compressed size %d, page takes %d", col.name, meta[7], got)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(body)) != header[2].(int64) || int64(headerLen+len(body)) != meta[6].(int64) {
+		t.Fatalf("%s: uncompressed size %d, header says %d", col.name, len(body), header[2])
+	}
+	if dp := header[5].(map[int16]interface{}); dp[1].(int64) != meta[5].(int64) {
+		t.Fatalf("%s: page has %d values, chunk %d", col.name, dp[1], meta[5])
+	}
+
+	var values []interface{}
+	switch {
+	case col.isList:
+		rep, body := readTestLevels(t, body)
+		def, body := readTestLevels(t, body)
+		for i := range rep {
+			if rep[i] == 0 {
+				values = append(values, []int{})
+			}
+			if def[i] == 1 {
+				last := &values[len(values)-1]
+				*last = append((*last).([]int), int(int64(binary.LittleEndian.Uint64(body))))
+				body = body[8:]
+			}
+		}
+	case col.isBytes:
+		for len(body) > 0 {
+			n := binary.LittleEndian.Uint32(body)
+			values = append(values, string(body[4:4+n]))
+			body = body[4+n:]
+		}
+	default:
+		for ; len(body) >= 8; body = body[8:] {
+			values = append(values, int64(binary.LittleEndian.Uint64(body)))
+		}
+	}
+	if len(values) != rows {
+		t.Fatalf("%s: %d rows, want %d", col.name, len(values), rows)
+	}
+	return values
+}
+
+// TestParquetFileRoundTrip writes two row groups and reads them back through
+// the footer, as a Parquet reader would.
+func TestParquetFileRoundTrip(t *testing.T) {
+	groups := [][]Packet{
+		{
+			{Timestamp: 100, Seq: 1, NodeID: 2, Src: "10.0.0.1", Dest: "10.0.0.2", TotalBytes: 300,
+				TCPPackets: []int{1, 2}, TCPBytes: []int{100, 200}, UDPPackets: []int{}, UDPBytes: nil},
+			{Timestamp: 101, Seq: 2, NodeID: 3, Src: "10.0.0.3", Dest: "10.0.0.4", TotalBytes: 5,
+				TCPPackets: []int{0}, TCPBytes: []int{0}, UDPPackets: []int{1, 1, 1}, UDPBytes: []int{1, 2, 2}},
+		},
+		{testPacket("10.0.0.5", "10.0.0.6", 102, 4, 70)},
+	}
+
+	path := filepath.Join(t.TempDir(), "test.parquet")
+	pf, err := createParquetFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, packets := range groups {
+		if err := pf.Append(packets); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(file[:4]) != parquetMagic || string(file[len(file)-4:]) != parquetMagic {
+		t.Fatal("missing PAR1 magic")
+	}
+	footerLen := int(binary.LittleEndian.Uint32(file[len(file)-8:]))
+	r := &thriftReader{t: t, buf: file[len(file)-8-footerLen : len(file)-8]}
+	meta := r.structure()
+	if len(r.buf) != 0 {
+		t.Fatalf("%d bytes after the footer", len(r.buf))
+	}
+
+	if meta[1].(int64) != 1 || meta[3].(int64) != 3 {
+		t.Fatalf("version %v, num_rows %v", meta[1], meta[3])
+	}
+	schema := meta[2].([]interface{})
+	if len(schema) != 1+len(parquetColumns)+2*4 || schema[0].(map[int16]interface{})[5].(int64) != int64(len(parquetColumns)) {
+		t.Fatalf("schema %v", schema)
+	}
+
+	rowGroups := meta[4].([]interface{})
+	if len(rowGroups) != len(groups) {
+		t.Fatalf("%d row groups, want %d", len(rowGroups), len(groups))
+	}
+	for g, rgValue := range rowGroups {
+		rg := rgValue.(map[int16]interface{})
+		packets := groups[g]
+		if rg[3].(int64) != int64(len(packets)) {
+			t.Fatalf("row group %d: %v rows", g, rg[3])
+		}
+		chunks := rg[1].([]interface{})
+		if len(chunks) != len(parquetColumns) {
+			t.Fatalf("row group %d: %d chunks", g, len(chunks))
+		}
+		for i, chunkValue := range chunks {
+			col := parquetColumns[i]
+			cm := chunkValue.(map[int16]interface{})[3].(map[int16]interface{})
+			path := cm[3].([]interface{})
+			if path[0] != col.name || cm[4].(int64) != parquetGzip {
+				t.Fatalf("row group %d column %d: path %v codec %v", g, i, path, cm[4])
+			}
+
+			values := readTestColumn(t, file, cm, col, len(packets))
+			for row, p := range packets {
+				var want interface{}
+				switch {
+				case col.isList:
+					want = append([]int{}, col.list(p)...)
+				case col.isBytes:
+					want = col.str(p)
+				default:
+					want = col.int64(p)
+				}
+				if !reflect.DeepEqual(values[row], want) {
+					t.Errorf("row group %d row %d %s = %v, want %v", g, row, col.name, values[row], want)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import "errors"
+
+// pauseState is a client's pause command: while paused it gets no update or
+// snapshot frames. With backlog, the ones it missed are kept, up to
+// WS_PAUSE_BACKLOG, and sent on resume; otherwise, or once the backlog
+// overflowed, resume sends a snapshot. Guarded by clientsMu.
+type pauseState struct {
+	paused  bool
+	keep    bool
+	backlog [][]byte
+
+	// lost is set when the backlog overflowed or no longer matches the
+	// client's projection.
+	lost bool
+}
+
+// pauseFeed stops the client's data frames; keep asks for a backlog.
+// Pausing again without backlog drops the backlog kept so far.
+func (c *client) pauseFeed(keep bool) {
+	c.srv.clientsMu.Lock()
+	defer c.srv.clientsMu.Unlock()
+
+	keep = keep && c.srv.config.WSPauseBacklog > 0
+	if !c.pause.paused {
+		c.pause = pauseState{paused: true, keep: keep, lost: !keep}
+	} else if !keep {
+		c.pause.keep, c.pause.backlog, c.pause.lost = false, nil, true
+	}
+	c.sendPauseFrame(map[string]interface{}{"type": "pause", "state": "paused", "backlog": keep})
+	debugLog("WebSocket client %s paused (backlog=%v)", c.remoteAddr, keep)
+}
+
+// resumeFeed restarts the client's data frames, first queuing the backlog
+// or, when there is none, a snapshot.
+func (c *client) resumeFeed() error {
+	c.srv.clientsMu.Lock()
+	defer c.srv.clientsMu.Unlock()
+
+	if !c.pause.paused {
+		return errors.New("not paused")
+	}
+	state := c.pause
+	c.pause = pauseState{}
+	if _, ok := c.srv.clients[c]; !ok {
+		return nil
+	}
+
+	if !state.lost {
+		c.sendPauseFrame(map[string]interface{}{"type": "pause", "state": "resumed", "frames": len(state.backlog)})
+		for _, payload := range state.backlog {
+			if !c.enqueue(payload) {
+				c.resync.Store(true)
+				break
+			}
+		}
+		debugLog("WebSocket client %s resumed (%d frames from its backlog)", c.remoteAddr, len(state.backlog))
+		return nil
+	}
+
+	c.sendPauseFrame(map[string]interface{}{"type": "pause", "state": "resumed", "snapshot": true})
+	payload, err := c.srv.snapshotFrame().encode(c.format, c.projection.Load())
+	if err != nil {
+		return err
+	}
+	if !c.allow(len(payload)) || !c.enqueue(payload) {
+		c.resync.Store(true)
+	}
+	debugLog("WebSocket client %s resumed with a snapshot", c.remoteAddr)
+	return nil
+}
+
+// holdBack reports whether the hub should not send msg to the paused
+// client, keeping its payload in the backlog when asked to. The caller
+// holds clientsMu.
+func (c *client) holdBack(msg *frameCache) bool {
+	if !c.pause.paused {
+		return false
+	}
+	if c.pause.lost {
+		return true
+	}
+	payload, err := msg.payload(c.format, c.projection.Load())
+	if err != nil {
+		errorLog("Error encoding %s payload: %v", msg.frame.Type, err)
+		c.pause.backlog, c.pause.lost = nil, true
+		return true
+	}
+	if payload == nil {
+		return true
+	}
+	if len(c.pause.backlog) >= c.srv.config.WSPauseBacklog {
+		debugLog("Pause backlog full for %s; will send a snapshot on resume", c.remoteAddr)
+		c.pause.backlog, c.pause.lost = nil, true
+		return true
+	}
+	c.pause.backlog = append(c.pause.backlog, payload)
+	return true
+}
+
+// dropBacklog discards the backlog of a paused client whose projection
+// changed, so it gets a snapshot in the new shape on resume instead. It
+// reports whether the client is paused.
+func (c *client) dropBacklog() bool {
+	c.srv.clientsMu.Lock()
+	defer c.srv.clientsMu.Unlock()
+	if c.pause.paused {
+		c.pause.backlog, c.pause.lost = nil, true
+	}
+	return c.pause.paused
+}
+
+func (c *client) sendPauseFrame(msg map[string]interface{}) {
+	payload, err := marshalFrame(c.format, msg)
+	if err == nil {
+		c.enqueue(payload)
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// pcap link-layer types handled by the reader.
+const (
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+	linkTypeLinuxSLL = 113
+
+	pcapMaxSnapLen = 1 << 18
+)
+
+// pcapReplay is a running (or finished) replay of a capture file.
+type pcapReplay struct {
+	Path     string
+	Speed    float64
+	Rebase   bool
+	Started  time.Time
+	Finished time.Time
+	Error    string
+
+	srv     *Server
+	frames  atomic.Int64
+	packets atomic.Int64
+	cancel  context.CancelFunc
+}
+
+// startPcapReplay begins replaying path in the background. speed scales the
+// original timing (0 ingests as fast as possible); rebase shifts capture
+// timestamps so the first second of the capture maps to now.
+func (s *Server) startPcapReplay(ctx context.Context, path string, speed float64, rebase bool) (*pcapReplay, error) {
+	s.pcapMu.Lock()
+	defer s.pcapMu.Unlock()
+
+	if s.pcap != nil && s.pcap.Finished.IsZero() {
+		return nil, errors.New("a pcap replay is already running")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	r := &pcapReplay{
+		Path:    path,
+		Speed:   speed,
+		Rebase:  rebase,
+		Started: time.Now(),
+		srv:     s,
+		cancel:  cancel,
+	}
+	s.pcap = r
+
+	go func() {
+		defer f.Close()
+		err := r.run(ctx, f)
+
+		s.pcapMu.Lock()
+		r.Finished = time.Now()
+		if err != nil {
+			r.Error = err.Error()
+		}
+		s.pcapMu.Unlock()
+
+		if err != nil {
+			errorLog("pcap replay of %s stopped: %v", path, err)
+		} else {
+			infoLog("pcap replay of %s finished: %d frames, %d packets", path, r.frames.Load(), r.packets.Load())
+		}
+	}()
+
+	infoLog("Replaying pcap %s (speed=%g, rebase=%v)", path, speed, rebase)
+	return r, nil
+}
+
+// stopPcapReplay cancels the running replay, reporting whether one was running.
+func (s *Server) stopPcapReplay() bool {
+	s.pcapMu.Lock()
+	defer s.pcapMu.Unlock()
+
+	if s.pcap == nil || !s.pcap.Finished.IsZero() {
+		return false
+	}
+	s.pcap.cancel()
+	return true
+}
+
+// pcapStatus describes the most recent replay, or nil if none was started.
+func (s *Server) pcapStatus() map[string]interface{} {
+	s.pcapMu.Lock()
+	defer s.pcapMu.Unlock()
+
+	replay := s.pcap
+	if replay == nil {
+		return nil
+	}
+	status := map[string]interface{}{
+		"path":    replay.Path,
+		"speed":   replay.Speed,
+		"rebase":  replay.Rebase,
+		"started": replay.Started,
+		"running": replay.Finished.IsZero(),
+		"frames":  replay.frames.Load(),
+		"packets": replay.packets.Load(),
+	}
+	if !replay.Finished.IsZero() {
+		status["finished"] = replay.Finished
+	}
+	if replay.Error != "" {
+		status["error"] = replay.Error
+	}
+	return status
+}
+
+// pcapBin accumulates one src/dest pair within one capture second.
+type pcapBin struct {
+	tcpPackets, tcpBytes int
+	udpPackets, udpBytes int
+}
+
+func (r *pcapReplay) run(ctx context.Context, f io.Reader) error {
+	pr, err := newPcapReader(f)
+	if err != nil {
+		return err
+	}
+
+	var (
+		second    int64 = -1
+		firstSec  int64
+		wallStart = time.Now()
+		bins      = make(map[[2]string]*pcapBin)
+		channel   = channelFor("pcap")
+	)
+
+	emit := func() error {
+		if len(bins) == 0 {
+			return nil
+		}
+		if r.Speed > 0 {
+			due := wallStart.Add(time.Duration(float64(second-firstSec) * float64(time.Second) / r.Speed))
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Until(due)):
+			}
+		}
+
+		ts := second
+		if r.Rebase {
+			ts = wallStart.Unix() + (second - firstSec)
+		}
+		packets := make([]Packet, 0, len(bins))
+		for pair, b := range bins {
+			packets = append(packets, Packet{
+				Key:        fmt.Sprintf("pcap:%s:%s:%d", pair[1], pair[0], ts),
+				Timestamp:  int(ts),
+				Src:        pair[0],
+				Dest:       pair[1],
+				TotalBytes: b.tcpBytes + b.udpBytes,
+				TCPPackets: []int{b.tcpPackets},
+				TCPBytes:   []int{b.tcpBytes},
+				UDPPackets: []int{b.udpPackets},
+				UDPBytes:   []int{b.udpBytes},
+			})
+		}
+		channel.decoded(len(packets))
+		r.srv.ingestPackets("pcap", packets)
+		r.packets.Add(int64(len(packets)))
+		bins = make(map[[2]string]*pcapBin)
+		return nil
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		rec, err := pr.next()
+		if err == io.EOF {
+			return emit()
+		}
+		if err != nil {
+			return err
+		}
+		r.frames.Add(1)
+		channel.message(len(rec.data))
+
+		src, dest, proto, ok := parseFrame(pr.linkType, rec.data)
+		if !ok || (proto != 6 && proto != 17) {
+			continue
+		}
+
+		if rec.sec != second {
+			if second >= 0 {
+				if err := emit(); err != nil {
+					return err
+				}
+			} else {
+				firstSec = rec.sec
+			}
+			second = rec.sec
+		}
+
+		b := bins[[2]string{src, dest}]
+		if b == nil {
+			b = &pcapBin{}
+			bins[[2]string{src, dest}] = b
+		}
+		if proto == 6 {
+			b.tcpPackets++
+			b.tcpBytes += rec.origLen
+		} else {
+			b.udpPackets++
+			b.udpBytes += rec.origLen
+		}
+	}
+}
+
+// pcapReader reads classic libpcap files (microsecond or nanosecond, either byte order).
+type pcapReader struct {
+	r        *bufio.Reader
+	order    binary.ByteOrder
+	linkType uint32
+}
+
+type pcapRecord struct {
+	sec     int64
+	origLen int
+	data    []byte
+}
+
+func newPcapReader(f io.Reader) (*pcapReader, error) {
+	pr := &pcapReader{r: bufio.NewReader(f)}
+
+	var header [24]byte
+	if _, err := io.ReadFull(pr.r, header[:]); err != nil {
+		return nil, fmt.Errorf("read pcap header: %w", err)
+	}
+	switch binary.LittleEndian.Uint32(header[0:4]) {
+	case 0xa1b2c3d4, 0xa1b23c4d:
+		pr.order = binary.LittleEndian
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		pr.order = binary.BigEndian
+	default:
+		return nil, errors.New("not a pcap file (pcapng is not supported)")
+	}
+	pr.linkType = pr.order.Uint32(header[20:24]) & 0x0fffffff
+	return pr, nil
+}
+
+func (pr *pcapReader) next() (pcapRecord, error) {
+	var header [16]byte
+	if _, err := io.ReadFull(pr.r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return pcapRecord{}, io.EOF
+		}
+		return pcapRecord{}, err
+	}
+
+	inclLen := pr.order.Uint32(header[8:12])
+	if inclLen > pcapMaxSnapLen {
+		return pcapRecord{}, fmt.Errorf("record of %d bytes exceeds limit", inclLen)
+	}
+	data := make([]byte, inclLen)
+	if _, err := io.ReadFull(pr.r, data); err != nil {
+		return pcapRecord{}, io.EOF
+	}
+	return pcapRecord{
+		sec:     int64(pr.order.Uint32(header[0:4])),
+		origLen: int(pr.order.Uint32(header[12:16])),
+		data:    data,
+	}, nil
+}
+
+// parseFrame extracts the IP endpoints and transport protocol of a captured frame.
+func parseFrame(linkType uint32, data []byte) (src, dest string, proto byte, ok bool) {
+	var etherType uint16
+	switch linkType {
+	case linkTypeEthernet:
+		if len(data) < 14 {
+			return
+		}
+		etherType = binary.BigEndian.Uint16(data[12:14])
+		data = data[14:]
+		for etherType == 0x8100 || etherType == 0x88a8 {
+			if len(data) < 4 {
+				return
+			}
+			etherType = binary.BigEndian.Uint16(data[2:4])
+			data = data[4:]
+		}
+	case linkTypeLinuxSLL:
+		if len(data) < 16 {
+			return
+		}
+		etherType = binary.BigEndian.Uint16(data[14:16])
+		data = data[16:]
+	case linkTypeRaw:
+		if len(data) < 1 {
+			return
+		}
+		etherType = 0x0800
+		if data[0]>>4 == 6 {
+			etherType = 0x86dd
+		}
+	default:
+		return
+	}
+
+	switch etherType {
+	case 0x0800:
+		if len(data) < 20 {
+			return
+		}
+		return net.IP(data[12:16]).String(), net.IP(data[16:20]).String(), data[9], true
+	case 0x86dd:
+		if len(data) < 40 {
+			return
+		}
+		return net.IP(data[8:24]).String(), net.IP(data[24:40]).String(), data[6], true
+	}
+	return
+}
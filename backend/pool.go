@@ -0,0 +1,70 @@
+package main
+
+import "sync"
+
+const (
+	// Buffers and slices that grew past these sizes are left to the GC so a
+	// single burst does not pin large arrays in the pools.
+	maxPooledBuffer  = 1 << 20
+	maxPooledPackets = 4096
+)
+
+// bufferPool recycles byte buffers for raw input payloads (ZeroMQ frames,
+// HTTP ingest bodies) and encoding scratch space.
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 4096)
+		return &b
+	},
+}
+
+// getBuffer returns a pooled buffer of length n.
+func getBuffer(n int) []byte {
+	b := *bufferPool.Get().(*[]byte)
+	if cap(b) < n {
+		return make([]byte, n)
+	}
+	return b[:n]
+}
+
+// putBuffer returns b to the pool; the caller must not use it afterwards.
+func putBuffer(b []byte) {
+	if cap(b) > maxPooledBuffer {
+		return
+	}
+	b = b[:0]
+	bufferPool.Put(&b)
+}
+
+// packetPool recycles the slices payloads are decoded into. Pooled slices are
+// zeroed, so decoding into one never sees (or keeps alive) earlier packets.
+var packetPool = sync.Pool{
+	New: func() interface{} {
+		p := make([]Packet, 0, 64)
+		return &p
+	},
+}
+
+// getPackets returns an empty pooled packet slice.
+func getPackets() []Packet {
+	return *packetPool.Get().(*[]Packet)
+}
+
+// releasePackets returns a slice from getPackets (or decodePackets) to the
+// pool once nothing refers to it. Packet values copied out of it stay valid.
+func releasePackets(packets []Packet) {
+	if cap(packets) > maxPooledPackets {
+		return
+	}
+	clear(packets[:cap(packets)])
+	packets = packets[:0]
+	packetPool.Put(&packets)
+}
+
+// payloadsPool recycles the frame lists writeBatch collects.
+var payloadsPool = sync.Pool{
+	New: func() interface{} {
+		p := make([][]byte, 0, 16)
+		return &p
+	},
+}
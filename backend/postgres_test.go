@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestPGSCRAMRFC7677 runs the client against the SCRAM-SHA-256 example of
+// RFC 7677. PostgreSQL sends an empty user name, so the test swaps in the
+// RFC's client-first-bare to reproduce its proof and signature.
+func TestPGSCRAMRFC7677(t *testing.T) {
+	c := &pgSCRAM{password: "pencil", clientNonce: "rOprNGfwEbeRWgbNEkqO"}
+	if got := c.clientFirst(); got != "n,,n=,r=rOprNGfwEbeRWgbNEkqO" {
+		t.Fatalf("client-first %q", got)
+	}
+	c.firstBare = "n=user,r=rOprNGfwEbeRWgbNEkqO"
+
+	final, err := c.clientFinal("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="; final != want {
+		t.Fatalf("client-final\n got %s\nwant %s", final, want)
+	}
+	if err := c.verifyServer("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.verifyServer("v=AAAATRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="); err == nil {
+		t.Fatal("a wrong server signature was accepted")
+	}
+	if _, err := c.clientFinal("r=someoneelse,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"); err == nil {
+		t.Fatal("a server nonce without the client nonce was accepted")
+	}
+}
+
+func TestPGMD5Password(t *testing.T) {
+	if got := pgMD5Password("archiver", "secret", []byte{1, 2, 3, 4}); got != "md5f155d85f5efbed52694fe802b5f2191e" {
+		t.Fatalf("md5 password %s", got)
+	}
+}
+
+func TestPGQuoting(t *testing.T) {
+	if got := pgQuoteLiteral("o'k\\\x00"); got != `E'o''k\\'` {
+		t.Errorf("literal %s", got)
+	}
+	if got := pgQuoteTable(`lab.tr"affic`); got != `"lab"."tr""affic"` {
+		t.Errorf("table %s", got)
+	}
+}
+
+// fakePostgres is a PostgreSQL server that authenticates with md5 or
+// SCRAM-SHA-256 and answers every simple query with CommandComplete, or
+// with an ErrorResponse for queries starting with fail.
+type fakePostgres struct {
+	t        *testing.T
+	l        net.Listener
+	auth     string
+	password string
+
+	mu      sync.Mutex
+	conns   int
+	startup map[string]string
+	queries []string
+	fail    string
+}
+
+func newFakePostgres(t *testing.T, auth, password string) *fakePostgres {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakePostgres{t: t, l: l, auth: auth, password: password}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return f
+}
+
+func pgTestMessage(typ byte, body []byte) []byte {
+	return append(binary.BigEndian.AppendUint32([]byte{typ}, uint32(len(body)+4)), body...)
+}
+
+func pgTestAuth(code uint32, data []byte) []byte {
+	return pgTestMessage('R', append(binary.BigEndian.AppendUint32(nil, code), data...))
+}
+
+func (f *fakePostgres) serve(conn net.Conn) {
+	defer conn.Close()
+	f.mu.Lock()
+	f.conns++
+	f.mu.Unlock()
+
+	var size [4]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return
+	}
+	body := make([]byte, binary.BigEndian.Uint32(size[:])-4)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return
+	}
+	if v := binary.BigEndian.Uint32(body); v != pgProtocol3 {
+		f.t.Errorf("protocol version %d", v)
+		return
+	}
+	params := make(map[string]string)
+	fields := strings.Split(string(body[4:]), "\x00")
+	for i := 0; i+1 < len(fields) && fields[i] != ""; i += 2 {
+		params[fields[i]] = fields[i+1]
+	}
+	f.mu.Lock()
+	f.startup = params
+	f.mu.Unlock()
+
+	r := &postgresSink{conn: conn, r: bufio.NewReader(conn)}
+	expect := func() []byte {
+		typ, msg, err := r.receive()
+		if err != nil || typ != 'p' {
+			f.t.Errorf("password message: %c %v", typ, err)
+			return nil
+		}
+		return msg
+	}
+
+	switch f.auth {
+	case "md5":
+		conn.Write(pgTestAuth(5, []byte{1, 2, 3, 4}))
+		if got := string(expect()); got != pgMD5Password(params["user"], f.password, []byte{1, 2, 3, 4})+"\x00" {
+			conn.Write(pgTestMessage('E', []byte("SFATAL\x00C28P01\x00Mpassword authentication failed\x00\x00")))
+			return
+		}
+	case "scram":
+		conn.Write(pgTestAuth(10, []byte("SCRAM-SHA-256\x00\x00")))
+		msg := expect()
+		mech, rest, _ := bytes.Cut(msg, []byte{0})
+		if string(mech) != "SCRAM-SHA-256" || len(rest) < 4 || int(binary.BigEndian.Uint32(rest)) != len(rest)-4 {
+			f.t.Errorf("SASLInitialResponse %q", msg)
+			return
+		}
+		clientFirstBare := strings.TrimPrefix(string(rest[4:]), "n,,")
+		nonce := strings.TrimPrefix(clientFirstBare, "n=,r=") + "server"
+		salt := []byte("0123456789abcdef")
+		serverFirst := "r=" + nonce + ",s=" + base64.StdEncoding.EncodeToString(salt) + ",i=4096"
+		conn.Write(pgTestAuth(11, []byte(serverFirst)))
+
+		clientFinal := string(expect())
+		withoutProof, proof64, _ := strings.Cut(clientFinal, ",p=")
+		proof, _ := base64.StdEncoding.DecodeString(proof64)
+		salted, _ := pbkdf2.Key(sha256.New, f.password, salt, 4096, sha256.Size)
+		storedKey := sha256.Sum256(pgHMAC(salted, "Client Key"))
+		authMessage := clientFirstBare + "," + serverFirst + "," + withoutProof
+		sig := pgHMAC(storedKey[:], authMessage)
+		if len(proof) != len(sig) || withoutProof != "c=biws,r="+nonce {
+			f.t.Errorf("SASLResponse %q", clientFinal)
+			return
+		}
+		for i := range proof {
+			proof[i] ^= sig[i]
+		}
+		if sha256.Sum256(proof) != storedKey {
+			conn.Write(pgTestMessage('E', []byte("SFATAL\x00C28P01\x00Mpassword authentication failed\x00\x00")))
+			return
+		}
+		serverSig := pgHMAC(pgHMAC(salted, "Server Key"), authMessage)
+		conn.Write(pgTestAuth(12, []byte("v="+base64.StdEncoding.EncodeToString(serverSig))))
+	}
+	conn.Write(pgTestAuth(0, nil))
+	conn.Write(pgTestMessage('S', []byte("server_version\x0016.0\x00")))
+	conn.Write(pgTestMessage('Z', []byte{'I'}))
+
+	for {
+		typ, msg, err := r.receive()
+		if err != nil || typ != 'Q' {
+			return
+		}
+		query := strings.TrimSuffix(string(msg), "\x00")
+		f.mu.Lock()
+		f.queries = append(f.queries, query)
+		fail := f.fail != "" && strings.HasPrefix(query, f.fail)
+		f.mu.Unlock()
+		if fail {
+			conn.Write(pgTestMessage('E', []byte("SERROR\x00C42P01\x00Mrelation does not exist\x00\x00")))
+		} else {
+			conn.Write(pgTestMessage('C', []byte("OK\x00")))
+		}
+		conn.Write(pgTestMessage('Z', []byte{'I'}))
+	}
+}
+
+func TestPostgresSinkWrite(t *testing.T) {
+	for _, auth := range []string{"md5", "scram"} {
+		t.Run(auth, func(t *testing.T) {
+			f := newFakePostgres(t, auth, "secret")
+			cfg := loadConfig()
+			s, err := newPostgresSink(cfg, "postgres://archiver:secret@"+f.l.Addr().String()+"/monitoring")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { s.conn.Close() }()
+
+			ts := int(time.Now().Unix())
+			if err := s.Write(context.Background(), []Packet{testPacket("10.0.0.1", "10.0.0.2", ts, 1, 100)}); err != nil {
+				t.Fatal(err)
+			}
+
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			if f.startup["user"] != "archiver" || f.startup["database"] != "monitoring" || f.startup["application_name"] != "traffic-backend" {
+				t.Errorf("startup parameters %v", f.startup)
+			}
+			if len(f.queries) < 2 || !strings.HasPrefix(f.queries[0], `CREATE TABLE IF NOT EXISTS "traffic_summaries"`) {
+				t.Fatalf("queries %q", f.queries)
+			}
+			insert := f.queries[len(f.queries)-1]
+			if !strings.HasPrefix(insert, `INSERT INTO "traffic_summaries" (time, src, dest,`) || !strings.Contains(insert, "E'10.0.0.1',E'10.0.0.2',1,100,") {
+				t.Fatalf("insert %q", insert)
+			}
+		})
+	}
+}
+
+func TestPostgresSinkWrongPassword(t *testing.T) {
+	f := newFakePostgres(t, "scram", "secret")
+	s, err := newPostgresSink(loadConfig(), "postgres://archiver:wrong@"+f.l.Addr().String()+"/monitoring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pgErr *postgresError
+	if err := s.Write(context.Background(), []Packet{testPacket("10.0.0.1", "10.0.0.2", 1, 1, 1)}); !errors.As(err, &pgErr) || pgErr.code != "28P01" {
+		t.Fatalf("Write with a wrong password: %v", err)
+	}
+}
+
+// TestPostgresErrorKeepsSession checks that an ErrorResponse fails the batch
+// but keeps the connection, which is still in a known state.
+func TestPostgresErrorKeepsSession(t *testing.T) {
+	f := newFakePostgres(t, "md5", "secret")
+	s, err := newPostgresSink(loadConfig(), "postgres://archiver:secret@"+f.l.Addr().String()+"/monitoring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { s.conn.Close() }()
+	packets := []Packet{testPacket("10.0.0.1", "10.0.0.2", 1, 1, 1)}
+
+	f.mu.Lock()
+	f.fail = "INSERT"
+	f.mu.Unlock()
+	var pgErr *postgresError
+	if err := s.Write(context.Background(), packets); !errors.As(err, &pgErr) || pgErr.code != "42P01" || pgErr.message != "relation does not exist" {
+		t.Fatalf("Write: %v, want the server's error", err)
+	}
+	if s.conn == nil {
+		t.Fatal("an ErrorResponse closed the connection")
+	}
+
+	f.mu.Lock()
+	f.fail = ""
+	f.mu.Unlock()
+	if err := s.Write(context.Background(), packets); err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.conns != 1 {
+		t.Fatalf("%d connections, want 1", f.conns)
+	}
+}
+
+func TestPostgresReceiveRejectsBadLength(t *testing.T) {
+	for _, n := range []uint32{3, 1<<30 + 1} {
+		s := &postgresSink{r: bufio.NewReader(bytes.NewReader(binary.BigEndian.AppendUint32([]byte{'Z'}, n)))}
+		if _, _, err := s.receive(); err == nil {
+			t.Errorf("message length %d was accepted", n)
+		}
+	}
+}
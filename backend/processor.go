@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// processStage orders processors: every decode processor runs before every
+// enrich processor, and so on.
+type processStage int
+
+const (
+	// stageDecode normalizes fields as producers sent them.
+	stageDecode processStage = iota
+	// stageEnrich adds fields, so filters can use them.
+	stageEnrich
+	// stageFilter drops packets.
+	stageFilter
+	// stageTransform changes the packets that are kept.
+	stageTransform
+)
+
+func (s processStage) String() string {
+	switch s {
+	case stageDecode:
+		return "decode"
+	case stageEnrich:
+		return "enrich"
+	case stageFilter:
+		return "filter"
+	case stageTransform:
+		return "transform"
+	}
+	return fmt.Sprintf("stage(%d)", int(s))
+}
+
+// processor is one step of the pipeline decoded packets pass before they
+// reach the view, clients, and sinks. Process returns the packets to keep;
+// it may drop, change, or reorder them, and may reuse the slice. It runs
+// under the applyMu of s, the Server applying the packets, and may record
+// per-Server state there.
+type processor interface {
+	Name() string
+	Stage() processStage
+	Process(s *Server, packets []Packet) []Packet
+}
+
+// previewer is implemented by processors whose Process records state, such
+// as counters, that only the apply path may change. Preview makes the same
+// decisions without recording them, for paths outside applyMu.
+type previewer interface {
+	Preview(packets []Packet) []Packet
+}
+
+// processorFunc adapts a function to processor.
+type processorFunc struct {
+	name  string
+	stage processStage
+	fn    func([]Packet) []Packet
+}
+
+func (p processorFunc) Name() string                                 { return p.name }
+func (p processorFunc) Stage() processStage                          { return p.stage }
+func (p processorFunc) Process(_ *Server, packets []Packet) []Packet { return p.fn(packets) }
+
+// timestampProcessor wraps checkTimestamps, which counts skewed packets
+// against the Server applying them. Preview uses the TIMESTAMP_* settings of
+// cfg.
+type timestampProcessor struct {
+	cfg *Config
+}
+
+func (timestampProcessor) Name() string        { return "timestamps" }
+func (timestampProcessor) Stage() processStage { return stageFilter }
+func (timestampProcessor) Process(s *Server, packets []Packet) []Packet {
+	return checkTimestamps(s, packets)
+}
+func (t timestampProcessor) Preview(packets []Packet) []Packet {
+	return withoutQuarantined(t.cfg, packets)
+}
+
+// processors is the pipeline, sorted by stage; registered before the first
+// packet is applied and read-only after.
+var processors []processor
+
+// registerProcessor adds p to the pipeline after the processors of its
+// stage registered before it; call before packets are applied.
+func registerProcessor(p processor) {
+	processors = append(processors, p)
+	sort.SliceStable(processors, func(i, j int) bool {
+		return processors[i].Stage() < processors[j].Stage()
+	})
+}
+
+// optionalProcessors are the processors PROCESSORS can enable.
+var optionalProcessors = map[string]func() processor{
+	"protocol": func() processor {
+		return processorFunc{"protocol", stageDecode, normalizeProtocols}
+	},
+}
+
+// initProcessors registers the built-in processors, which do nothing unless
+// their own settings (TIMESTAMP_QUARANTINE, FILTER, DROP_RULES, sampling,
+// TRANSFORMS, ANONYMIZE_IPS) are set, and
+// the optional ones named in PROCESSORS.
+func initProcessors(cfg *Config) error {
+	registerProcessor(timestampProcessor{cfg})
+	registerProcessor(processorFunc{"filter", stageFilter, filterPackets})
+	registerProcessor(dropRulesProcessor{})
+	registerProcessor(processorFunc{"sample", stageFilter, cfg.samplePackets})
+	registerProcessor(transformProcessor{})
+	registerProcessor(anonymizeProcessor{})
+
+	for _, name := range splitList(cfg.Processors) {
+		newProcessor, ok := optionalProcessors[name]
+		if !ok {
+			names := make([]string, 0, len(optionalProcessors))
+			for n := range optionalProcessors {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("unknown processor %q (available: %s)", name, strings.Join(names, ", "))
+		}
+		registerProcessor(newProcessor())
+	}
+
+	steps := make([]string, len(processors))
+	for i, p := range processors {
+		steps[i] = p.Stage().String() + ":" + p.Name()
+	}
+	debugLog("Packet pipeline: %s", strings.Join(steps, " -> "))
+	return nil
+}
+
+// processPackets runs packets through the pipeline for s. Callers hold
+// s.applyMu.
+func processPackets(s *Server, packets []Packet) []Packet {
+	for _, p := range processors {
+		if len(packets) == 0 {
+			break
+		}
+		packets = p.Process(s, packets)
+	}
+	return packets
+}
+
+// previewPackets returns the packets processPackets would keep, as they
+// would be kept, without recording anything; it does not need applyMu.
+func previewPackets(s *Server, packets []Packet) []Packet {
+	for _, p := range processors {
+		if len(packets) == 0 {
+			break
+		}
+		if pv, ok := p.(previewer); ok {
+			packets = pv.Preview(packets)
+		} else {
+			packets = p.Process(s, packets)
+		}
+	}
+	return packets
+}
+
+// protocolNames maps IANA protocol numbers some producers send to names.
+var protocolNames = map[string]string{"1": "icmp", "6": "tcp", "17": "udp", "58": "ipv6-icmp"}
+
+// normalizeProtocols lower-cases protocol names and replaces the common
+// protocol numbers by names, so "TCP", "tcp", and "6" filter and index
+// alike.
+func normalizeProtocols(packets []Packet) []Packet {
+	for i := range packets {
+		p := &packets[i]
+		if p.Protocol == "" {
+			continue
+		}
+		p.Protocol = strings.ToLower(strings.TrimSpace(p.Protocol))
+		if name, ok := protocolNames[p.Protocol]; ok {
+			p.Protocol = name
+		}
+	}
+	return packets
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// summaryFieldIndex maps PacketSummary JSON field names to struct field indexes.
+var summaryFieldIndex = func() map[string]int {
+	t := reflect.TypeOf(PacketSummary{})
+	index := make(map[string]int, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		index[name] = i
+	}
+	return index
+}()
+
+// projection selects the PacketSummary fields and edges a client wants in its frames.
+type projection struct {
+	fields []string
+	// filter drops edges whose summary does not match (nil keeps all).
+	filter *filter
+	// key identifies the projection so frames are encoded once per distinct
+	// field set and filter.
+	key string
+}
+
+// newProjection validates field names and compiles the filter, returning nil
+// (all fields, all edges) when both are empty.
+func newProjection(fields []string, filterSource string) (*projection, error) {
+	var clean []string
+	for _, f := range fields {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if _, ok := summaryFieldIndex[f]; !ok {
+			return nil, fmt.Errorf("unknown field %q", f)
+		}
+		clean = append(clean, f)
+	}
+	p := &projection{fields: clean, key: strings.Join(clean, ",")}
+	if filterSource = strings.TrimSpace(filterSource); filterSource != "" {
+		f, err := compileFilter(filterSource, false)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter: %w", err)
+		}
+		p.filter = f
+		p.key += "|" + filterSource
+	}
+	if len(clean) == 0 && p.filter == nil {
+		return nil, nil
+	}
+	return p, nil
+}
+
+// restrict returns p keeping only tenant t's edges. The tenant filter is
+// ANDed with p's compiled filter, never spliced into its source, so no
+// filter text can widen the scope.
+func (p *projection) restrict(t string) (*projection, error) {
+	scope := tenantProjection(t)
+	if scope == nil {
+		return nil, fmt.Errorf("unknown tenant %q", t)
+	}
+	if p == nil {
+		return scope, nil
+	}
+	r := &projection{fields: p.fields, filter: scope.filter, key: "tenant=" + t + "\x00" + p.key}
+	if p.filter != nil {
+		r.filter = andFilters(scope.filter, p.filter)
+	}
+	return r, nil
+}
+
+// apply returns only the projected fields of s (all fields without a field list).
+func (p *projection) apply(s PacketSummary) interface{} {
+	if len(p.fields) == 0 {
+		return s
+	}
+	v := reflect.ValueOf(s)
+	out := make(map[string]interface{}, len(p.fields))
+	for _, f := range p.fields {
+		out[f] = v.Field(summaryFieldIndex[f]).Interface()
+	}
+	return out
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket QoS classes, from the first evicted to the last.
+const (
+	qosBestEffort  = "best-effort"
+	qosStandard    = "standard"
+	qosControlRoom = "control-room"
+)
+
+// qosClass is a class of WebSocket clients: how many frames each client can
+// have queued, how many bytes per second it may be sent, and which clients
+// make room when WS_MAX_CLIENTS is reached.
+type qosClass struct {
+	name string
+
+	// rank orders eviction: a full server evicts a client of a lower rank to
+	// admit one of a higher rank.
+	rank int
+
+	sendQueue int
+	maxRate   int64
+
+	clients   atomic.Int64
+	rejected  atomic.Int64
+	evicted   atomic.Int64
+	throttled atomic.Int64
+}
+
+// qosToken is one QOS_TOKENS entry.
+type qosToken struct {
+	class *qosClass
+	token string
+}
+
+var (
+	// qosClasses are the classes by rank; initQoS sets their limits.
+	qosClasses = []*qosClass{
+		{name: qosBestEffort, rank: 0},
+		{name: qosStandard, rank: 1},
+		{name: qosControlRoom, rank: 2},
+	}
+
+	// qosTokens are the parsed QOS_TOKENS.
+	qosTokens []qosToken
+)
+
+// initQoS parses QOS_TOKENS, QOS_SEND_QUEUE, and QOS_MAX_BYTES_PER_SEC.
+func initQoS(cfg *Config) error {
+	for _, entry := range splitList(cfg.QoSTokens) {
+		name, token, ok := strings.Cut(entry, ":")
+		q := qosClassNamed(name)
+		if !ok || token == "" || q == nil {
+			return fmt.Errorf("invalid QOS_TOKENS entry %q (want class:token)", entry)
+		}
+		qosTokens = append(qosTokens, qosToken{class: q, token: token})
+	}
+
+	queues, err := parseQoSLimit("QOS_SEND_QUEUE", cfg.QoSSendQueue)
+	if err != nil {
+		return err
+	}
+	rates, err := parseQoSLimit("QOS_MAX_BYTES_PER_SEC", cfg.QoSMaxBytesPerSec)
+	if err != nil {
+		return err
+	}
+	defaultQueues := map[string]int{
+		qosBestEffort:  max(cfg.WSSendQueue/4, 1),
+		qosStandard:    cfg.WSSendQueue,
+		qosControlRoom: cfg.WSSendQueue * 4,
+	}
+	for _, q := range qosClasses {
+		q.sendQueue = defaultQueues[q.name]
+		if n, ok := queues[q.name]; ok {
+			if n < 1 {
+				return fmt.Errorf("QOS_SEND_QUEUE for %s must be at least 1", q.name)
+			}
+			q.sendQueue = int(n)
+		}
+		q.maxRate = rates[q.name]
+	}
+	return nil
+}
+
+// parseQoSLimit reads "class:n" entries.
+func parseQoSLimit(env, v string) (map[string]int64, error) {
+	limits := make(map[string]int64)
+	for _, entry := range splitList(v) {
+		name, n, ok := strings.Cut(entry, ":")
+		limit, err := strconv.ParseInt(n, 10, 64)
+		if !ok || err != nil || limit < 0 || qosClassNamed(name) == nil {
+			return nil, fmt.Errorf("invalid %s entry %q (want class:n)", env, entry)
+		}
+		limits[name] = limit
+	}
+	return limits, nil
+}
+
+func qosClassNamed(name string) *qosClass {
+	for _, q := range qosClasses {
+		if q.name == name {
+			return q
+		}
+	}
+	return nil
+}
+
+// tokenQoS returns the class the request's token claims: its QOS_TOKENS
+// class, control-room for ADMIN_TOKEN, or nil.
+func (s *Server) tokenQoS(r *http.Request) *qosClass {
+	token := requestToken(r)
+	if token == "" {
+		return nil
+	}
+	for _, qt := range qosTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(qt.token)) == 1 {
+			return qt.class
+		}
+	}
+	if s.config.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.config.AdminToken)) == 1 {
+		return qosClassNamed(qosControlRoom)
+	}
+	return nil
+}
+
+// requestQoS resolves the class of a WebSocket request and writes an error
+// response when it cannot. ?qos= picks a class up to the one the token
+// claims, or up to standard without a claim; the default is the claimed
+// class, or standard.
+func (s *Server) requestQoS(w http.ResponseWriter, r *http.Request) (*qosClass, bool) {
+	ceiling := s.tokenQoS(r)
+	if ceiling == nil {
+		ceiling = qosClassNamed(qosStandard)
+	}
+	param := r.URL.Query().Get("qos")
+	if param == "" {
+		return ceiling, true
+	}
+	q := qosClassNamed(param)
+	if q == nil {
+		writeError(w, badQuery.errorf("Unknown qos %s (use %s, %s, or %s)", param, qosControlRoom, qosStandard, qosBestEffort))
+		return nil, false
+	}
+	if q.rank > ceiling.rank {
+		writeError(w, forbidden.errorf("qos %s needs a token that claims it", param))
+		return nil, false
+	}
+	return q, true
+}
+
+// admitClient takes a WS_MAX_CLIENTS slot for a client of class q. When the
+// server is full it evicts the newest client of the lowest class below q,
+// and reports false when there is none.
+func (s *Server) admitClient(q *qosClass) bool {
+	if n := s.wsAdmitted.Add(1); s.config.WSMaxClients > 0 && n > int64(s.config.WSMaxClients) {
+		victim := s.evictionCandidate(q)
+		if victim == nil {
+			s.wsAdmitted.Add(-1)
+			q.rejected.Add(1)
+			return false
+		}
+		victim.qos.evicted.Add(1)
+		infoLog("Evicting %s WebSocket client %s (id=%d, req=%s) for a %s client", victim.qos.name, victim.remoteAddr, victim.id, victim.requestID, q.name)
+		victim.disconnect(websocket.CloseTryAgainLater, "evicted for a "+q.name+" client")
+	}
+	q.clients.Add(1)
+	return true
+}
+
+// releaseClient gives back the slot taken by admitClient.
+func (s *Server) releaseClient(q *qosClass) {
+	q.clients.Add(-1)
+	s.wsAdmitted.Add(-1)
+}
+
+// evictionCandidate picks the client to make room for one of class q and
+// marks it, so concurrent admissions do not pick it again.
+func (s *Server) evictionCandidate(q *qosClass) *client {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	var victim *client
+	for c := range s.clients {
+		if c.qos.rank >= q.rank || c.evicting {
+			continue
+		}
+		if victim == nil || c.qos.rank < victim.qos.rank ||
+			c.qos.rank == victim.qos.rank && c.connectedAt.After(victim.connectedAt) {
+			victim = c
+		}
+	}
+	if victim != nil {
+		victim.evicting = true
+	}
+	return victim
+}
+
+// qosStats describes every class for /admin/broadcast.
+func qosStats() []map[string]interface{} {
+	stats := make([]map[string]interface{}, 0, len(qosClasses))
+	for i := len(qosClasses) - 1; i >= 0; i-- {
+		q := qosClasses[i]
+		stats = append(stats, map[string]interface{}{
+			"class":             q.name,
+			"clients":           q.clients.Load(),
+			"send_queue":        q.sendQueue,
+			"max_bytes_per_sec": q.maxRate,
+			"throttled":         q.throttled.Load(),
+			"rejected":          q.rejected.Load(),
+			"evicted":           q.evicted.Load(),
+		})
+	}
+	return stats
+}
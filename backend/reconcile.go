@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// reconcileRuns counts completed reconciliation passes.
+	reconcileRuns atomic.Int64
+	// reconcileUpdates counts pairs a pass changed in latest.
+	reconcileUpdates atomic.Int64
+	// reconcileMissed counts packets a pass found that the poller missed.
+	reconcileMissed atomic.Int64
+	// reconcileRewinds counts passes that moved the watermark back to Redis.
+	reconcileRewinds atomic.Int64
+)
+
+// startReconciler runs reconcileOnce every RECONCILE_INTERVAL (0 disables
+// it). The poller only reads from its own watermark, so once the watermark
+// and Redis disagree it never looks back; this loop closes that drift.
+func (s *Server) startReconciler(ctx context.Context, rdb redisClient) {
+	if s.config.ReconcileInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.config.ReconcileInterval)
+	defer ticker.Stop()
+
+	infoLog("Reconciling latest with Redis every %s", s.config.ReconcileInterval)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.reconcileOnce(ctx, rdb)
+		}
+	}
+}
+
+// reconcileOnce reads the newest timestamp in Redis and re-applies the
+// packets of the window below it. A watermark ahead of Redis (for example
+// after a restored STATE_FILE or a packet with a future timestamp) is moved
+// back; while a push input is delivering packets Redis does not hold, the
+// pass is skipped instead. Pairs missing from latest or older there than in
+// Redis are repaired and broadcast; packets the poller never saw also go to
+// sinks.
+func (s *Server) reconcileOnce(ctx context.Context, rdb redisClient) {
+	maxTs, err := maxTimestampFromIndex(ctx, s.config, rdb)
+	if errors.Is(err, errRedisUnavailable) {
+		debugLog("Reconcile skipped: %v", err)
+		return
+	}
+	if err != nil {
+		errorLog("Reconcile error: %v", err)
+		return
+	}
+	if maxTs == 0 {
+		// An empty Redis is clearLatestIfRedisEmpty's case.
+		return
+	}
+
+	since := max(maxTs-safetyWindow, 0)
+	docs, err := getPacketsSince(ctx, s.config, rdb, since)
+	if err != nil {
+		errorLog("Reconcile error: %v", err)
+		return
+	}
+	packets := decodeDocuments(s.config, docs)
+
+	// applyMu is released by a defer so a panic in a processor, recovered
+	// by the reconciler's supervisor, does not leave the view locked.
+	var (
+		watermark                int
+		rewound, skipped, pruned bool
+		updates                  map[string]PacketSummary
+		fresh                    []Packet
+	)
+	func() {
+		s.applyMu.Lock()
+		defer s.applyMu.Unlock()
+		watermark = s.getStartingTimestamp()
+		rewound = watermark > maxTs
+		if rewound && s.pushedRecently() {
+			skipped = true
+			return
+		}
+		if rewound {
+			s.setStartingTimestamp(maxTs)
+		}
+		updates, fresh, pruned = s.applyPackets(packets)
+	}()
+	releasePackets(packets)
+	if skipped {
+		debugLog("Reconcile skipped: push inputs are ahead of Redis")
+		return
+	}
+
+	reconcileRuns.Add(1)
+	reconcileUpdates.Add(int64(len(updates)))
+	reconcileMissed.Add(int64(len(fresh)))
+	if rewound {
+		reconcileRewinds.Add(1)
+		infoLog("Reconcile: watermark %d was ahead of Redis, moved back to %d", watermark, maxTs)
+	}
+	if len(fresh) > 0 {
+		infoLog("Reconcile: %d packets the poller missed, %d pairs updated", len(fresh), len(updates))
+	} else {
+		// Under merge-by-packet-id re-read packets are merged again.
+		debugLog("Reconcile: %d pairs updated", len(updates))
+	}
+
+	recordPolled(fresh)
+	s.publishChanges(updates, fresh, pruned)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// superviseMaxDelay caps the wait before restarting a goroutine that
+	// keeps panicking.
+	superviseMaxDelay = 30 * time.Second
+	// superviseReset is how long a restarted goroutine has to run before
+	// its next panic restarts it without delay again.
+	superviseReset = time.Minute
+)
+
+// panics counts recovered panics by where they happened: "http" for
+// handlers, or the name a goroutine is supervised under. Every supervised
+// goroutine has an entry from its start, so the metric exists before the
+// first panic.
+var (
+	panics   = map[string]int64{"http": 0}
+	panicsMu sync.Mutex
+)
+
+// recordPanic logs a recovered panic value with the stack of the panicking
+// goroutine and counts it under where. what describes it for the log.
+func recordPanic(where, what string, v interface{}) {
+	errorLog("Panic in %s: %v\n%s", what, v, debug.Stack())
+	panicsMu.Lock()
+	panics[where]++
+	panicsMu.Unlock()
+}
+
+// panicCounts returns the panic counts for /metrics, ordered by where.
+func panicCounts() ([]string, []int64) {
+	panicsMu.Lock()
+	defer panicsMu.Unlock()
+	wheres := make([]string, 0, len(panics))
+	for where := range panics {
+		wheres = append(wheres, where)
+	}
+	sort.Strings(wheres)
+	counts := make([]int64, len(wheres))
+	for i, where := range wheres {
+		counts[i] = panics[where]
+	}
+	return wheres, counts
+}
+
+// recoverPanics answers a request whose handler panicked with a 500, if
+// nothing was written yet, and logs and counts the panic instead of leaving
+// it to net/http, which only drops the connection. http.ErrAbortHandler is
+// passed on: handlers panic with it to abort a response on purpose.
+func recoverPanics(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			recordPanic("http", r.Method+" "+r.URL.Path+" (request "+requestID(r.Context())+")", v)
+			if rec.status == 0 {
+				writeError(rec, internalError.errorf("Internal server error"))
+			}
+		}()
+		next(rec, r)
+	}
+}
+
+// supervise runs run until it returns or ctx ends. If run panics, the panic
+// is logged and counted under name, and run is started again after a delay
+// that grows while it keeps panicking; restarted, if not nil, runs first to
+// repair what the panic left behind.
+func supervise(ctx context.Context, name string, run func(ctx context.Context), restarted func()) {
+	panicsMu.Lock()
+	if _, ok := panics[name]; !ok {
+		panics[name] = 0
+	}
+	panicsMu.Unlock()
+
+	policy := backoff{base: time.Second, max: superviseMaxDelay}
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		if !runRecovered(ctx, name, run) || ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) >= superviseReset {
+			attempt = 0
+		}
+		delay := policy.delay(attempt)
+		errorLog("Restarting %s in %s", name, delay.Round(time.Millisecond))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if restarted != nil {
+			restarted()
+		}
+	}
+}
+
+// runRecovered runs run and reports whether it panicked.
+func runRecovered(ctx context.Context, name string, run func(ctx context.Context)) (panicked bool) {
+	defer func() {
+		if v := recover(); v != nil {
+			recordPanic(name, name, v)
+			panicked = true
+		}
+	}()
+	run(ctx)
+	return false
+}
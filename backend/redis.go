@@ -3,103 +3,248 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
-// initializeLatestData seeds the materialized view and poll watermark from Redis on startup.
-func initializeLatestData(ctx context.Context, rdb *redis.Client) {
-	if err := ensureSearchIndex(ctx, rdb); err != nil {
-		errorLog("Error ensuring search index: %v", err)
-		initializeEmptyLatest()
-		return
+// redisClient is the Redis API the poller, hydration, sinks, and query
+// handlers depend on: the commands, Do for raw ones, and the options
+// searchClient copies into a RESP2 twin. *redis.Client implements it; a
+// test double can embed redis.Cmdable and override what it needs.
+type redisClient interface {
+	redis.Cmdable
+	Do(ctx context.Context, args ...interface{}) *redis.Cmd
+	Options() *redis.Options
+}
+
+// redisReady is set once startRedis has created the indexes and seeded the
+// materialized view; /readyz reports down until then.
+var redisReady atomic.Bool
+
+// startRedis sets up Redis in the background so the HTTP server and push
+// inputs start without it: it creates the search indexes and seeds the
+// materialized view, retrying on the Redis backoff without a retry limit
+// until that works, then polls and reconciles.
+func (s *Server) startRedis(ctx context.Context, rdb redisClient) {
+	policy := s.config.redisBackoff()
+	for attempt := 0; ; attempt++ {
+		err := s.setupRedis(ctx, rdb)
+		if err == nil {
+			break
+		}
+		delay := policy.delay(attempt)
+		if attempt == 0 {
+			errorLog("Redis setup failed: %v; retrying in %s", err, delay.Round(time.Millisecond))
+		} else {
+			debugLog("Redis setup attempt %d failed (retrying in %s): %v", attempt+1, delay.Round(time.Millisecond), err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
 	}
+	redisReady.Store(true)
+	infoLog("Connected to Redis at %s (db=%d, resp=%d)", s.config.RedisAddr, s.config.RedisDB, s.config.RedisProtocol)
+	go supervise(ctx, "reconciler", func(ctx context.Context) { s.startReconciler(ctx, rdb) }, nil)
+	go supervise(ctx, "consistency checker", func(ctx context.Context) { s.startConsistencyChecker(ctx, rdb) }, nil)
+	supervise(ctx, "Redis poller", func(ctx context.Context) { s.startRedisPoller(ctx, rdb) }, nil)
+}
 
-	maxTs, err := maxTimestampFromIndex(ctx, rdb)
-	if err != nil {
-		errorLog("Error getting max timestamp: %v", err)
-		initializeEmptyLatest()
-		return
+// setupRedis creates the packet and rollup indexes and seeds the view.
+func (s *Server) setupRedis(ctx context.Context, rdb redisClient) error {
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		return err
+	}
+	if err := ensureSearchIndex(ctx, s.config, rdb); err != nil {
+		return fmt.Errorf("ensure search index: %w", err)
+	}
+	if s.config.Rollups {
+		if err := ensureRollupIndex(ctx, s.config, rdb); err != nil {
+			return fmt.Errorf("ensure rollup index: %w", err)
+		}
+	}
+	return s.initializeLatestData(ctx, rdb)
+}
+
+// initializeLatestData seeds the materialized view and poll watermark from
+// Redis. A view that already holds packets (restored from STATE_FILE or
+// pushed while Redis was unavailable) is kept; the poller catches up from
+// its watermark.
+func (s *Server) initializeLatestData(ctx context.Context, rdb redisClient) error {
+	if s.hasLatestPackets() {
+		infoLog("Keeping the current materialized view (watermark=%d)", s.getStartingTimestamp())
+		return nil
 	}
 
-	setStartingTimestamp(maxTs)
+	maxTs, packets, err := readLatest(ctx, s.config, rdb)
+	if err != nil {
+		return err
+	}
 	if maxTs == 0 {
 		debugLog("No data found in index")
-		initializeEmptyLatest()
-		return
+		return nil
 	}
 
-	docs, err := getNewPackets(ctx, rdb)
+	count := func() int {
+		s.applyMu.Lock()
+		defer s.applyMu.Unlock()
+		return s.seedLatest(maxTs, packets)
+	}()
+	// Clients may have connected while Redis was unavailable.
+	s.broadcastSnapshot()
+	infoLog("Initialized materialized view: %d pairs (watermark=%d)", count, maxTs)
+	return nil
+}
+
+// rebuildLatest replaces the view with the one initializeLatestData would
+// build now, for use after an index rebuild or a Redis restore. Pushes and
+// polls wait until it is done. If Redis cannot be read, the view is kept.
+func (s *Server) rebuildLatest(ctx context.Context, rdb redisClient) (pairs, watermark int, err error) {
+	pairs, maxTs, err := func() (int, int, error) {
+		s.applyMu.Lock()
+		defer s.applyMu.Unlock()
+		maxTs, packets, err := readLatest(ctx, s.config, rdb)
+		if err != nil {
+			return 0, 0, err
+		}
+		s.initializeEmptyLatest()
+		return s.seedLatest(maxTs, packets), maxTs, nil
+	}()
 	if err != nil {
-		debugLog("Error fetching initial data: %v", err)
-		initializeEmptyLatest()
-		return
+		return 0, 0, err
 	}
-	if len(docs) == 0 {
-		debugLog("No documents in initial poll window")
-		initializeEmptyLatest()
-		return
+
+	s.broadcastSnapshot()
+	infoLog("Rebuilt materialized view: %d pairs (watermark=%d)", pairs, maxTs)
+	return pairs, maxTs, nil
+}
+
+// readLatest reads the newest packet timestamp in Redis and the packets of
+// the poll window below it. The packets come from packetPool.
+func readLatest(ctx context.Context, cfg *Config, rdb redisClient) (int, []Packet, error) {
+	maxTs, err := maxTimestampFromIndex(ctx, cfg, rdb)
+	if err != nil {
+		return 0, nil, fmt.Errorf("get max timestamp: %w", err)
 	}
+	if maxTs == 0 {
+		return 0, nil, nil
+	}
+	docs, err := getPacketsSince(ctx, cfg, rdb, max(maxTs-safetyWindow, 0))
+	if err != nil {
+		return 0, nil, fmt.Errorf("fetch initial data: %w", err)
+	}
+	return maxTs, decodeDocuments(cfg, docs), nil
+}
+
+// seedLatest applies packets read by readLatest at watermark maxTs and
+// returns the pairs in the view. Packets already in Redis are marked seen
+// but not sent to sinks. Callers hold applyMu.
+func (s *Server) seedLatest(maxTs int, packets []Packet) int {
+	if maxTs > 0 {
+		s.setStartingTimestamp(maxTs)
+		_, _, _ = s.applyPackets(packets)
+		releasePackets(packets)
+	}
+	s.latestMu.RLock()
+	defer s.latestMu.RUnlock()
+	return len(s.latest)
+}
 
-	_, _ = applyDocuments(docs)
-	latestMu.RLock()
-	count := len(latest)
-	latestMu.RUnlock()
-	infoLog("Initialized materialized view: %d pairs (watermark=%d)", count, getStartingTimestamp())
+// handleAdminRebuildLatest runs rebuildLatest (POST).
+func (s *Server) handleAdminRebuildLatest(rdb redisClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, methodNotAllowed.errorf("Method not allowed"))
+			return
+		}
+		pairs, watermark, err := s.rebuildLatest(r.Context(), rdb)
+		if errors.Is(err, errRedisUnavailable) {
+			writeError(w, unavailable.errorf("Redis unavailable"))
+			return
+		}
+		if err != nil {
+			errorLog("Failed to rebuild materialized view: %v", err)
+			writeError(w, upstreamFailed.errorf("Failed to rebuild: %v", err))
+			return
+		}
+		writeJSON(w, map[string]interface{}{"pairs": pairs, "watermark": watermark})
+	}
 }
 
 // startRedisPoller keeps the materialized src:dest state current.
-func startRedisPoller(ctx context.Context, rdb *redis.Client) {
-	ticker := time.NewTicker(config.PollInterval)
+func (s *Server) startRedisPoller(ctx context.Context, rdb redisClient) {
+	ticker := time.NewTicker(s.config.PollInterval)
 	defer ticker.Stop()
 
-	infoLog("Polling Redis every %s for latest src:dest state", config.PollInterval)
+	infoLog("Polling Redis every %s for latest src:dest state", s.config.PollInterval)
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			pollRedisOnce(ctx, rdb)
+			s.pollRedisOnce(ctx, rdb)
 		}
 	}
 }
 
-func pollRedisOnce(ctx context.Context, rdb *redis.Client) {
-	docs, err := getNewPackets(ctx, rdb)
+// pollRedisOnce applies the packets stored since the watermark. A poll that
+// runs past QUERY_TIMEOUT is abandoned; the next one starts from the same
+// watermark.
+func (s *Server) pollRedisOnce(ctx context.Context, rdb redisClient) {
+	ctx, cancel := context.WithTimeout(ctx, s.config.QueryTimeout)
+	defer cancel()
+
+	docs, err := s.getNewPackets(ctx, rdb)
+	if errors.Is(err, errRedisUnavailable) {
+		// Logged when the breaker opened; latest keeps serving the last view.
+		debugLog("Poll skipped: %v", err)
+		return
+	}
 	if err != nil {
 		errorLog("Poll error: %v", err)
 		return
 	}
 
 	if len(docs) == 0 {
-		clearLatestIfRedisEmpty(ctx, rdb)
-		debugLog("Poll: no documents in window (watermark=%d)", getStartingTimestamp())
+		s.clearLatestIfRedisEmpty(ctx, rdb)
+		debugLog("Poll: no documents in window (watermark=%d)", s.getStartingTimestamp())
 		return
 	}
 
-	updates, pruned := applyDocuments(docs)
+	// Decode outside applyMu so push inputs are not held up.
+	packets := decodeDocuments(s.config, docs)
+	updates, fresh, pruned := s.applyLocked(packets)
+	releasePackets(packets)
+
+	recordPolled(fresh)
+	s.publishChanges(updates, fresh, pruned)
 	if pruned {
-		broadcastSnapshot()
-		debugLog("Poll: stale pairs pruned; broadcast snapshot (watermark=%d)", getStartingTimestamp())
-		return
+		debugLog("Poll: stale pairs pruned; broadcast snapshot (watermark=%d)", s.getStartingTimestamp())
+	} else if len(updates) > 0 {
+		debugLog("Poll: %d updates (watermark=%d)", len(updates), s.getStartingTimestamp())
 	}
+}
 
-	if len(updates) == 0 {
+func (s *Server) clearLatestIfRedisEmpty(ctx context.Context, rdb redisClient) {
+	// Packets pushed by other inputs never reach Redis; don't wipe them.
+	if s.pushedRecently() {
 		return
 	}
 
-	broadcastUpdates(updates)
-	debugLog("Poll: %d updates (watermark=%d)", len(updates), getStartingTimestamp())
-}
-
-func clearLatestIfRedisEmpty(ctx context.Context, rdb *redis.Client) {
-	maxTs, err := maxTimestampFromIndex(ctx, rdb)
-	if err != nil || maxTs != 0 || !hasLatestPackets() {
+	maxTs, err := maxTimestampFromIndex(ctx, s.config, rdb)
+	if err != nil || maxTs != 0 || !s.hasLatestPackets() {
 		return
 	}
 
-	initializeEmptyLatest()
-	broadcastSnapshot()
+	s.applyMu.Lock()
+	s.initializeEmptyLatest()
+	s.applyMu.Unlock()
+	s.broadcastSnapshot()
 }
@@ -1,16 +1,21 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
 // docToPacket converts a RediSearch document into the packet shape used by the server.
-func docToPacket(doc redis.Document) (Packet, error) {
+func docToPacket(cfg *Config, doc redis.Document) (Packet, error) {
 	var p Packet
 	p.Key = doc.ID
+	p.Tenant = cfg.tenantOfKey(doc.ID)
 
 	fields := doc.Fields
 
@@ -50,6 +55,14 @@ func docToPacket(doc redis.Document) (Packet, error) {
 	p.Src = mustStr("source_ip")
 	p.Dest = mustStr("dest_ip")
 	p.TotalBytes = mustInt("total_bytes")
+	p.SrcPort = mustInt("src_port")
+	p.DstPort = mustInt("dst_port")
+	p.Protocol = mustStr("protocol")
+	p.Location = mustStr("location")
+	p.Annotation = mustStr("annotation")
+	if tags := mustStr("tags"); tags != "" {
+		p.Tags = strings.Split(tags, ",")
+	}
 	p.UDPPackets = decode("udp_packets")
 	p.UDPBytes = decode("udp_bytes")
 	p.TCPPackets = decode("tcp_packets")
@@ -57,3 +70,83 @@ func docToPacket(doc redis.Document) (Packet, error) {
 
 	return p, nil
 }
+
+// packetKey returns the simulator-compatible hash key for a packet.
+func (c *Config) packetKey(p Packet) string {
+	return fmt.Sprintf("%s%s:%s:%d", c.packetPrefixFor(p.Tenant), p.Dest, p.Src, p.Timestamp)
+}
+
+// packetToFields is the inverse of docToPacket: the hash fields for a packet,
+// with bin arrays JSON-encoded as the simulator writes them. Flow fields are
+// written only when set, so the index leaves them out for aggregate packets.
+func packetToFields(p Packet) map[string]interface{} {
+	encode := func(v []int) string {
+		if v == nil {
+			v = []int{}
+		}
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+
+	fields := map[string]interface{}{
+		"timestamp":   p.Timestamp,
+		"seq":         p.Seq,
+		"node_id":     p.NodeID,
+		"source_ip":   p.Src,
+		"dest_ip":     p.Dest,
+		"total_bytes": p.TotalBytes,
+		"udp_packets": encode(p.UDPPackets),
+		"udp_bytes":   encode(p.UDPBytes),
+		"tcp_packets": encode(p.TCPPackets),
+		"tcp_bytes":   encode(p.TCPBytes),
+	}
+	if p.SrcPort != 0 {
+		fields["src_port"] = p.SrcPort
+	}
+	if p.DstPort != 0 {
+		fields["dst_port"] = p.DstPort
+	}
+	if p.Protocol != "" {
+		fields["protocol"] = p.Protocol
+	}
+	if loc := packetLocation(p); loc != "" {
+		fields["location"] = loc
+	}
+	if p.Annotation != "" {
+		fields["annotation"] = p.Annotation
+	}
+	if len(p.Tags) > 0 {
+		fields["tags"] = strings.Join(p.Tags, ",")
+	}
+	return fields
+}
+
+// storePackets writes packets as packet:* hashes (expiring after ttl when
+// positive) so they are indexed like simulator output. Under the zset search
+// fallback it also adds them to packetTimeIndex, trimming entries older than
+// ttl.
+func storePackets(ctx context.Context, cfg *Config, rdb redisClient, packets []Packet, ttl time.Duration) error {
+	zset := searchFallback.Load() && cfg.SearchFallback == fallbackZSet
+	pipe := rdb.Pipeline()
+	indexes := make(map[string]bool)
+	for _, p := range packets {
+		key := cfg.packetKey(p)
+		pipe.HSet(ctx, key, packetToFields(p))
+		if ttl > 0 {
+			pipe.Expire(ctx, key, ttl)
+		}
+		if zset {
+			index := tenantPrefix(p.Tenant) + packetTimeIndex
+			pipe.ZAdd(ctx, index, redis.Z{Score: float64(p.Timestamp), Member: key})
+			indexes[index] = true
+		}
+	}
+	if ttl > 0 {
+		cutoff := time.Now().Add(-ttl).Unix()
+		for index := range indexes {
+			pipe.ZRemRangeByScore(ctx, index, "-inf", "("+strconv.FormatInt(cutoff, 10))
+		}
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Layouts read when RediSearch is not loaded (SEARCH_FALLBACK).
+const (
+	fallbackScan = "scan"
+	fallbackZSet = "zset"
+)
+
+// packetTimeIndex is the sorted set of packet:* keys scored by timestamp
+// that the zset fallback reads, one per tenant behind its prefix.
+// storePackets maintains it in that mode.
+const packetTimeIndex = "packets:by_ts"
+
+// fallbackScanCount is the SCAN COUNT hint of one key-scan round trip.
+const fallbackScanCount = 1000
+
+// searchFallback is set once ensureSearchIndex finds the FT.* commands
+// missing or SEARCH_DISABLED set; packet queries then use
+// SEARCH_FALLBACK instead.
+var searchFallback atomic.Bool
+
+// isUnknownCommand reports whether err is Redis rejecting a command it does
+// not know, as vanilla Redis does for FT.*.
+func isUnknownCommand(err error) bool {
+	return err != nil && strings.Contains(strings.ToLower(err.Error()), "unknown command")
+}
+
+// searchMode names how packets are queried, for /readyz and logs.
+func (c *Config) searchMode() string {
+	if searchFallback.Load() {
+		return c.SearchFallback
+	}
+	return "redisearch"
+}
+
+// keyTimestamp returns the timestamp that ends a packet:{dest}:{src}:{ts}
+// key. IPv6 addresses contain colons, so it is taken after the last one.
+func keyTimestamp(key string) (int, bool) {
+	i := strings.LastIndexByte(key, ':')
+	if i < 0 {
+		return 0, false
+	}
+	ts, err := strconv.Atoi(key[i+1:])
+	return ts, err == nil
+}
+
+// fallbackPacketKeys returns the keys of packets with timestamp >= since,
+// newest first, and the newest timestamp seen in Redis, over all tenants.
+func fallbackPacketKeys(ctx context.Context, cfg *Config, rdb redisClient, since int) ([]string, int, error) {
+	if cfg.SearchFallback == fallbackZSet {
+		var all []string
+		maxTs := 0
+		for _, t := range cfg.tenantNames() {
+			keys, ts, err := zsetPacketKeys(ctx, rdb, tenantPrefix(t)+packetTimeIndex, since)
+			if err != nil {
+				return nil, 0, err
+			}
+			all = append(all, keys...)
+			maxTs = max(maxTs, ts)
+		}
+		return all, maxTs, nil
+	}
+
+	type keyed struct {
+		key string
+		ts  int
+	}
+	var found []keyed
+	maxTs := 0
+	for _, t := range cfg.tenantNames() {
+		var cursor uint64
+		for {
+			var keys []string
+			err := redisDo(ctx, func(ctx context.Context) (err error) {
+				keys, cursor, err = rdb.Scan(ctx, cursor, cfg.packetPrefixFor(t)+"*", fallbackScanCount).Result()
+				return err
+			})
+			if err != nil {
+				return nil, 0, err
+			}
+			for _, key := range keys {
+				ts, ok := keyTimestamp(key)
+				if !ok {
+					continue
+				}
+				maxTs = max(maxTs, ts)
+				if ts >= since {
+					found = append(found, keyed{key, ts})
+				}
+			}
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+
+	sort.Slice(found, func(i, j int) bool { return found[i].ts > found[j].ts })
+	out := make([]string, len(found))
+	for i, k := range found {
+		out[i] = k.key
+	}
+	return out, maxTs, nil
+}
+
+// zsetPacketKeys reads a tenant's packetTimeIndex instead of scanning the
+// keyspace.
+func zsetPacketKeys(ctx context.Context, rdb redisClient, index string, since int) ([]string, int, error) {
+	var keys []string
+	var newest []redis.Z
+	err := redisDo(ctx, func(ctx context.Context) error {
+		pipe := rdb.Pipeline()
+		rangeCmd := pipe.ZRevRangeByScore(ctx, index, &redis.ZRangeBy{
+			Min: strconv.Itoa(since),
+			Max: "+inf",
+		})
+		newestCmd := pipe.ZRevRangeWithScores(ctx, index, 0, 0)
+		if _, err := pipe.Exec(ctx); err != nil {
+			return err
+		}
+		keys, newest = rangeCmd.Val(), newestCmd.Val()
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	maxTs := 0
+	if len(newest) > 0 {
+		maxTs = int(newest[0].Score)
+	}
+	return keys, maxTs, nil
+}
+
+// fallbackNewPackets is getNewPackets without RediSearch: it loads the
+// hashes of the keys in the poll window with one pipelined HGETALL each.
+// Keys that expired since they were listed come back empty and are skipped.
+func fallbackNewPackets(ctx context.Context, cfg *Config, rdb redisClient, since int) ([]redis.Document, error) {
+	keys, _, err := fallbackPacketKeys(ctx, cfg, rdb, since)
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+
+	var docs []redis.Document
+	err = redisDo(ctx, func(ctx context.Context) error {
+		pipe := rdb.Pipeline()
+		cmds := make([]*redis.MapStringStringCmd, len(keys))
+		for i, key := range keys {
+			cmds[i] = pipe.HGetAll(ctx, key)
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return err
+		}
+
+		docs = docs[:0]
+		for i, cmd := range cmds {
+			if fields := cmd.Val(); len(fields) > 0 {
+				docs = append(docs, redis.Document{ID: keys[i], Fields: fields})
+			}
+		}
+		return nil
+	})
+	return docs, err
+}
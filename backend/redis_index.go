@@ -3,83 +3,193 @@ package main
 import (
 	"context"
 	"fmt"
+	"strings"
+	"sync"
+	"unicode"
 
 	"github.com/redis/go-redis/v9"
 )
 
-const (
-	searchIndexName = "idx:packets"
-	searchLimit     = 10000
-)
+const searchLimit = 10000
+
+// packetIndexSchema is the schema of the packet index (SEARCH_INDEX). Addresses are TAG fields under
+// the names analysts query by (src_ip, dst_ip); ports are sortable NUMERIC
+// fields; location is the GeoIP source location; annotation and tags are
+// full-text. Hashes without the optional fields are still indexed.
+var packetIndexSchema = []*redis.FieldSchema{
+	{FieldName: "timestamp", As: "timestamp", FieldType: redis.SearchFieldTypeNumeric, Sortable: true},
+	{FieldName: "total_bytes", As: "total_bytes", FieldType: redis.SearchFieldTypeNumeric, Sortable: true},
+	{FieldName: "source_ip", As: "src_ip", FieldType: redis.SearchFieldTypeTag},
+	{FieldName: "dest_ip", As: "dst_ip", FieldType: redis.SearchFieldTypeTag},
+	{FieldName: "src_port", As: "src_port", FieldType: redis.SearchFieldTypeNumeric, Sortable: true},
+	{FieldName: "dst_port", As: "dst_port", FieldType: redis.SearchFieldTypeNumeric, Sortable: true},
+	{FieldName: "protocol", As: "protocol", FieldType: redis.SearchFieldTypeTag},
+	{FieldName: "location", As: "location", FieldType: redis.SearchFieldTypeGeo},
+	{FieldName: "annotation", As: "annotation", FieldType: redis.SearchFieldTypeText},
+	{FieldName: "tags", As: "tags", FieldType: redis.SearchFieldTypeText},
+}
+
+// searchClients maps RESP3 clients to the RESP2 clients their RediSearch
+// commands go through.
+var searchClients sync.Map
+
+// searchClient returns the client to send FT.* commands on. go-redis only
+// parses RediSearch replies under RESP2 (under RESP3 it refuses them unless
+// they are read raw), so a RESP3 client gets a RESP2 twin with the same
+// options; everything else keeps using RESP3.
+func searchClient(rdb redisClient) redisClient {
+	opt := rdb.Options()
+	if opt.Protocol == 2 {
+		return rdb
+	}
+	if twin, ok := searchClients.Load(rdb); ok {
+		return twin.(redisClient)
+	}
+	resp2 := *opt
+	resp2.Protocol = 2
+	c := redis.NewClient(&resp2)
+	twin, loaded := searchClients.LoadOrStore(rdb, c)
+	if loaded {
+		// Another caller stored its twin first.
+		c.Close()
+	}
+	return twin.(redisClient)
+}
+
+// checkKeyLayout validates SEARCH_INDEX and PACKET_PREFIX. The prefix is
+// used as a SCAN pattern by the scan fallback, so it may not hold glob
+// characters.
+func (c *Config) checkKeyLayout() error {
+	if c.SearchIndex == "" || strings.ContainsFunc(c.SearchIndex, unicode.IsSpace) {
+		return fmt.Errorf("SEARCH_INDEX %q must be non-empty without spaces", c.SearchIndex)
+	}
+	if c.PacketPrefix == "" || strings.ContainsFunc(c.PacketPrefix, unicode.IsSpace) || strings.ContainsAny(c.PacketPrefix, `*?[]\`) {
+		return fmt.Errorf("PACKET_PREFIX %q must be non-empty, without spaces or glob characters", c.PacketPrefix)
+	}
+	return nil
+}
 
-// ensureSearchIndex creates or migrates the RediSearch index for simulator v2 hashes.
-func ensureSearchIndex(ctx context.Context, rdb *redis.Client) error {
-	info, err := rdb.FTInfo(ctx, searchIndexName).Result()
+// ensureSearchIndex creates or migrates the RediSearch index of every tenant.
+// Without the RediSearch module, or with SEARCH_DISABLED, it switches packet
+// queries to the SEARCH_FALLBACK layout (redis_fallback.go).
+func ensureSearchIndex(ctx context.Context, cfg *Config, rdb redisClient) error {
+	if cfg.SearchDisabled {
+		searchFallback.Store(true)
+		infoLog("RediSearch disabled (SEARCH_DISABLED); querying packets by %s", cfg.SearchFallback)
+		return nil
+	}
+	for _, t := range cfg.tenantNames() {
+		if err := ensurePacketIndex(ctx, cfg, rdb, t); err != nil || searchFallback.Load() {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensurePacketIndex creates or migrates the index over one tenant's
+// simulator v2 hashes.
+func ensurePacketIndex(ctx context.Context, cfg *Config, rdb redisClient, tenant string) error {
+	index := cfg.packetIndexFor(tenant)
+	var info redis.FTInfoResult
+	err := redisDo(ctx, func(ctx context.Context) (err error) {
+		info, err = searchClient(rdb).FTInfo(ctx, index).Result()
+		return err
+	})
+	if isUnknownCommand(err) {
+		searchFallback.Store(true)
+		infoLog("RediSearch not available (%v); querying packets by %s", err, cfg.SearchFallback)
+		return nil
+	}
 	if err == nil {
-		hasTimestamp := false
+		have := make(map[string]bool, len(info.Attributes))
 		for _, attr := range info.Attributes {
-			if attr.Identifier == "timestamp" {
-				hasTimestamp = true
+			have[attr.Attribute] = true
+		}
+		outdated := ""
+		for _, field := range packetIndexSchema {
+			if !have[field.As] {
+				outdated = "missing " + field.As + " field"
 				break
 			}
 		}
-		if hasTimestamp {
-			debugLog("Index '%s' already exists with timestamp", searchIndexName)
+		if prefixes := info.IndexDefinition.Prefixes; len(prefixes) != 1 || prefixes[0] != cfg.packetPrefixFor(tenant) {
+			outdated = fmt.Sprintf("key prefixes %v", prefixes)
+		}
+		if outdated == "" {
+			debugLog("Index '%s' already exists with all fields", index)
 			return nil
 		}
-		infoLog("Dropping outdated index '%s' (missing timestamp field)", searchIndexName)
-		if err := rdb.FTDropIndex(ctx, searchIndexName).Err(); err != nil {
+		// Dropping the index keeps the hashes; FT.CREATE re-indexes them.
+		infoLog("Dropping outdated index '%s' (%s)", index, outdated)
+		err := redisDo(ctx, func(ctx context.Context) error {
+			return searchClient(rdb).FTDropIndex(ctx, index).Err()
+		})
+		if err != nil {
 			return fmt.Errorf("drop index: %w", err)
 		}
 	}
 
-	_, err = rdb.FTCreate(
-		ctx,
-		searchIndexName,
-		&redis.FTCreateOptions{
-			OnHash: true,
-			Prefix: []interface{}{"packet:"},
-		},
-		&redis.FieldSchema{
-			FieldName: "timestamp",
-			As:        "timestamp",
-			FieldType: redis.SearchFieldTypeNumeric,
-			Sortable:  true,
-		},
-		&redis.FieldSchema{
-			FieldName: "total_bytes",
-			As:        "total_bytes",
-			FieldType: redis.SearchFieldTypeNumeric,
-		},
-	).Result()
+	err = redisDo(ctx, func(ctx context.Context) error {
+		return searchClient(rdb).FTCreate(
+			ctx,
+			index,
+			&redis.FTCreateOptions{
+				OnHash: true,
+				Prefix: []interface{}{cfg.packetPrefixFor(tenant)},
+			},
+			packetIndexSchema...,
+		).Err()
+	})
 	if err != nil {
 		return err
 	}
 
-	infoLog("Index '%s' created successfully", searchIndexName)
+	infoLog("Index '%s' created successfully", index)
 	return nil
 }
 
-func maxTimestampFromIndex(ctx context.Context, rdb *redis.Client) (int, error) {
-	aggResult, err := rdb.FTAggregateWithArgs(
-		ctx,
-		searchIndexName,
-		"*",
-		&redis.FTAggregateOptions{
-			GroupBy: []redis.FTAggregateGroupBy{
-				{
-					Fields: []interface{}{},
-					Reduce: []redis.FTAggregateReducer{
-						{
-							Reducer: redis.SearchMax,
-							Args:    []interface{}{"@timestamp"},
-							As:      "max_timestamp",
+// maxTimestampFromIndex returns the newest packet timestamp over all tenants.
+func maxTimestampFromIndex(ctx context.Context, cfg *Config, rdb redisClient) (int, error) {
+	if searchFallback.Load() {
+		_, maxTs, err := fallbackPacketKeys(ctx, cfg, rdb, 0)
+		return maxTs, err
+	}
+
+	maxTs := 0
+	for _, t := range cfg.tenantNames() {
+		ts, err := indexMaxTimestamp(ctx, rdb, cfg.packetIndexFor(t))
+		if err != nil {
+			return 0, err
+		}
+		maxTs = max(maxTs, ts)
+	}
+	return maxTs, nil
+}
+
+func indexMaxTimestamp(ctx context.Context, rdb redisClient, index string) (int, error) {
+	var aggResult *redis.FTAggregateResult
+	err := redisDo(ctx, func(ctx context.Context) (err error) {
+		aggResult, err = searchClient(rdb).FTAggregateWithArgs(
+			ctx,
+			index,
+			"*",
+			&redis.FTAggregateOptions{
+				GroupBy: []redis.FTAggregateGroupBy{
+					{
+						Fields: []interface{}{},
+						Reduce: []redis.FTAggregateReducer{
+							{
+								Reducer: redis.SearchMax,
+								Args:    []interface{}{"@timestamp"},
+								As:      "max_timestamp",
+							},
 						},
 					},
 				},
 			},
-		},
-	).Result()
+		).Result()
+		return err
+	})
 	if err != nil {
 		return 0, err
 	}
@@ -98,31 +208,68 @@ func maxTimestampFromIndex(ctx context.Context, rdb *redis.Client) (int, error)
 	return ts, nil
 }
 
-func getNewPackets(ctx context.Context, rdb *redis.Client) ([]redis.Document, error) {
-	since := pollSinceTimestamp()
-	query := fmt.Sprintf("@timestamp:[%d +inf]", since)
+// getNewPackets reads the packets of the poll window.
+func (s *Server) getNewPackets(ctx context.Context, rdb redisClient) ([]redis.Document, error) {
+	return getPacketsSince(ctx, s.config, rdb, s.pollSinceTimestamp())
+}
+
+// getPacketsSince reads every tenant's packets with timestamp >= since.
+func getPacketsSince(ctx context.Context, cfg *Config, rdb redisClient, since int) ([]redis.Document, error) {
+	if searchFallback.Load() {
+		docs, err := fallbackNewPackets(ctx, cfg, rdb, since)
+		if err != nil {
+			return nil, fmt.Errorf("scan packets since %d: %w", since, err)
+		}
+		return docs, nil
+	}
 
+	var docs []redis.Document
+	for _, t := range cfg.tenantNames() {
+		found, err := searchPacketsSince(ctx, rdb, cfg.packetIndexFor(t), since)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, found...)
+	}
+	return docs, nil
+}
+
+// searchPacketsSince pages through one index's packets with timestamp >= since.
+func searchPacketsSince(ctx context.Context, rdb redisClient, index string, since int) ([]redis.Document, error) {
+	docs, err := searchPacketQuery(ctx, rdb, index, fmt.Sprintf("@timestamp:[%d +inf]", since))
+	if err != nil {
+		return nil, fmt.Errorf("search packets since %d: %w", since, err)
+	}
+	return docs, nil
+}
+
+// searchPacketQuery pages through every packet of one index matching query.
+func searchPacketQuery(ctx context.Context, rdb redisClient, index, query string) ([]redis.Document, error) {
 	var docs []redis.Document
 	offset := 0
 
 	for {
-		result, err := rdb.FTSearchWithArgs(
-			ctx,
-			searchIndexName,
-			query,
-			&redis.FTSearchOptions{
-				LimitOffset: offset,
-				Limit:       searchLimit,
-				SortBy: []redis.FTSearchSortBy{
-					{
-						FieldName: "timestamp",
-						Asc:       false,
+		var result redis.FTSearchResult
+		err := redisDo(ctx, func(ctx context.Context) (err error) {
+			result, err = searchClient(rdb).FTSearchWithArgs(
+				ctx,
+				index,
+				query,
+				&redis.FTSearchOptions{
+					LimitOffset: offset,
+					Limit:       searchLimit,
+					SortBy: []redis.FTSearchSortBy{
+						{
+							FieldName: "timestamp",
+							Asc:       false,
+						},
 					},
 				},
-			},
-		).Result()
+			).Result()
+			return err
+		})
 		if err != nil {
-			return nil, fmt.Errorf("search packets since %d: %w", since, err)
+			return nil, err
 		}
 
 		docs = append(docs, result.Docs...)
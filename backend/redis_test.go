@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"backend/testsupport"
+)
+
+// TestRedisHydrationAndPoll runs setupRedis and pollRedisOnce in process
+// against the testsupport Redis double: hydration seeds the view from the
+// stored packets, and a poll applies the ones stored after it.
+func TestRedisHydrationAndPoll(t *testing.T) {
+	r, err := testsupport.NewRedis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var rdb redisClient = r.Client()
+
+	cfg := loadConfig()
+	initRedisBreaker(cfg)
+	s := newServer(cfg)
+	ctx := context.Background()
+
+	ts := int(time.Now().Unix())
+	if err := storePackets(ctx, cfg, rdb, []Packet{testPacket("10.0.0.1", "10.0.0.2", ts-1, 1, 100)}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.setupRedis(ctx, rdb); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.latestSnapshot()[pairKey("10.0.0.1", "10.0.0.2")].TCPBytesTotal; got != 100 {
+		t.Fatalf("after hydration tcp_bytes_total = %d, want 100", got)
+	}
+	if got := s.getStartingTimestamp(); got != ts-1 {
+		t.Fatalf("watermark = %d, want %d", got, ts-1)
+	}
+
+	if err := storePackets(ctx, cfg, rdb, []Packet{testPacket("10.0.0.1", "10.0.0.2", ts, 1, 40), testPacket("10.0.0.3", "10.0.0.2", ts, 1, 7)}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	s.pollRedisOnce(ctx, rdb)
+	snapshot := s.latestSnapshot()
+	if len(snapshot) != 2 {
+		t.Fatalf("after poll the view has %d pairs, want 2: %v", len(snapshot), snapshot)
+	}
+	if got := snapshot[pairKey("10.0.0.1", "10.0.0.2")].TCPBytesTotal; got != 40 {
+		t.Fatalf("after poll tcp_bytes_total = %d, want 40", got)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// relaySink republishes packets to a second Redis, e.g. from the experiment
+// enclave to a public monitoring instance. In "store" mode it writes
+// simulator-compatible packet:* hashes so another backend can poll them; in
+// "publish" mode it PUBLISHes each batch as a JSON array.
+type relaySink struct {
+	cfg       *Config
+	rdb       redisClient
+	publish   bool
+	channel   string
+	ttl       time.Duration
+	aggregate bool
+	sources   *relayFilter
+	dests     *relayFilter
+}
+
+// relayFilter matches an address against CIDR prefixes or exact names.
+type relayFilter struct {
+	prefixes []netip.Prefix
+	names    map[string]bool
+}
+
+func initRelaySink(cfg *Config) {
+	if cfg.RelayRedisAddr == "" {
+		return
+	}
+
+	s := &relaySink{
+		cfg: cfg,
+		rdb: redis.NewClient(&redis.Options{
+			Addr:     cfg.RelayRedisAddr,
+			Password: cfg.RelayRedisPassword,
+			DB:       cfg.RelayRedisDB,
+			Protocol: cfg.RedisProtocol,
+		}),
+		publish:   cfg.RelayMode == "publish",
+		channel:   cfg.RelayChannel,
+		ttl:       cfg.RelayTTL,
+		aggregate: cfg.RelayAggregate,
+		sources:   newRelayFilter(cfg.RelaySources),
+		dests:     newRelayFilter(cfg.RelayDests),
+	}
+	if !s.publish && cfg.RelayRedisAddr == cfg.RedisAddr && cfg.RelayRedisDB == cfg.RedisDB {
+		errorLog("RELAY_REDIS_ADDR is the polled Redis; store mode would feed packets back into the poller, relay disabled")
+		return
+	}
+	registerSink(s, cfg.RelayBatchSize, cfg.RelayInterval)
+}
+
+func (s *relaySink) Name() string { return "relay" }
+func (s *relaySink) external()    {}
+
+func (s *relaySink) Write(ctx context.Context, packets []Packet) error {
+	packets = s.filter(packets)
+	if len(packets) == 0 {
+		return nil
+	}
+	if s.aggregate {
+		packets = aggregatePackets(packets)
+	}
+
+	if !s.publish {
+		return storePackets(ctx, s.cfg, s.rdb, packets, s.ttl)
+	}
+	// Each tenant's packets go to the channel behind its prefix.
+	byTenant := make(map[string][]Packet)
+	for _, p := range packets {
+		byTenant[p.Tenant] = append(byTenant[p.Tenant], p)
+	}
+	for tenant, batch := range byTenant {
+		payload, err := json.Marshal(batch)
+		if err != nil {
+			return err
+		}
+		if err := s.rdb.Publish(ctx, tenantPrefix(tenant)+s.channel, payload).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *relaySink) filter(packets []Packet) []Packet {
+	if s.sources == nil && s.dests == nil {
+		return packets
+	}
+	kept := packets[:0:0]
+	for _, p := range packets {
+		if s.sources.match(p.Src) && s.dests.match(p.Dest) {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// aggregatePackets merges packets of the same src:dest pair into one packet
+// carrying the newest timestamp and single-element counter totals.
+func aggregatePackets(packets []Packet) []Packet {
+	index := make(map[string]int)
+	var out []Packet
+	for _, p := range packets {
+		key := viewKey(p)
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(out)
+			out = append(out, Packet{
+				Tenant:     p.Tenant,
+				Timestamp:  p.Timestamp,
+				Seq:        p.Seq,
+				NodeID:     p.NodeID,
+				Src:        p.Src,
+				Dest:       p.Dest,
+				TotalBytes: p.TotalBytes,
+				UDPPackets: []int{Sum(p.UDPPackets)},
+				UDPBytes:   []int{Sum(p.UDPBytes)},
+				TCPPackets: []int{Sum(p.TCPPackets)},
+				TCPBytes:   []int{Sum(p.TCPBytes)},
+			})
+			continue
+		}
+
+		agg := &out[i]
+		if p.Timestamp > agg.Timestamp {
+			agg.Timestamp = p.Timestamp
+			agg.Seq = p.Seq
+			agg.NodeID = p.NodeID
+		}
+		agg.TotalBytes += p.TotalBytes
+		agg.UDPPackets[0] += Sum(p.UDPPackets)
+		agg.UDPBytes[0] += Sum(p.UDPBytes)
+		agg.TCPPackets[0] += Sum(p.TCPPackets)
+		agg.TCPBytes[0] += Sum(p.TCPBytes)
+	}
+	return out
+}
+
+// newRelayFilter parses a comma-separated list of IPs, CIDRs, or host names;
+// it returns nil (match everything) for an empty list.
+func newRelayFilter(list string) *relayFilter {
+	if strings.TrimSpace(list) == "" {
+		return nil
+	}
+	f := &relayFilter{names: make(map[string]bool)}
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(item); err == nil {
+			f.prefixes = append(f.prefixes, prefix.Masked())
+		} else if addr, err := netip.ParseAddr(item); err == nil {
+			f.prefixes = append(f.prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+		} else {
+			f.names[item] = true
+		}
+	}
+	return f
+}
+
+func (f *relayFilter) match(addr string) bool {
+	if f == nil || f.names[addr] {
+		return true
+	}
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, prefix := range f.prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
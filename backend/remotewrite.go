@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const remoteWriteTimeout = 10 * time.Second
+
+// remoteWriter pushes srv's collectMetrics() to a Prometheus remote-write
+// endpoint (Prometheus, Mimir, Cortex, Thanos receive) for deployments that
+// cannot be scraped.
+type remoteWriter struct {
+	srv      *Server
+	interval time.Duration
+	url      string
+	user     string
+	password string
+	tenant   string
+	labels   [][2]string
+	client   *http.Client
+}
+
+// initRemoteWrite starts the exporter when REMOTE_WRITE_URL is set.
+func (s *Server) initRemoteWrite(ctx context.Context) {
+	if s.config.RemoteWriteURL == "" {
+		return
+	}
+
+	instance, _ := os.Hostname()
+	if instance == "" {
+		instance = "backend"
+	}
+	rw := &remoteWriter{
+		srv:      s,
+		interval: s.config.RemoteWriteInterval,
+		url:      s.config.RemoteWriteURL,
+		user:     s.config.RemoteWriteUser,
+		password: s.config.RemoteWritePassword,
+		tenant:   s.config.RemoteWriteTenant,
+		labels:   [][2]string{{"instance", instance}, {"job", s.config.RemoteWriteJob}},
+		client:   &http.Client{Timeout: remoteWriteTimeout},
+	}
+	go rw.run(ctx)
+	infoLog("Remote-writing metrics to %s every %s", s.config.RemoteWriteURL, s.config.RemoteWriteInterval)
+}
+
+func (rw *remoteWriter) run(ctx context.Context) {
+	ticker := time.NewTicker(rw.interval)
+	defer ticker.Stop()
+
+	failing := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			// A failed push is not retried: the next one carries current values.
+			err := rw.push(ctx, rw.srv.collectMetrics(), now)
+			switch {
+			case err != nil && !failing:
+				errorLog("Remote write to %s failed: %v", rw.url, err)
+			case err != nil:
+				debugLog("Remote write to %s failed: %v", rw.url, err)
+			case failing:
+				infoLog("Remote write to %s recovered", rw.url)
+			}
+			failing = err != nil
+		}
+	}
+}
+
+// push sends one sample per metric, all stamped now.
+func (rw *remoteWriter) push(ctx context.Context, metrics []metric, now time.Time) error {
+	body := snappyEncode(rw.writeRequest(metrics, now))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rw.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if rw.tenant != "" {
+		req.Header.Set("X-Scope-OrgID", rw.tenant)
+	}
+	if rw.user != "" {
+		req.SetBasicAuth(rw.user, rw.password)
+	}
+
+	resp, err := rw.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// writeRequest encodes a prometheus.WriteRequest protobuf:
+//
+//	WriteRequest { repeated TimeSeries timeseries = 1; }
+//	TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label        { string name = 1; string value = 2; }
+//	Sample       { double value = 1; int64 timestamp = 2; }
+//
+// Labels of each series are sorted by name, as receivers require.
+func (rw *remoteWriter) writeRequest(metrics []metric, now time.Time) []byte {
+	var req, series, label, sample []byte
+	for _, m := range metrics {
+		labels := append([][2]string{{"__name__", m.name}}, rw.labels...)
+		labels = append(labels, m.labels...)
+		sort.Slice(labels, func(i, j int) bool { return labels[i][0] < labels[j][0] })
+
+		series = series[:0]
+		for _, l := range labels {
+			label = protoAppendBytes(label[:0], 1, []byte(l[0]))
+			label = protoAppendBytes(label, 2, []byte(l[1]))
+			series = protoAppendBytes(series, 1, label)
+		}
+		sample = protoAppendFixed64(sample[:0], 1, math.Float64bits(m.value))
+		sample = protoAppendVarint(sample, 2, uint64(now.UnixMilli()))
+		series = protoAppendBytes(series, 2, sample)
+		req = protoAppendBytes(req, 1, series)
+	}
+	return req
+}
+
+// snappyEncode produces a valid snappy block made only of literals. Metric
+// batches are small, so compressing them is not worth an encoder; receivers
+// only require the snappy framing.
+func snappyEncode(src []byte) []byte {
+	dst := binary.AppendUvarint(make([]byte, 0, len(src)+len(src)/60+16), uint64(len(src)))
+	for len(src) > 0 {
+		n := min(len(src), 65536)
+		switch {
+		case n <= 60:
+			dst = append(dst, byte(n-1)<<2)
+		case n <= 256:
+			dst = append(dst, 60<<2, byte(n-1))
+		default:
+			dst = append(dst, 61<<2, byte(n-1), byte((n-1)>>8))
+		}
+		dst = append(dst, src[:n]...)
+		src = src[n:]
+	}
+	return dst
+}
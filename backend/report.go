@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// reportGrace delays each report so packets still in sink queues are counted.
+	reportGrace = time.Minute
+
+	reportCheckInterval = 15 * time.Second
+	reportFlushInterval = 5 * time.Second
+	reportTimeout       = 30 * time.Second
+)
+
+// reportSchedule is one report period: a UTC hour or day.
+type reportSchedule struct {
+	name  string
+	start func(t time.Time) time.Time
+	next  func(start time.Time) time.Time
+}
+
+var reportSchedules = map[string]reportSchedule{
+	"hourly": {
+		name:  "hourly",
+		start: func(t time.Time) time.Time { return t.UTC().Truncate(time.Hour) },
+		next:  func(start time.Time) time.Time { return start.Add(time.Hour) },
+	},
+	"daily": {
+		name: "daily",
+		start: func(t time.Time) time.Time {
+			y, m, d := t.UTC().Date()
+			return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+		},
+		next: func(start time.Time) time.Time { return start.AddDate(0, 0, 1) },
+	},
+}
+
+// trafficReport is the summary of one period, posted to REPORT_WEBHOOK_URL
+// and kept in the reports:{period} list.
+type trafficReport struct {
+	Period  string    `json:"period"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Partial bool      `json:"partial,omitempty"`
+
+	// SampleRate is set when ingest sampling is on; counts are then
+	// estimates scaled by 1/SampleRate.
+	SampleRate float64 `json:"sample_rate,omitempty"`
+
+	Messages     int `json:"messages"`
+	Pairs        int `json:"pairs"`
+	TCPPackets   int `json:"tcp_packets"`
+	TCPBytes     int `json:"tcp_bytes"`
+	UDPPackets   int `json:"udp_packets"`
+	UDPBytes     int `json:"udp_bytes"`
+	TotalPackets int `json:"total_packets"`
+	TotalBytes   int `json:"total_bytes"`
+
+	TopTalkers  []reportPair `json:"top_talkers"`
+	AlertsFired int          `json:"alerts_fired"`
+
+	GeneratedAt time.Time `json:"generated_at"`
+}
+
+// reportPair is one source:destination pair's share of a period.
+type reportPair struct {
+	Src          string `json:"src"`
+	Dest         string `json:"dest"`
+	Messages     int    `json:"messages"`
+	TotalPackets int    `json:"total_packets"`
+	TotalBytes   int    `json:"total_bytes"`
+}
+
+// reportAgg accumulates one period until it is reported.
+type reportAgg struct {
+	report trafficReport
+	pairs  map[string]*reportPair
+}
+
+// reporter builds hourly/daily summaries from new packets. Packets are
+// assigned to periods by their timestamp; a period is reported once it has
+// been over for reportGrace, and later packets for it are not counted.
+type reporter struct {
+	cfg       *Config
+	rdb       redisClient
+	webhook   string
+	client    *http.Client
+	topN      int
+	startedAt time.Time
+
+	mu        sync.Mutex
+	schedules []reportSchedule
+	current   map[string]time.Time // start of the oldest unreported period per schedule
+	aggs      map[string]*reportAgg
+}
+
+var reports *reporter
+
+func initReports(ctx context.Context, cfg *Config, rdb redisClient) error {
+	if cfg.Reports == "" {
+		return nil
+	}
+
+	now := time.Now()
+	r := &reporter{
+		cfg:       cfg,
+		rdb:       rdb,
+		webhook:   cfg.ReportWebhookURL,
+		client:    &http.Client{Timeout: reportTimeout},
+		topN:      cfg.ReportTopN,
+		startedAt: now,
+		current:   make(map[string]time.Time),
+		aggs:      make(map[string]*reportAgg),
+	}
+	for _, name := range splitList(cfg.Reports) {
+		schedule, ok := reportSchedules[name]
+		if !ok {
+			return fmt.Errorf("unknown report schedule %q (use hourly and/or daily)", name)
+		}
+		r.schedules = append(r.schedules, schedule)
+		r.current[name] = schedule.start(now)
+	}
+
+	reports = r
+	registerSink(r, sinkQueueSize, reportFlushInterval)
+	go r.run(ctx)
+	return nil
+}
+
+func (r *reporter) Name() string { return "report" }
+
+func (r *reporter) Write(ctx context.Context, packets []Packet) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, p := range packets {
+		e := generateEdgeSummary(p)
+		t := time.Unix(int64(p.Timestamp), 0)
+		for _, schedule := range r.schedules {
+			agg := r.agg(schedule, t)
+			if agg == nil {
+				continue
+			}
+			agg.report.Messages++
+			agg.report.TCPPackets += e.TCPPacketsTotal
+			agg.report.TCPBytes += e.TCPBytesTotal
+			agg.report.UDPPackets += e.UDPPacketsTotal
+			agg.report.UDPBytes += e.UDPBytesTotal
+
+			key := pairKey(p.Src, p.Dest)
+			pair, ok := agg.pairs[key]
+			if !ok {
+				pair = &reportPair{Src: p.Src, Dest: p.Dest}
+				agg.pairs[key] = pair
+			}
+			pair.Messages++
+			pair.TotalPackets += e.TotalPackets
+			pair.TotalBytes += e.TotalBytes
+		}
+	}
+	return nil
+}
+
+// agg returns the accumulator for the period containing t, or nil if that
+// period has already been reported. Callers hold r.mu.
+func (r *reporter) agg(schedule reportSchedule, t time.Time) *reportAgg {
+	start := schedule.start(t)
+	if start.Before(r.current[schedule.name]) {
+		return nil
+	}
+	key := schedule.name + "|" + strconv.FormatInt(start.Unix(), 10)
+	agg, ok := r.aggs[key]
+	if !ok {
+		agg = &reportAgg{
+			report: trafficReport{Period: schedule.name, Start: start, End: schedule.next(start)},
+			pairs:  make(map[string]*reportPair),
+		}
+		r.aggs[key] = agg
+	}
+	return agg
+}
+
+// alertFired counts a firing alert toward the current periods.
+func (r *reporter) alertFired(t time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, schedule := range r.schedules {
+		if agg := r.agg(schedule, t); agg != nil {
+			agg.report.AlertsFired++
+		}
+	}
+}
+
+// reportAlertFired is called by the alert engine when a rule starts firing.
+func reportAlertFired(t time.Time) {
+	if reports != nil {
+		reports.alertFired(t)
+	}
+}
+
+func (r *reporter) run(ctx context.Context) {
+	ticker := time.NewTicker(reportCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, report := range r.due(now) {
+				r.publish(ctx, report)
+			}
+		}
+	}
+}
+
+// due finalizes every period that ended at least reportGrace ago, including
+// periods without traffic.
+func (r *reporter) due(now time.Time) []trafficReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var due []trafficReport
+	for _, schedule := range r.schedules {
+		for {
+			start := r.current[schedule.name]
+			end := schedule.next(start)
+			if now.Sub(end) < reportGrace {
+				break
+			}
+			key := schedule.name + "|" + strconv.FormatInt(start.Unix(), 10)
+			agg, ok := r.aggs[key]
+			if !ok {
+				agg = &reportAgg{report: trafficReport{Period: schedule.name, Start: start, End: end}}
+			}
+			delete(r.aggs, key)
+			r.current[schedule.name] = end
+			due = append(due, r.finish(agg, now))
+		}
+	}
+	return due
+}
+
+func (r *reporter) finish(agg *reportAgg, now time.Time) trafficReport {
+	report := agg.report
+	report.Partial = report.Start.Before(r.startedAt)
+	if r.cfg.SampleRate < 1 {
+		report.SampleRate = r.cfg.SampleRate
+		scale := func(n *int) { *n = int(math.Round(float64(*n) * r.cfg.sampleWeight())) }
+		for _, n := range []*int{&report.Messages, &report.TCPPackets, &report.TCPBytes, &report.UDPPackets, &report.UDPBytes} {
+			scale(n)
+		}
+		for _, pair := range agg.pairs {
+			scale(&pair.Messages)
+			scale(&pair.TotalPackets)
+			scale(&pair.TotalBytes)
+		}
+	}
+	report.Pairs = len(agg.pairs)
+	report.TotalPackets = report.TCPPackets + report.UDPPackets
+	report.TotalBytes = report.TCPBytes + report.UDPBytes
+	report.GeneratedAt = now
+
+	report.TopTalkers = make([]reportPair, 0, len(agg.pairs))
+	for _, pair := range agg.pairs {
+		report.TopTalkers = append(report.TopTalkers, *pair)
+	}
+	sort.Slice(report.TopTalkers, func(i, j int) bool {
+		a, b := report.TopTalkers[i], report.TopTalkers[j]
+		if a.TotalBytes != b.TotalBytes {
+			return a.TotalBytes > b.TotalBytes
+		}
+		return pairKey(a.Src, a.Dest) < pairKey(b.Src, b.Dest)
+	})
+	if len(report.TopTalkers) > r.topN {
+		report.TopTalkers = report.TopTalkers[:r.topN]
+	}
+	return report
+}
+
+// publish stores the report in Redis and posts it to the webhook.
+func (r *reporter) publish(ctx context.Context, report trafficReport) {
+	infoLog("%s report for %s: %d messages, %d bytes, %d alerts",
+		report.Period, report.Start.Format(time.RFC3339), report.Messages, report.TotalBytes, report.AlertsFired)
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		errorLog("Error encoding %s report: %v", report.Period, err)
+		return
+	}
+
+	if r.cfg.ReportHistory > 0 {
+		key := "reports:" + report.Period
+		pipe := r.rdb.Pipeline()
+		pipe.LPush(ctx, key, data)
+		pipe.LTrim(ctx, key, 0, int64(r.cfg.ReportHistory-1))
+		if _, err := pipe.Exec(ctx); err != nil {
+			errorLog("Error storing %s report: %v", report.Period, err)
+		}
+	}
+
+	if r.webhook != "" {
+		err := r.cfg.notifyBackoff().retry(ctx, report.Period+" report post", func(ctx context.Context) error {
+			return r.post(ctx, data)
+		})
+		if err != nil {
+			errorLog("Error posting %s report: %v", report.Period, err)
+		}
+	}
+}
+
+func (r *reporter) post(ctx context.Context, data []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.webhook, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return httpStatusError(resp)
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// handleReports returns stored reports, newest first:
+// GET /reports?period=hourly&limit=24
+func (s *Server) handleReports(rdb redisClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.requestAllTenants(w, r) {
+			return
+		}
+		if reports == nil || s.config.ReportHistory == 0 {
+			writeError(w, notFound.errorf("Endpoint disabled (REPORTS not set)"))
+			return
+		}
+
+		period := r.URL.Query().Get("period")
+		if period == "" {
+			period = reports.schedules[0].name
+		}
+		if _, ok := reportSchedules[period]; !ok {
+			writeError(w, badQuery.errorf("Invalid period (use hourly or daily)"))
+			return
+		}
+		limit := 24
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				writeError(w, badQuery.errorf("Invalid limit"))
+				return
+			}
+			limit = n
+		}
+
+		ctx, cancel := s.queryContext(r)
+		defer cancel()
+		var entries []string
+		err := redisDo(ctx, func(ctx context.Context) (err error) {
+			entries, err = rdb.LRange(ctx, "reports:"+period, 0, int64(limit-1)).Result()
+			return err
+		})
+		if err != nil {
+			s.queryFailed(w, r, "Report query", err)
+			return
+		}
+		list := make([]json.RawMessage, 0, len(entries))
+		for _, entry := range entries {
+			list = append(list, json.RawMessage(entry))
+		}
+		response := map[string]interface{}{
+			"period":  period,
+			"count":   len(list),
+			"reports": list,
+		}
+		s.cacheQuery(r, response)
+		writeJSON(w, response)
+	}
+}
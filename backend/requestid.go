@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// requestIDHeader carries a request's ID in both directions.
+const requestIDHeader = "X-Request-ID"
+
+// requestIDMaxLen bounds an incoming ID; longer ones are replaced.
+const requestIDMaxLen = 128
+
+type requestIDKey struct{}
+
+// requestID returns the ID of the request ctx belongs to, or "" outside one.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// newRequestID returns a random 16-digit hex ID.
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestID reports whether an incoming ID can be used as is: printable
+// ASCII without spaces, so it cannot break a log line or a header.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > requestIDMaxLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// withRequestID gives the request an ID, the caller's X-Request-ID if it is
+// valid or a new one, stores it in the request context, and returns it in
+// the X-Request-ID response header, where writeError finds it for the error
+// envelope.
+func withRequestID(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+		next(w, r)
+	}
+}
+
+// requestIDResponseHeader is the header for a WebSocket upgrade response,
+// which the upgrader writes itself and so would lose X-Request-ID.
+func requestIDResponseHeader(r *http.Request) http.Header {
+	id := requestID(r.Context())
+	if id == "" {
+		return nil
+	}
+	return http.Header{requestIDHeader: {id}}
+}
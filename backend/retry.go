@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Circuit breaker states.
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// queryCacheSize bounds the responses kept for serving while Redis is down.
+const queryCacheSize = 256
+
+// errRedisUnavailable is returned without contacting Redis while the circuit
+// breaker is open.
+var errRedisUnavailable = errors.New("redis circuit breaker open")
+
+// circuitBreaker stops calling Redis after REDIS_BREAKER_FAILURES consecutive
+// failed calls. Once REDIS_BREAKER_COOLDOWN has passed it lets one probe
+// call through (half-open): success closes it, failure opens it again.
+type circuitBreaker struct {
+	// threshold is the failures that open the breaker (0 never does) and
+	// cooldown how long it stays open; policy retries the calls it lets
+	// through. initRedisBreaker sets them before the first call.
+	threshold int
+	cooldown  time.Duration
+	policy    backoff
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+}
+
+var redisBreaker = &circuitBreaker{state: breakerClosed}
+
+// initRedisBreaker applies REDIS_BREAKER_FAILURES, REDIS_BREAKER_COOLDOWN, and
+// the Redis retry policy to redisBreaker.
+func initRedisBreaker(cfg *Config) {
+	redisBreaker.threshold = cfg.RedisBreakerFailures
+	redisBreaker.cooldown = cfg.RedisBreakerCooldown
+	redisBreaker.policy = cfg.redisBackoff()
+}
+
+// allow reports whether a call may go to Redis now.
+func (b *circuitBreaker) allow() bool {
+	if b.threshold == 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerClosed:
+		return true
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		return true
+	default:
+		// A probe is already in flight.
+		return false
+	}
+}
+
+// record updates the breaker with the outcome of an allowed call. A call
+// that was cancelled says nothing about Redis; it only ends a probe, so the
+// next call probes again.
+func (b *circuitBreaker) record(err error, cancelled bool) {
+	if b.threshold == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case cancelled:
+		if b.state == breakerHalfOpen {
+			b.state = breakerOpen
+		}
+	case err == nil:
+		if b.state != breakerClosed {
+			infoLog("Redis circuit breaker closed")
+		}
+		b.state = breakerClosed
+		b.failures = 0
+	default:
+		b.failures++
+		if b.state == breakerHalfOpen || b.failures >= b.threshold {
+			if b.state != breakerHalfOpen {
+				errorLog("Redis circuit breaker open after %d failed calls: %v", b.failures, err)
+			}
+			b.state = breakerOpen
+			b.openedAt = time.Now()
+		}
+	}
+}
+
+// current returns the breaker state.
+func (b *circuitBreaker) current() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// redisDo runs one Redis operation through the circuit breaker, retrying
+// connection failures and timeouts with redisBackoff (REDIS_RETRIES times
+// from REDIS_RETRY_BACKOFF). Error replies from the server (including
+// redis.Nil) are returned at once and count as success: Redis is up. A call
+// cut short by ctx returns an error wrapping ctx.Err(), whatever the client
+// made of the deadline.
+func redisDo(ctx context.Context, fn func(ctx context.Context) error) error {
+	if !redisBreaker.allow() {
+		return errRedisUnavailable
+	}
+
+	err := redisBreaker.policy.retry(ctx, "Redis call", func(ctx context.Context) error {
+		err := fn(ctx)
+		var reply redis.Error
+		if errors.As(err, &reply) {
+			return permanent(err)
+		}
+		return err
+	})
+	var reply redis.Error
+	switch {
+	case err == nil || errors.As(err, &reply):
+		redisBreaker.record(nil, false)
+		return err
+	case ctx.Err() != nil:
+		redisBreaker.record(err, true)
+		return contextError(ctx, err)
+	}
+	redisBreaker.record(err, false)
+	return err
+}
+
+// contextError is err from a call ctx ended, wrapping ctx.Err() too: go-redis
+// reports a passed deadline as a network timeout.
+func contextError(ctx context.Context, err error) error {
+	if errors.Is(err, ctx.Err()) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ctx.Err(), err)
+}
+
+// queryContext bounds a Redis-backed query to QUERY_TIMEOUT. It derives
+// from the request's context, so the query also ends when the client goes
+// away or the server shuts down.
+func (s *Server) queryContext(r *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(r.Context(), s.config.QueryTimeout)
+}
+
+// cachedResponse is the last successful response of a Redis-backed query.
+type cachedResponse struct {
+	body map[string]interface{}
+	at   time.Time
+}
+
+// queryCacheKey is r's URL, behind the tenant of its token so a tenant is
+// never served another tenant's cached response for the same URL.
+func queryCacheKey(r *http.Request) string {
+	return tenantPrefix(tokenTenant(r)) + r.URL.RequestURI()
+}
+
+// cacheQuery remembers body as the response to r.
+func (s *Server) cacheQuery(r *http.Request, body map[string]interface{}) {
+	s.queryCacheMu.Lock()
+	defer s.queryCacheMu.Unlock()
+
+	key := queryCacheKey(r)
+	if _, ok := s.queryCache[key]; !ok && len(s.queryCache) >= queryCacheSize {
+		for k := range s.queryCache {
+			delete(s.queryCache, k)
+			break
+		}
+	}
+	s.queryCache[key] = cachedResponse{body: body, at: time.Now()}
+}
+
+// serveCachedQuery answers r with its cached response, marked stale, after
+// the Redis query failed. It reports false when nothing is cached.
+func (s *Server) serveCachedQuery(w http.ResponseWriter, r *http.Request) bool {
+	s.queryCacheMu.Lock()
+	cached, ok := s.queryCache[queryCacheKey(r)]
+	s.queryCacheMu.Unlock()
+	if !ok {
+		return false
+	}
+
+	body := make(map[string]interface{}, len(cached.body)+2)
+	for k, v := range cached.body {
+		body[k] = v
+	}
+	body["stale"] = true
+	body["cached_at"] = cached.at
+	writeJSON(w, body)
+	return true
+}
+
+// queryFailed answers a Redis-backed query whose Redis call failed: with the
+// cached response if there is one, otherwise 503 while the breaker is open,
+// 504 when it ran past QUERY_TIMEOUT, and 502 for other failures.
+func (s *Server) queryFailed(w http.ResponseWriter, r *http.Request, what string, err error) {
+	if s.serveCachedQuery(w, r) {
+		debugLog("%s failed (request %s), served cached response: %v", what, requestID(r.Context()), err)
+		return
+	}
+	if errors.Is(err, errRedisUnavailable) {
+		writeError(w, unavailable.errorf("%s unavailable (Redis circuit breaker open)", what))
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		errorLog("%s timed out after %s (request %s)", what, s.config.QueryTimeout, requestID(r.Context()))
+		writeError(w, timedOut.errorf("%s timed out", what))
+		return
+	}
+	errorLog("%s failed (request %s): %v", what, requestID(r.Context()), err)
+	writeError(w, upstreamFailed.errorf("%s failed", what))
+}
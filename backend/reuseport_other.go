@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+)
+
+func reusePort(network, address string, c syscall.RawConn) error {
+	return fmt.Errorf("REUSE_PORT is not supported on %s/%s", runtime.GOOS, runtime.GOARCH)
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const rollupIndexName = "idx:rollups"
+
+// rollupResolution is one rollup granularity and how long its hashes live.
+type rollupResolution struct {
+	name string
+	size int
+	ttl  time.Duration
+}
+
+// rollupAgg accumulates one rollup:{resolution}:{bucket}:{dest}:{src} hash.
+type rollupAgg struct {
+	resolution string
+	bucket     int
+	size       int
+	src        string
+	dest       string
+
+	// Counters are floats so sampled packets can be scaled by fractional
+	// weights; they are rounded when written.
+	count      float64
+	tcpPackets float64
+	tcpBytes   float64
+	udpPackets float64
+	udpBytes   float64
+	minBytes   int
+	maxBytes   int
+
+	ttl   time.Duration
+	dirty bool
+}
+
+// rollupSink maintains per-minute and per-hour rollups of new packets in
+// Redis. Open buckets stay in memory and are rewritten on every flush; a
+// bucket first touched by this process (after a restart, or a packet arriving
+// after eviction) is merged with the hash already in Redis. Only one backend
+// per Redis should write rollups.
+type rollupSink struct {
+	cfg         *Config
+	rdb         redisClient
+	resolutions []rollupResolution
+	lateness    time.Duration
+	aggs        map[string]*rollupAgg
+}
+
+func initRollups(ctx context.Context, cfg *Config, rdb redisClient) {
+	if !cfg.Rollups {
+		return
+	}
+
+	s := &rollupSink{
+		cfg: cfg,
+		rdb: rdb,
+		resolutions: []rollupResolution{
+			{name: "1m", size: 60, ttl: cfg.RollupMinuteTTL},
+			{name: "1h", size: 3600, ttl: cfg.RollupHourTTL},
+		},
+		lateness: cfg.RollupLateness,
+		aggs:     make(map[string]*rollupAgg),
+	}
+	registerSink(s, sinkQueueSize, cfg.RollupFlushInterval)
+}
+
+func (s *rollupSink) Name() string { return "rollup" }
+
+// Write folds packets into their buckets and writes every changed bucket.
+// It only runs on the sink goroutine, so aggs needs no lock.
+func (s *rollupSink) Write(ctx context.Context, packets []Packet) error {
+	if err := s.load(ctx, packets); err != nil {
+		return err
+	}
+
+	weight := s.cfg.sampleWeight()
+	for _, p := range packets {
+		e := generateEdgeSummary(p)
+		for _, res := range s.resolutions {
+			agg := s.aggs[rollupKey(res, p)]
+			if agg.count == 0 || e.TotalBytes < agg.minBytes {
+				agg.minBytes = e.TotalBytes
+			}
+			if agg.count == 0 || e.TotalBytes > agg.maxBytes {
+				agg.maxBytes = e.TotalBytes
+			}
+			agg.count += weight
+			agg.tcpPackets += float64(e.TCPPacketsTotal) * weight
+			agg.tcpBytes += float64(e.TCPBytesTotal) * weight
+			agg.udpPackets += float64(e.UDPPacketsTotal) * weight
+			agg.udpBytes += float64(e.UDPBytesTotal) * weight
+			agg.dirty = true
+		}
+	}
+
+	pipe := s.rdb.Pipeline()
+	var written []*rollupAgg
+	for key, agg := range s.aggs {
+		if !agg.dirty {
+			continue
+		}
+		pipe.HSet(ctx, key, agg.fields())
+		if agg.ttl > 0 {
+			pipe.Expire(ctx, key, agg.ttl)
+		}
+		written = append(written, agg)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		// Buckets stay dirty and are rewritten with the next batch.
+		return err
+	}
+	for _, agg := range written {
+		agg.dirty = false
+	}
+
+	s.evict(time.Now())
+	return nil
+}
+
+// load makes sure every bucket touched by packets is in memory, reading
+// buckets that already exist in Redis so their totals are preserved.
+func (s *rollupSink) load(ctx context.Context, packets []Packet) error {
+	pending := make(map[string]*redis.MapStringStringCmd)
+	pipe := s.rdb.Pipeline()
+	for _, p := range packets {
+		for _, res := range s.resolutions {
+			key := rollupKey(res, p)
+			if _, ok := s.aggs[key]; ok {
+				continue
+			}
+			s.aggs[key] = &rollupAgg{
+				resolution: res.name,
+				bucket:     p.Timestamp - p.Timestamp%res.size,
+				size:       res.size,
+				src:        p.Src,
+				dest:       p.Dest,
+				ttl:        res.ttl,
+			}
+			pending[key] = pipe.HGetAll(ctx, key)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		for key := range pending {
+			delete(s.aggs, key)
+		}
+		return err
+	}
+
+	for key, cmd := range pending {
+		fields := cmd.Val()
+		if len(fields) == 0 {
+			continue
+		}
+		agg := s.aggs[key]
+		num := func(k string) float64 {
+			n, _ := strconv.ParseFloat(fields[k], 64)
+			return n
+		}
+		agg.count = num("count")
+		agg.tcpPackets = num("tcp_packets")
+		agg.tcpBytes = num("tcp_bytes")
+		agg.udpPackets = num("udp_packets")
+		agg.udpBytes = num("udp_bytes")
+		agg.minBytes = int(num("min_bytes"))
+		agg.maxBytes = int(num("max_bytes"))
+	}
+	return nil
+}
+
+// evict drops buckets that closed more than the allowed lateness ago.
+func (s *rollupSink) evict(now time.Time) {
+	cutoff := int(now.Add(-s.lateness).Unix())
+	for key, agg := range s.aggs {
+		if agg.bucket+agg.size < cutoff {
+			delete(s.aggs, key)
+		}
+	}
+}
+
+func (a *rollupAgg) fields() map[string]interface{} {
+	return map[string]interface{}{
+		"resolution":    a.resolution,
+		"bucket":        a.bucket,
+		"source_ip":     a.src,
+		"dest_ip":       a.dest,
+		"count":         int64(math.Round(a.count)),
+		"tcp_packets":   int64(math.Round(a.tcpPackets)),
+		"tcp_bytes":     int64(math.Round(a.tcpBytes)),
+		"udp_packets":   int64(math.Round(a.udpPackets)),
+		"udp_bytes":     int64(math.Round(a.udpBytes)),
+		"total_packets": int64(math.Round(a.tcpPackets + a.udpPackets)),
+		"total_bytes":   int64(math.Round(a.tcpBytes + a.udpBytes)),
+		"min_bytes":     a.minBytes,
+		"max_bytes":     a.maxBytes,
+	}
+}
+
+// rollupKey mirrors packetKey's tenant prefix and dest-before-src order.
+func rollupKey(res rollupResolution, p Packet) string {
+	return fmt.Sprintf("%srollup:%s:%d:%s:%s", tenantPrefix(p.Tenant), res.name, p.Timestamp-p.Timestamp%res.size, p.Dest, p.Src)
+}
+
+// rollupIndexSchema is the idx:rollups schema.
+var rollupIndexSchema = []*redis.FieldSchema{
+	{FieldName: "resolution", FieldType: redis.SearchFieldTypeTag},
+	{FieldName: "bucket", FieldType: redis.SearchFieldTypeNumeric, Sortable: true},
+	{FieldName: "source_ip", FieldType: redis.SearchFieldTypeTag},
+	{FieldName: "dest_ip", FieldType: redis.SearchFieldTypeTag},
+	{FieldName: "total_bytes", FieldType: redis.SearchFieldTypeNumeric, Sortable: true},
+}
+
+// ensureRollupIndex creates the RediSearch index over rollup:* hashes, one
+// per tenant.
+func ensureRollupIndex(ctx context.Context, cfg *Config, rdb redisClient) error {
+	if searchFallback.Load() {
+		infoLog("RediSearch not in use; rollups are written but GET /rollups is disabled")
+		return nil
+	}
+	for _, tenant := range cfg.tenantNames() {
+		index := rollupIndexFor(tenant)
+		err := redisDo(ctx, func(ctx context.Context) error {
+			return searchClient(rdb).FTInfo(ctx, index).Err()
+		})
+		if err == nil {
+			debugLog("Index '%s' already exists", index)
+			continue
+		}
+
+		err = redisDo(ctx, func(ctx context.Context) error {
+			return searchClient(rdb).FTCreate(
+				ctx,
+				index,
+				&redis.FTCreateOptions{
+					OnHash: true,
+					Prefix: []interface{}{tenantPrefix(tenant) + "rollup:"},
+				},
+				rollupIndexSchema...,
+			).Err()
+		})
+		if err != nil {
+			return err
+		}
+		infoLog("Index '%s' created successfully", index)
+	}
+	return nil
+}
+
+// handleRollups queries rollups by resolution and time range, optionally
+// restricted to one source and/or destination:
+// GET /rollups?resolution=1h&from=<unix>&to=<unix>&src=&dest=
+func (s *Server) handleRollups(rdb redisClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.config.Rollups {
+			writeError(w, notFound.errorf("Endpoint disabled (ROLLUPS not set)"))
+			return
+		}
+		if searchFallback.Load() {
+			writeError(w, notImplemented.errorf("Rollup queries need RediSearch"))
+			return
+		}
+		tenant, ok := s.requestIndexTenant(w, r)
+		if !ok {
+			return
+		}
+
+		q := r.URL.Query()
+		resolution := q.Get("resolution")
+		span := 24 * time.Hour
+		switch resolution {
+		case "", "1h":
+			resolution = "1h"
+		case "1m":
+			span = time.Hour
+		default:
+			writeError(w, badQuery.errorf("Invalid resolution (use 1m or 1h)"))
+			return
+		}
+
+		to := time.Now().Unix()
+		if v := cmp.Or(q.Get("to"), q.Get("bucket_max")); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				writeError(w, badQuery.errorf("Invalid to"))
+				return
+			}
+			to = n
+		}
+		from := to - int64(span.Seconds())
+		if v := cmp.Or(q.Get("from"), q.Get("bucket_min")); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n > to {
+				writeError(w, badQuery.errorf("Invalid from"))
+				return
+			}
+			from = n
+		}
+
+		query := fmt.Sprintf("@resolution:{%s} @bucket:[%d %d]", resolution, from, to)
+		// src_ip/dst_ip match the GET /packets parameter names.
+		if src := cmp.Or(q.Get("src"), q.Get("src_ip")); src != "" {
+			query += " @source_ip:{" + escapeTagValue(src) + "}"
+		}
+		if dest := cmp.Or(q.Get("dest"), q.Get("dst_ip")); dest != "" {
+			query += " @dest_ip:{" + escapeTagValue(dest) + "}"
+		}
+
+		ranges, err := numericRanges(q, rollupIndexSchema, "bucket")
+		if err != nil {
+			writeError(w, badQuery.errorf("%v", err))
+			return
+		}
+		query += ranges
+
+		sortBy, err := parseSort(q.Get("sort"), rollupIndexSchema, redis.FTSearchSortBy{FieldName: "bucket", Asc: true})
+		if err != nil {
+			writeError(w, badQuery.errorf("%v", err))
+			return
+		}
+
+		ctx, cancel := s.queryContext(r)
+		defer cancel()
+		rollups := []map[string]interface{}{}
+		for offset := 0; ; offset += searchLimit {
+			var result redis.FTSearchResult
+			err := redisDo(ctx, func(ctx context.Context) (err error) {
+				result, err = searchClient(rdb).FTSearchWithArgs(ctx, rollupIndexFor(tenant), query, &redis.FTSearchOptions{
+					LimitOffset: offset,
+					Limit:       searchLimit,
+					SortBy:      sortBy,
+				}).Result()
+				return err
+			})
+			if err != nil {
+				s.queryFailed(w, r, "Rollup query", err)
+				return
+			}
+			for _, doc := range result.Docs {
+				rollups = append(rollups, rollupDocument(doc))
+			}
+			if len(result.Docs) < searchLimit {
+				break
+			}
+		}
+
+		response := map[string]interface{}{
+			"resolution": resolution,
+			"from":       from,
+			"to":         to,
+			"rollups":    rollups,
+		}
+		s.attachAnnotations(ctx, rdb, response, tenant, from, to)
+		s.cacheQuery(r, response)
+		writeJSON(w, response)
+	}
+}
+
+// rollupDocument converts a rollup hash to JSON with numeric counters.
+func rollupDocument(doc redis.Document) map[string]interface{} {
+	out := make(map[string]interface{}, len(doc.Fields))
+	for k, v := range doc.Fields {
+		if n, err := strconv.Atoi(v); err == nil && k != "source_ip" && k != "dest_ip" {
+			out[k] = n
+		} else {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// escapeTagValue backslash-escapes the punctuation RediSearch treats as
+// separators inside a {tag} query (dots and colons in addresses included).
+func escapeTagValue(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c > 127 {
+			b.WriteRune(c)
+		} else {
+			b.WriteByte('\\')
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strconv"
+)
+
+func initSampling(cfg *Config) error {
+	if v := cfg.SampleProbability; v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || !(f > 0 && f <= 1) {
+			return fmt.Errorf("%q is not a probability in (0, 1]", v)
+		}
+		cfg.SampleRate = f
+	}
+	if cfg.SampleRate < 1 {
+		infoLog("Sampling %.4g of packets (weight %.4g)", cfg.SampleRate, cfg.sampleWeight())
+	}
+	return nil
+}
+
+// samplePackets keeps about SAMPLE_RATE of packets. The decision is a
+// hash of the packet's Redis key rather than a coin flip, so a packet read
+// again by a later poll, or stored by /ingest and then polled, is always
+// kept or dropped the same way.
+func (c *Config) samplePackets(packets []Packet) []Packet {
+	if c.SampleRate >= 1 {
+		return packets
+	}
+	threshold := uint64(c.SampleRate * math.MaxUint64)
+	kept := packets[:0:0]
+	for _, p := range packets {
+		h := fnv.New64a()
+		h.Write([]byte(c.packetKey(p)))
+		// Mix the FNV output so nearby keys do not land in nearby buckets.
+		if mix64(h.Sum64()) <= threshold {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// sampleWeight is the number of packets each kept packet stands for; derived
+// counts and rates (alerts, reports, rollups) are scaled by it.
+func (c *Config) sampleWeight() float64 {
+	return 1 / c.SampleRate
+}
+
+// mix64 is the splitmix64 finalizer.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
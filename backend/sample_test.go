@@ -0,0 +1,15 @@
+package main
+
+import "testing"
+
+func TestInitSamplingProbability(t *testing.T) {
+	cfg := &Config{SampleRate: 0.5, SampleProbability: "0.25"}
+	if err := initSampling(cfg); err != nil || cfg.SampleRate != 0.25 {
+		t.Fatalf("SAMPLE_PROBABILITY=0.25: rate %v (%v)", cfg.SampleRate, err)
+	}
+	for _, bad := range []string{"0", "1.5", "-0.1", "half", "NaN"} {
+		if err := initSampling(&Config{SampleRate: 1, SampleProbability: bad}); err == nil {
+			t.Errorf("SAMPLE_PROBABILITY=%s was accepted", bad)
+		}
+	}
+}
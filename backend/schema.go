@@ -0,0 +1,111 @@
+package main
+
+import (
+	"cmp"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// schemaField describes a field of packets or summaries for /schema.
+type schemaField struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Items    string `json:"items,omitempty"`
+	Unit     string `json:"unit,omitempty"`
+	Optional bool   `json:"optional,omitempty"`
+
+	// Filter is "any" for fields every filter takes, "packet" for fields
+	// only FILTER and alert rules take, and empty for neither.
+	Filter string `json:"filter,omitempty"`
+
+	// Index is the field's attribute in the packet index, if it has one.
+	Index *schemaIndex `json:"index,omitempty"`
+}
+
+type schemaIndex struct {
+	Field    string `json:"field"`
+	Type     string `json:"type"`
+	Sortable bool   `json:"sortable"`
+}
+
+// schemaFields lists the fields of struct type t as encoding/json names
+// them, with their index attributes in schema.
+func schemaFields(t reflect.Type, schema []*redis.FieldSchema) []schemaField {
+	var fields []schemaField
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(sf.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		f := schemaField{
+			Name:     cmp.Or(name, sf.Name),
+			Type:     schemaType(sf.Type),
+			Unit:     sf.Tag.Get("unit"),
+			Optional: strings.Contains(opts, "omitempty"),
+		}
+		if sf.Type.Kind() == reflect.Slice {
+			f.Items = schemaType(sf.Type.Elem())
+		}
+		if ff, ok := filterFields[f.Name]; ok {
+			f.Filter = "any"
+			if ff.packetOnly {
+				f.Filter = "packet"
+			}
+		}
+		for _, attr := range schema {
+			if attr.FieldName == f.Name {
+				f.Index = &schemaIndex{
+					Field:    cmp.Or(attr.As, attr.FieldName),
+					Type:     strings.ToLower(attr.FieldType.String()),
+					Sortable: attr.Sortable,
+				}
+			}
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// schemaType is the JSON type of values of Go type t.
+func schemaType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	}
+	return "object"
+}
+
+// The schemas are derived from the types once; they only change with the code.
+var (
+	packetSchema  = schemaFields(reflect.TypeOf(Packet{}), packetIndexSchema)
+	summarySchema = schemaFields(reflect.TypeOf(PacketSummary{}), nil)
+)
+
+// handleSchema describes the fields of packets, as /packets and /export
+// return them and producers send them, and of the edge summaries in
+// /latest and broadcast frames, which the fields parameter projects.
+// search is false while packet queries run without RediSearch, so index
+// attributes cannot be queried.
+func handleSchema(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]interface{}{
+		"search":  !searchFallback.Load(),
+		"packet":  packetSchema,
+		"summary": summarySchema,
+	})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// publisherSeq tracks the seq numbers of one publisher (source_ip and node_id).
+type publisherSeq struct {
+	Src        string `json:"src"`
+	NodeID     int    `json:"node_id"`
+	Last       int    `json:"last_seq"`
+	Gaps       int64  `json:"gaps"`
+	Missing    int64  `json:"missing"`
+	Duplicates int64  `json:"duplicates"`
+	Restarts   int64  `json:"restarts"`
+}
+
+var (
+	seqMu      sync.Mutex
+	publishers = make(map[string]*publisherSeq)
+
+	// seqMissing and seqDuplicates are totals over all publishers, reported
+	// in status frames.
+	seqMissing    atomic.Int64
+	seqDuplicates atomic.Int64
+)
+
+// checkSequences compares the publisher seq of new packets with the last one
+// seen from the same publisher. A jump counts the skipped numbers as missing,
+// a repeated or older number counts as a duplicate, and seq 0 after a higher
+// number is taken as a publisher restart. Packets within one batch are
+// checked in seq order, since the poller reads them newest first.
+func checkSequences(cfg *Config, packets []Packet) {
+	if !cfg.SeqTracking || len(packets) == 0 {
+		return
+	}
+
+	ordered := make([]Packet, len(packets))
+	copy(ordered, packets)
+	sort.SliceStable(ordered, func(i, j int) bool { return ordered[i].Seq < ordered[j].Seq })
+
+	seqMu.Lock()
+	defer seqMu.Unlock()
+	for _, p := range ordered {
+		key := p.Src + "/" + strconv.Itoa(p.NodeID)
+		pub, ok := publishers[key]
+		if !ok {
+			publishers[key] = &publisherSeq{Src: p.Src, NodeID: p.NodeID, Last: p.Seq}
+			continue
+		}
+
+		switch {
+		case p.Seq == pub.Last+1:
+			pub.Last = p.Seq
+		case p.Seq > pub.Last:
+			missing := int64(p.Seq - pub.Last - 1)
+			pub.Gaps++
+			pub.Missing += missing
+			seqMissing.Add(missing)
+			debugLog("Seq gap from %s (node %d): %d -> %d", p.Src, p.NodeID, pub.Last, p.Seq)
+			pub.Last = p.Seq
+		case p.Seq == 0 && pub.Last > 0:
+			pub.Restarts++
+			infoLog("Publisher %s (node %d) restarted its sequence after %d", p.Src, p.NodeID, pub.Last)
+			pub.Last = 0
+		default:
+			pub.Duplicates++
+			seqDuplicates.Add(1)
+		}
+	}
+}
+
+// handleAdminSequences lists per-publisher sequence tracking state.
+func (s *Server) handleAdminSequences(w http.ResponseWriter, r *http.Request) {
+	if !s.config.SeqTracking {
+		writeError(w, notFound.errorf("Endpoint disabled (SEQ_TRACKING not set)"))
+		return
+	}
+
+	seqMu.Lock()
+	list := make([]publisherSeq, 0, len(publishers))
+	for _, pub := range publishers {
+		list = append(list, *pub)
+	}
+	seqMu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Src != list[j].Src {
+			return list[i].Src < list[j].Src
+		}
+		return list[i].NodeID < list[j].NodeID
+	})
+	writeJSON(w, map[string]interface{}{
+		"missing":    seqMissing.Load(),
+		"duplicates": seqDuplicates.Load(),
+		"publishers": list,
+	})
+}
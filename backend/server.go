@@ -0,0 +1,175 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Server is the state of one backend instance: its configuration, its
+// materialized view, its WebSocket hub and sessions, and the feed status and
+// counters it reports, and its alert rules. The handlers, inputs, and poller
+// are its methods; main runs one, and newServer builds independent ones, so
+// tests can run several side by side. Sinks, notifiers, and the parsed
+// tables (tenants, access lists, filters, processors) are process-wide.
+type Server struct {
+	// config is the configuration the Server was built with; it does not
+	// change afterwards.
+	config *Config
+
+	// applyMu serializes changes to the view between the Redis poller and
+	// push inputs.
+	applyMu sync.Mutex
+
+	// latest is the materialized view: latest packet per "source_ip:dest_ip"
+	// pair, behind the tenant prefix when TENANTS is set (viewKey).
+	latest   map[string]Packet
+	latestMu sync.RWMutex
+
+	// latestParts holds, per pair, the packets merged into its latest entry
+	// by packet id (merge-by-packet-id only). Guarded by latestMu.
+	latestParts map[string]map[string]Packet
+
+	// seenKeys remembers document keys inside the poll window so overlapping
+	// polls hand each packet to sinks only once. dropRulesSeen and skewSeen
+	// hold the keys DROP_RULES and the timestamp check already counted. All
+	// three are guarded by applyMu and pruned with the window.
+	seenKeys      seenSet
+	dropRulesSeen seenSet
+	skewSeen      seenSet
+
+	// startingTimestamp tracks the Redis poll watermark. watermarkChanged is
+	// closed and replaced whenever it moves, waking any long-poll requests
+	// waiting on it.
+	startingTimestamp int
+	watermarkChanged  chan struct{}
+	watermarkMu       sync.Mutex
+
+	// clients is the set of connected WebSocket clients.
+	clients   map[*client]bool
+	clientsMu sync.Mutex
+
+	// broadcast is buffered so Redis polling is not blocked by slow clients;
+	// newServer sizes it and publishFrame applies the overflow policy.
+	// It is the data lane, of update and snapshot frames; broadcastControl
+	// is the control lane, of alert, status, and annotation frames, which
+	// the hub always empties first.
+	broadcast        chan frame
+	broadcastControl chan frame
+
+	// frameSeq is the seq of the last frame the hub delivered.
+	frameSeq atomic.Uint64
+
+	// framesLost is set when an update or snapshot was dropped; the hub then
+	// resynchronizes every client with a snapshot.
+	framesLost atomic.Bool
+
+	// sampler thins updates while the hub is overloaded (overload.go).
+	sampler broadcastSampler
+
+	// replay is the buffer resuming sessions are replayed from (session.go).
+	replay replayBuffer
+
+	// sessions are the resumable WebSocket sessions by token (session.go).
+	sessions   map[string]*wsSession
+	sessionsMu sync.Mutex
+
+	// wsAdmitted counts WebSocket clients admitted under WS_MAX_CLIENTS,
+	// including ones not yet registered for broadcasts (qos.go).
+	wsAdmitted atomic.Int64
+
+	// streams are the GET /stream subscribers the hub delivers to.
+	streams   map[*streamSubscriber]struct{}
+	streamsMu sync.Mutex
+
+	// startedAt is when the Server was built; the feed counts as stale if
+	// nothing arrives within STALE_AFTER of it. lastMessageAt is the unix
+	// time in milliseconds at which the last new packet reached the view
+	// (0 before the first), and reportedStatus the status last sent to
+	// clients (stale.go).
+	startedAt      time.Time
+	lastMessageAt  atomic.Int64
+	reportedStatus feedStatus
+
+	// lastPushAt is the unix time of the last packet accepted from a push
+	// input.
+	lastPushAt atomic.Int64
+
+	// traffic counts every fresh packet per second, like an alert window,
+	// for the rates in /latest/summary and /metrics.
+	traffic   *alertWindow
+	trafficMu sync.Mutex
+
+	// lag is a ring of per-second buckets covering lagWindow (lag.go).
+	lag   [int(lagWindow/time.Second) + 1]lagBucket
+	lagMu sync.Mutex
+
+	// packetsReceived counts packets new to the view from any input.
+	// framesSent counts frames written to WebSocket clients (a batch counts
+	// each frame in it).
+	packetsReceived atomic.Int64
+	framesSent      atomic.Int64
+
+	// framesPublished and framesDropped count frames offered to the
+	// broadcast channel and dropped by the overflow policy;
+	// controlFramesDropped counts the dropped frames that were control
+	// frames.
+	framesPublished      atomic.Int64
+	framesDropped        atomic.Int64
+	controlFramesDropped atomic.Int64
+
+	// alerts are the alert rules evaluated over the packets the Server
+	// receives, by name, with their windows and status (alert.go).
+	alerts  map[string]*alertState
+	alertMu sync.Mutex
+
+	// queryCache holds the last successful response of each Redis-backed
+	// query, served while Redis is down (retry.go).
+	queryCache   map[string]cachedResponse
+	queryCacheMu sync.Mutex
+
+	// framesSampled counts update frames folded into a later one, and
+	// samplingPeriods the times sampling started (overload.go).
+	framesSampled   atomic.Int64
+	samplingPeriods atomic.Int64
+
+	// journal records the delivered frames to JOURNAL_DIR, or is nil
+	// (journal.go).
+	journal *frameJournal
+
+	// pcap is the most recent pcap replay; only one runs at a time.
+	pcap   *pcapReplay
+	pcapMu sync.Mutex
+
+	// drain refuses new sessions while the Server drains (drain.go).
+	drain *drainState
+
+	// rateBuckets are the RATE_LIMIT token buckets by client IP
+	// (middleware.go).
+	rateBuckets   map[string]*rateBucket
+	rateBucketsMu sync.Mutex
+}
+
+// newServer returns a Server for cfg with an empty view and its broadcast
+// lanes and replay buffer sized from BROADCAST_BUFFER,
+// BROADCAST_CONTROL_BUFFER, and WS_REPLAY_FRAMES.
+func newServer(cfg *Config) *Server {
+	s := &Server{
+		config:           cfg,
+		clients:          make(map[*client]bool),
+		watermarkChanged: make(chan struct{}),
+		broadcast:        make(chan frame, cfg.BroadcastBuffer),
+		broadcastControl: make(chan frame, cfg.BroadcastControlBuffer),
+		replay:           replayBuffer{frames: make([]frame, cfg.WSReplayFrames)},
+		sessions:         make(map[string]*wsSession),
+		streams:          make(map[*streamSubscriber]struct{}),
+		startedAt:        time.Now(),
+		traffic:          newAlertWindow(summaryRateWindow),
+		queryCache:       make(map[string]cachedResponse),
+		alerts:           make(map[string]*alertState),
+		drain:            newDrainState(),
+		rateBuckets:      make(map[string]*rateBucket),
+	}
+	s.initializeEmptyLatest()
+	return s
+}
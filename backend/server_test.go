@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestServersAreIndependent checks that two Servers in one process keep
+// their own view, watermark, and broadcast lanes.
+func TestServersAreIndependent(t *testing.T) {
+	cfg := loadConfig()
+	a, b := newServer(cfg), newServer(cfg)
+
+	ts := int(time.Now().Unix())
+	updates, _, _ := a.applyLocked([]Packet{testPacket("10.0.0.1", "10.0.0.2", ts, 1, 100)})
+	if len(updates) != 1 {
+		t.Fatalf("applying one packet gave %d updates, want 1", len(updates))
+	}
+	if got := a.latestSnapshot()[pairKey("10.0.0.1", "10.0.0.2")].TCPBytesTotal; got != 100 {
+		t.Fatalf("a: tcp_bytes_total = %d, want 100", got)
+	}
+	if a.getStartingTimestamp() != ts {
+		t.Errorf("a: watermark = %d, want %d", a.getStartingTimestamp(), ts)
+	}
+	if b.hasLatestPackets() || b.getStartingTimestamp() != 0 {
+		t.Fatalf("b: view %v at watermark %d, want it empty", b.latestSnapshot(), b.getStartingTimestamp())
+	}
+
+	a.broadcastUpdates(updates)
+	if len(a.broadcast) != 1 || len(b.broadcast) != 0 {
+		t.Fatalf("queued frames: a=%d b=%d, want 1 and 0", len(a.broadcast), len(b.broadcast))
+	}
+	b.broadcastSnapshot()
+	if f := <-b.broadcast; f.Type != "snapshot" || len(f.Data) != 0 {
+		t.Fatalf("b: snapshot %v, want an empty one", f)
+	}
+}
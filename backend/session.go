@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// replayBuffer holds the last WS_REPLAY_FRAMES frames a hub delivered,
+// indexed by seq. It is guarded by the Server's clientsMu: the hub records
+// each frame under the lock it delivers with, and a resuming client is
+// replayed to and registered under the same lock, so it gets every frame
+// exactly once.
+type replayBuffer struct {
+	frames []frame
+
+	// last is the seq of the newest recorded frame. from is the oldest seq a
+	// client may have seen last and still be resumed: frames after it are
+	// all in the buffer, and no update was lost after it.
+	last uint64
+	from uint64
+}
+
+// record adds a delivered frame to the buffer.
+func (b *replayBuffer) record(f frame) {
+	n := uint64(len(b.frames))
+	if n == 0 {
+		return
+	}
+	b.frames[f.Seq%n] = f
+	b.last = f.Seq
+	if f.Seq > n && b.from < f.Seq-n {
+		b.from = f.Seq - n
+	}
+}
+
+// reset is called when updates were lost before reaching the hub. Only
+// clients that got the resync snapshot for seq can be resumed afterwards.
+func (b *replayBuffer) reset(seq uint64) {
+	clear(b.frames)
+	b.from = seq
+}
+
+// since returns the frames delivered after seq, reporting false when some
+// of them are no longer in the buffer.
+func (b *replayBuffer) since(seq uint64) ([]frame, bool) {
+	if len(b.frames) == 0 || seq < b.from || seq > b.last {
+		return nil, false
+	}
+	n := uint64(len(b.frames))
+	frames := make([]frame, 0, b.last-seq)
+	for s := seq + 1; s <= b.last; s++ {
+		frames = append(frames, b.frames[s%n])
+	}
+	return frames, true
+}
+
+// wsSession survives a client's reconnects: a client that presents the
+// session token and the last seq it saw gets the frames it missed instead of
+// a new snapshot, and keeps the projection it subscribed to.
+type wsSession struct {
+	token string
+
+	// mu is the Server's sessionsMu, which guards the fields below.
+	mu *sync.Mutex
+
+	// conns counts the connections using the session; detachedAt is when
+	// the last one closed and projection the subscription it had.
+	conns      int
+	detachedAt time.Time
+	projection *projection
+}
+
+// openSession attaches to the session with the given token, or starts a new
+// one when the token is unknown or expired. found reports whether it existed.
+func (s *Server) openSession(token string) (ws *wsSession, found bool) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	now := time.Now()
+	for t, ws := range s.sessions {
+		if ws.conns == 0 && now.Sub(ws.detachedAt) > s.config.WSSessionTTL {
+			delete(s.sessions, t)
+		}
+	}
+
+	if ws, ok := s.sessions[token]; ok {
+		ws.conns++
+		return ws, true
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	ws = &wsSession{token: hex.EncodeToString(b), mu: &s.sessionsMu, conns: 1}
+	s.sessions[ws.token] = ws
+	return ws, false
+}
+
+// detach records that a connection using the session closed with projection p.
+func (s *wsSession) detach(p *projection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.conns--
+	s.detachedAt = time.Now()
+	s.projection = p
+}
+
+// savedProjection is the projection the session's last connection had.
+func (s *wsSession) savedProjection() *projection {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.projection
+}
+
+// replayStats describes the replay buffer and sessions for the admin API.
+func (s *Server) replayStats() map[string]interface{} {
+	s.clientsMu.Lock()
+	buffered := uint64(0)
+	if len(s.replay.frames) > 0 && s.replay.last > s.replay.from {
+		buffered = s.replay.last - s.replay.from
+	}
+	capacity := len(s.replay.frames)
+	s.clientsMu.Unlock()
+
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	return map[string]interface{}{
+		"capacity": capacity,
+		"buffered": buffered,
+		"sessions": len(s.sessions),
+	}
+}
+
+// resume queues the frames the client missed since seq and registers it for
+// broadcasts. It reports false, doing neither, when they are not all in the
+// replay buffer. Frames beyond the send queue are replaced by a resync.
+func (c *client) resume(seq uint64) bool {
+	c.srv.clientsMu.Lock()
+	defer c.srv.clientsMu.Unlock()
+
+	frames, ok := c.srv.replay.since(seq)
+	if !ok {
+		return false
+	}
+	p := c.projection.Load()
+	payloads := make([][]byte, 0, len(frames))
+	for _, f := range frames {
+		if !c.wants(f) {
+			continue
+		}
+		payload, err := f.encode(c.format, p)
+		if err != nil {
+			errorLog("Error encoding replayed %s payload: %v", f.Type, err)
+			return false
+		}
+		if payload != nil {
+			payloads = append(payloads, payload)
+		}
+	}
+
+	c.sendSession(true, len(payloads))
+	for _, payload := range payloads {
+		if !c.enqueue(payload) {
+			c.resync.Store(true)
+			break
+		}
+	}
+	c.srv.clients[c] = true
+	infoLog("WebSocket client %s resumed its session after seq %d (%d frames replayed)", c.remoteAddr, seq, len(payloads))
+	return true
+}
+
+// sendSession queues the session frame telling the client its token and
+// whether it was resumed (replayed frames follow) or starts from a snapshot.
+func (c *client) sendSession(resumed bool, replayed int) {
+	payload, err := marshalFrame(c.format, map[string]interface{}{
+		"type":     "session",
+		"token":    c.session.token,
+		"resumed":  resumed,
+		"replayed": replayed,
+	})
+	if err == nil {
+		c.enqueue(payload)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+const sinkQueueSize = 10000
+
+// sink receives every new packet read from Redis. Each sink runs on its own
+// goroutine behind a bounded queue, so a slow backend never stalls polling.
+type sink interface {
+	Name() string
+	Write(ctx context.Context, packets []Packet) error
+}
+
+// externalSink is a sink that writes to another service. Its failed writes
+// are retried with sinkBackoff, so a batch may reach the service twice; the
+// in-process sinks are not retried, since they fold a batch into state as
+// they go and would count its packets twice.
+type externalSink interface {
+	sink
+	external()
+}
+
+// sinkRunner batches packets for one sink. policy retries the writes of an
+// external sink.
+type sinkRunner struct {
+	sink          sink
+	queue         chan Packet
+	batchSize     int
+	flushInterval time.Duration
+	policy        backoff
+}
+
+var sinks []*sinkRunner
+
+// registerSink adds a sink; call before startSinks.
+func registerSink(s sink, batchSize int, flushInterval time.Duration) {
+	sinks = append(sinks, &sinkRunner{
+		sink:          s,
+		queue:         make(chan Packet, sinkQueueSize),
+		batchSize:     max(batchSize, 1),
+		flushInterval: flushInterval,
+	})
+	infoLog("Registered %s sink (batch=%d, flush=%s)", s.Name(), batchSize, flushInterval)
+}
+
+// startSinks runs the registered sinks until ctx ends, retrying external
+// writes with cfg's sinkBackoff.
+func startSinks(ctx context.Context, cfg *Config) {
+	for _, r := range sinks {
+		r.policy = cfg.sinkBackoff()
+		workers.Add(1)
+		go r.run(ctx)
+	}
+}
+
+// dispatchToSinks queues packets for every registered sink without blocking.
+func dispatchToSinks(packets []Packet) {
+	for _, r := range sinks {
+		dropped := 0
+		for _, p := range packets {
+			select {
+			case r.queue <- p:
+			default:
+				dropped++
+			}
+		}
+		if dropped > 0 {
+			errorLog("%s sink queue full, dropped %d packets", r.sink.Name(), dropped)
+		}
+	}
+}
+
+func (r *sinkRunner) run(ctx context.Context) {
+	defer workers.Done()
+	ticker := time.NewTicker(r.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]Packet, 0, r.batchSize)
+	flush := func(ctx context.Context) {
+		if len(batch) == 0 {
+			return
+		}
+		var err error
+		if _, ok := r.sink.(externalSink); ok {
+			err = r.policy.retry(ctx, r.sink.Name()+" sink write", func(ctx context.Context) error {
+				return r.sink.Write(ctx, batch)
+			})
+		} else {
+			err = r.sink.Write(ctx, batch)
+		}
+		if err != nil {
+			errorLog("%s sink write failed (%d packets dropped): %v", r.sink.Name(), len(batch), err)
+		} else {
+			debugLog("%s sink wrote %d packets", r.sink.Name(), len(batch))
+		}
+		batch = make([]Packet, 0, r.batchSize)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			// The last batch is written on the way out, on a deadline of
+			// its own.
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), shutdownFlushTimeout)
+			flush(ctx)
+			cancel()
+			return
+		case p := <-r.queue:
+			batch = append(batch, p)
+			if len(batch) >= r.batchSize {
+				flush(ctx)
+			}
+		case <-ticker.C:
+			flush(ctx)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// skewRecent is how many skewed packets /admin/skew keeps for inspection.
+	skewRecent = 100
+
+	// skewLogInterval limits skew warnings to one summary line per interval.
+	skewLogInterval = 10 * time.Second
+)
+
+// skewedPacket describes a packet whose timestamp is too far from server time.
+type skewedPacket struct {
+	Src       string    `json:"src"`
+	Dest      string    `json:"dest"`
+	Key       string    `json:"key,omitempty"`
+	Timestamp int       `json:"timestamp"`
+	Skew      string    `json:"skew"`
+	Direction string    `json:"direction"`
+	SeenAt    time.Time `json:"seen_at"`
+}
+
+var (
+	skewMu      sync.Mutex
+	skewFuture  int
+	skewPast    int
+	skewLatest  []skewedPacket
+	skewLogged  time.Time
+	skewPending int
+)
+
+// clockSkew reports how far the packet's timestamp is outside the accepted
+// range around now: direction is "future" or "past", or "" when it is fine.
+func (c *Config) clockSkew(p Packet, now time.Time) (string, time.Duration) {
+	ts := time.Unix(int64(p.Timestamp), 0)
+	if d := ts.Sub(now); d > c.TimestampMaxFuture {
+		return "future", d
+	}
+	if c.TimestampMaxPast > 0 {
+		if d := now.Sub(ts); d > c.TimestampMaxPast {
+			return "past", d
+		}
+	}
+	return "", 0
+}
+
+// checkTimestamps counts and logs packets with skewed timestamps and, when
+// TIMESTAMP_QUARANTINE is set, removes them so they never reach latest, the
+// poll watermark, clients, or sinks. Callers hold s.applyMu.
+func checkTimestamps(s *Server, packets []Packet) []Packet {
+	cfg := s.config
+	now := time.Now()
+	kept := packets[:0:0]
+	dropped := false
+	for i, p := range packets {
+		direction, d := cfg.clockSkew(p, now)
+		if direction == "" {
+			if dropped {
+				kept = append(kept, p)
+			}
+			continue
+		}
+		recordSkew(s, p, direction, d, now)
+		if !cfg.TimestampQuarantine {
+			continue
+		}
+		if !dropped {
+			kept = append(kept, packets[:i]...)
+			dropped = true
+		}
+	}
+	if !dropped {
+		return packets
+	}
+	return kept
+}
+
+// withoutQuarantined drops the packets checkTimestamps would quarantine,
+// without counting them again.
+func withoutQuarantined(cfg *Config, packets []Packet) []Packet {
+	if !cfg.TimestampQuarantine {
+		return packets
+	}
+	now := time.Now()
+	kept := packets[:0:0]
+	for _, p := range packets {
+		if direction, _ := cfg.clockSkew(p, now); direction == "" {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+func recordSkew(s *Server, p Packet, direction string, d time.Duration, now time.Time) {
+	cfg := s.config
+	if p.Key != "" && !s.skewSeen.add(p.Key, p.Timestamp) {
+		return
+	}
+
+	skewMu.Lock()
+	defer skewMu.Unlock()
+
+	if direction == "future" {
+		skewFuture++
+	} else {
+		skewPast++
+	}
+	entry := skewedPacket{
+		Src:       p.Src,
+		Dest:      p.Dest,
+		Key:       p.Key,
+		Timestamp: p.Timestamp,
+		Skew:      d.Truncate(time.Second).String(),
+		Direction: direction,
+		SeenAt:    now,
+	}
+	skewLatest = append(skewLatest, entry)
+	if len(skewLatest) > skewRecent {
+		skewLatest = skewLatest[len(skewLatest)-skewRecent:]
+	}
+
+	skewPending++
+	if now.Sub(skewLogged) >= skewLogInterval {
+		action := "applied anyway"
+		if cfg.TimestampQuarantine {
+			action = "quarantined"
+		}
+		errorLog("Clock skew: %d packets with out-of-range timestamps %s (latest %s -> %s at %d, %s in the %s)",
+			skewPending, action, p.Src, p.Dest, p.Timestamp, entry.Skew, direction)
+		skewLogged = now
+		skewPending = 0
+	}
+}
+
+// handleAdminSkew reports skewed-timestamp counters and the latest offenders.
+func (s *Server) handleAdminSkew(w http.ResponseWriter, r *http.Request) {
+	skewMu.Lock()
+	defer skewMu.Unlock()
+
+	recent := make([]skewedPacket, len(skewLatest))
+	for i, e := range skewLatest {
+		recent[len(recent)-1-i] = e
+	}
+	maxPast := "off"
+	if s.config.TimestampMaxPast > 0 {
+		maxPast = s.config.TimestampMaxPast.String()
+	}
+	writeJSON(w, map[string]interface{}{
+		"max_future": s.config.TimestampMaxFuture.String(),
+		"max_past":   maxPast,
+		"quarantine": s.config.TimestampQuarantine,
+		"future":     skewFuture,
+		"past":       skewPast,
+		"recent":     recent,
+	})
+}
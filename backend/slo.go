@@ -0,0 +1,278 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sloFastBurn is the burn rate at which the budget of a 30-day window would
+// last two days. A service burning this fast over both the short and the
+// long window needs attention now, not at the next review.
+const sloFastBurn = 14.4
+
+// sloWindows are the spans burn rates and latency percentiles are reported
+// over, besides SLO_WINDOW itself.
+var sloWindows = []struct {
+	name string
+	span time.Duration
+}{
+	{"5m", 5 * time.Minute},
+	{"1h", time.Hour},
+}
+
+// Request counts for /metrics, so Prometheus can compute its own ratios.
+var (
+	sloRequests       atomic.Int64
+	sloRequestsFailed atomic.Int64
+)
+
+// sloBucket holds one minute of requests and broadcast frames.
+type sloBucket struct {
+	min      int64
+	requests int64
+	failed   int64
+	frames   int64
+	slow     int64
+	latency  latencyHistogram
+}
+
+// sloTracker is a ring of per-minute buckets covering SLO_WINDOW, in the
+// manner of alertWindow.
+type sloTracker struct {
+	mu      sync.Mutex
+	buckets []sloBucket
+
+	// The objectives, from SLO_*; set by initSLO.
+	window        time.Duration
+	latency       time.Duration
+	availability  float64
+	latencyTarget float64
+}
+
+var slo = &sloTracker{buckets: make([]sloBucket, 1)}
+
+// initSLO sizes the ring for SLO_WINDOW, and at least the longest of
+// sloWindows.
+func initSLO(cfg *Config) {
+	span := max(cfg.SLOWindow, sloWindows[len(sloWindows)-1].span)
+	slo.buckets = make([]sloBucket, int(span/time.Minute)+1)
+	slo.window, slo.latency = cfg.SLOWindow, cfg.SLOLatency
+	slo.availability, slo.latencyTarget = cfg.SLOAvailability, cfg.SLOLatencyTarget
+}
+
+// bucket returns the bucket of minute m, emptied if it held an older minute.
+// The caller holds mu.
+func (t *sloTracker) bucket(m int64) *sloBucket {
+	b := &t.buckets[m%int64(len(t.buckets))]
+	if b.min != m {
+		*b = sloBucket{min: m}
+	}
+	return b
+}
+
+// observeRequest counts a finished request; a 5xx status is a failure.
+func (t *sloTracker) observeRequest(status int) {
+	failed := status >= http.StatusInternalServerError
+	sloRequests.Add(1)
+	if failed {
+		sloRequestsFailed.Add(1)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := t.bucket(time.Now().Unix() / 60)
+	b.requests++
+	if failed {
+		b.failed++
+	}
+}
+
+// observeFrame counts a frame the hub delivered after latency.
+func (t *sloTracker) observeFrame(latency time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := t.bucket(time.Now().Unix() / 60)
+	b.frames++
+	b.latency.observe(latency)
+	if latency > t.latency {
+		b.slow++
+	}
+}
+
+// observeDroppedFrame counts a frame that never reached the hub: it missed
+// the latency objective by never arriving.
+func (t *sloTracker) observeDroppedFrame() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := t.bucket(time.Now().Unix() / 60)
+	b.frames++
+	b.slow++
+}
+
+// totals sums the buckets of the last d, the current minute included.
+func (t *sloTracker) totals(d time.Duration) sloBucket {
+	now := time.Now().Unix() / 60
+	n := min(int64(d/time.Minute), int64(len(t.buckets)))
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var sum sloBucket
+	for m := now - n + 1; m <= now; m++ {
+		b := &t.buckets[m%int64(len(t.buckets))]
+		if b.min != m {
+			continue
+		}
+		sum.requests += b.requests
+		sum.failed += b.failed
+		sum.frames += b.frames
+		sum.slow += b.slow
+		sum.latency.add(&b.latency)
+	}
+	return sum
+}
+
+// sloStatus is an objective's standing, as shown on /stats.
+type sloStatus struct {
+	Name      string             `json:"name"`
+	Objective string             `json:"objective"`
+	Target    float64            `json:"target"`
+	Good      int64              `json:"good"`
+	Total     int64              `json:"total"`
+	Ratio     *float64           `json:"ratio"`
+	BurnRates map[string]float64 `json:"burn_rates"`
+
+	// BudgetRemaining is the fraction of SLO_WINDOW's error budget left;
+	// negative once it is overspent.
+	BudgetRemaining float64 `json:"error_budget_remaining"`
+
+	// Status is "ok", "burning" (fast burn over every short window), or
+	// "exhausted" (no budget left).
+	Status string `json:"status"`
+}
+
+// sloCounts picks one objective's bad and total events out of a bucket.
+type sloCounts func(b sloBucket) (bad, total int64)
+
+func requestCounts(b sloBucket) (int64, int64) { return b.failed, b.requests }
+func frameCounts(b sloBucket) (int64, int64)   { return b.slow, b.frames }
+
+// burnRate is the share of bad events over the share the target allows: 1
+// spends the budget exactly over the window, 0 without events.
+func burnRate(bad, total int64, target float64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(bad) / float64(total) / (1 - target)
+}
+
+// status computes an objective's standing from per-window totals.
+func (t *sloTracker) status(name, objective string, target float64, counts sloCounts, windows map[string]sloBucket) sloStatus {
+	bad, total := counts(windows["window"])
+	s := sloStatus{
+		Name:            name,
+		Objective:       objective,
+		Target:          target,
+		Good:            total - bad,
+		Total:           total,
+		BurnRates:       map[string]float64{},
+		BudgetRemaining: 1 - burnRate(bad, total, target),
+		Status:          "ok",
+	}
+	if total > 0 {
+		ratio := float64(total-bad) / float64(total)
+		s.Ratio = &ratio
+	}
+
+	burning := true
+	for _, w := range sloWindows {
+		bad, total := counts(windows[w.name])
+		s.BurnRates[w.name] = burnRate(bad, total, target)
+		burning = burning && s.BurnRates[w.name] >= sloFastBurn
+	}
+	switch {
+	case s.BudgetRemaining <= 0:
+		s.Status = "exhausted"
+	case burning:
+		s.Status = "burning"
+	}
+	return s
+}
+
+// sloReport is the body of /stats.
+type sloReport struct {
+	Healthy bool        `json:"healthy"`
+	Window  string      `json:"window"`
+	SLOs    []sloStatus `json:"slos"`
+
+	// LatencyMS holds broadcast latency percentiles per window.
+	LatencyMS map[string]map[string]*float64 `json:"broadcast_latency_ms"`
+
+	// RouteLatency, WSWriteLatency, IngestLag, and BroadcastQueue are filled
+	// in by handleStats only.
+	RouteLatency   map[string]latencySummary `json:"route_latency,omitempty"`
+	WSWriteLatency *latencySummary           `json:"ws_write_latency,omitempty"`
+	IngestLag      *ingestLag                `json:"ingest_lag,omitempty"`
+	BroadcastQueue *queueOccupancy           `json:"broadcast_queue,omitempty"`
+}
+
+// report computes every objective's standing and the latency percentiles.
+func (t *sloTracker) report() sloReport {
+	windows := map[string]sloBucket{"window": t.totals(t.window)}
+	for _, w := range sloWindows {
+		windows[w.name] = t.totals(w.span)
+	}
+
+	r := sloReport{
+		Healthy: true,
+		Window:  t.window.String(),
+		SLOs: []sloStatus{
+			t.status("availability", "HTTP requests answered without a 5xx", t.availability, requestCounts, windows),
+			t.status("broadcast_latency", "broadcast frames queued to clients within "+t.latency.String(), t.latencyTarget, frameCounts, windows),
+		},
+		LatencyMS: map[string]map[string]*float64{},
+	}
+	for _, s := range r.SLOs {
+		r.Healthy = r.Healthy && s.Status == "ok"
+	}
+	for name, b := range windows {
+		if name == "window" {
+			name = r.Window
+		}
+		r.LatencyMS[name] = map[string]*float64{
+			"p50": b.latency.quantile(0.5),
+			"p95": b.latency.quantile(0.95),
+			"p99": b.latency.quantile(0.99),
+		}
+	}
+	return r
+}
+
+// observeRequests counts each request for the availability objective once
+// it has been answered, and records its latency by route.
+func observeRequests(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next(rec, r)
+		slo.observeRequest(rec.status)
+		observeRouteLatency(r.Pattern, rec.status, time.Since(start))
+	}
+}
+
+// handleStats reports whether the server meets its objectives, the
+// latencies of routes and WebSocket writes, and signs of backpressure.
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	report := slo.report()
+	report.RouteLatency = map[string]latencySummary{}
+	routes, summaries := routeLatencies()
+	for i, route := range routes {
+		report.RouteLatency[route] = summaries[i]
+	}
+	ws := wsWriteLatencies()
+	report.WSWriteLatency = &ws
+	lag, queue := s.lagStats()
+	report.IngestLag, report.BroadcastQueue = &lag, &queue
+	writeJSON(w, report)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// handleAt rebuilds the view as it was at a stored timestamp: the newest
+// packet of every pair within the poll window ending at ?ts= (unix
+// seconds), with FILTER and sampling applied as the live view does. The
+// response has the shape of GET /latest, so a time scrubber can render it
+// the same way.
+func (s *Server) handleAt(rdb redisClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if searchFallback.Load() {
+			writeError(w, notImplemented.errorf("Historical snapshots need RediSearch"))
+			return
+		}
+		tenant, scoped, ok := s.requestTenant(w, r)
+		if !ok {
+			return
+		}
+		v := r.URL.Query().Get("ts")
+		if v == "" {
+			writeError(w, badQuery.errorf("Missing ts"))
+			return
+		}
+		ts, err := strconv.Atoi(v)
+		if err != nil || ts < 0 {
+			writeError(w, badQuery.errorf("Invalid ts"))
+			return
+		}
+
+		tenants := s.config.tenantNames()
+		if scoped {
+			tenants = []string{tenant}
+		}
+		query := fmt.Sprintf("@timestamp:[%d %d]", max(ts-safetyWindow, 0), ts)
+		ctx, cancel := s.queryContext(r)
+		defer cancel()
+		var docs []redis.Document
+		for _, t := range tenants {
+			found, err := searchPacketQuery(ctx, rdb, s.config.packetIndexFor(t), query)
+			if err != nil {
+				s.queryFailed(w, r, "Snapshot query", err)
+				return
+			}
+			docs = append(docs, found...)
+		}
+
+		packets := decodeDocuments(s.config, docs)
+		s.config.assignTenants(packets)
+		snapshot := make(map[string]PacketSummary)
+		for _, p := range anonymizePackets(transformPackets(s.config.samplePackets(applyDropRules(filterPackets(packets), nil)))) {
+			if p.Src == "" || p.Dest == "" {
+				continue
+			}
+			if prev, ok := snapshot[viewKey(p)]; !ok || p.Timestamp > prev.Timestamp {
+				snapshot[viewKey(p)] = generateEdgeSummary(p)
+			}
+		}
+		releasePackets(packets)
+
+		response := map[string]interface{}{
+			"type":      "snapshot",
+			"timestamp": ts,
+			"data":      snapshot,
+		}
+		s.cacheQuery(r, response)
+		writeJSON(w, response)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// staleCheckInterval is how often the feed is checked for going stale.
+const staleCheckInterval = time.Second
+
+// feedStatus tells clients whether latest is live: stale is set when no
+// message has arrived for STALE_AFTER, and AgeMS is the time since the last
+// one. With SEQ_TRACKING, SeqMissing and SeqDuplicates are the publisher
+// sequence numbers skipped and repeated so far.
+type feedStatus struct {
+	Stale         bool   `json:"stale"`
+	AgeMS         *int64 `json:"age_ms"`
+	SeqMissing    *int64 `json:"seq_missing,omitempty"`
+	SeqDuplicates *int64 `json:"seq_duplicates,omitempty"`
+}
+
+// markMessage records that a new packet reached the view.
+func (s *Server) markMessage() {
+	s.lastMessageAt.Store(time.Now().UnixMilli())
+}
+
+// currentFeedStatus computes the status at the current time. AgeMS is nil
+// until the first message arrives.
+func (s *Server) currentFeedStatus() feedStatus {
+	var status feedStatus
+	now := time.Now()
+	if last := s.lastMessageAt.Load(); last == 0 {
+		status.Stale = now.Sub(s.startedAt) >= s.config.StaleAfter
+	} else {
+		age := now.UnixMilli() - last
+		status.Stale = age >= s.config.StaleAfter.Milliseconds()
+		status.AgeMS = &age
+	}
+	if s.config.SeqTracking {
+		missing, duplicates := seqMissing.Load(), seqDuplicates.Load()
+		status.SeqMissing, status.SeqDuplicates = &missing, &duplicates
+	}
+	return status
+}
+
+// changed reports whether s differs from the last reported status in
+// anything but its age.
+func (s feedStatus) changed(prev feedStatus) bool {
+	count := func(n *int64) int64 {
+		if n == nil {
+			return 0
+		}
+		return *n
+	}
+	return s.Stale != prev.Stale ||
+		count(s.SeqMissing) != count(prev.SeqMissing) ||
+		count(s.SeqDuplicates) != count(prev.SeqDuplicates)
+}
+
+// watchFeedStatus broadcasts a status frame whenever the feed goes stale or
+// becomes live again, or publisher sequence gaps or duplicates are counted.
+func (s *Server) watchFeedStatus(ctx context.Context) {
+	ticker := time.NewTicker(staleCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			status := s.currentFeedStatus()
+			if !status.changed(s.reportedStatus) {
+				continue
+			}
+			if status.Stale != s.reportedStatus.Stale {
+				if status.Stale {
+					errorLog("Feed stale: no messages for %s", s.config.StaleAfter)
+				} else {
+					infoLog("Feed live again")
+				}
+			}
+			s.reportedStatus = status
+			s.publishFrame(frame{Type: "status", Status: &status})
+		}
+	}
+}
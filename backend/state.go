@@ -1,9 +1,8 @@
 package main
 
 import (
-	"sync"
-
-	"github.com/redis/go-redis/v9"
+	"reflect"
+	"strconv"
 )
 
 const (
@@ -11,56 +10,146 @@ const (
 	safetyWindow = 2
 )
 
-var (
-	// latest is the materialized view: latest packet per "source_ip:dest_ip" pair.
-	latest   = make(map[string]Packet)
-	latestMu sync.RWMutex
-
-	// startingTimestamp tracks the Redis poll watermark.
-	startingTimestamp int
+// Update strategies (UPDATE_STRATEGY) decide how packets for one pair that
+// share a timestamp combine in the view.
+const (
+	// strategyReplace keeps the last packet applied.
+	strategyReplace = "replace"
+	// strategyAccumulate sums every packet, for producers sending deltas.
+	strategyAccumulate = "accumulate"
+	// strategyMerge sums the latest packet of each packet id, for producers
+	// resending cumulative values under the same id.
+	strategyMerge = "merge-by-packet-id"
 )
 
-func pollSinceTimestamp() int {
-	since := startingTimestamp - safetyWindow
+func (s *Server) pollSinceTimestamp() int {
+	since := s.getStartingTimestamp() - safetyWindow
 	if since < 0 {
 		return 0
 	}
 	return since
 }
 
-func setStartingTimestamp(ts int) {
-	startingTimestamp = ts
+func (s *Server) setStartingTimestamp(ts int) {
+	s.watermarkMu.Lock()
+	defer s.watermarkMu.Unlock()
+
+	if ts == s.startingTimestamp {
+		return
+	}
+	s.startingTimestamp = ts
+	close(s.watermarkChanged)
+	s.watermarkChanged = make(chan struct{})
 }
 
-func getStartingTimestamp() int {
-	return startingTimestamp
+func (s *Server) getStartingTimestamp() int {
+	s.watermarkMu.Lock()
+	defer s.watermarkMu.Unlock()
+	return s.startingTimestamp
 }
 
-func upsertPacket(packet Packet) bool {
-	key := pairKey(packet.Src, packet.Dest)
+// watchStartingTimestamp returns the current watermark and a channel that is
+// closed the next time it changes.
+func (s *Server) watchStartingTimestamp() (int, <-chan struct{}) {
+	s.watermarkMu.Lock()
+	defer s.watermarkMu.Unlock()
+	return s.startingTimestamp, s.watermarkChanged
+}
+
+// upsertPacket applies packet to its pair's view entry according to
+// UPDATE_STRATEGY and returns the stored entry, reporting whether it changed.
+// Under accumulate and merge the entry combines packet with earlier ones, so
+// updates must carry it rather than packet. fresh is false for packets
+// already applied by an earlier poll.
+func (s *Server) upsertPacket(packet Packet, fresh bool) (Packet, bool) {
+	key := viewKey(packet)
 
 	incomingTs := packet.Timestamp
 	if incomingTs == 0 {
-		return false
+		return Packet{}, false
 	}
 
-	latestMu.Lock()
-	defer latestMu.Unlock()
+	s.latestMu.Lock()
+	defer s.latestMu.Unlock()
 
-	if existing, exists := latest[key]; exists {
-		existingTs := existing.Timestamp
+	existing, exists := s.latest[key]
+	if exists {
+		if incomingTs < existing.Timestamp {
+			return Packet{}, false
+		}
 
-		if incomingTs < existingTs {
-			return false
+		// Merging by id is idempotent, so a re-read packet may carry new
+		// cumulative values and is merged again.
+		if packet.Key != "" && packet.Key == existing.Key && s.config.UpdateStrategy != strategyMerge {
+			return Packet{}, false
 		}
+	}
 
-		if packet.Key != "" && packet.Key == existing.Key {
-			return false
+	sameTs := exists && incomingTs == existing.Timestamp
+	switch {
+	case !sameTs || s.config.UpdateStrategy == strategyReplace:
+		if s.config.UpdateStrategy == strategyMerge {
+			s.latestParts[key] = map[string]Packet{packetID(packet): packet}
 		}
+	case s.config.UpdateStrategy == strategyAccumulate:
+		if !fresh {
+			return Packet{}, false
+		}
+		packet = rederive(addPackets(existing, packet))
+	default:
+		parts := s.latestParts[key]
+		if parts == nil {
+			parts = map[string]Packet{packetID(existing): existing}
+			s.latestParts[key] = parts
+		}
+		parts[packetID(packet)] = packet
+		merged := packet
+		for id, p := range parts {
+			if id != packetID(packet) {
+				merged = addPackets(p, merged)
+			}
+		}
+		merged = rederive(merged)
+		if reflect.DeepEqual(generateEdgeSummary(merged), generateEdgeSummary(existing)) {
+			return Packet{}, false
+		}
+		packet = merged
+	}
+
+	s.latest[key] = packet
+	return packet, true
+}
+
+// packetID identifies a packet for merge-by-packet-id: its Redis key, or the
+// publishing node for pushed packets without one.
+func packetID(p Packet) string {
+	if p.Key != "" {
+		return p.Key
 	}
+	return "node:" + strconv.Itoa(p.NodeID)
+}
+
+// addPackets returns b with a's byte and packet counters added to it.
+func addPackets(a, b Packet) Packet {
+	b.TotalBytes += a.TotalBytes
+	b.UDPPackets = addCounters(a.UDPPackets, b.UDPPackets)
+	b.UDPBytes = addCounters(a.UDPBytes, b.UDPBytes)
+	b.TCPPackets = addCounters(a.TCPPackets, b.TCPPackets)
+	b.TCPBytes = addCounters(a.TCPBytes, b.TCPBytes)
+	return b
+}
 
-	latest[key] = packet
-	return true
+// addCounters sums two per-port counter arrays element-wise into a new slice.
+func addCounters(a, b []int) []int {
+	if len(a) < len(b) {
+		a, b = b, a
+	}
+	sum := make([]int, len(a))
+	copy(sum, a)
+	for i, n := range b {
+		sum[i] += n
+	}
+	return sum
 }
 
 func generateEdgeSummary(packet Packet) PacketSummary {
@@ -70,6 +159,7 @@ func generateEdgeSummary(packet Packet) PacketSummary {
 	udpBytesTotal := Sum(packet.UDPBytes)
 
 	return PacketSummary{
+		Tenant:    packet.Tenant,
 		Src:       packet.Src,
 		Dest:      packet.Dest,
 		Timestamp: packet.Timestamp,
@@ -82,35 +172,51 @@ func generateEdgeSummary(packet Packet) PacketSummary {
 
 		TotalPackets: tcpPacketsTotal + udpPacketsTotal,
 		TotalBytes:   tcpBytesTotal + udpBytesTotal,
+
+		Derived: packet.Derived,
 	}
 }
 
-func pruneStalePackets(cutoff int) int {
-	latestMu.Lock()
-	defer latestMu.Unlock()
+func (s *Server) pruneStalePackets(cutoff int) int {
+	s.latestMu.Lock()
+	defer s.latestMu.Unlock()
 
 	pruned := 0
-	for key, packet := range latest {
+	for key, packet := range s.latest {
 		if packet.Timestamp < cutoff {
-			delete(latest, key)
+			delete(s.latest, key)
+			delete(s.latestParts, key)
 			pruned++
 		}
 	}
 	return pruned
 }
 
-// applyDocuments updates the materialized view and reports incremental updates plus prune status.
-func applyDocuments(docs []redis.Document) (map[string]PacketSummary, bool) {
-	updates := make(map[string]PacketSummary, len(docs))
-	maxTs := getStartingTimestamp()
+// markSeen reports whether packet is new to this process and remembers it.
+func (s *Server) markSeen(packet Packet) bool {
+	if packet.Key == "" {
+		return true
+	}
+	return s.seenKeys.add(packet.Key, packet.Timestamp)
+}
 
-	for _, doc := range docs {
-		packet, err := docToPacket(doc)
-		if err != nil {
-			debugLog("Skipping document: %v", err)
-			continue
-		}
+// pruneSeenKeys forgets the keys of packets stamped before cutoff.
+func (s *Server) pruneSeenKeys(cutoff int) {
+	s.seenKeys.prune(cutoff)
+	s.dropRulesSeen.prune(cutoff)
+	s.skewSeen.prune(cutoff)
+}
 
+// applyPackets updates the materialized view and reports incremental updates,
+// packets not seen before, and prune status. Callers hold applyMu.
+func (s *Server) applyPackets(packets []Packet) (map[string]PacketSummary, []Packet, bool) {
+	s.config.assignTenants(packets)
+	packets = processPackets(s, packets)
+	updates := make(map[string]PacketSummary, len(packets))
+	var fresh []Packet
+	maxTs := s.getStartingTimestamp()
+
+	for _, packet := range packets {
 		if packet.Src == "" || packet.Dest == "" {
 			continue
 		}
@@ -119,39 +225,61 @@ func applyDocuments(docs []redis.Document) (map[string]PacketSummary, bool) {
 			maxTs = packet.Timestamp
 		}
 
-		if upsertPacket(packet) {
-			key := pairKey(packet.Src, packet.Dest)
-			updates[key] = generateEdgeSummary(packet)
+		isFresh := s.markSeen(packet)
+		if isFresh {
+			fresh = append(fresh, packet)
+		}
+
+		if stored, changed := s.upsertPacket(packet, isFresh); changed {
+			updates[viewKey(stored)] = generateEdgeSummary(stored)
 		}
 	}
 
-	setStartingTimestamp(maxTs)
-	pruned := pruneStalePackets(pollSinceTimestamp())
-	return updates, pruned > 0
+	if len(fresh) > 0 {
+		// Re-polled packets from the lookback window do not count as traffic.
+		s.markMessage()
+		checkSequences(s.config, fresh)
+	}
+	s.setStartingTimestamp(maxTs)
+	pruned := s.pruneStalePackets(s.pollSinceTimestamp())
+	s.pruneSeenKeys(s.pollSinceTimestamp())
+	return updates, fresh, pruned > 0
+}
+
+// applyLocked is applyPackets under applyMu. The unlock is deferred so a
+// panic in a processor, recovered further up, does not leave the view locked.
+func (s *Server) applyLocked(packets []Packet) (map[string]PacketSummary, []Packet, bool) {
+	s.applyMu.Lock()
+	defer s.applyMu.Unlock()
+	return s.applyPackets(packets)
 }
 
-func latestSnapshot() map[string]PacketSummary {
-	latestMu.RLock()
-	defer latestMu.RUnlock()
+func (s *Server) latestSnapshot() map[string]PacketSummary {
+	s.latestMu.RLock()
+	defer s.latestMu.RUnlock()
 
-	snapshot := make(map[string]PacketSummary, len(latest))
-	for key, packet := range latest {
+	snapshot := make(map[string]PacketSummary, len(s.latest))
+	for key, packet := range s.latest {
 		snapshot[key] = generateEdgeSummary(packet)
 	}
 	return snapshot
 }
 
-func hasLatestPackets() bool {
-	latestMu.RLock()
-	defer latestMu.RUnlock()
-	return len(latest) > 0
+func (s *Server) hasLatestPackets() bool {
+	s.latestMu.RLock()
+	defer s.latestMu.RUnlock()
+	return len(s.latest) > 0
 }
 
-func initializeEmptyLatest() {
-	latestMu.Lock()
-	latest = make(map[string]Packet)
-	latestMu.Unlock()
+func (s *Server) initializeEmptyLatest() {
+	s.latestMu.Lock()
+	s.latest = make(map[string]Packet)
+	s.latestParts = make(map[string]map[string]Packet)
+	s.latestMu.Unlock()
 
-	setStartingTimestamp(0)
+	s.seenKeys = make(seenSet)
+	s.dropRulesSeen = make(seenSet)
+	s.skewSeen = make(seenSet)
+	s.setStartingTimestamp(0)
 	debugLog("Initialized with empty materialized view")
 }
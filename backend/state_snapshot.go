@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// stateSnapshotVersion is bumped whenever stateSnapshot changes incompatibly.
+const stateSnapshotVersion = 1
+
+// stateSnapshotMaxBody bounds a snapshot uploaded to PUT /admin/state.
+const stateSnapshotMaxBody = 256 << 20
+
+// stateSnapshot is the in-memory state saved across planned restarts: the
+// materialized view and poll watermark, the replay buffer, and the
+// per-publisher sequence stats. WebSocket sessions are not included, so
+// clients reconnecting after a restart get a snapshot of the restored view.
+type stateSnapshot struct {
+	Version     int                          `json:"version"`
+	SavedAt     time.Time                    `json:"saved_at"`
+	Watermark   int                          `json:"watermark"`
+	Latest      map[string]Packet            `json:"latest"`
+	LatestParts map[string]map[string]Packet `json:"latest_parts,omitempty"`
+	SeenKeys    map[string]int               `json:"seen_keys,omitempty"`
+
+	// FrameSeq is the seq of the last delivered frame; Replay holds the
+	// buffered frames after ReplayFrom, oldest first.
+	FrameSeq   uint64  `json:"frame_seq"`
+	ReplayFrom uint64  `json:"replay_from"`
+	Replay     []frame `json:"replay,omitempty"`
+
+	Publishers    []publisherSeq `json:"publishers,omitempty"`
+	SeqMissing    int64          `json:"seq_missing"`
+	SeqDuplicates int64          `json:"seq_duplicates"`
+}
+
+// captureState copies the current state. Locks are taken one at a time, so
+// a poll landing in between can make the parts disagree by one batch.
+func (s *Server) captureState() *stateSnapshot {
+	snap := &stateSnapshot{
+		Version:   stateSnapshotVersion,
+		SavedAt:   time.Now().UTC(),
+		Watermark: s.getStartingTimestamp(),
+	}
+
+	s.applyMu.Lock()
+	snap.SeenKeys = make(map[string]int, len(s.seenKeys))
+	for k, ts := range s.seenKeys {
+		snap.SeenKeys[k] = ts
+	}
+	s.applyMu.Unlock()
+
+	s.latestMu.RLock()
+	snap.Latest = make(map[string]Packet, len(s.latest))
+	for k, p := range s.latest {
+		snap.Latest[k] = p
+	}
+	if len(s.latestParts) > 0 {
+		snap.LatestParts = make(map[string]map[string]Packet, len(s.latestParts))
+		for k, parts := range s.latestParts {
+			snap.LatestParts[k] = make(map[string]Packet, len(parts))
+			for id, p := range parts {
+				snap.LatestParts[k][id] = p
+			}
+		}
+	}
+	s.latestMu.RUnlock()
+
+	s.clientsMu.Lock()
+	snap.FrameSeq = s.frameSeq.Load()
+	snap.ReplayFrom = s.replay.from
+	if frames, ok := s.replay.since(s.replay.from); ok {
+		snap.Replay = frames
+	}
+	s.clientsMu.Unlock()
+
+	seqMu.Lock()
+	for _, pub := range publishers {
+		snap.Publishers = append(snap.Publishers, *pub)
+	}
+	seqMu.Unlock()
+	sort.Slice(snap.Publishers, func(i, j int) bool {
+		if snap.Publishers[i].Src != snap.Publishers[j].Src {
+			return snap.Publishers[i].Src < snap.Publishers[j].Src
+		}
+		return snap.Publishers[i].NodeID < snap.Publishers[j].NodeID
+	})
+	snap.SeqMissing = seqMissing.Load()
+	snap.SeqDuplicates = seqDuplicates.Load()
+	return snap
+}
+
+// restoreState replaces the current state with snap and sends connected
+// clients a snapshot of it. The replay buffer is only restored when snap is
+// not behind the frames already delivered, so seq numbers never go backwards.
+func (s *Server) restoreState(snap *stateSnapshot) error {
+	if snap.Version != stateSnapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d (want %d)", snap.Version, stateSnapshotVersion)
+	}
+
+	s.applyMu.Lock()
+	s.latestMu.Lock()
+	s.latest = snap.Latest
+	if s.latest == nil {
+		s.latest = make(map[string]Packet)
+	}
+	s.latestParts = snap.LatestParts
+	if s.latestParts == nil {
+		s.latestParts = make(map[string]map[string]Packet)
+	}
+	pairs := len(s.latest)
+	s.latestMu.Unlock()
+	s.seenKeys = snap.SeenKeys
+	if s.seenKeys == nil {
+		s.seenKeys = make(seenSet)
+	}
+	s.setStartingTimestamp(snap.Watermark)
+	s.applyMu.Unlock()
+
+	s.clientsMu.Lock()
+	if cur := s.frameSeq.Load(); snap.FrameSeq >= cur && s.frameSeq.CompareAndSwap(cur, snap.FrameSeq) {
+		s.replay.reset(snap.ReplayFrom)
+		s.replay.last = snap.ReplayFrom
+		sort.Slice(snap.Replay, func(i, j int) bool { return snap.Replay[i].Seq < snap.Replay[j].Seq })
+		for _, f := range snap.Replay {
+			if f.Seq > snap.ReplayFrom && f.Seq <= snap.FrameSeq {
+				s.replay.record(f)
+			}
+		}
+	}
+	s.clientsMu.Unlock()
+
+	seqMu.Lock()
+	publishers = make(map[string]*publisherSeq, len(snap.Publishers))
+	for _, pub := range snap.Publishers {
+		pub := pub
+		publishers[pub.Src+"/"+strconv.Itoa(pub.NodeID)] = &pub
+	}
+	seqMu.Unlock()
+	seqMissing.Store(snap.SeqMissing)
+	seqDuplicates.Store(snap.SeqDuplicates)
+
+	infoLog("Restored state saved at %s: %d pairs (watermark=%d, seq=%d)",
+		snap.SavedAt.Format(time.RFC3339), pairs, snap.Watermark, snap.FrameSeq)
+	s.broadcastSnapshot()
+	return nil
+}
+
+// stateFormat picks the snapshot encoding: gob when format is "gob", JSON
+// otherwise.
+func stateFormat(format string) (string, error) {
+	switch format {
+	case "", "json":
+		return "json", nil
+	case "gob":
+		return "gob", nil
+	}
+	return "", fmt.Errorf("Invalid format %q (use json or gob)", format)
+}
+
+// stateFileFormat is the encoding of a snapshot file, chosen by extension.
+func stateFileFormat(path string) string {
+	if strings.EqualFold(filepath.Ext(path), ".gob") {
+		return "gob"
+	}
+	return "json"
+}
+
+func encodeState(w io.Writer, s *stateSnapshot, format string) error {
+	if format == "gob" {
+		return gob.NewEncoder(w).Encode(s)
+	}
+	return json.NewEncoder(w).Encode(s)
+}
+
+func decodeState(r io.Reader, format string) (*stateSnapshot, error) {
+	var s stateSnapshot
+	var err error
+	if format == "gob" {
+		err = gob.NewDecoder(r).Decode(&s)
+	} else {
+		err = json.NewDecoder(r).Decode(&s)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// saveStateFile writes the current state to path. It writes a temporary
+// file next to it first, so a crash never leaves a truncated snapshot.
+func (s *Server) saveStateFile(path string) (*stateSnapshot, error) {
+	snap := s.captureState()
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := encodeState(tmp, snap, stateFileFormat(path)); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	return snap, os.Rename(tmp.Name(), path)
+}
+
+// loadStateFile restores the state saved in path.
+func (s *Server) loadStateFile(path string) (*stateSnapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	snap, err := decodeState(f, stateFileFormat(path))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return snap, s.restoreState(snap)
+}
+
+// initStateFile restores STATE_FILE at startup, after the view was hydrated
+// from Redis. A missing file is not an error: it is the first start.
+func (s *Server) initStateFile() error {
+	if s.config.StateFile == "" {
+		return nil
+	}
+	_, err := s.loadStateFile(s.config.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		debugLog("No state file at %s; starting from Redis", s.config.StateFile)
+		return nil
+	}
+	return err
+}
+
+// handleAdminState exports the state (GET) or replaces it with the uploaded
+// snapshot (PUT). ?format=gob selects gob instead of JSON.
+func (s *Server) handleAdminState(w http.ResponseWriter, r *http.Request) {
+	format, err := stateFormat(r.URL.Query().Get("format"))
+	if err != nil {
+		writeError(w, badQuery.errorf("%v", err))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if format == "gob" {
+			w.Header().Set("Content-Type", "application/octet-stream")
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		if err := encodeState(w, s.captureState(), format); err != nil {
+			errorLog("Failed to encode state snapshot: %v", err)
+		}
+	case http.MethodPut:
+		snap, err := decodeState(http.MaxBytesReader(w, r.Body, stateSnapshotMaxBody), format)
+		if err != nil {
+			writeError(w, badQuery.errorf("Invalid snapshot: %v", err))
+			return
+		}
+		if err := s.restoreState(snap); err != nil {
+			writeError(w, badQuery.errorf("%v", err))
+			return
+		}
+		writeJSON(w, stateSummary(snap))
+	default:
+		writeError(w, methodNotAllowed.errorf("Method not allowed"))
+	}
+}
+
+// handleAdminStateFile saves the state to, or loads it from, ?path= or
+// STATE_FILE: POST /admin/state/save and POST /admin/state/load.
+func (s *Server) handleAdminStateFile(save bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, methodNotAllowed.errorf("Method not allowed"))
+			return
+		}
+		path := r.URL.Query().Get("path")
+		if path == "" {
+			path = s.config.StateFile
+		}
+		if path == "" {
+			writeError(w, badQuery.errorf("Missing path (STATE_FILE not set)"))
+			return
+		}
+
+		if save {
+			snap, err := s.saveStateFile(path)
+			if err != nil {
+				errorLog("Failed to save state to %s: %v", path, err)
+				writeError(w, internalError.errorf("Failed to save state: %v", err))
+				return
+			}
+			infoLog("Saved state to %s: %d pairs (watermark=%d)", path, len(snap.Latest), snap.Watermark)
+			writeJSON(w, stateSummary(snap))
+			return
+		}
+
+		snap, err := s.loadStateFile(path)
+		if err != nil {
+			kind := badQuery
+			if errors.Is(err, os.ErrNotExist) {
+				kind = notFound
+			}
+			writeError(w, kind.errorf("Failed to load state: %v", err))
+			return
+		}
+		writeJSON(w, stateSummary(snap))
+	}
+}
+
+// stateSummary describes a saved or restored snapshot for admin responses.
+func stateSummary(s *stateSnapshot) map[string]interface{} {
+	return map[string]interface{}{
+		"saved_at":   s.SavedAt,
+		"watermark":  s.Watermark,
+		"pairs":      len(s.Latest),
+		"frame_seq":  s.FrameSeq,
+		"replay":     len(s.Replay),
+		"publishers": len(s.Publishers),
+	}
+}
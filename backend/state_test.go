@@ -0,0 +1,47 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"backend/testsupport"
+)
+
+// TestUpdateStrategyUpdatesMatchLatest checks that under accumulate and
+// merge the update frame for a pair carries the combined entry /latest
+// serves, not the packet that changed it.
+func TestUpdateStrategyUpdatesMatchLatest(t *testing.T) {
+	for _, strategy := range []string{strategyAccumulate, strategyMerge} {
+		t.Run(strategy, func(t *testing.T) {
+			s := startServer(t, "UPDATE_STRATEGY="+strategy)
+			ws := dialWS(t, s, "/ws")
+			expectFrame(t, ws, "snapshot")
+
+			ts := int(time.Now().Unix())
+			ingest(t, s, testPacket("10.0.0.1", "10.0.0.2", ts, 1, 100))
+			expectFrame(t, ws, "update")
+			ingest(t, s, testPacket("10.0.0.1", "10.0.0.2", ts, 2, 50))
+
+			var latest struct {
+				Data map[string]map[string]interface{} `json:"data"`
+			}
+			getJSON(t, s, "/latest", nil, 200, &latest)
+			if len(latest.Data) != 1 {
+				t.Fatalf("/latest has %d pairs, want 1: %v", len(latest.Data), latest.Data)
+			}
+			for key, edge := range latest.Data {
+				if got := edge["tcp_bytes_total"]; got != float64(150) {
+					t.Fatalf("/latest tcp_bytes_total = %v, want 150", got)
+				}
+				_, err := ws.ExpectMatch("update matching /latest", 5*time.Second, func(f testsupport.Frame) bool {
+					data, _ := f["data"].(map[string]interface{})
+					return f.Type() == "update" && reflect.DeepEqual(data[key], map[string]interface{}(edge))
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// statsdMaxPacket keeps datagrams under a typical path MTU.
+const statsdMaxPacket = 1400
+
+// statsdEmitter sends the core counters to a StatsD or DogStatsD agent over
+// UDP. Counters are sent as deltas since the previous flush, gauges as
+// current values.
+type statsdEmitter struct {
+	srv      *Server
+	conn     net.Conn
+	interval time.Duration
+	prefix   string
+	tags     string
+
+	// last holds each counter's value at the previous flush.
+	last map[string]int64
+}
+
+// initStatsD starts the emitter when STATSD_ADDR is set.
+func (s *Server) initStatsD(ctx context.Context) {
+	if s.config.StatsDAddr == "" {
+		return
+	}
+
+	// UDP "connects" without contacting the agent, so this only fails on a
+	// bad address; an agent that is down just loses datagrams.
+	conn, err := net.Dial("udp", s.config.StatsDAddr)
+	if err != nil {
+		errorLog("Invalid STATSD_ADDR %s: %v", s.config.StatsDAddr, err)
+		return
+	}
+	e := &statsdEmitter{
+		srv:      s,
+		conn:     conn,
+		interval: s.config.StatsDInterval,
+		prefix:   s.config.StatsDPrefix,
+		last:     make(map[string]int64),
+	}
+	if s.config.StatsDTags != "" {
+		e.tags = "|#" + s.config.StatsDTags
+	}
+	go e.run(ctx)
+	infoLog("Sending StatsD metrics to %s every %s (prefix %q)", s.config.StatsDAddr, s.config.StatsDInterval, s.config.StatsDPrefix)
+}
+
+func (e *statsdEmitter) run(ctx context.Context) {
+	defer e.conn.Close()
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.flush()
+		}
+	}
+}
+
+// flush sends one round of metrics, packing lines into as few datagrams as fit.
+func (e *statsdEmitter) flush() {
+	s := e.srv
+	s.clientsMu.Lock()
+	clientCount := len(s.clients)
+	s.clientsMu.Unlock()
+
+	lines := []string{
+		e.counter("messages.in", s.packetsReceived.Load()),
+		e.counter("messages.out", s.framesSent.Load()),
+		e.counter("broadcast.dropped", s.framesDropped.Load()),
+		e.counter("errors", errorsLogged.Load()),
+		e.gauge("clients", int64(clientCount)),
+	}
+
+	var b strings.Builder
+	for _, line := range lines {
+		if b.Len() > 0 && b.Len()+1+len(line) > statsdMaxPacket {
+			e.send(b.String())
+			b.Reset()
+		}
+		if b.Len() > 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString(line)
+	}
+	e.send(b.String())
+}
+
+func (e *statsdEmitter) counter(name string, total int64) string {
+	delta := total - e.last[name]
+	e.last[name] = total
+	return fmt.Sprintf("%s%s:%d|c%s", e.prefix, name, delta, e.tags)
+}
+
+func (e *statsdEmitter) gauge(name string, v int64) string {
+	return fmt.Sprintf("%s%s:%d|g%s", e.prefix, name, v, e.tags)
+}
+
+func (e *statsdEmitter) send(payload string) {
+	if _, err := e.conn.Write([]byte(payload)); err != nil {
+		debugLog("StatsD send failed: %v", err)
+	}
+}
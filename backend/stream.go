@@ -0,0 +1,218 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// streamSubscriber is a GET /stream response registered with the hub. Like a
+// WebSocket client it has a bounded queue of JSON frames; when it fills, the
+// subscriber skips updates and is resynchronized with a snapshot.
+type streamSubscriber struct {
+	tenant     string
+	scoped     bool
+	hub        *tenantHub
+	projection *projection
+
+	alerts      bool
+	status      bool
+	annotations bool
+
+	// format is the subscriber's JSON format, in its API version.
+	format string
+
+	send   chan []byte
+	resync atomic.Bool
+}
+
+var newline = []byte{'\n'}
+
+// wants reports whether the subscriber receives f, as client.wants does.
+func (s *streamSubscriber) wants(f frame) bool {
+	switch {
+	case f.Alert != nil:
+		return s.alerts
+	case f.Status != nil:
+		return s.status
+	case f.Annotation != nil:
+		return s.annotations && (!s.scoped || f.Annotation.Tenant == s.tenant)
+	}
+	return true
+}
+
+func (s *streamSubscriber) enqueue(payload []byte) bool {
+	select {
+	case s.send <- payload:
+		return true
+	default:
+		return false
+	}
+}
+
+// publishStreams queues msg for every /stream subscriber. The hub calls it
+// for every frame; lost is set when frames were dropped before the hub and
+// everyone needs a snapshot.
+func (s *Server) publishStreams(msg *frameCache, lost bool) {
+	s.streamsMu.Lock()
+	defer s.streamsMu.Unlock()
+
+	side := msg.frame.control()
+	var snapshot *frameCache
+	for sub := range s.streams {
+		if lost {
+			sub.resync.Store(true)
+		}
+		if !sub.wants(msg.frame) {
+			continue
+		}
+
+		fc := msg
+		resync := !side && sub.resync.Load()
+		if resync {
+			if snapshot == nil {
+				snapshot = newFrameCache(s.snapshotFrame())
+			}
+			fc = snapshot
+		}
+		p := sub.projection
+		if side {
+			p = nil
+		}
+		payload, err := fc.payload(sub.format, p)
+		if err != nil {
+			errorLog("Error encoding %s payload: %v", fc.frame.Type, err)
+			continue
+		}
+		if payload == nil {
+			continue
+		}
+		if !sub.hub.allow(len(payload)) || !sub.enqueue(payload) {
+			if !side {
+				sub.resync.Store(true)
+			}
+			continue
+		}
+		if resync {
+			sub.resync.Store(false)
+		}
+	}
+}
+
+// handleStream serves broadcast frames as newline-delimited JSON until the
+// client goes away: the snapshot first, then one frame per line, flushed as
+// soon as the queue is drained. It takes the WebSocket URL parameters
+// fields, filter, alerts, status, and annotations.
+func (s *Server) handleStream(w http.ResponseWriter, r *http.Request) {
+	if s.refuseDraining(w) {
+		return
+	}
+	ip := clientIP(r)
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, internalError.errorf("Streaming unsupported"))
+		return
+	}
+	tenant, scoped, ok := s.requestTenant(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	hub := hubFor(tenant, scoped)
+	var fields []string
+	if v := q.Get("fields"); v != "" {
+		fields = strings.Split(v, ",")
+	}
+	p, err := hubProjection(hub, tenant, scoped, fields, q.Get("filter"))
+	if err != nil {
+		writeError(w, badQuery.errorf("Invalid subscription: %v", err))
+		return
+	}
+	if !hub.join() {
+		debugLog("Rejected stream from %s: tenant %s is at its client limit", ip, tenant)
+		writeError(w, unavailable.errorf("Too many clients for tenant %s", tenant))
+		return
+	}
+	defer hub.leave()
+
+	sub := &streamSubscriber{
+		tenant:      tenant,
+		scoped:      scoped,
+		hub:         hub,
+		projection:  p,
+		alerts:      !scoped && q.Get("alerts") == "1",
+		status:      q.Get("status") == "1",
+		annotations: q.Get("annotations") == "1",
+		format:      jsonFormat(requestAPIVersion(r.Context())),
+		send:        make(chan []byte, s.config.WSSendQueue),
+	}
+
+	// Queue the snapshot before registering so it precedes every update.
+	payload, err := s.snapshotFrame().encode(sub.format, p)
+	if err != nil {
+		errorLog("Failed to encode snapshot: %v", err)
+		writeError(w, internalError.errorf("Failed to encode snapshot"))
+		return
+	}
+	sub.enqueue(payload)
+	if sub.status {
+		status := s.currentFeedStatus()
+		if payload, err := (frame{Type: "status", Status: &status, Seq: s.frameSeq.Load()}).encode(sub.format, nil); err == nil {
+			sub.enqueue(payload)
+		}
+	}
+	if sub.alerts {
+		for _, e := range s.currentAlerts() {
+			if payload, err := (frame{Type: "alert", Alert: &e, Seq: s.frameSeq.Load()}).encode(sub.format, nil); err == nil {
+				sub.enqueue(payload)
+			}
+		}
+	}
+
+	s.streamsMu.Lock()
+	s.streams[sub] = struct{}{}
+	s.streamsMu.Unlock()
+	defer func() {
+		s.streamsMu.Lock()
+		delete(s.streams, sub)
+		s.streamsMu.Unlock()
+	}()
+	debugLog("Stream client %s connected (req=%s)", ip, requestID(r.Context()))
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	holdOpen(s.config, w)
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	expired := s.drain.expired()
+	for {
+		select {
+		case <-r.Context().Done():
+			debugLog("Stream client %s disconnected", ip)
+			return
+		case <-expired:
+			debugLog("Closing stream to %s: %s", ip, drainReason)
+			return
+		case payload := <-sub.send:
+			holdOpen(s.config, w)
+			for {
+				// The payload is shared with other subscribers; write the
+				// newline separately rather than appending to it.
+				if _, err := w.Write(payload); err != nil {
+					return
+				}
+				if _, err := w.Write(newline); err != nil {
+					return
+				}
+				s.framesSent.Add(1)
+				if len(sub.send) == 0 {
+					break
+				}
+				payload = <-sub.send
+			}
+			flusher.Flush()
+		}
+	}
+}
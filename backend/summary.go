@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// summaryRateWindow is the span /latest/summary computes rates over.
+const summaryRateWindow = 10 * time.Second
+
+// observeTraffic adds fresh packets to the Server's traffic window.
+func (s *Server) observeTraffic(packets []Packet) {
+	if len(packets) == 0 {
+		return
+	}
+	now := time.Now().Unix()
+	weight := s.config.sampleWeight()
+
+	s.trafficMu.Lock()
+	defer s.trafficMu.Unlock()
+	for i := range packets {
+		v := alertPacketValues(packets[i])
+		s.traffic.add(now, &v, weight)
+	}
+}
+
+// latestTotals sums the edge summaries of the view without copying it,
+// only over tenant's edges when scoped.
+func (s *Server) latestTotals(tenant string, scoped bool) (pairs, packets, bytes int) {
+	s.latestMu.RLock()
+	defer s.latestMu.RUnlock()
+
+	for _, packet := range s.latest {
+		if scoped && packet.Tenant != tenant {
+			continue
+		}
+		e := generateEdgeSummary(packet)
+		pairs++
+		packets += e.TotalPackets
+		bytes += e.TotalBytes
+	}
+	return pairs, packets, bytes
+}
+
+// trafficRates returns the per-second message, packet, and byte arrival
+// rates over the last summaryRateWindow.
+func (s *Server) trafficRates() (messages, packets, bytes float64) {
+	s.trafficMu.Lock()
+	sum, _ := s.traffic.totals(time.Now().Unix(), summaryRateWindow)
+	s.trafficMu.Unlock()
+
+	secs := summaryRateWindow.Seconds()
+	return sum[alertFields["messages"]] / secs, sum[alertFields["packets"]] / secs, sum[alertFields["bytes"]] / secs
+}
+
+// handleLatestSummary returns the totals of the materialized view and recent
+// arrival rates, without the per-pair data. The rates are over all tenants.
+func (s *Server) handleLatestSummary(w http.ResponseWriter, r *http.Request) {
+	tenant, scoped, ok := s.requestTenant(w, r)
+	if !ok {
+		return
+	}
+	pairs, packets, bytes := s.latestTotals(tenant, scoped)
+	status := s.currentFeedStatus()
+	messageRate, packetRate, byteRate := s.trafficRates()
+
+	writeJSON(w, map[string]interface{}{
+		"timestamp":    s.getStartingTimestamp(),
+		"pairs":        pairs,
+		"packet_count": packets,
+		"total_bytes":  bytes,
+		"rates": map[string]interface{}{
+			"window":              summaryRateWindow.String(),
+			"messages_per_second": messageRate,
+			"packets_per_second":  packetRate,
+			"bytes_per_second":    byteRate,
+		},
+		"stale":  status.Stale,
+		"age_ms": status.AgeMS,
+	})
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// tenantNameRe restricts tenant names to characters that are safe in Redis
+// key prefixes, index names, and NATS subjects.
+var tenantNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,31}$`)
+
+// tenantProjections keep one tenant's edges of a frame, for consumers that
+// are scoped without a client of their own; set once by initTenants.
+var tenantProjections map[string]*projection
+
+// tenantToken is one TENANT_TOKENS entry.
+type tenantToken struct {
+	tenant string
+	token  string
+}
+
+// tenantTokens are the parsed TENANT_TOKENS; set once by initTenants.
+var tenantTokens []tenantToken
+
+// initTenants validates TENANTS and parses TENANT_TOKENS.
+func initTenants(cfg *Config) error {
+	seen := make(map[string]bool, len(cfg.Tenants))
+	for _, t := range cfg.Tenants {
+		if !tenantNameRe.MatchString(t) {
+			return fmt.Errorf("invalid tenant name %q", t)
+		}
+		if seen[t] {
+			return fmt.Errorf("duplicate tenant %q", t)
+		}
+		seen[t] = true
+	}
+	tenantProjections = make(map[string]*projection, len(cfg.Tenants))
+	for _, t := range cfg.Tenants {
+		p, err := newProjection(nil, tenantFilter(t))
+		if err != nil {
+			return err
+		}
+		tenantProjections[t] = p
+	}
+
+	for _, entry := range splitList(cfg.TenantTokens) {
+		t, token, ok := strings.Cut(entry, ":")
+		if !ok || token == "" {
+			return fmt.Errorf("invalid TENANT_TOKENS entry %q (want tenant:token)", entry)
+		}
+		if !seen[t] {
+			return fmt.Errorf("TENANT_TOKENS names unknown tenant %q", t)
+		}
+		tenantTokens = append(tenantTokens, tenantToken{tenant: t, token: token})
+	}
+
+	if err := initTenantHubs(cfg); err != nil {
+		return err
+	}
+
+	if len(cfg.Tenants) > 0 {
+		infoLog("Tenants: %s (%d scoped tokens)", strings.Join(cfg.Tenants, ", "), len(tenantTokens))
+	}
+	return nil
+}
+
+// tenantNames lists the tenants, or one unnamed tenant when TENANTS is unset.
+func (c *Config) tenantNames() []string {
+	if len(c.Tenants) == 0 {
+		return []string{""}
+	}
+	return c.Tenants
+}
+
+// knownTenant reports whether t is a configured tenant ("" when none are).
+func (c *Config) knownTenant(t string) bool {
+	for _, name := range c.tenantNames() {
+		if name == t {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultTenant receives packets that do not name a known tenant.
+func (c *Config) defaultTenant() string {
+	return c.tenantNames()[0]
+}
+
+// tenantPrefix is prepended to the tenant's Redis keys, index names, and
+// channels: "hallB:" for tenant hallB, nothing for the unnamed tenant.
+func tenantPrefix(t string) string {
+	if t == "" {
+		return ""
+	}
+	return t + ":"
+}
+
+// tenantOfKey returns the tenant whose prefix key starts with.
+func (c *Config) tenantOfKey(key string) string {
+	for _, t := range c.Tenants {
+		if strings.HasPrefix(key, t+":") {
+			return t
+		}
+	}
+	return ""
+}
+
+// tenantFilter is the client filter that keeps tenant t's edges.
+func tenantFilter(t string) string {
+	return `tenant == "` + t + `"`
+}
+
+// tenantProjection keeps tenant t's edges of a frame.
+func tenantProjection(t string) *projection {
+	return tenantProjections[t]
+}
+
+// packetIndexFor and rollupIndexFor name a tenant's RediSearch indexes.
+func (c *Config) packetIndexFor(t string) string { return tenantPrefix(t) + c.SearchIndex }
+func rollupIndexFor(t string) string             { return tenantPrefix(t) + rollupIndexName }
+
+// packetPrefixFor is the key prefix of a tenant's packet hashes.
+func (c *Config) packetPrefixFor(t string) string { return tenantPrefix(t) + c.PacketPrefix }
+
+// viewKey is the key of a packet's pair in latest and in frames: the
+// "source_ip:dest_ip" pair key behind the tenant prefix.
+func viewKey(p Packet) string {
+	return tenantPrefix(p.Tenant) + pairKey(p.Src, p.Dest)
+}
+
+// assignTenants gives packets without a known tenant the default one.
+func (c *Config) assignTenants(packets []Packet) {
+	for i := range packets {
+		if !c.knownTenant(packets[i].Tenant) {
+			packets[i].Tenant = c.defaultTenant()
+		}
+	}
+}
+
+// requestToken is the request's bearer token, or ?token= for browser
+// WebSocket clients, which cannot set headers.
+func requestToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	return r.URL.Query().Get("token")
+}
+
+// tokenTenant returns the tenant of the request's TENANT_TOKENS token, or "".
+func tokenTenant(r *http.Request) string {
+	token := requestToken(r)
+	if token == "" {
+		return ""
+	}
+	for _, tt := range tenantTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(tt.token)) == 1 {
+			return tt.tenant
+		}
+	}
+	return ""
+}
+
+// requestTenant resolves the tenant a request is for and writes an error
+// response when it cannot. A tenant token scopes the request to its tenant;
+// otherwise ?tenant= selects one. With TENANT_TOKENS set, requests without
+// a tenant token need ADMIN_TOKEN. scoped is false when the request may see
+// every tenant.
+func (s *Server) requestTenant(w http.ResponseWriter, r *http.Request) (tenant string, scoped, ok bool) {
+	param := r.URL.Query().Get("tenant")
+	if t := tokenTenant(r); t != "" {
+		if param != "" && param != t {
+			writeError(w, forbidden.errorf("Token is not valid for tenant %s", param))
+			return "", false, false
+		}
+		return t, true, true
+	}
+
+	if len(tenantTokens) > 0 {
+		token := requestToken(r)
+		if s.config.AdminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.config.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, unauthorized.errorf("Unauthorized"))
+			return "", false, false
+		}
+	}
+	if param == "" {
+		return "", false, true
+	}
+	if len(s.config.Tenants) == 0 || !s.config.knownTenant(param) {
+		writeError(w, badQuery.errorf("Unknown tenant %s", param))
+		return "", false, false
+	}
+	return param, true, true
+}
+
+// requestAllTenants is requestTenant for endpoints whose data spans every
+// tenant, such as alerts and reports: a request scoped to a tenant gets
+// 403, so with TENANT_TOKENS set only ADMIN_TOKEN reads them.
+func (s *Server) requestAllTenants(w http.ResponseWriter, r *http.Request) bool {
+	_, scoped, ok := s.requestTenant(w, r)
+	if ok && scoped {
+		writeError(w, forbidden.errorf("Endpoint covers every tenant and cannot be scoped to one"))
+		return false
+	}
+	return ok
+}
+
+// requestIndexTenant is requestTenant for endpoints that query one tenant's
+// indexes: an unscoped request is only accepted when there is one tenant.
+func (s *Server) requestIndexTenant(w http.ResponseWriter, r *http.Request) (string, bool) {
+	tenant, scoped, ok := s.requestTenant(w, r)
+	if !ok || scoped {
+		return tenant, ok
+	}
+	if names := s.config.tenantNames(); len(names) == 1 {
+		return names[0], true
+	}
+	writeError(w, badQuery.errorf("Missing tenant"))
+	return "", false
+}
+
+// tenantSnapshot keeps the edges of one tenant.
+func tenantSnapshot(data map[string]PacketSummary, tenant string) map[string]PacketSummary {
+	out := make(map[string]PacketSummary)
+	for key, s := range data {
+		if s.Tenant == tenant {
+			out[key] = s
+		}
+	}
+	return out
+}
+
+// ingestTenant is requestTenant for /ingest, which requireIngest already
+// authorized: scoped is false when the packets keep their own tenant field.
+func (s *Server) ingestTenant(w http.ResponseWriter, r *http.Request) (tenant string, scoped, ok bool) {
+	param := r.URL.Query().Get("tenant")
+	if t := tokenTenant(r); t != "" {
+		if param != "" && param != t {
+			writeError(w, forbidden.errorf("Token is not valid for tenant %s", param))
+			return "", false, false
+		}
+		return t, true, true
+	}
+	if param == "" {
+		return "", false, true
+	}
+	if len(s.config.Tenants) == 0 || !s.config.knownTenant(param) {
+		writeError(w, badQuery.errorf("Unknown tenant %s", param))
+		return "", false, false
+	}
+	return param, true, true
+}
+
+// requireIngest admits /ingest requests carrying INGEST_TOKEN or a tenant
+// token; the latter may only ingest for its tenant.
+func (s *Server) requireIngest(next http.HandlerFunc) http.HandlerFunc {
+	if len(tenantTokens) == 0 {
+		return requireBearer("INGEST_TOKEN", s.config.IngestToken, next)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if tokenTenant(r) == "" && (s.config.IngestToken == "" || !bearerMatches(r, s.config.IngestToken)) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, unauthorized.errorf("Unauthorized"))
+			return
+		}
+		next(w, r)
+	}
+}
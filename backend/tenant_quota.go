@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tenantHub holds one tenant's WebSocket limits and counters, so a busy
+// tenant's clients cannot take the hub's time and bandwidth from another's.
+type tenantHub struct {
+	name        string
+	maxClients  int
+	maxRate     int64
+	filter      string
+	clients     atomic.Int64
+	rejected    atomic.Int64
+	throttled   atomic.Int64
+	bytesQueued atomic.Int64
+
+	// budget holds maxRate bytes per second.
+	budget byteBucket
+}
+
+// byteBucket is a token bucket of rate bytes per second with one second of
+// burst. It may go negative: a frame larger than the remaining budget is let
+// through and the debt is paid back before the next one.
+type byteBucket struct {
+	mu       sync.Mutex
+	rate     int64
+	budget   float64
+	refilled time.Time
+}
+
+func newByteBucket(rate int64) byteBucket {
+	return byteBucket{rate: rate, budget: float64(rate), refilled: time.Now()}
+}
+
+// take charges n bytes, reporting false when the budget is exhausted. A
+// bucket without a rate takes everything.
+func (b *byteBucket) take(n int) bool {
+	if b.rate <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.budget = min(b.budget+now.Sub(b.refilled).Seconds()*float64(b.rate), float64(b.rate))
+	b.refilled = now
+	if b.budget <= 0 {
+		return false
+	}
+	b.budget -= float64(n)
+	return true
+}
+
+// tenantHubs are the configured tenants' hubs; set once by initTenantHubs.
+var tenantHubs map[string]*tenantHub
+
+// initTenantHubs parses TENANT_MAX_CLIENTS, TENANT_MAX_BYTES_PER_SEC, and
+// TENANT_FILTERS.
+func initTenantHubs(cfg *Config) error {
+	tenantHubs = make(map[string]*tenantHub, len(cfg.Tenants))
+	for _, t := range cfg.Tenants {
+		tenantHubs[t] = &tenantHub{name: t}
+	}
+	if len(cfg.Tenants) == 0 {
+		if cfg.TenantMaxClients != "" || cfg.TenantMaxBytesPerSec != "" || cfg.TenantFilters != "" {
+			return fmt.Errorf("tenant limits need TENANTS")
+		}
+		return nil
+	}
+
+	clients, err := parseTenantLimit(cfg, "TENANT_MAX_CLIENTS", cfg.TenantMaxClients)
+	if err != nil {
+		return err
+	}
+	rates, err := parseTenantLimit(cfg, "TENANT_MAX_BYTES_PER_SEC", cfg.TenantMaxBytesPerSec)
+	if err != nil {
+		return err
+	}
+	for t, h := range tenantHubs {
+		h.maxClients = int(clients[t])
+		h.maxRate = rates[t]
+		h.budget = newByteBucket(h.maxRate)
+	}
+
+	for _, entry := range strings.Split(cfg.TenantFilters, ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		t, expr, ok := strings.Cut(entry, ":")
+		h := tenantHubs[strings.TrimSpace(t)]
+		if !ok || h == nil {
+			return fmt.Errorf("invalid TENANT_FILTERS entry %q (want tenant:expr for a known tenant)", entry)
+		}
+		if _, err := compileFilter(expr, false); err != nil {
+			return fmt.Errorf("TENANT_FILTERS for %s: %w", h.name, err)
+		}
+		h.filter = strings.TrimSpace(expr)
+	}
+	return nil
+}
+
+// parseTenantLimit reads "n" (every tenant), "tenant:n" entries, or both
+// into a per-tenant limit.
+func parseTenantLimit(cfg *Config, env, v string) (map[string]int64, error) {
+	limits := make(map[string]int64, len(cfg.Tenants))
+	var def int64
+	perTenant := make(map[string]int64)
+	for _, entry := range splitList(v) {
+		t, n, ok := strings.Cut(entry, ":")
+		if !ok {
+			t, n = "", entry
+		}
+		limit, err := strconv.ParseInt(n, 10, 64)
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid %s entry %q", env, entry)
+		}
+		if !ok {
+			def = limit
+			continue
+		}
+		if tenantHubs[t] == nil {
+			return nil, fmt.Errorf("%s names unknown tenant %q", env, t)
+		}
+		perTenant[t] = limit
+	}
+	for _, t := range cfg.Tenants {
+		limits[t] = def
+		if limit, ok := perTenant[t]; ok {
+			limits[t] = limit
+		}
+	}
+	return limits, nil
+}
+
+// hubFor returns the hub of a scoped client's tenant, nil when there is none.
+func hubFor(tenant string, scoped bool) *tenantHub {
+	if !scoped {
+		return nil
+	}
+	return tenantHubs[tenant]
+}
+
+// join takes a client slot, reporting false when the tenant is full.
+func (h *tenantHub) join() bool {
+	if h == nil {
+		return true
+	}
+	if n := h.clients.Add(1); h.maxClients > 0 && n > int64(h.maxClients) {
+		h.clients.Add(-1)
+		h.rejected.Add(1)
+		return false
+	}
+	return true
+}
+
+// leave gives back the slot taken by join.
+func (h *tenantHub) leave() {
+	if h != nil {
+		h.clients.Add(-1)
+	}
+}
+
+// allow charges n queued bytes to the tenant's budget, reporting false when
+// it is exhausted; the caller then skips the frame.
+func (h *tenantHub) allow(n int) bool {
+	if h == nil {
+		return true
+	}
+	if !h.budget.take(n) {
+		h.throttled.Add(1)
+		return false
+	}
+	h.bytesQueued.Add(int64(n))
+	return true
+}
+
+// tenantHubStats describes every tenant's hub for /admin/broadcast.
+func tenantHubStats() []map[string]interface{} {
+	stats := make([]map[string]interface{}, 0, len(tenantHubs))
+	for _, h := range tenantHubs {
+		stats = append(stats, map[string]interface{}{
+			"tenant":            h.name,
+			"clients":           h.clients.Load(),
+			"max_clients":       h.maxClients,
+			"rejected":          h.rejected.Load(),
+			"bytes_queued":      h.bytesQueued.Load(),
+			"max_bytes_per_sec": h.maxRate,
+			"throttled":         h.throttled.Load(),
+			"filter":            h.filter,
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i]["tenant"].(string) < stats[j]["tenant"].(string) })
+	return stats
+}
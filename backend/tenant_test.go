@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"backend/testsupport"
+)
+
+// TestAllTenantEndpointsNeedAdmin checks that alerts and reports, which
+// span every tenant, are refused to anonymous and tenant-scoped requests
+// once TENANT_TOKENS is set.
+func TestAllTenantEndpointsNeedAdmin(t *testing.T) {
+	s := startServer(t,
+		"TENANTS=hallB,hallD",
+		"TENANT_TOKENS=hallB:b-token",
+		"ADMIN_TOKEN=admin-token",
+		"ALERT_HISTORY_SIZE=10",
+	)
+	bearer := func(token string) http.Header {
+		return http.Header{"Authorization": {"Bearer " + token}}
+	}
+	for _, path := range []string{"/alerts", "/alerts/history"} {
+		getJSON(t, s, path, nil, http.StatusUnauthorized, nil)
+		getJSON(t, s, path, bearer("b-token"), http.StatusForbidden, nil)
+		getJSON(t, s, path+"?tenant=hallD", bearer("admin-token"), http.StatusForbidden, nil)
+		getJSON(t, s, path, bearer("admin-token"), http.StatusOK, nil)
+	}
+	getJSON(t, s, "/reports", nil, http.StatusUnauthorized, nil)
+	getJSON(t, s, "/reports", bearer("b-token"), http.StatusForbidden, nil)
+}
+
+// startTenantServer runs a server with tenants hallB and hallD, a hallB
+// token, and one edge in each tenant.
+func startTenantServer(t *testing.T, env ...string) *testsupport.Server {
+	t.Helper()
+	s := startServer(t, append([]string{"TENANTS=hallB,hallD", "TENANT_TOKENS=hallB:b-token", "ADMIN_TOKEN=admin-token"}, env...)...)
+	ts := int(time.Now().Unix())
+	b, d := testPacket("10.0.0.1", "10.0.0.2", ts, 1, 100), testPacket("10.0.0.3", "10.0.0.4", ts, 1, 200)
+	b.Tenant, d.Tenant = "hallB", "hallD"
+	ingest(t, s, b, d)
+	return s
+}
+
+// expectTenantEdges fails unless every edge of f belongs to tenant and
+// there is at least one.
+func expectTenantEdges(t *testing.T, what string, f testsupport.Frame, tenant string) {
+	t.Helper()
+	edges := frameEdges(t, f)
+	if len(edges) == 0 {
+		t.Fatalf("%s: no edges", what)
+	}
+	for key, e := range edges {
+		if edge, _ := e.(map[string]interface{}); edge["tenant"] != tenant {
+			t.Errorf("%s: edge %s = %v, want only tenant %s", what, key, e, tenant)
+		}
+	}
+}
+
+// TestScopedFilterCannotEscapeTenant checks that a filter closing the
+// parenthesis of the tenant clause does not widen a scoped subscriber's
+// view, on /ws and on /stream. The filter is compiled on its own, where it
+// does not parse; a filter that matches every edge is still scoped.
+func TestScopedFilterCannotEscapeTenant(t *testing.T) {
+	s := startTenantServer(t)
+	escape := url.QueryEscape("total_bytes >= 0) || (total_bytes >= 0")
+	wide := url.QueryEscape("total_bytes >= 0 || total_bytes < 0")
+
+	ws := dialWS(t, s, "/ws?token=b-token&filter="+escape)
+	expectFrame(t, ws, "error")
+	expectTenantEdges(t, "/ws snapshot", expectFrame(t, ws, "snapshot"), "hallB")
+	ws = dialWS(t, s, "/ws?token=b-token&filter="+wide)
+	expectTenantEdges(t, "/ws snapshot", expectFrame(t, ws, "snapshot"), "hallB")
+	if err := ws.Send(map[string]interface{}{"cmd": "subscribe", "filter": "total_bytes >= 0) || (total_bytes >= 0"}); err != nil {
+		t.Fatal(err)
+	}
+	expectFrame(t, ws, "error")
+
+	stream := func(filter string) *http.Response {
+		t.Helper()
+		resp, err := http.Get(s.URL + "/stream?token=b-token&filter=" + filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	if resp := stream(escape); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("GET /stream with an escaping filter: HTTP %d, want 400", resp.StatusCode)
+	}
+	resp := stream(wide)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /stream: HTTP %d", resp.StatusCode)
+	}
+	line, err := bufio.NewReader(resp.Body).ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snap testsupport.Frame
+	if err := json.Unmarshal(line, &snap); err != nil {
+		t.Fatal(err)
+	}
+	expectTenantEdges(t, "/stream snapshot", snap, "hallB")
+}
+
+// TestScopedClientRefusedAlertsFeature checks that the proto 2 handshake
+// does not grant a scoped client the alerts feature.
+func TestScopedClientRefusedAlertsFeature(t *testing.T) {
+	s := startTenantServer(t)
+	ws := dialWS(t, s, "/ws?proto=2&token=b-token")
+	if err := ws.Send(map[string]interface{}{"proto": 2, "features": []string{"alerts", "status"}}); err != nil {
+		t.Fatal(err)
+	}
+	hello := expectFrame(t, ws, "hello")
+	if features, _ := hello["features"].([]interface{}); len(features) != 1 || features[0] != "status" {
+		t.Fatalf("scoped hello features = %v, want [status]", hello["features"])
+	}
+}
+
+// TestAccessLogRedactsToken checks that a ?token= never reaches the access log.
+func TestAccessLogRedactsToken(t *testing.T) {
+	s := startTenantServer(t, "ACCESS_LOG=1")
+	getJSON(t, s, "/latest?token=b-token", nil, http.StatusOK, nil)
+	logs := s.Logs()
+	if strings.Contains(logs, "b-token") {
+		t.Fatalf("access log contains the token:\n%s", logs)
+	}
+	if !strings.Contains(logs, "/latest?token=REDACTED") {
+		t.Fatalf("access log has no redacted /latest line:\n%s", logs)
+	}
+}
+
+func TestTenantFramePayloadFailsClosed(t *testing.T) {
+	for name, payload := range map[string]string{
+		"unreadable": `{"type":"update",`,
+		"alert":      `{"type":"alert","seq":3,"alert":{"rule":"r","state":"firing"}}`,
+		"status":     `{"type":"status","seq":4,"status":{"stale":true}}`,
+		"bad data":   `{"type":"update","seq":5,"data":[1]}`,
+		"other":      `{"type":"update","seq":6,"data":{"hallD:10.0.0.3:10.0.0.4":{}}}`,
+	} {
+		if out := tenantFramePayload([]byte(payload), "hallB"); out != nil {
+			t.Errorf("%s: tenantFramePayload = %s, want nil", name, out)
+		}
+	}
+	out := tenantFramePayload([]byte(`{"type":"update","seq":7,"data":{"hallB:a:b":{},"hallD:c:d":{}}}`), "hallB")
+	if string(out) != `{"data":{"hallB:a:b":{}},"seq":7,"type":"update"}` {
+		t.Errorf("tenantFramePayload = %s, want only hallB's edge", out)
+	}
+}
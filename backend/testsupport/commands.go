@@ -0,0 +1,637 @@
+package testsupport
+
+import (
+	"errors"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errSyntax    = errors.New("ERR syntax error")
+	errNotInt    = errors.New("ERR value is not an integer or out of range")
+	errNotFloat  = errors.New("ERR value is not a valid float")
+	errMinMax    = errors.New("ERR min or max is not a float")
+	errNoScript  = errors.New("NOSCRIPT the test double has no handler for this script; register one with HandleScript")
+	errSubscribe = errors.New("ERR only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context")
+)
+
+func cmdOK(r *Redis, c *redisConn, args []string) interface{} { return ok }
+
+func cmdPing(r *Redis, c *redisConn, args []string) interface{} {
+	if len(args) > 1 {
+		return args[1]
+	}
+	return status("PONG")
+}
+
+// cmdHello refuses RESP3, as Redis before 6 does; go-redis then speaks
+// RESP2, which is all the double encodes.
+func cmdHello(r *Redis, c *redisConn, args []string) interface{} {
+	if len(args) > 1 && args[1] != "2" {
+		return errors.New("NOPROTO unsupported protocol version")
+	}
+	return []interface{}{"server", "redis", "version", "7.4.0", "proto", 2, "mode", "standalone"}
+}
+
+func cmdFlushAll(r *Redis, c *redisConn, args []string) interface{} {
+	r.flushAll()
+	return ok
+}
+
+func cmdDel(r *Redis, c *redisConn, args []string) interface{} {
+	n := 0
+	for _, key := range args[1:] {
+		if r.del(key) {
+			n++
+		}
+	}
+	return n
+}
+
+func cmdExists(r *Redis, c *redisConn, args []string) interface{} {
+	n := 0
+	for _, key := range args[1:] {
+		if r.keyType(key) != "none" {
+			n++
+		}
+	}
+	return n
+}
+
+func cmdType(r *Redis, c *redisConn, args []string) interface{} {
+	return status(r.keyType(args[1]))
+}
+
+func cmdExpire(r *Redis, c *redisConn, args []string) interface{} {
+	n, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return errNotInt
+	}
+	if r.keyType(args[1]) == "none" {
+		return 0
+	}
+	unit := time.Second
+	if strings.EqualFold(args[0], "PEXPIRE") {
+		unit = time.Millisecond
+	}
+	r.expires[args[1]] = r.now().Add(time.Duration(n) * unit)
+	r.expireKeys()
+	return 1
+}
+
+func cmdTTL(r *Redis, c *redisConn, args []string) interface{} {
+	if r.keyType(args[1]) == "none" {
+		return -2
+	}
+	at, ok := r.expires[args[1]]
+	if !ok {
+		return -1
+	}
+	return int64(math.Ceil(at.Sub(r.now()).Seconds()))
+}
+
+// keys returns the keys matching a glob pattern, sorted.
+func (r *Redis) keys(pattern string) []string {
+	var out []string
+	add := func(key string) {
+		if matched, _ := path.Match(pattern, key); matched {
+			out = append(out, key)
+		}
+	}
+	for key := range r.hashes {
+		add(key)
+	}
+	for key := range r.lists {
+		add(key)
+	}
+	for key := range r.zsets {
+		add(key)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// cmdScan returns every matching key in one batch, with cursor 0.
+func cmdScan(r *Redis, c *redisConn, args []string) interface{} {
+	pattern, typ := "*", ""
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return errSyntax
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+		case "TYPE":
+			typ = strings.ToLower(args[i+1])
+		default:
+			return errSyntax
+		}
+	}
+	keys := []string{}
+	for _, key := range r.keys(pattern) {
+		if typ == "" || r.keyType(key) == typ {
+			keys = append(keys, key)
+		}
+	}
+	return []interface{}{"0", keys}
+}
+
+func cmdKeys(r *Redis, c *redisConn, args []string) interface{} {
+	return r.keys(args[1])
+}
+
+func cmdDBSize(r *Redis, c *redisConn, args []string) interface{} {
+	return len(r.hashes) + len(r.lists) + len(r.zsets)
+}
+
+func cmdHSet(r *Redis, c *redisConn, args []string) interface{} {
+	if len(args)%2 != 0 {
+		return errors.New("ERR wrong number of arguments for 'hset' command")
+	}
+	if err := r.checkType(args[1], "hash"); err != nil {
+		return err
+	}
+	h := r.hashes[args[1]]
+	if h == nil {
+		h = make(map[string]string)
+		r.hashes[args[1]] = h
+	}
+	n := 0
+	for i := 2; i < len(args); i += 2 {
+		if _, ok := h[args[i]]; !ok {
+			n++
+		}
+		h[args[i]] = args[i+1]
+	}
+	return n
+}
+
+func cmdHGet(r *Redis, c *redisConn, args []string) interface{} {
+	if err := r.checkType(args[1], "hash"); err != nil {
+		return err
+	}
+	if v, ok := r.hashes[args[1]][args[2]]; ok {
+		return v
+	}
+	return nil
+}
+
+func cmdHGetAll(r *Redis, c *redisConn, args []string) interface{} {
+	if err := r.checkType(args[1], "hash"); err != nil {
+		return err
+	}
+	return flattenHash(r.hashes[args[1]])
+}
+
+func cmdHDel(r *Redis, c *redisConn, args []string) interface{} {
+	if err := r.checkType(args[1], "hash"); err != nil {
+		return err
+	}
+	h := r.hashes[args[1]]
+	n := 0
+	for _, field := range args[2:] {
+		if _, ok := h[field]; ok {
+			delete(h, field)
+			n++
+		}
+	}
+	if len(h) == 0 {
+		r.del(args[1])
+	}
+	return n
+}
+
+// flattenHash returns h's fields and values, by field name.
+func flattenHash(h map[string]string) []interface{} {
+	fields := make([]string, 0, len(h))
+	for f := range h {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	out := make([]interface{}, 0, 2*len(h))
+	for _, f := range fields {
+		out = append(out, f, h[f])
+	}
+	return out
+}
+
+func cmdPush(r *Redis, c *redisConn, args []string) interface{} {
+	if err := r.checkType(args[1], "list"); err != nil {
+		return err
+	}
+	l := r.lists[args[1]]
+	for _, v := range args[2:] {
+		if strings.EqualFold(args[0], "LPUSH") {
+			l = append([]string{v}, l...)
+		} else {
+			l = append(l, v)
+		}
+	}
+	r.lists[args[1]] = l
+	return len(l)
+}
+
+// listRange resolves LRANGE-style indexes, which may count from the end,
+// to a slice range of a sequence of n elements.
+func listRange(n int, start, stop string) (int, int, error) {
+	a, err1 := strconv.Atoi(start)
+	b, err2 := strconv.Atoi(stop)
+	if err1 != nil || err2 != nil {
+		return 0, 0, errNotInt
+	}
+	if a < 0 {
+		a += n
+	}
+	if b < 0 {
+		b += n
+	}
+	a = max(a, 0)
+	b = min(b, n-1)
+	if a > b {
+		return 0, 0, nil
+	}
+	return a, b + 1, nil
+}
+
+func cmdLRange(r *Redis, c *redisConn, args []string) interface{} {
+	if err := r.checkType(args[1], "list"); err != nil {
+		return err
+	}
+	l := r.lists[args[1]]
+	a, b, err := listRange(len(l), args[2], args[3])
+	if err != nil {
+		return err
+	}
+	return append([]string{}, l[a:b]...)
+}
+
+func cmdLTrim(r *Redis, c *redisConn, args []string) interface{} {
+	if err := r.checkType(args[1], "list"); err != nil {
+		return err
+	}
+	l := r.lists[args[1]]
+	a, b, err := listRange(len(l), args[2], args[3])
+	if err != nil {
+		return err
+	}
+	if a == b {
+		r.del(args[1])
+		return ok
+	}
+	r.lists[args[1]] = append([]string(nil), l[a:b]...)
+	return ok
+}
+
+func cmdLLen(r *Redis, c *redisConn, args []string) interface{} {
+	if err := r.checkType(args[1], "list"); err != nil {
+		return err
+	}
+	return len(r.lists[args[1]])
+}
+
+func cmdZAdd(r *Redis, c *redisConn, args []string) interface{} {
+	if err := r.checkType(args[1], "zset"); err != nil {
+		return err
+	}
+	pairs := args[2:]
+	if len(pairs)%2 != 0 {
+		return errSyntax
+	}
+	scores := make([]float64, len(pairs)/2)
+	for i := range scores {
+		f, err := strconv.ParseFloat(pairs[2*i], 64)
+		if err != nil {
+			return errNotFloat
+		}
+		scores[i] = f
+	}
+	z := r.zsets[args[1]]
+	if z == nil {
+		z = make(map[string]float64)
+		r.zsets[args[1]] = z
+	}
+	n := 0
+	for i, score := range scores {
+		member := pairs[2*i+1]
+		if _, ok := z[member]; !ok {
+			n++
+		}
+		z[member] = score
+	}
+	return n
+}
+
+func cmdZRem(r *Redis, c *redisConn, args []string) interface{} {
+	if err := r.checkType(args[1], "zset"); err != nil {
+		return err
+	}
+	z := r.zsets[args[1]]
+	n := 0
+	for _, member := range args[2:] {
+		if _, ok := z[member]; ok {
+			delete(z, member)
+			n++
+		}
+	}
+	if len(z) == 0 {
+		r.del(args[1])
+	}
+	return n
+}
+
+func cmdZCard(r *Redis, c *redisConn, args []string) interface{} {
+	if err := r.checkType(args[1], "zset"); err != nil {
+		return err
+	}
+	return len(r.zsets[args[1]])
+}
+
+func cmdZScore(r *Redis, c *redisConn, args []string) interface{} {
+	if err := r.checkType(args[1], "zset"); err != nil {
+		return err
+	}
+	if score, ok := r.zsets[args[1]][args[2]]; ok {
+		return score
+	}
+	return nil
+}
+
+// zmember is a sorted set member with its score.
+type zmember struct {
+	member string
+	score  float64
+}
+
+// sortedMembers returns z ordered by score, then member, as Redis orders
+// sorted sets.
+func sortedMembers(z map[string]float64) []zmember {
+	out := make([]zmember, 0, len(z))
+	for m, s := range z {
+		out = append(out, zmember{m, s})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].score != out[j].score {
+			return out[i].score < out[j].score
+		}
+		return out[i].member < out[j].member
+	})
+	return out
+}
+
+// scoreBound parses a ZRANGEBYSCORE bound: a float, -inf, +inf, or a float
+// after "(" for an exclusive bound.
+type scoreBound struct {
+	value     float64
+	exclusive bool
+}
+
+func parseScoreBound(s string) (scoreBound, error) {
+	var b scoreBound
+	if strings.HasPrefix(s, "(") {
+		b.exclusive = true
+		s = s[1:]
+	}
+	switch strings.ToLower(s) {
+	case "-inf":
+		b.value = math.Inf(-1)
+	case "+inf", "inf":
+		b.value = math.Inf(1)
+	default:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return b, errMinMax
+		}
+		b.value = f
+	}
+	return b, nil
+}
+
+func (b scoreBound) above(f float64) bool {
+	return f > b.value || !b.exclusive && f == b.value
+}
+
+func (b scoreBound) below(f float64) bool {
+	return f < b.value || !b.exclusive && f == b.value
+}
+
+// cmdZRange serves ZRANGE (with BYSCORE, REV, LIMIT, WITHSCORES) and the
+// older ZREVRANGE, ZRANGEBYSCORE, and ZREVRANGEBYSCORE forms.
+func cmdZRange(r *Redis, c *redisConn, args []string) interface{} {
+	if err := r.checkType(args[1], "zset"); err != nil {
+		return err
+	}
+	name := strings.ToUpper(args[0])
+	byScore := strings.HasSuffix(name, "BYSCORE")
+	rev := strings.HasPrefix(name, "ZREV")
+	withScores := false
+	offset, count := 0, -1
+	for i := 4; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "BYSCORE":
+			byScore = true
+		case "REV":
+			rev = true
+		case "WITHSCORES":
+			withScores = true
+		case "LIMIT":
+			if i+2 >= len(args) {
+				return errSyntax
+			}
+			var err1, err2 error
+			offset, err1 = strconv.Atoi(args[i+1])
+			count, err2 = strconv.Atoi(args[i+2])
+			if err1 != nil || err2 != nil {
+				return errNotInt
+			}
+			i += 2
+		default:
+			return errSyntax
+		}
+	}
+
+	members := sortedMembers(r.zsets[args[1]])
+	if rev {
+		for i, j := 0, len(members)-1; i < j; i, j = i+1, j-1 {
+			members[i], members[j] = members[j], members[i]
+		}
+	}
+	var picked []zmember
+	if byScore {
+		lo, hi := args[2], args[3]
+		if rev {
+			// The reverse forms take max before min.
+			lo, hi = hi, lo
+		}
+		from, err := parseScoreBound(lo)
+		if err != nil {
+			return err
+		}
+		to, err := parseScoreBound(hi)
+		if err != nil {
+			return err
+		}
+		for _, m := range members {
+			if from.above(m.score) && to.below(m.score) {
+				picked = append(picked, m)
+			}
+		}
+		if offset > 0 {
+			picked = picked[min(offset, len(picked)):]
+		}
+		if count >= 0 && count < len(picked) {
+			picked = picked[:count]
+		}
+	} else {
+		a, b, err := listRange(len(members), args[2], args[3])
+		if err != nil {
+			return err
+		}
+		picked = members[a:b]
+	}
+
+	out := make([]interface{}, 0, len(picked))
+	for _, m := range picked {
+		out = append(out, m.member)
+		if withScores {
+			out = append(out, m.score)
+		}
+	}
+	return out
+}
+
+func cmdZRemRange(r *Redis, c *redisConn, args []string) interface{} {
+	if err := r.checkType(args[1], "zset"); err != nil {
+		return err
+	}
+	z := r.zsets[args[1]]
+	members := sortedMembers(z)
+	var doomed []zmember
+	if strings.EqualFold(args[0], "ZREMRANGEBYRANK") {
+		a, b, err := listRange(len(members), args[2], args[3])
+		if err != nil {
+			return err
+		}
+		doomed = members[a:b]
+	} else {
+		from, err := parseScoreBound(args[2])
+		if err != nil {
+			return err
+		}
+		to, err := parseScoreBound(args[3])
+		if err != nil {
+			return err
+		}
+		for _, m := range members {
+			if from.above(m.score) && to.below(m.score) {
+				doomed = append(doomed, m)
+			}
+		}
+	}
+	for _, m := range doomed {
+		delete(z, m.member)
+	}
+	if len(z) == 0 {
+		r.del(args[1])
+	}
+	return len(doomed)
+}
+
+func cmdPublish(r *Redis, c *redisConn, args []string) interface{} {
+	msg := []interface{}{"message", args[1], args[2]}
+	n := 0
+	for sub := range r.subs[args[1]] {
+		if sub.write(msg) == nil {
+			n++
+		}
+	}
+	return n
+}
+
+func cmdSubscribe(r *Redis, c *redisConn, args []string) interface{} {
+	if c == nil {
+		return errSubscribe
+	}
+	out := replies{}
+	for _, ch := range args[1:] {
+		if r.subs[ch] == nil {
+			r.subs[ch] = make(map[*redisConn]bool)
+		}
+		r.subs[ch][c] = true
+		out = append(out, []interface{}{"subscribe", ch, r.subscriptions(c)})
+	}
+	return out
+}
+
+func cmdUnsubscribe(r *Redis, c *redisConn, args []string) interface{} {
+	if c == nil {
+		return errSubscribe
+	}
+	channels := args[1:]
+	if len(channels) == 0 {
+		for ch, subs := range r.subs {
+			if subs[c] {
+				channels = append(channels, ch)
+			}
+		}
+		sort.Strings(channels)
+	}
+	out := replies{}
+	for _, ch := range channels {
+		delete(r.subs[ch], c)
+		out = append(out, []interface{}{"unsubscribe", ch, r.subscriptions(c)})
+	}
+	if len(out) == 0 {
+		out = append(out, []interface{}{"unsubscribe", nil, 0})
+	}
+	return out
+}
+
+func (r *Redis) subscriptions(c *redisConn) int {
+	n := 0
+	for _, subs := range r.subs {
+		if subs[c] {
+			n++
+		}
+	}
+	return n
+}
+
+// cmdEval runs the ScriptFunc registered for the script.
+func cmdEval(r *Redis, c *redisConn, args []string) interface{} {
+	fn, ok := r.scripts[args[1]]
+	if !ok {
+		return errNoScript
+	}
+	numKeys, err := strconv.Atoi(args[2])
+	if err != nil || numKeys < 0 || numKeys > len(args)-3 {
+		return errors.New("ERR Number of keys can't be greater than number of args")
+	}
+	call := func(cargs ...string) (interface{}, error) {
+		if len(cargs) == 0 {
+			return nil, errors.New("ERR Please specify at least one argument for this redis lib call")
+		}
+		return unwrapReply(r.exec(nil, cargs))
+	}
+	reply, err := fn(call, args[3:3+numKeys], args[3+numKeys:])
+	if err != nil {
+		return err
+	}
+	switch v := reply.(type) {
+	case int64, string, nil, []interface{}:
+		return v
+	case int:
+		return v
+	case bool:
+		// Lua true is 1 and false is nil.
+		if v {
+			return 1
+		}
+		return nil
+	}
+	return errors.New("ERR unsupported script reply type")
+}
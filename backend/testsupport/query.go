@@ -0,0 +1,471 @@
+package testsupport
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// parseQuery compiles the query syntax the backend builds: "*", and clauses
+// joined by spaces, all required, each optionally negated with "-":
+//
+//	@num:[lo hi]                 numeric range; "(" excludes, -inf and +inf
+//	@geo:[lon lat radius unit]   geo radius in m, km, mi, or ft
+//	@tag:{a|b}                   any of the tag values
+//	@text1|text2:(w (x|y) z*)    every word, alternatives, prefixes
+//	words                        as above, over all TEXT fields
+func parseQuery(idx *searchIndex, query string) (func(map[string]string) bool, error) {
+	p := &queryParser{idx: idx, s: query}
+	var clauses []func(map[string]string) bool
+	for {
+		p.skipSpace()
+		if p.i >= len(p.s) {
+			break
+		}
+		negate := p.s[p.i] == '-'
+		if negate {
+			p.i++
+		}
+		match, err := p.clause()
+		if err != nil {
+			return nil, fmt.Errorf("Syntax error at offset %d near %s", p.i, query)
+		}
+		if negate {
+			inner := match
+			match = func(h map[string]string) bool { return !inner(h) }
+		}
+		clauses = append(clauses, match)
+	}
+	return func(h map[string]string) bool {
+		for _, match := range clauses {
+			if !match(h) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+type queryParser struct {
+	idx *searchIndex
+	s   string
+	i   int
+}
+
+var errQuery = errors.New("bad query")
+
+func (p *queryParser) skipSpace() {
+	for p.i < len(p.s) && p.s[p.i] == ' ' {
+		p.i++
+	}
+}
+
+func (p *queryParser) clause() (func(map[string]string) bool, error) {
+	if p.s[p.i] == '*' {
+		p.i++
+		return func(map[string]string) bool { return true }, nil
+	}
+	if p.s[p.i] != '@' {
+		var text []*searchField
+		for i := range p.idx.fields {
+			if p.idx.fields[i].typ == "TEXT" {
+				text = append(text, &p.idx.fields[i])
+			}
+		}
+		return p.text(text)
+	}
+
+	p.i++
+	colon := strings.IndexByte(p.s[p.i:], ':')
+	if colon < 0 {
+		return nil, errQuery
+	}
+	var fields []*searchField
+	for _, name := range strings.Split(p.s[p.i:p.i+colon], "|") {
+		f := p.idx.field(name)
+		if f == nil {
+			return nil, errQuery
+		}
+		fields = append(fields, f)
+	}
+	p.i += colon + 1
+	if p.i >= len(p.s) {
+		return nil, errQuery
+	}
+
+	f := fields[0]
+	switch {
+	case f.typ == "TEXT":
+		return p.text(fields)
+	case len(fields) > 1:
+		return nil, errQuery
+	case f.typ == "TAG" && p.s[p.i] == '{':
+		body, err := p.enclosed('{', '}')
+		if err != nil {
+			return nil, err
+		}
+		var tags []string
+		for _, t := range splitUnescaped(body, '|') {
+			tags = append(tags, strings.ToLower(strings.TrimSpace(unescape(t))))
+		}
+		return func(h map[string]string) bool {
+			for _, v := range strings.Split(h[f.name], ",") {
+				v = strings.ToLower(strings.TrimSpace(v))
+				for _, t := range tags {
+					if v == t {
+						return true
+					}
+				}
+			}
+			return false
+		}, nil
+	case f.typ == "NUMERIC" && p.s[p.i] == '[':
+		body, err := p.enclosed('[', ']')
+		if err != nil {
+			return nil, err
+		}
+		bounds := strings.Fields(body)
+		if len(bounds) != 2 {
+			return nil, errQuery
+		}
+		lo, err1 := parseScoreBound(bounds[0])
+		hi, err2 := parseScoreBound(bounds[1])
+		if err1 != nil || err2 != nil {
+			return nil, errQuery
+		}
+		return func(h map[string]string) bool {
+			v, err := strconv.ParseFloat(h[f.name], 64)
+			return err == nil && lo.above(v) && hi.below(v)
+		}, nil
+	case f.typ == "GEO" && p.s[p.i] == '[':
+		body, err := p.enclosed('[', ']')
+		if err != nil {
+			return nil, err
+		}
+		return geoClause(f, strings.Fields(body))
+	}
+	return nil, errQuery
+}
+
+// enclosed reads from the open character to its matching close, skipping
+// escaped characters, and returns what is between.
+func (p *queryParser) enclosed(open, close byte) (string, error) {
+	start := p.i + 1
+	depth := 0
+	for ; p.i < len(p.s); p.i++ {
+		switch p.s[p.i] {
+		case '\\':
+			p.i++
+		case open:
+			depth++
+		case close:
+			if depth--; depth == 0 {
+				p.i++
+				return p.s[start : p.i-1], nil
+			}
+		}
+	}
+	return "", errQuery
+}
+
+// textTerm is a required word with its alternatives.
+type textTerm []textAlt
+
+type textAlt struct {
+	word   string
+	prefix bool
+}
+
+// text parses a parenthesized word list, or one word, matched against the
+// words of fields.
+func (p *queryParser) text(fields []*searchField) (func(map[string]string) bool, error) {
+	var body string
+	if p.s[p.i] == '(' {
+		var err error
+		if body, err = p.enclosed('(', ')'); err != nil {
+			return nil, err
+		}
+	} else {
+		start := p.i
+		for p.i < len(p.s) && p.s[p.i] != ' ' {
+			if p.s[p.i] == '\\' {
+				p.i++
+			}
+			p.i++
+		}
+		body = p.s[start:min(p.i, len(p.s))]
+	}
+
+	var terms []textTerm
+	for _, word := range splitUnescaped(body, ' ') {
+		word = strings.TrimSuffix(strings.TrimPrefix(word, "("), ")")
+		if word == "" {
+			continue
+		}
+		var term textTerm
+		for _, alt := range splitUnescaped(word, '|') {
+			a := textAlt{word: alt}
+			if strings.HasSuffix(alt, "*") && !strings.HasSuffix(alt, `\*`) {
+				a = textAlt{word: strings.TrimSuffix(alt, "*"), prefix: true}
+			}
+			a.word = strings.ToLower(unescape(a.word))
+			term = append(term, a)
+		}
+		terms = append(terms, term)
+	}
+	if len(terms) == 0 {
+		return nil, errQuery
+	}
+
+	return func(h map[string]string) bool {
+		var words []string
+		for _, f := range fields {
+			words = append(words, tokenize(h[f.name])...)
+		}
+		for _, term := range terms {
+			if !term.matches(words) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func (t textTerm) matches(words []string) bool {
+	for _, alt := range t {
+		for _, w := range words {
+			if w == alt.word || alt.prefix && strings.HasPrefix(w, alt.word) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tokenize splits text into lower-cased words at whitespace and
+// punctuation, as RediSearch does.
+func tokenize(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	})
+}
+
+var geoUnits = map[string]float64{"m": 1, "km": 1000, "mi": 1609.344, "ft": 0.3048}
+
+func geoClause(f *searchField, args []string) (func(map[string]string) bool, error) {
+	if len(args) != 4 {
+		return nil, errQuery
+	}
+	lon, err1 := strconv.ParseFloat(args[0], 64)
+	lat, err2 := strconv.ParseFloat(args[1], 64)
+	radius, err3 := strconv.ParseFloat(args[2], 64)
+	unit, ok := geoUnits[strings.ToLower(args[3])]
+	if err1 != nil || err2 != nil || err3 != nil || !ok {
+		return nil, errQuery
+	}
+	radius *= unit
+	return func(h map[string]string) bool {
+		// Hashes hold GEO fields as "lon,lat".
+		lonStr, latStr, ok := strings.Cut(h[f.name], ",")
+		if !ok {
+			return false
+		}
+		plon, err1 := strconv.ParseFloat(strings.TrimSpace(lonStr), 64)
+		plat, err2 := strconv.ParseFloat(strings.TrimSpace(latStr), 64)
+		return err1 == nil && err2 == nil && haversine(lat, lon, plat, plon) <= radius
+	}, nil
+}
+
+// haversine is the distance in meters between two points, on the sphere
+// Redis uses for GEO.
+func haversine(lat1, lon1, lat2, lon2 float64) float64 {
+	const earthRadius = 6372797.560856
+	rad := math.Pi / 180
+	dlat := (lat2 - lat1) * rad
+	dlon := (lon2 - lon1) * rad
+	a := math.Pow(math.Sin(dlat/2), 2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Pow(math.Sin(dlon/2), 2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+// splitUnescaped splits s at sep characters that are not escaped with a
+// backslash, keeping the escapes.
+func splitUnescaped(s string, sep byte) []string {
+	var out []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case sep:
+			out = append(out, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(out, s[start:])
+}
+
+func unescape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// evalExpr evaluates an APPLY expression: numbers, @fields, + - * / % ^,
+// parentheses, and floor, ceil, abs, sqrt, log, log2, and exp.
+func evalExpr(expr string, get func(string) (string, bool)) (float64, error) {
+	e := &exprParser{s: expr, get: get}
+	v, err := e.sum()
+	if err == nil && e.skipSpace() < len(e.s) {
+		err = fmt.Errorf("unexpected %q", e.s[e.i:])
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Invalid APPLY expression %q: %v", expr, err)
+	}
+	return v, nil
+}
+
+type exprParser struct {
+	s   string
+	i   int
+	get func(string) (string, bool)
+}
+
+var exprFunctions = map[string]func(float64) float64{
+	"floor": math.Floor, "ceil": math.Ceil, "abs": math.Abs, "sqrt": math.Sqrt,
+	"log": math.Log, "log2": math.Log2, "exp": math.Exp,
+}
+
+func (e *exprParser) skipSpace() int {
+	for e.i < len(e.s) && e.s[e.i] == ' ' {
+		e.i++
+	}
+	return e.i
+}
+
+func (e *exprParser) peek() byte {
+	if e.skipSpace() >= len(e.s) {
+		return 0
+	}
+	return e.s[e.i]
+}
+
+func (e *exprParser) sum() (float64, error) {
+	v, err := e.product()
+	for err == nil {
+		op := e.peek()
+		if op != '+' && op != '-' {
+			break
+		}
+		e.i++
+		var w float64
+		if w, err = e.product(); op == '+' {
+			v += w
+		} else {
+			v -= w
+		}
+	}
+	return v, err
+}
+
+func (e *exprParser) product() (float64, error) {
+	v, err := e.unary()
+	for err == nil {
+		op := e.peek()
+		if op != '*' && op != '/' && op != '%' {
+			break
+		}
+		e.i++
+		var w float64
+		w, err = e.unary()
+		switch op {
+		case '*':
+			v *= w
+		case '/':
+			v /= w
+		case '%':
+			v = math.Mod(v, w)
+		}
+	}
+	return v, err
+}
+
+func (e *exprParser) unary() (float64, error) {
+	if e.peek() == '-' {
+		e.i++
+		v, err := e.unary()
+		return -v, err
+	}
+	return e.power()
+}
+
+func (e *exprParser) power() (float64, error) {
+	v, err := e.operand()
+	if err == nil && e.peek() == '^' {
+		e.i++
+		var w float64
+		w, err = e.unary()
+		v = math.Pow(v, w)
+	}
+	return v, err
+}
+
+func (e *exprParser) operand() (float64, error) {
+	c := e.peek()
+	start := e.i
+	switch {
+	case c == '(':
+		e.i++
+		v, err := e.sum()
+		if err == nil && e.peek() != ')' {
+			err = errors.New("missing )")
+		}
+		e.i++
+		return v, err
+	case c == '@':
+		e.i++
+		name := e.word()
+		s, ok := e.get(name)
+		if !ok {
+			return 0, fmt.Errorf("property @%s not loaded", name)
+		}
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return 0, fmt.Errorf("@%s is not a number", name)
+		}
+		return v, nil
+	case c >= '0' && c <= '9' || c == '.':
+		for e.i < len(e.s) && (e.s[e.i] >= '0' && e.s[e.i] <= '9' || e.s[e.i] == '.') {
+			e.i++
+		}
+		return strconv.ParseFloat(e.s[start:e.i], 64)
+	case c >= 'a' && c <= 'z':
+		name := e.word()
+		fn, ok := exprFunctions[name]
+		if !ok || e.peek() != '(' {
+			return 0, fmt.Errorf("unknown function %s", name)
+		}
+		v, err := e.operand()
+		return fn(v), err
+	}
+	return 0, fmt.Errorf("unexpected %q", e.s[start:])
+}
+
+func (e *exprParser) word() string {
+	start := e.i
+	for e.i < len(e.s) {
+		c := e.s[e.i]
+		if c != '_' && !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') {
+			break
+		}
+		e.i++
+	}
+	return e.s[start:e.i]
+}
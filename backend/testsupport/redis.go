@@ -0,0 +1,364 @@
+// Package testsupport provides test doubles for the backend.
+//
+// Redis is an in-memory Redis server that the backend's go-redis client
+// talks to over loopback TCP, so subscriber, hydration, and query code runs
+// unchanged against it: pipelines, retries, and the RESP2 search client
+// included. It implements the commands the backend sends and the part of
+// RediSearch it uses; anything else is answered with an "unknown command"
+// error, as by a server without the module.
+package testsupport
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis is an in-memory Redis server on a loopback port. It is safe for
+// concurrent use; every command runs atomically.
+type Redis struct {
+	ln net.Listener
+	wg sync.WaitGroup
+
+	mu      sync.Mutex
+	conns   map[net.Conn]bool
+	hashes  map[string]map[string]string
+	lists   map[string][]string
+	zsets   map[string]map[string]float64
+	expires map[string]time.Time
+	subs    map[string]map[*redisConn]bool
+	scripts map[string]ScriptFunc
+	// indexes and cursors are the RediSearch state; see search.go.
+	indexes    map[string]*searchIndex
+	cursors    map[int64]*searchCursor
+	nextCursor int64
+	noSearch   bool
+	now        func() time.Time
+}
+
+// ScriptFunc stands in for a Lua script sent with EVAL. call runs a command
+// against the store, as redis.call does, while the script holds the lock.
+type ScriptFunc func(call func(args ...string) (interface{}, error), keys, argv []string) (interface{}, error)
+
+// NewRedis starts a Redis double on a free loopback port. Close it when done.
+func NewRedis() (*Redis, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	r := &Redis{
+		ln:      ln,
+		conns:   make(map[net.Conn]bool),
+		hashes:  make(map[string]map[string]string),
+		lists:   make(map[string][]string),
+		zsets:   make(map[string]map[string]float64),
+		expires: make(map[string]time.Time),
+		subs:    make(map[string]map[*redisConn]bool),
+		scripts: make(map[string]ScriptFunc),
+		indexes: make(map[string]*searchIndex),
+		cursors: make(map[int64]*searchCursor),
+		now:     time.Now,
+	}
+	r.wg.Add(1)
+	go r.serve()
+	return r, nil
+}
+
+// Addr is the server's host:port, for REDIS_ADDR or redis.Options.
+func (r *Redis) Addr() string {
+	return r.ln.Addr().String()
+}
+
+// Client returns a go-redis client for the server.
+func (r *Redis) Client() *redis.Client {
+	return redis.NewClient(&redis.Options{Addr: r.Addr()})
+}
+
+// Close stops the server and drops its connections.
+func (r *Redis) Close() error {
+	err := r.ln.Close()
+	r.mu.Lock()
+	for c := range r.conns {
+		c.Close()
+	}
+	r.mu.Unlock()
+	r.wg.Wait()
+	return err
+}
+
+// DisableSearch makes the server answer FT.* commands like one without
+// RediSearch, so the SEARCH_FALLBACK paths run.
+func (r *Redis) DisableSearch() {
+	r.mu.Lock()
+	r.noSearch = true
+	r.mu.Unlock()
+}
+
+// HandleScript runs fn for EVAL calls of script, which the server cannot
+// interpret itself.
+func (r *Redis) HandleScript(script string, fn ScriptFunc) {
+	r.mu.Lock()
+	r.scripts[script] = fn
+	r.mu.Unlock()
+}
+
+// SetClock replaces the clock key expiry is checked against.
+func (r *Redis) SetClock(now func() time.Time) {
+	r.mu.Lock()
+	r.now = now
+	r.mu.Unlock()
+}
+
+// FlushAll removes every key, index, and cursor.
+func (r *Redis) FlushAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.flushAll()
+}
+
+func (r *Redis) flushAll() {
+	clear(r.hashes)
+	clear(r.lists)
+	clear(r.zsets)
+	clear(r.expires)
+	clear(r.indexes)
+	clear(r.cursors)
+}
+
+// Do runs one command against the store and returns its reply, as a client
+// would see it: string, int64, []interface{}, nil, or an error.
+func (r *Redis) Do(args ...string) (interface{}, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return unwrapReply(r.exec(nil, args))
+}
+
+func (r *Redis) serve() {
+	defer r.wg.Done()
+	for {
+		nc, err := r.ln.Accept()
+		if err != nil {
+			return
+		}
+		r.mu.Lock()
+		r.conns[nc] = true
+		r.mu.Unlock()
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			c := &redisConn{conn: nc, w: bufio.NewWriter(nc)}
+			c.serve(r)
+			r.mu.Lock()
+			delete(r.conns, nc)
+			for _, subs := range r.subs {
+				delete(subs, c)
+			}
+			r.mu.Unlock()
+			nc.Close()
+		}()
+	}
+}
+
+// redisConn is one client connection. Writes are serialized by wmu, since
+// PUBLISH on another connection writes to subscribers.
+type redisConn struct {
+	conn net.Conn
+	wmu  sync.Mutex
+	w    *bufio.Writer
+}
+
+func (c *redisConn) serve(r *Redis) {
+	rd := bufio.NewReader(c.conn)
+	for {
+		args, err := readCommand(rd)
+		if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		r.mu.Lock()
+		reply := r.exec(c, args)
+		r.mu.Unlock()
+		if err := c.write(reply); err != nil {
+			return
+		}
+	}
+}
+
+func (c *redisConn) write(reply interface{}) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	writeReply(c.w, reply)
+	return c.w.Flush()
+}
+
+// command handles one command under mu. c is nil for Do and scripts.
+type command func(r *Redis, c *redisConn, args []string) interface{}
+
+// commandSpec is a command and its arity, as in COMMAND INFO: n means
+// exactly n arguments including the name, -n at least n.
+type commandSpec struct {
+	fn    command
+	arity int
+}
+
+var commands map[string]commandSpec
+
+func init() {
+	commands = map[string]commandSpec{
+		"PING":   {cmdPing, -1},
+		"ECHO":   {func(r *Redis, c *redisConn, args []string) interface{} { return args[1] }, 2},
+		"HELLO":  {cmdHello, -1},
+		"CLIENT": {cmdOK, -2},
+		"SELECT": {cmdOK, 2},
+		"AUTH":   {cmdOK, -2},
+		"QUIT":   {cmdOK, 1},
+
+		"FLUSHALL": {cmdFlushAll, -1},
+		"FLUSHDB":  {cmdFlushAll, -1},
+		"DEL":      {cmdDel, -2},
+		"UNLINK":   {cmdDel, -2},
+		"EXISTS":   {cmdExists, -2},
+		"TYPE":     {cmdType, 2},
+		"EXPIRE":   {cmdExpire, -3},
+		"PEXPIRE":  {cmdExpire, -3},
+		"TTL":      {cmdTTL, 2},
+		"SCAN":     {cmdScan, -2},
+		"KEYS":     {cmdKeys, 2},
+		"DBSIZE":   {cmdDBSize, 1},
+
+		"HSET":    {cmdHSet, -4},
+		"HGET":    {cmdHGet, 3},
+		"HGETALL": {cmdHGetAll, 2},
+		"HDEL":    {cmdHDel, -3},
+
+		"LPUSH":  {cmdPush, -3},
+		"RPUSH":  {cmdPush, -3},
+		"LRANGE": {cmdLRange, 4},
+		"LTRIM":  {cmdLTrim, 4},
+		"LLEN":   {cmdLLen, 2},
+
+		"ZADD":             {cmdZAdd, -4},
+		"ZREM":             {cmdZRem, -3},
+		"ZCARD":            {cmdZCard, 2},
+		"ZSCORE":           {cmdZScore, 3},
+		"ZRANGE":           {cmdZRange, -4},
+		"ZREVRANGE":        {cmdZRange, -4},
+		"ZRANGEBYSCORE":    {cmdZRange, -4},
+		"ZREVRANGEBYSCORE": {cmdZRange, -4},
+		"ZREMRANGEBYSCORE": {cmdZRemRange, 4},
+		"ZREMRANGEBYRANK":  {cmdZRemRange, 4},
+
+		"PUBLISH":     {cmdPublish, 3},
+		"SUBSCRIBE":   {cmdSubscribe, -2},
+		"UNSUBSCRIBE": {cmdUnsubscribe, -1},
+
+		"EVAL": {cmdEval, -3},
+
+		"FT.CREATE":    {cmdFTCreate, -5},
+		"FT.INFO":      {cmdFTInfo, 2},
+		"FT.DROPINDEX": {cmdFTDropIndex, -2},
+		"FT._LIST":     {cmdFTList, 1},
+		"FT.SEARCH":    {cmdFTSearch, -3},
+		"FT.AGGREGATE": {cmdFTAggregate, -3},
+		"FT.CURSOR":    {cmdFTCursor, -4},
+	}
+}
+
+func (r *Redis) exec(c *redisConn, args []string) interface{} {
+	name := strings.ToUpper(args[0])
+	spec, ok := commands[name]
+	if !ok || r.noSearch && strings.HasPrefix(name, "FT.") {
+		return fmt.Errorf("ERR unknown command '%s', with args beginning with: %s", args[0], strings.Join(args[1:min(len(args), 3)], " "))
+	}
+	if spec.arity > 0 && len(args) != spec.arity || spec.arity < 0 && len(args) < -spec.arity {
+		return fmt.Errorf("ERR wrong number of arguments for '%s' command", strings.ToLower(args[0]))
+	}
+	r.expireKeys()
+	return spec.fn(r, c, args)
+}
+
+// expireKeys deletes the keys whose TTL has passed.
+func (r *Redis) expireKeys() {
+	now := r.now()
+	for key, at := range r.expires {
+		if !now.Before(at) {
+			r.del(key)
+		}
+	}
+}
+
+func (r *Redis) del(key string) bool {
+	_, h := r.hashes[key]
+	_, l := r.lists[key]
+	_, z := r.zsets[key]
+	delete(r.hashes, key)
+	delete(r.lists, key)
+	delete(r.zsets, key)
+	delete(r.expires, key)
+	return h || l || z
+}
+
+// keyType is the TYPE of key, or "none".
+func (r *Redis) keyType(key string) string {
+	switch {
+	case r.hashes[key] != nil:
+		return "hash"
+	case r.lists[key] != nil:
+		return "list"
+	case r.zsets[key] != nil:
+		return "zset"
+	}
+	return "none"
+}
+
+var errWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+// checkType reports the WRONGTYPE error for key holding something other
+// than want.
+func (r *Redis) checkType(key, want string) error {
+	if t := r.keyType(key); t != "none" && t != want {
+		return errWrongType
+	}
+	return nil
+}
+
+// unwrapReply turns a reply into what go-redis would return for it.
+func unwrapReply(reply interface{}) (interface{}, error) {
+	switch v := reply.(type) {
+	case error:
+		return nil, v
+	case status:
+		return string(v), nil
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			if err, ok := e.(error); ok {
+				out[i] = err
+				continue
+			}
+			out[i], _ = unwrapReply(e)
+		}
+		return out, nil
+	case []string:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			out[i] = e
+		}
+		return out, nil
+	case replies:
+		return unwrapReply([]interface{}(v))
+	case int:
+		return int64(v), nil
+	case float64:
+		return formatFloat(v), nil
+	}
+	return reply, nil
+}
@@ -0,0 +1,791 @@
+package testsupport
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The RediSearch subset: FT.CREATE ON HASH with PREFIX and a schema of
+// TEXT, TAG, NUMERIC, and GEO fields; FT.INFO; FT.DROPINDEX; FT.SEARCH with
+// LIMIT, SORTBY, RETURN, and NOCONTENT; FT.AGGREGATE with LOAD, APPLY,
+// GROUPBY/REDUCE, SORTBY, LIMIT, and WITHCURSOR; and FT.CURSOR. Documents are
+// indexed as they are queried, so hashes written before or after FT.CREATE
+// are found alike. Text is matched by whole or prefixed words, without
+// stemming or stop words.
+
+var (
+	errUnknownIndex = errors.New("Unknown index name")
+	errNoCursor     = errors.New("Cursor not found")
+)
+
+func errUnsupported(command, arg string) error {
+	return fmt.Errorf("ERR testsupport: %s argument %s is not supported", command, arg)
+}
+
+// searchField is one schema field: name is the hash field, alias the name
+// queries use.
+type searchField struct {
+	name, alias, typ string
+	sortable         bool
+}
+
+type searchIndex struct {
+	name     string
+	prefixes []string
+	fields   []searchField
+}
+
+// field finds a schema field by alias.
+func (idx *searchIndex) field(alias string) *searchField {
+	for i := range idx.fields {
+		if idx.fields[i].alias == alias {
+			return &idx.fields[i]
+		}
+	}
+	return nil
+}
+
+// searchDoc is an indexed hash.
+type searchDoc struct {
+	key  string
+	hash map[string]string
+}
+
+// docs returns the hashes under the index's prefixes, by key.
+func (r *Redis) docs(idx *searchIndex) []searchDoc {
+	var out []searchDoc
+	for key, h := range r.hashes {
+		for _, p := range idx.prefixes {
+			if strings.HasPrefix(key, p) {
+				out = append(out, searchDoc{key, h})
+				break
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].key < out[j].key })
+	return out
+}
+
+func (r *Redis) index(name string) (*searchIndex, error) {
+	idx := r.indexes[name]
+	if idx == nil {
+		return nil, errUnknownIndex
+	}
+	return idx, nil
+}
+
+// argReader walks command arguments.
+type argReader struct {
+	command string
+	args    []string
+	i       int
+}
+
+func (a *argReader) more() bool { return a.i < len(a.args) }
+
+func (a *argReader) next() (string, error) {
+	if a.i >= len(a.args) {
+		return "", errSyntax
+	}
+	a.i++
+	return a.args[a.i-1], nil
+}
+
+func (a *argReader) int() (int, error) {
+	s, err := a.next()
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, errNotInt
+	}
+	return n, nil
+}
+
+// accept consumes the next argument if it is one of words, ignoring case,
+// and returns the word.
+func (a *argReader) accept(words ...string) (string, bool) {
+	if a.i >= len(a.args) {
+		return "", false
+	}
+	for _, w := range words {
+		if strings.EqualFold(a.args[a.i], w) {
+			a.i++
+			return w, true
+		}
+	}
+	return "", false
+}
+
+func cmdFTCreate(r *Redis, c *redisConn, args []string) interface{} {
+	if r.indexes[args[1]] != nil {
+		return errors.New("Index already exists")
+	}
+	idx := &searchIndex{name: args[1]}
+	a := &argReader{command: "FT.CREATE", args: args, i: 2}
+	for {
+		arg, err := a.next()
+		if err != nil {
+			return err
+		}
+		switch strings.ToUpper(arg) {
+		case "ON":
+			on, err := a.next()
+			if err != nil {
+				return err
+			}
+			if !strings.EqualFold(on, "HASH") {
+				return errUnsupported(a.command, "ON "+on)
+			}
+			continue
+		case "PREFIX":
+			n, err := a.int()
+			if err != nil {
+				return err
+			}
+			for range n {
+				p, err := a.next()
+				if err != nil {
+					return err
+				}
+				idx.prefixes = append(idx.prefixes, p)
+			}
+			continue
+		case "SCHEMA":
+		default:
+			return errUnsupported(a.command, arg)
+		}
+		break
+	}
+	for a.more() {
+		name, _ := a.next()
+		f := searchField{name: name, alias: name}
+		if _, ok := a.accept("AS"); ok {
+			alias, err := a.next()
+			if err != nil {
+				return err
+			}
+			f.alias = alias
+		}
+		typ, err := a.next()
+		if err != nil {
+			return err
+		}
+		f.typ = strings.ToUpper(typ)
+		switch f.typ {
+		case "TEXT", "TAG", "NUMERIC", "GEO":
+		default:
+			return errUnsupported(a.command, "field type "+typ)
+		}
+		for {
+			if _, ok := a.accept("SORTABLE"); ok {
+				f.sortable = true
+				continue
+			}
+			if _, ok := a.accept("UNF", "NOSTEM", "NOINDEX", "CASESENSITIVE", "WITHSUFFIXTRIE", "INDEXEMPTY", "INDEXMISSING"); ok {
+				continue
+			}
+			break
+		}
+		idx.fields = append(idx.fields, f)
+	}
+	if len(idx.prefixes) == 0 {
+		idx.prefixes = []string{""}
+	}
+	r.indexes[idx.name] = idx
+	return ok
+}
+
+func cmdFTInfo(r *Redis, c *redisConn, args []string) interface{} {
+	idx, err := r.index(args[1])
+	if err != nil {
+		return err
+	}
+	attrs := make([]interface{}, len(idx.fields))
+	for i, f := range idx.fields {
+		attr := []interface{}{"identifier", f.name, "attribute", f.alias, "type", f.typ}
+		if f.sortable {
+			attr = append(attr, "SORTABLE")
+		}
+		attrs[i] = attr
+	}
+	prefixes := make([]interface{}, len(idx.prefixes))
+	for i, p := range idx.prefixes {
+		prefixes[i] = p
+	}
+	return []interface{}{
+		"index_name", idx.name,
+		"index_options", []interface{}{},
+		"index_definition", []interface{}{"key_type", "HASH", "prefixes", prefixes, "default_score", "1"},
+		"attributes", attrs,
+		"num_docs", len(r.docs(idx)),
+		"indexing", 0,
+		"percent_indexed", "1",
+	}
+}
+
+func cmdFTDropIndex(r *Redis, c *redisConn, args []string) interface{} {
+	idx, err := r.index(args[1])
+	if err != nil {
+		return err
+	}
+	if len(args) > 2 && strings.EqualFold(args[2], "DD") {
+		for _, d := range r.docs(idx) {
+			r.del(d.key)
+		}
+	}
+	delete(r.indexes, idx.name)
+	return ok
+}
+
+func cmdFTList(r *Redis, c *redisConn, args []string) interface{} {
+	names := make([]string, 0, len(r.indexes))
+	for name := range r.indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func cmdFTSearch(r *Redis, c *redisConn, args []string) interface{} {
+	idx, err := r.index(args[1])
+	if err != nil {
+		return err
+	}
+	match, err := parseQuery(idx, args[2])
+	if err != nil {
+		return err
+	}
+	offset, limit := 0, 10
+	noContent := false
+	var sortBy *searchField
+	desc := false
+	var ret []string
+	a := &argReader{command: "FT.SEARCH", args: args, i: 3}
+	for a.more() {
+		arg, _ := a.next()
+		switch strings.ToUpper(arg) {
+		case "NOCONTENT":
+			noContent = true
+		case "VERBATIM", "NOSTOPWORDS", "WITHCOUNT":
+		case "LIMIT":
+			if offset, err = a.int(); err != nil {
+				return err
+			}
+			if limit, err = a.int(); err != nil {
+				return err
+			}
+		case "SORTBY":
+			name, err := a.next()
+			if err != nil {
+				return err
+			}
+			if sortBy = idx.field(strings.TrimPrefix(name, "@")); sortBy == nil || !sortBy.sortable {
+				return fmt.Errorf("Property `%s` not loaded nor in schema", name)
+			}
+			dir, _ := a.accept("ASC", "DESC")
+			desc = dir == "DESC"
+		case "RETURN":
+			n, err := a.int()
+			if err != nil {
+				return err
+			}
+			for range n {
+				name, err := a.next()
+				if err != nil {
+					return err
+				}
+				ret = append(ret, name)
+			}
+		case "DIALECT", "TIMEOUT":
+			if _, err := a.next(); err != nil {
+				return err
+			}
+		default:
+			return errUnsupported(a.command, arg)
+		}
+	}
+
+	var docs []searchDoc
+	for _, d := range r.docs(idx) {
+		if match(d.hash) {
+			docs = append(docs, d)
+		}
+	}
+	if sortBy != nil {
+		sort.SliceStable(docs, func(i, j int) bool {
+			less := compareValues(docs[i].hash[sortBy.name], docs[j].hash[sortBy.name])
+			if desc {
+				return less > 0
+			}
+			return less < 0
+		})
+	}
+	total := len(docs)
+	docs = docs[min(offset, len(docs)):]
+	docs = docs[:min(limit, len(docs))]
+
+	out := []interface{}{total}
+	for _, d := range docs {
+		out = append(out, d.key)
+		if noContent {
+			continue
+		}
+		if ret == nil {
+			out = append(out, flattenHash(d.hash))
+			continue
+		}
+		fields := []interface{}{}
+		for _, name := range ret {
+			hashField := name
+			if f := idx.field(strings.TrimPrefix(name, "@")); f != nil {
+				hashField = f.name
+			}
+			if v, ok := d.hash[hashField]; ok {
+				fields = append(fields, strings.TrimPrefix(name, "@"), v)
+			}
+		}
+		out = append(out, fields)
+	}
+	return out
+}
+
+// compareValues orders two field values as numbers when both are, else as
+// strings; a missing value sorts last.
+func compareValues(a, b string) int {
+	switch {
+	case a == "" && b == "":
+		return 0
+	case a == "":
+		return 1
+	case b == "":
+		return -1
+	}
+	fa, errA := strconv.ParseFloat(a, 64)
+	fb, errB := strconv.ParseFloat(b, 64)
+	if errA == nil && errB == nil {
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(a, b)
+}
+
+// aggRow is a row of the FT.AGGREGATE pipeline. Until GROUPBY it keeps its
+// document, so steps can read fields that were not loaded.
+type aggRow struct {
+	doc    *searchDoc
+	names  []string
+	values map[string]string
+}
+
+func (row *aggRow) get(idx *searchIndex, name string) (string, bool) {
+	name = strings.TrimPrefix(name, "@")
+	if v, ok := row.values[name]; ok {
+		return v, true
+	}
+	if row.doc == nil {
+		return "", false
+	}
+	if name == "__key" {
+		return row.doc.key, true
+	}
+	if f := idx.field(name); f != nil {
+		name = f.name
+	}
+	v, ok := row.doc.hash[name]
+	return v, ok
+}
+
+func (row *aggRow) set(name, value string) {
+	if _, ok := row.values[name]; !ok {
+		row.names = append(row.names, name)
+	}
+	row.values[name] = value
+}
+
+func (row *aggRow) reply() []interface{} {
+	out := make([]interface{}, 0, 2*len(row.names))
+	for _, name := range row.names {
+		out = append(out, name, row.values[name])
+	}
+	return out
+}
+
+type searchCursor struct {
+	index string
+	total int
+	rows  []*aggRow
+}
+
+func cmdFTAggregate(r *Redis, c *redisConn, args []string) interface{} {
+	idx, err := r.index(args[1])
+	if err != nil {
+		return err
+	}
+	match, err := parseQuery(idx, args[2])
+	if err != nil {
+		return err
+	}
+	var rows []*aggRow
+	for _, d := range r.docs(idx) {
+		if match(d.hash) {
+			rows = append(rows, &aggRow{doc: &d, values: map[string]string{}})
+		}
+	}
+
+	withCursor, count := false, 1000
+	a := &argReader{command: "FT.AGGREGATE", args: args, i: 3}
+	for a.more() {
+		arg, _ := a.next()
+		switch strings.ToUpper(arg) {
+		case "VERBATIM":
+		case "LOAD":
+			rows, err = aggLoad(idx, a, rows)
+		case "APPLY":
+			rows, err = aggApply(idx, a, rows)
+		case "GROUPBY":
+			rows, err = aggGroupBy(idx, a, rows)
+		case "SORTBY":
+			rows, err = aggSortBy(idx, a, rows)
+		case "LIMIT":
+			var offset, n int
+			if offset, err = a.int(); err == nil {
+				if n, err = a.int(); err == nil {
+					rows = rows[min(offset, len(rows)):]
+					rows = rows[:min(n, len(rows))]
+				}
+			}
+		case "WITHCURSOR":
+			withCursor = true
+		case "COUNT":
+			count, err = a.int()
+		case "MAXIDLE", "DIALECT", "TIMEOUT":
+			_, err = a.next()
+		default:
+			err = errUnsupported(a.command, arg)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if !withCursor {
+		out := []interface{}{len(rows)}
+		for _, row := range rows {
+			out = append(out, row.reply())
+		}
+		return out
+	}
+	r.nextCursor++
+	r.cursors[r.nextCursor] = &searchCursor{index: idx.name, total: len(rows), rows: rows}
+	return r.readCursor(r.nextCursor, count)
+}
+
+// readCursor returns the next count rows of a cursor as
+// [[total, row...], cursor], where cursor is 0 once the rows run out.
+func (r *Redis) readCursor(id int64, count int) interface{} {
+	cur := r.cursors[id]
+	batch := cur.rows[:min(count, len(cur.rows))]
+	cur.rows = cur.rows[len(batch):]
+	if len(cur.rows) == 0 {
+		delete(r.cursors, id)
+		id = 0
+	}
+	results := []interface{}{cur.total}
+	for _, row := range batch {
+		results = append(results, row.reply())
+	}
+	return []interface{}{results, id}
+}
+
+func cmdFTCursor(r *Redis, c *redisConn, args []string) interface{} {
+	id, err := strconv.ParseInt(args[3], 10, 64)
+	if err != nil {
+		return errNotInt
+	}
+	cur := r.cursors[id]
+	if cur == nil || cur.index != args[2] {
+		return errNoCursor
+	}
+	switch strings.ToUpper(args[1]) {
+	case "READ":
+		count := 1000
+		if len(args) == 6 && strings.EqualFold(args[4], "COUNT") {
+			if count, err = strconv.Atoi(args[5]); err != nil {
+				return errNotInt
+			}
+		}
+		return r.readCursor(id, count)
+	case "DEL":
+		delete(r.cursors, id)
+		return ok
+	}
+	return errUnsupported("FT.CURSOR", args[1])
+}
+
+func aggLoad(idx *searchIndex, a *argReader, rows []*aggRow) ([]*aggRow, error) {
+	arg, err := a.next()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	if arg == "*" {
+		for _, f := range idx.fields {
+			names = append(names, f.alias)
+		}
+	} else {
+		n, err := strconv.Atoi(arg)
+		if err != nil {
+			return nil, errNotInt
+		}
+		for range n {
+			name, err := a.next()
+			if err != nil {
+				return nil, err
+			}
+			names = append(names, strings.TrimPrefix(name, "@"))
+		}
+	}
+	for _, row := range rows {
+		for _, name := range names {
+			if v, ok := row.get(idx, name); ok {
+				row.set(name, v)
+			}
+		}
+	}
+	return rows, nil
+}
+
+func aggApply(idx *searchIndex, a *argReader, rows []*aggRow) ([]*aggRow, error) {
+	expr, err := a.next()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := a.accept("AS"); !ok {
+		return nil, errUnsupported(a.command, "APPLY without AS")
+	}
+	name, err := a.next()
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		v, err := evalExpr(expr, func(field string) (string, bool) { return row.get(idx, field) })
+		if err != nil {
+			return nil, err
+		}
+		row.set(name, formatFloat(v))
+	}
+	return rows, nil
+}
+
+// reducer accumulates one REDUCE over a group.
+type reducer struct {
+	fn, field, as string
+	values        []string
+}
+
+func (rd *reducer) result() (string, error) {
+	if rd.fn == "COUNT" {
+		return strconv.Itoa(len(rd.values)), nil
+	}
+	if rd.fn == "COUNT_DISTINCT" {
+		seen := map[string]bool{}
+		for _, v := range rd.values {
+			seen[v] = true
+		}
+		return strconv.Itoa(len(seen)), nil
+	}
+	nums := make([]float64, 0, len(rd.values))
+	for _, v := range rd.values {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			continue
+		}
+		nums = append(nums, f)
+	}
+	var sum float64
+	for _, f := range nums {
+		sum += f
+	}
+	switch rd.fn {
+	case "SUM":
+		return formatFloat(sum), nil
+	case "AVG":
+		if len(nums) == 0 {
+			return "nan", nil
+		}
+		return formatFloat(sum / float64(len(nums))), nil
+	case "MIN", "MAX":
+		if len(nums) == 0 {
+			return "", nil
+		}
+		m := nums[0]
+		for _, f := range nums[1:] {
+			if rd.fn == "MIN" && f < m || rd.fn == "MAX" && f > m {
+				m = f
+			}
+		}
+		return formatFloat(m), nil
+	case "STDDEV":
+		if len(nums) < 2 {
+			return "0", nil
+		}
+		mean := sum / float64(len(nums))
+		var sq float64
+		for _, f := range nums {
+			sq += (f - mean) * (f - mean)
+		}
+		return formatFloat(math.Sqrt(sq / float64(len(nums)-1))), nil
+	}
+	return "", errUnsupported("FT.AGGREGATE", "REDUCE "+rd.fn)
+}
+
+func aggGroupBy(idx *searchIndex, a *argReader, rows []*aggRow) ([]*aggRow, error) {
+	n, err := a.int()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, n)
+	for i := range keys {
+		if keys[i], err = a.next(); err != nil {
+			return nil, err
+		}
+		keys[i] = strings.TrimPrefix(keys[i], "@")
+	}
+	var specs []reducer
+	for {
+		if _, ok := a.accept("REDUCE"); !ok {
+			break
+		}
+		fn, err := a.next()
+		if err != nil {
+			return nil, err
+		}
+		nargs, err := a.int()
+		if err != nil {
+			return nil, err
+		}
+		rd := reducer{fn: strings.ToUpper(fn)}
+		for i := range nargs {
+			arg, err := a.next()
+			if err != nil {
+				return nil, err
+			}
+			if i == 0 {
+				rd.field = strings.TrimPrefix(arg, "@")
+			}
+		}
+		rd.as = "__generated_alias" + strings.ToLower(rd.fn) + rd.field
+		if _, ok := a.accept("AS"); ok {
+			if rd.as, err = a.next(); err != nil {
+				return nil, err
+			}
+		}
+		specs = append(specs, rd)
+	}
+
+	type group struct {
+		values   []string
+		reducers []reducer
+	}
+	groups := map[string]*group{}
+	var order []string
+	for _, row := range rows {
+		values := make([]string, len(keys))
+		for i, k := range keys {
+			values[i], _ = row.get(idx, k)
+		}
+		id := strings.Join(values, "\x00")
+		g := groups[id]
+		if g == nil {
+			g = &group{values: values, reducers: append([]reducer(nil), specs...)}
+			groups[id] = g
+			order = append(order, id)
+		}
+		for i := range g.reducers {
+			rd := &g.reducers[i]
+			v := ""
+			if rd.field != "" {
+				var ok bool
+				if v, ok = row.get(idx, rd.field); !ok {
+					continue
+				}
+			}
+			rd.values = append(rd.values, v)
+		}
+	}
+
+	out := make([]*aggRow, 0, len(order))
+	for _, id := range order {
+		g := groups[id]
+		row := &aggRow{values: map[string]string{}}
+		for i, k := range keys {
+			row.set(k, g.values[i])
+		}
+		for i := range g.reducers {
+			v, err := g.reducers[i].result()
+			if err != nil {
+				return nil, err
+			}
+			row.set(g.reducers[i].as, v)
+		}
+		out = append(out, row)
+	}
+	return out, nil
+}
+
+func aggSortBy(idx *searchIndex, a *argReader, rows []*aggRow) ([]*aggRow, error) {
+	n, err := a.int()
+	if err != nil {
+		return nil, err
+	}
+	type sortKey struct {
+		name string
+		desc bool
+	}
+	var keys []sortKey
+	for i := 0; i < n; i++ {
+		name, err := a.next()
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(name, "@") {
+			return nil, errSyntax
+		}
+		k := sortKey{name: name}
+		if i+1 < n {
+			if dir, ok := a.accept("ASC", "DESC"); ok {
+				k.desc = dir == "DESC"
+				i++
+			}
+		}
+		keys = append(keys, k)
+	}
+	limit := len(rows)
+	if _, ok := a.accept("MAX"); ok {
+		if limit, err = a.int(); err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		for _, k := range keys {
+			vi, _ := rows[i].get(idx, k.name)
+			vj, _ := rows[j].get(idx, k.name)
+			if c := compareValues(vi, vj); c != 0 {
+				return c < 0 != k.desc
+			}
+		}
+		return false
+	})
+	return rows[:min(limit, len(rows))], nil
+}
@@ -0,0 +1,168 @@
+package testsupport
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Server is a backend process serving SERVER_PORT on a free loopback port,
+// with a Redis double of its own. The backend is a main package, so it is
+// run as a binary from BuildServer rather than in the test process.
+type Server struct {
+	// Redis is the server's Redis; seed or inspect it directly.
+	Redis *Redis
+	// URL is the HTTP base URL, e.g. http://127.0.0.1:40123.
+	URL string
+
+	cmd    *exec.Cmd
+	logs   *syncBuffer
+	exited chan struct{}
+}
+
+// BuildServer compiles the backend package in dir (the directory holding
+// main.go) into a temporary directory and returns the binary's path.
+// Remove filepath.Dir of it when done.
+func BuildServer(dir string) (string, error) {
+	tmp, err := os.MkdirTemp("", "backend-test-")
+	if err != nil {
+		return "", err
+	}
+	bin := filepath.Join(tmp, "backend")
+	cmd := exec.Command("go", "build", "-o", bin, ".")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.RemoveAll(tmp)
+		return "", fmt.Errorf("go build: %w\n%s", err, out)
+	}
+	return bin, nil
+}
+
+// StartServer runs binary against a new Redis double with env (KEY=value
+// settings, on top of an empty environment and DRAIN_TIMEOUT=2s) and waits
+// until /healthz answers. REDIS_ADDR and SERVER_PORT are set by the harness;
+// LISTENERS is not supported, since URL points at SERVER_PORT.
+func StartServer(binary string, env ...string) (*Server, error) {
+	r, err := NewRedis()
+	if err != nil {
+		return nil, err
+	}
+	port, err := freePort()
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+
+	s := &Server{Redis: r, URL: "http://" + addr, logs: &syncBuffer{}, exited: make(chan struct{})}
+	s.cmd = exec.Command(binary)
+	s.cmd.Env = append([]string{"PATH=" + os.Getenv("PATH"), "HOME=" + os.Getenv("HOME"), "DRAIN_TIMEOUT=2s"}, env...)
+	s.cmd.Env = append(s.cmd.Env, "REDIS_ADDR="+r.Addr(), "SERVER_PORT="+addr, "LISTENERS=")
+	s.cmd.Stdout = s.logs
+	s.cmd.Stderr = s.logs
+	if err := s.cmd.Start(); err != nil {
+		r.Close()
+		return nil, err
+	}
+	go func() {
+		s.cmd.Wait()
+		close(s.exited)
+	}()
+
+	if err := s.waitHealthy(15 * time.Second); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("%w\n%s", err, s.Logs())
+	}
+	return s, nil
+}
+
+// freePort returns a loopback port that was free a moment ago; another
+// process can take it before the server listens, which StartServer reports
+// as a failed start.
+func freePort() (int, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port, nil
+}
+
+func (s *Server) waitHealthy(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	client := &http.Client{Timeout: time.Second}
+	for time.Now().Before(deadline) {
+		select {
+		case <-s.exited:
+			return errors.New("server exited during startup")
+		default:
+		}
+		resp, err := client.Get(s.URL + "/healthz")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return fmt.Errorf("server not healthy within %s", timeout)
+}
+
+// WSURL is the ws:// URL of path, which may carry a query, e.g.
+// "/ws?batch=1&fields=src,dest".
+func (s *Server) WSURL(path string) string {
+	return "ws" + strings.TrimPrefix(s.URL, "http") + path
+}
+
+// Logs returns the server's output so far.
+func (s *Server) Logs() string {
+	return s.logs.String()
+}
+
+// Close stops the server with SIGTERM, which drains it for DRAIN_TIMEOUT,
+// kills it if it is still running 10s later, then closes its Redis.
+func (s *Server) Close() error {
+	var err error
+	select {
+	case <-s.exited:
+	default:
+		s.cmd.Process.Signal(syscall.SIGTERM)
+		select {
+		case <-s.exited:
+		case <-time.After(10 * time.Second):
+			s.cmd.Process.Kill()
+			<-s.exited
+			err = errors.New("server did not exit after SIGTERM; killed")
+		}
+	}
+	s.Redis.Close()
+	return err
+}
+
+// syncBuffer is a bytes.Buffer the process writes to while tests read it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
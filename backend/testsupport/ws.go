@@ -0,0 +1,205 @@
+package testsupport
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Frame is a decoded JSON frame from /ws.
+type Frame map[string]interface{}
+
+// Type is the frame's "type" field.
+func (f Frame) Type() string {
+	s, _ := f["type"].(string)
+	return s
+}
+
+// Seq is the frame's "seq" field, or 0.
+func (f Frame) Seq() uint64 {
+	n, _ := f["seq"].(float64)
+	return uint64(n)
+}
+
+// WSClient is a /ws client for tests. A goroutine reads every message, so
+// the server is never blocked on it; JSON frames are queued in order, with
+// batch=1 arrays split into their frames.
+type WSClient struct {
+	Conn *websocket.Conn
+
+	received atomic.Int64
+
+	mu     sync.Mutex
+	frames []Frame
+	// err is the read error that ended the connection.
+	err error
+	// arrived is signalled when frames or err change.
+	arrived chan struct{}
+
+	writeMu sync.Mutex
+}
+
+// DialWS connects to a ws:// URL, such as Server.WSURL returns.
+func DialWS(url string, header http.Header) (*WSClient, error) {
+	conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("dial %s: %w (HTTP %d)", url, err, resp.StatusCode)
+		}
+		return nil, fmt.Errorf("dial %s: %w", url, err)
+	}
+	c := &WSClient{Conn: conn, arrived: make(chan struct{}, 1)}
+	go c.readLoop()
+	return c, nil
+}
+
+func (c *WSClient) readLoop() {
+	for {
+		_, msg, err := c.Conn.ReadMessage()
+		if err != nil {
+			c.push(nil, err)
+			return
+		}
+		c.received.Add(int64(len(msg)))
+		var batch []Frame
+		if len(msg) > 0 && msg[0] == '[' {
+			err = json.Unmarshal(msg, &batch)
+		} else {
+			var f Frame
+			err = json.Unmarshal(msg, &f)
+			batch = []Frame{f}
+		}
+		if err != nil {
+			c.push(nil, fmt.Errorf("decode frame %q: %w", msg, err))
+			return
+		}
+		c.push(batch, nil)
+	}
+}
+
+func (c *WSClient) push(frames []Frame, err error) {
+	c.mu.Lock()
+	c.frames = append(c.frames, frames...)
+	if err != nil {
+		c.err = err
+	}
+	c.mu.Unlock()
+	select {
+	case c.arrived <- struct{}{}:
+	default:
+	}
+}
+
+// Send writes v as a JSON message, such as a subscribe or replay command.
+func (c *WSClient) Send(v interface{}) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.Conn.WriteJSON(v)
+}
+
+// Received is the number of message bytes read so far, as ack counts them.
+func (c *WSClient) Received() int64 {
+	return c.received.Load()
+}
+
+// Ack reports the bytes received so far, for clients connected with ack=1.
+func (c *WSClient) Ack() error {
+	return c.Send(map[string]interface{}{"cmd": "ack", "bytes": c.Received()})
+}
+
+// errClosed is wrapped in the errors Next returns once the connection has
+// ended and its frames are drained.
+var errClosed = errors.New("connection closed")
+
+// Next returns the next frame, waiting up to timeout.
+func (c *WSClient) Next(timeout time.Duration) (Frame, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		c.mu.Lock()
+		if len(c.frames) > 0 {
+			f := c.frames[0]
+			c.frames = c.frames[1:]
+			c.mu.Unlock()
+			return f, nil
+		}
+		err := c.err
+		c.mu.Unlock()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errClosed, err)
+		}
+		select {
+		case <-c.arrived:
+		case <-timer.C:
+			return nil, fmt.Errorf("no frame within %s", timeout)
+		}
+	}
+}
+
+// ExpectMatch returns the first frame match accepts, skipping the others,
+// waiting up to timeout in all.
+func (c *WSClient) ExpectMatch(what string, timeout time.Duration, match func(Frame) bool) (Frame, error) {
+	deadline := time.Now().Add(timeout)
+	var skipped []string
+	for {
+		f, err := c.Next(time.Until(deadline))
+		if err != nil {
+			return nil, fmt.Errorf("waiting for %s (skipped: %s): %w", what, strings.Join(skipped, ", "), err)
+		}
+		if match(f) {
+			return f, nil
+		}
+		skipped = append(skipped, f.Type())
+	}
+}
+
+// Expect returns the first frame of type typ, skipping frames of other
+// types, such as heartbeats and updates, for up to timeout.
+func (c *WSClient) Expect(typ string, timeout time.Duration) (Frame, error) {
+	return c.ExpectMatch(typ+" frame", timeout, func(f Frame) bool { return f.Type() == typ })
+}
+
+// ExpectNone returns an error if a frame of type typ arrives within d.
+func (c *WSClient) ExpectNone(typ string, d time.Duration) error {
+	f, err := c.Expect(typ, d)
+	if err == nil {
+		return fmt.Errorf("unexpected %s frame: %v", typ, f)
+	}
+	if errors.Is(err, errClosed) {
+		return err
+	}
+	return nil
+}
+
+// ExpectClose waits up to timeout for the server to close the connection,
+// skipping frames, and checks the close code.
+func (c *WSClient) ExpectClose(code int, timeout time.Duration) error {
+	_, err := c.ExpectMatch("close", timeout, func(Frame) bool { return false })
+	if !errors.Is(err, errClosed) {
+		return err
+	}
+	var ce *websocket.CloseError
+	if !errors.As(err, &ce) {
+		return fmt.Errorf("connection ended without a close frame: %v", err)
+	}
+	if ce.Code != code {
+		return fmt.Errorf("close code %d (%q), want %d", ce.Code, ce.Text, code)
+	}
+	return nil
+}
+
+// Close sends a normal close frame and closes the connection.
+func (c *WSClient) Close() error {
+	c.writeMu.Lock()
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	_ = c.Conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	c.writeMu.Unlock()
+	return c.Conn.Close()
+}
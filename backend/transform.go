@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// A transform changes packets in the pipeline's transform stage. TRANSFORMS
+// lists them, separated by ";", and they run in that order:
+//
+//	derive bits_per_packet = total_bytes * 8 / total_packets
+//	set total_bytes = total_bytes / 1024
+//	strip annotation
+//
+// derive stores a number under Packet.Derived, which edge summaries carry to
+// clients; set assigns a packet field; strip clears one. Expressions are
+// filter expressions evaluated against the packet as it is at that step.
+type transform struct {
+	source string
+	derive bool
+	apply  func(p *Packet, r *filterRecord)
+}
+
+// transformField is a packet field set or strip can change. Source and
+// destination addresses and the tenant key the view and are not offered.
+type transformField struct {
+	num   func(p *Packet, v float64)
+	str   func(p *Packet, v string)
+	strip func(p *Packet)
+}
+
+// transformFields maps packet field names to their setters.
+var transformFields = func() map[string]transformField {
+	num := func(f func(p *Packet) *int) transformField {
+		return transformField{
+			num:   func(p *Packet, v float64) { *f(p) = int(math.Round(v)) },
+			strip: func(p *Packet) { *f(p) = 0 },
+		}
+	}
+	str := func(f func(p *Packet) *string) transformField {
+		return transformField{
+			str:   func(p *Packet, v string) { *f(p) = v },
+			strip: func(p *Packet) { *f(p) = "" },
+		}
+	}
+	return map[string]transformField{
+		"timestamp":   num(func(p *Packet) *int { return &p.Timestamp }),
+		"seq":         num(func(p *Packet) *int { return &p.Seq }),
+		"node_id":     num(func(p *Packet) *int { return &p.NodeID }),
+		"total_bytes": num(func(p *Packet) *int { return &p.TotalBytes }),
+		"src_port":    num(func(p *Packet) *int { return &p.SrcPort }),
+		"dst_port":    num(func(p *Packet) *int { return &p.DstPort }),
+		"protocol":    str(func(p *Packet) *string { return &p.Protocol }),
+		"location":    str(func(p *Packet) *string { return &p.Location }),
+		"annotation":  str(func(p *Packet) *string { return &p.Annotation }),
+		"tags":        {strip: func(p *Packet) { p.Tags = nil }},
+		"derived":     {strip: func(p *Packet) { p.Derived = nil }},
+	}
+}()
+
+// transforms are the TRANSFORMS steps, in order.
+var transforms []transform
+
+// initTransforms parses TRANSFORMS.
+func initTransforms(cfg *Config) error {
+	for _, entry := range strings.Split(cfg.Transforms, ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		t, err := compileTransform(entry)
+		if err != nil {
+			return fmt.Errorf("%q: %w", entry, err)
+		}
+		transforms = append(transforms, t)
+		infoLog("Transform: %s", entry)
+	}
+	return nil
+}
+
+// compileTransform parses one step: "derive name = expr", "set field =
+// expr", or "strip field".
+func compileTransform(source string) (transform, error) {
+	verb, rest, _ := strings.Cut(source, " ")
+	rest = strings.TrimSpace(rest)
+
+	if verb == "strip" {
+		field, ok := transformFields[rest]
+		if !ok {
+			return transform{}, fmt.Errorf("cannot strip %q (fields: %s)", rest, transformFieldNames(true))
+		}
+		return transform{source: source, apply: func(p *Packet, _ *filterRecord) { field.strip(p) }}, nil
+	}
+	if verb != "derive" && verb != "set" {
+		return transform{}, fmt.Errorf("unknown step %q (use derive, set, or strip)", verb)
+	}
+
+	name, exprSource, ok := strings.Cut(rest, "=")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return transform{}, fmt.Errorf("want %s name = expr", verb)
+	}
+	expr, err := compileExpr(exprSource, true)
+	if err != nil {
+		return transform{}, err
+	}
+
+	if verb == "derive" {
+		if !validDerivedName(name) {
+			return transform{}, fmt.Errorf("invalid derived field name %q (letters, digits, and _)", name)
+		}
+		if expr.kind != kindNum {
+			return transform{}, fmt.Errorf("derive needs a number, not a %s", expr.kind)
+		}
+		value := expr.num
+		return transform{source: source, derive: true, apply: func(p *Packet, r *filterRecord) {
+			v := value(r)
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				// Leave the field out rather than send a value JSON cannot hold.
+				delete(p.Derived, name)
+				return
+			}
+			if p.Derived == nil {
+				p.Derived = make(map[string]float64)
+			}
+			p.Derived[name] = v
+		}}, nil
+	}
+
+	field, ok := transformFields[name]
+	switch {
+	case !ok || field.num == nil && field.str == nil:
+		return transform{}, fmt.Errorf("cannot set %q (fields: %s)", name, transformFieldNames(false))
+	case field.num != nil && expr.kind != kindNum:
+		return transform{}, fmt.Errorf("%s needs a number, not a %s", name, expr.kind)
+	case field.str != nil && expr.kind != kindStr:
+		return transform{}, fmt.Errorf("%s needs a string, not a %s", name, expr.kind)
+	}
+	if field.num != nil {
+		value := expr.num
+		return transform{source: source, apply: func(p *Packet, r *filterRecord) {
+			if v := value(r); !math.IsNaN(v) && !math.IsInf(v, 0) {
+				field.num(p, v)
+			}
+		}}, nil
+	}
+	value := expr.str
+	return transform{source: source, apply: func(p *Packet, r *filterRecord) { field.str(p, value(r)) }}, nil
+}
+
+func validDerivedName(name string) bool {
+	for i, c := range name {
+		if c != '_' && !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || i > 0 && '0' <= c && c <= '9') {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// transformFieldNames lists the fields set (or, with strip, strip) takes.
+func transformFieldNames(strip bool) string {
+	var names []string
+	for name, f := range transformFields {
+		if strip || f.num != nil || f.str != nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// transformProcessor runs TRANSFORMS. It works on a copy, so the packets
+// passed in, which /ingest also stores, are left as producers sent them.
+type transformProcessor struct{}
+
+func (transformProcessor) Name() string        { return "transform" }
+func (transformProcessor) Stage() processStage { return stageTransform }
+func (transformProcessor) Process(_ *Server, packets []Packet) []Packet {
+	return transformPackets(packets)
+}
+
+// Preview leaves packets untransformed: /ingest stores what producers sent,
+// and the poller transforms the stored packets when it reads them back.
+func (transformProcessor) Preview(packets []Packet) []Packet { return packets }
+
+// transformPackets returns transformed copies of packets.
+func transformPackets(packets []Packet) []Packet {
+	if len(transforms) == 0 {
+		return packets
+	}
+	out := make([]Packet, len(packets))
+	for i := range packets {
+		p := &out[i]
+		*p = packets[i]
+		if p.Derived != nil {
+			derived := make(map[string]float64, len(p.Derived))
+			for k, v := range p.Derived {
+				derived[k] = v
+			}
+			p.Derived = derived
+		}
+		for _, t := range transforms {
+			t.apply(p, &filterRecord{summary: generateEdgeSummary(*p), packet: p})
+		}
+	}
+	return out
+}
+
+// rederive recomputes the derived values of a packet whose counters were
+// summed from several (UPDATE_STRATEGY accumulate or merge-by-packet-id), so
+// they describe the sum rather than the last packet added.
+func rederive(p Packet) Packet {
+	if len(transforms) == 0 {
+		return p
+	}
+	p.Derived = nil
+	for _, t := range transforms {
+		if t.derive {
+			t.apply(&p, &filterRecord{summary: generateEdgeSummary(p), packet: &p})
+		}
+	}
+	return p
+}
@@ -1,35 +1,101 @@
 // Package main implements a real-time traffic data server.
 package main
 
-// Packet represents a network packet with arbitrary fields.
+import "time"
+
+// Packet represents a network packet with arbitrary fields. Numeric fields
+// with a unit carry it in a unit tag, which /schema reports.
 type Packet struct {
 	Key string `json:"_key"`
 
-	Timestamp  int    `json:"timestamp"`
+	// Tenant is the experiment the packet belongs to (TENANTS); empty when
+	// tenants are not configured.
+	Tenant string `json:"tenant,omitempty"`
+
+	Timestamp  int    `json:"timestamp" unit:"s"`
 	Seq        int    `json:"seq"`
 	NodeID     int    `json:"node_id"`
 	Src        string `json:"source_ip"`
 	Dest       string `json:"dest_ip"`
-	TotalBytes int    `json:"total_bytes"`
+	TotalBytes int    `json:"total_bytes" unit:"bytes"`
+
+	// SrcPort, DstPort, and Protocol ("tcp", "udp", ...) are set only by
+	// producers that report single flows; simulator output leaves them empty.
+	SrcPort  int    `json:"src_port,omitempty"`
+	DstPort  int    `json:"dst_port,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+
+	// Location is the source's "lon,lat" from GeoIP enrichment (GEOIP_FILE).
+	Location string `json:"location,omitempty"`
 
-	UDPPackets []int `json:"udp_packets"`
-	UDPBytes   []int `json:"udp_bytes"`
-	TCPPackets []int `json:"tcp_packets"`
-	TCPBytes   []int `json:"tcp_bytes"`
+	// Annotation and Tags are free text a producer may attach, e.g. "sync"
+	// or "retransmit"; both are full-text indexed.
+	Annotation string   `json:"annotation,omitempty"`
+	Tags       []string `json:"tags,omitempty"`
+
+	UDPPackets []int `json:"udp_packets" unit:"packets"`
+	UDPBytes   []int `json:"udp_bytes" unit:"bytes"`
+	TCPPackets []int `json:"tcp_packets" unit:"packets"`
+	TCPBytes   []int `json:"tcp_bytes" unit:"bytes"`
+
+	// Derived holds the values of TRANSFORMS derive steps by name. It is
+	// set by the pipeline, not by producers, and never stored to Redis.
+	Derived map[string]float64 `json:"derived,omitempty"`
 }
 
 // PacketSummary is the compact edge payload sent to the frontend.
 type PacketSummary struct {
+	Tenant    string `json:"tenant,omitempty"`
 	Src       string `json:"src"`
 	Dest      string `json:"dest"`
-	Timestamp int    `json:"timestamp"`
+	Timestamp int    `json:"timestamp" unit:"s"`
+
+	TCPPacketsTotal int `json:"tcp_packets_total" unit:"packets"`
+	TCPBytesTotal   int `json:"tcp_bytes_total" unit:"bytes"`
+
+	UDPPacketsTotal int `json:"udp_packets_total" unit:"packets"`
+	UDPBytesTotal   int `json:"udp_bytes_total" unit:"bytes"`
 
-	TCPPacketsTotal int `json:"tcp_packets_total"`
-	TCPBytesTotal   int `json:"tcp_bytes_total"`
+	TotalPackets int `json:"total_packets" unit:"packets"`
+	TotalBytes   int `json:"total_bytes" unit:"bytes"`
 
-	UDPPacketsTotal int `json:"udp_packets_total"`
-	UDPBytesTotal   int `json:"udp_bytes_total"`
+	// Derived is the packet's TRANSFORMS derived values.
+	Derived map[string]float64 `json:"derived,omitempty"`
+}
+
+// ClientInfo describes a connected WebSocket client for /admin/clients.
+type ClientInfo struct {
+	ID          uint64    `json:"id"`
+	RemoteAddr  string    `json:"remote_addr"`
+	ConnectedAt time.Time `json:"connected_at"`
+	RequestID   string    `json:"request_id,omitempty"`
+
+	Proto    int      `json:"proto"`
+	Features []string `json:"features,omitempty"`
+	Format   string   `json:"format"`
+	Tenant   string   `json:"tenant,omitempty"`
+	QoS      string   `json:"qos"`
+
+	Batch   bool     `json:"batch"`
+	AckMode bool     `json:"ack"`
+	Alerts  bool     `json:"alerts"`
+	Status  bool     `json:"status"`
+	Session bool     `json:"session"`
+	Fields  []string `json:"fields,omitempty"`
+	Filter  string   `json:"filter,omitempty"`
+
+	Queued    int   `json:"queued"`
+	BytesSent int64 `json:"bytes_sent"`
+	Unacked   int64 `json:"unacked_bytes,omitempty"`
+
+	Replaying bool `json:"replaying,omitempty"`
+	Paused    bool `json:"paused,omitempty"`
+}
 
-	TotalPackets int `json:"total_packets"`
-	TotalBytes   int `json:"total_bytes"`
+// ErrorResponse is the body of every error response: a code clients can
+// switch on, a message for people, and the request's X-Request-ID.
+type ErrorResponse struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
 }
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// EJFAT load-balancer header layouts (network byte order).
+//
+//	LB data header (16 bytes): 'L' 'B' version protocol reserved(2) entropy(2) event(8)
+//	LC sync header (28 bytes): 'L' 'C' version protocol srcId(4) event(8) avgRateHz(4) unixTimeNano(8)
+const (
+	lbHeaderSize   = 16
+	syncHeaderSize = 28
+	udpReadBuffer  = 65535
+)
+
+// udpSender tracks one source IP. Counters reset at every flush; the source
+// ID from its sync packets is kept until the sender goes quiet.
+type udpSender struct {
+	packets int
+	bytes   int
+	srcID   int
+	event   int
+	active  bool
+}
+
+// udpInput listens for EJFAT LB data and sync packets and turns per-sender
+// datagram counts into traffic packets every flush interval.
+type udpInput struct {
+	srv      *Server
+	conn     *net.UDPConn
+	dest     string
+	interval time.Duration
+
+	mu      sync.Mutex
+	senders map[string]*udpSender
+	invalid int
+
+	channel *ingestChannel
+}
+
+func (s *Server) initUDPInput(ctx context.Context) error {
+	if s.config.UDPListen == "" {
+		return nil
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", s.config.UDPListen)
+	if err != nil {
+		return fmt.Errorf("%q: %w", s.config.UDPListen, err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return fmt.Errorf("listen on %s: %w", s.config.UDPListen, err)
+	}
+
+	dest := s.config.UDPDest
+	if dest == "" {
+		ip := conn.LocalAddr().(*net.UDPAddr).IP
+		dest = ip.String()
+		if ip.IsUnspecified() {
+			dest, _ = os.Hostname()
+		}
+	}
+
+	in := &udpInput{
+		srv:      s,
+		conn:     conn,
+		dest:     dest,
+		interval: s.config.UDPFlushInterval,
+		senders:  make(map[string]*udpSender),
+		channel:  channelFor("udp"),
+	}
+	go in.read(ctx)
+	go in.flushLoop(ctx)
+	infoLog("UDP input listening on %s for EJFAT LB/sync packets (dest=%s)", conn.LocalAddr(), dest)
+	return nil
+}
+
+func (in *udpInput) read(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		in.conn.Close()
+	}()
+
+	buf := make([]byte, udpReadBuffer)
+	for {
+		n, from, err := in.conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				errorLog("UDP input read: %v", err)
+			}
+			return
+		}
+		in.channel.message(n)
+		in.record(from.IP.String(), buf[:n])
+	}
+}
+
+// record parses one datagram and adds it to its sender's counters.
+func (in *udpInput) record(src string, datagram []byte) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	if len(datagram) < 2 || datagram[0] != 'L' {
+		in.invalid++
+		return
+	}
+
+	s := in.senders[src]
+	if s == nil {
+		s = &udpSender{}
+		in.senders[src] = s
+	}
+
+	s.active = true
+	switch datagram[1] {
+	case 'B':
+		if len(datagram) < lbHeaderSize {
+			in.invalid++
+			return
+		}
+		s.packets++
+		s.bytes += len(datagram)
+		s.event = int(binary.BigEndian.Uint64(datagram[8:16]))
+	case 'C':
+		if len(datagram) < syncHeaderSize {
+			in.invalid++
+			return
+		}
+		s.srcID = int(binary.BigEndian.Uint32(datagram[4:8]))
+		s.event = int(binary.BigEndian.Uint64(datagram[8:16]))
+	default:
+		in.invalid++
+	}
+}
+
+func (in *udpInput) flushLoop(ctx context.Context) {
+	ticker := time.NewTicker(in.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			in.flush(now)
+		}
+	}
+}
+
+// flush converts the accumulated counters into packets and ingests them.
+func (in *udpInput) flush(now time.Time) {
+	in.mu.Lock()
+	var packets []Packet
+	for src, s := range in.senders {
+		if !s.active {
+			delete(in.senders, src)
+			continue
+		}
+		if s.packets > 0 {
+			packets = append(packets, Packet{
+				Key:        fmt.Sprintf("udp:%s:%s:%d", in.dest, src, now.UnixNano()),
+				Timestamp:  int(now.Unix()),
+				Seq:        s.event,
+				NodeID:     s.srcID,
+				Src:        src,
+				Dest:       in.dest,
+				TotalBytes: s.bytes,
+				UDPPackets: []int{s.packets},
+				UDPBytes:   []int{s.bytes},
+			})
+		}
+		s.packets, s.bytes, s.active = 0, 0, false
+	}
+	invalid := in.invalid
+	in.invalid = 0
+	in.mu.Unlock()
+
+	if invalid > 0 {
+		debugLog("UDP input: ignored %d non-EJFAT datagrams", invalid)
+		in.channel.decodeErrors.Add(int64(invalid))
+	}
+	in.channel.decoded(len(packets))
+	in.srv.ingestPackets("udp", packets)
+}
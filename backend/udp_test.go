@@ -0,0 +1,23 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestInitUDPInputFails(t *testing.T) {
+	taken, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	for _, addr := range []string{"127.0.0.1:notaport", taken.LocalAddr().String()} {
+		s := newServer(loadConfig())
+		s.config.UDPListen = addr
+		if err := s.initUDPInput(context.Background()); err == nil {
+			t.Errorf("UDP_LISTEN=%s was accepted", addr)
+		}
+	}
+}
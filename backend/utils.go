@@ -1,7 +1,38 @@
 // Package main implements a real-time traffic data server.
 package main
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// seenSet remembers document keys with their packet timestamps, so packets
+// polled again within the lookback window are only handled once. prune
+// forgets the keys older than the window. It is not safe for concurrent use.
+type seenSet map[string]int
+
+// add remembers key, of a packet stamped ts, and reports whether it was new.
+func (s seenSet) add(key string, ts int) bool {
+	if _, ok := s[key]; ok {
+		return false
+	}
+	s[key] = ts
+	return true
+}
+
+// prune forgets the keys of packets stamped before cutoff, which no poll
+// returns again.
+func (s seenSet) prune(cutoff int) {
+	for key, ts := range s {
+		if ts < cutoff {
+			delete(s, key)
+		}
+	}
+}
 
 // parseIntField attempts to parse a value as an integer, returning (value, ok).
 func parseIntField(v interface{}) (int, bool) {
@@ -26,6 +57,92 @@ func pairKey(src, dest string) string {
 	return fmt.Sprintf("%s:%s", src, dest)
 }
 
+// clientIP returns the IP address of the client that sent r: the peer, or
+// the client a trusted proxy (TRUSTED_PROXIES) forwarded the request for.
+func clientIP(r *http.Request) string {
+	ip, _ := resolveClient(r)
+	return ip
+}
+
+// remoteAddr is the client's address for logs and /admin/clients: the
+// peer's host:port, or the forwarded client IP behind a trusted proxy.
+func remoteAddr(r *http.Request) string {
+	if ip, forwarded := resolveClient(r); forwarded {
+		return ip
+	}
+	return r.RemoteAddr
+}
+
+func resolveClient(r *http.Request) (ip string, forwarded bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	trusted := trustedProxy(host)
+	if la, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok && la.Network() == "unix" {
+		trusted = trustUnixPeers
+	}
+	if trusted {
+		if fwd, ok := forwardedClient(r); ok {
+			return fwd, true
+		}
+	}
+	return host, false
+}
+
+// unixSocketMode lets the socket's group, e.g. a co-located reverse proxy,
+// connect to a unix socket listener.
+const unixSocketMode = 0o660
+
+// listenHTTP opens the HTTP listener for addr: a TCP address such as ":8080",
+// with SO_REUSEPORT when REUSE_PORT is set, or "unix://<path>" for a unix
+// domain socket. A socket left at path by an earlier run, or still served by
+// a process that is draining, is replaced; any other file there is an error.
+func listenHTTP(cfg *Config, addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix://")
+	if !ok {
+		var lc net.ListenConfig
+		if cfg.ReusePort {
+			lc.Control = reusePort
+		}
+		return lc.Listen(context.Background(), "tcp", addr)
+	}
+	if path == "" {
+		return nil, fmt.Errorf("no socket path in %q", addr)
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// The path may belong to the process that replaced this one by the
+	// time this listener closes.
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(path, unixSocketMode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// splitList splits a comma-separated setting, dropping blanks.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func Sum(nums []int) int {
 	sum := 0
 	for _, v := range nums {
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestSeenSetPrunesByTimestamp(t *testing.T) {
+	s := make(seenSet)
+	if !s.add("old", 100) || s.add("old", 100) {
+		t.Fatal("add should report a key as new only the first time")
+	}
+	for i := 0; i < 20000; i++ {
+		s.add(strconv.Itoa(i), 105)
+	}
+	// Re-polled documents stay counted however many keys arrived since.
+	if s.add("old", 100) {
+		t.Fatal("a key inside the window was forgotten")
+	}
+
+	s.prune(101)
+	if !s.add("old", 100) {
+		t.Fatal("prune should forget keys stamped before the cutoff")
+	}
+	if len(s) != 20001 {
+		t.Fatalf("after prune: %d keys, want the 20000 newer ones and old", len(s))
+	}
+}
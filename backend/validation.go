@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// schemaRecent is how many rejected payloads /admin/validation keeps.
+	schemaRecent = 100
+
+	// schemaSampleBytes truncates each kept payload.
+	schemaSampleBytes = 1024
+
+	// schemaLogInterval limits rejection warnings to one summary line per
+	// interval.
+	schemaLogInterval = 10 * time.Second
+)
+
+// ingestSchema is the JSON Schema every packet must match (PACKET_SCHEMA_FILE);
+// nil accepts everything decodable.
+var ingestSchema *jsonSchema
+
+func initPacketSchema(cfg *Config) error {
+	if cfg.PacketSchemaFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(cfg.PacketSchemaFile)
+	if err != nil {
+		return err
+	}
+	s, err := compileJSONSchema(data)
+	if err != nil {
+		return err
+	}
+	ingestSchema = s
+	infoLog("Validating packets against %s", cfg.PacketSchemaFile)
+	return nil
+}
+
+// schemaError is a payload that does not match PACKET_SCHEMA_FILE. Sample is
+// the offending packet as sent, truncated to schemaSampleBytes.
+type schemaError struct {
+	// Index is the packet's position in an array message, -1 for a single
+	// packet.
+	Index  int
+	Err    error
+	Sample string
+}
+
+func (e *schemaError) Error() string {
+	if e.Index < 0 {
+		return fmt.Sprintf("packet does not match schema: %v", e.Err)
+	}
+	return fmt.Sprintf("packet %d does not match schema: %v", e.Index, e.Err)
+}
+
+func (e *schemaError) Unwrap() error { return e.Err }
+
+// checkPayloadSchema validates a traffic message (one packet object or an
+// array of them) as the producer sent it. A message with any invalid packet
+// is rejected as a whole with a *schemaError; one that is not JSON gets a
+// plain error.
+func checkPayloadSchema(payload []byte) error {
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return err
+	}
+	if arr, ok := doc.([]interface{}); ok {
+		for i, p := range arr {
+			if err := ingestSchema.validate(p); err != nil {
+				return &schemaError{Index: i, Err: err, Sample: schemaSample(p)}
+			}
+		}
+		return nil
+	}
+	if err := ingestSchema.validate(doc); err != nil {
+		return &schemaError{Index: -1, Err: err, Sample: schemaSample(doc)}
+	}
+	return nil
+}
+
+// checkPacketSchema validates a packet the server decoded itself (a Redis
+// hash, a gRPC message) in its traffic message form. The server-assigned
+// _key is left out.
+func checkPacketSchema(p Packet) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	var doc map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return err
+	}
+	delete(doc, "_key")
+	if err := ingestSchema.validate(doc); err != nil {
+		return &schemaError{Index: -1, Err: err, Sample: schemaSample(doc)}
+	}
+	return nil
+}
+
+// acceptPacketSchema reports whether p matches PACKET_SCHEMA_FILE, recording
+// a rejection against ch when it does not.
+func acceptPacketSchema(ch *ingestChannel, p Packet) bool {
+	if ingestSchema == nil {
+		return true
+	}
+	err := checkPacketSchema(p)
+	if err == nil {
+		return true
+	}
+	se, ok := err.(*schemaError)
+	if !ok {
+		se = &schemaError{Index: -1, Err: err}
+	}
+	recordSchemaRejection(ch, p.Key, p.Timestamp, se)
+	return false
+}
+
+func schemaSample(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	if len(data) > schemaSampleBytes {
+		return string(data[:schemaSampleBytes]) + "..."
+	}
+	return string(data)
+}
+
+// schemaRejection is a rejected payload in /admin/validation.
+type schemaRejection struct {
+	Channel string    `json:"channel"`
+	Key     string    `json:"key,omitempty"`
+	Error   string    `json:"error"`
+	Payload string    `json:"payload"`
+	SeenAt  time.Time `json:"seen_at"`
+}
+
+var (
+	schemaMu      sync.Mutex
+	schemaLatest  []schemaRejection
+	schemaLogged  time.Time
+	schemaPending int
+
+	// schemaSeen holds the keys already counted, pruned to the poll window
+	// behind schemaNewest, the newest packet timestamp it has seen. It is
+	// process-wide: decoding runs before packets reach a Server.
+	schemaSeen   = make(seenSet)
+	schemaNewest int
+)
+
+// recordSchemaRejection counts a rejected payload against ch and keeps a
+// sample. A key already counted (a Redis document polled again) is skipped;
+// ts is the packet's timestamp.
+func recordSchemaRejection(ch *ingestChannel, key string, ts int, err *schemaError) {
+	schemaMu.Lock()
+	defer schemaMu.Unlock()
+
+	if key != "" {
+		if !schemaSeen.add(key, ts) {
+			return
+		}
+		if ts > schemaNewest {
+			schemaNewest = ts
+			schemaSeen.prune(ts - safetyWindow)
+		}
+	}
+	ch.schemaRejections.Add(1)
+
+	now := time.Now()
+	schemaLatest = append(schemaLatest, schemaRejection{
+		Channel: ch.name,
+		Key:     key,
+		Error:   err.Error(),
+		Payload: err.Sample,
+		SeenAt:  now,
+	})
+	if len(schemaLatest) > schemaRecent {
+		schemaLatest = schemaLatest[len(schemaLatest)-schemaRecent:]
+	}
+
+	schemaPending++
+	if now.Sub(schemaLogged) >= schemaLogInterval {
+		errorLog("Schema validation: %d payloads rejected (latest on %s: %v)", schemaPending, ch.name, err)
+		schemaLogged = now
+		schemaPending = 0
+	}
+}
+
+// handleAdminValidation reports schema rejections per channel and the latest
+// rejected payloads.
+func (s *Server) handleAdminValidation(w http.ResponseWriter, r *http.Request) {
+	if ingestSchema == nil {
+		writeError(w, notFound.errorf("Schema validation is not enabled (set PACKET_SCHEMA_FILE)"))
+		return
+	}
+
+	rejected := make(map[string]int64)
+	for _, ch := range listChannels() {
+		if n := *ch.SchemaRejections; n > 0 {
+			rejected[ch.Channel] = n
+		}
+	}
+
+	schemaMu.Lock()
+	recent := make([]schemaRejection, len(schemaLatest))
+	for i, e := range schemaLatest {
+		recent[len(recent)-1-i] = e
+	}
+	schemaMu.Unlock()
+
+	writeJSON(w, map[string]interface{}{
+		"schema":   s.config.PacketSchemaFile,
+		"rejected": rejected,
+		"recent":   recent,
+	})
+}
@@ -2,93 +2,897 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
 	"net/http"
-	"sync"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
 var (
-	// clients is the set of connected WebSocket clients.
-	clients   = make(map[*websocket.Conn]bool)
-	clientsMu sync.Mutex
+	// nextClientID numbers WebSocket connections for admin tooling.
+	nextClientID atomic.Uint64
 
-	// broadcast is buffered so Redis polling is not blocked by slow clients.
-	broadcast = make(chan string, 100)
+	// wsClosedIdle and wsClosedTooLarge count connections closed for going
+	// quiet past WS_IDLE_TIMEOUT and for a message over WS_READ_LIMIT.
+	wsClosedIdle     atomic.Int64
+	wsClosedTooLarge atomic.Int64
 )
 
-// upgrader converts HTTP requests to WebSocket connections and allows all origins.
+// upgrader converts HTTP requests to WebSocket connections. It allows all
+// origins unless CORS_ORIGINS is set (see initCORS).
 var upgrader = websocket.Upgrader{
 	// CheckOrigin allows connections from any origin (for development).
 	CheckOrigin: func(r *http.Request) bool {
 		return true
 	},
+	Error: upgradeFailed,
+}
+
+// upgradeFailed answers a request the upgrader refused in the error envelope.
+func upgradeFailed(w http.ResponseWriter, r *http.Request, status int, reason error) {
+	kind := badQuery
+	switch status {
+	case http.StatusForbidden:
+		kind = forbidden
+	case http.StatusMethodNotAllowed:
+		kind = methodNotAllowed
+	case http.StatusInternalServerError:
+		kind = internalError
+	}
+	writeError(w, kind.errorf("%v", reason))
+}
+
+// client is a connected WebSocket consumer.
+type client struct {
+	// srv is the Server whose hub the client is registered with.
+	srv *Server
+
+	id          uint64
+	conn        *websocket.Conn
+	remoteAddr  string
+	ip          string
+	connectedAt time.Time
+
+	// requestID is the X-Request-ID of the upgrade request, in the
+	// connection's log lines and its hello and error frames.
+	requestID string
+
+	// ctx is the connection's lifetime: it ends when the handler returns or
+	// the server shuts down, and stops writePump and journal replays.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// send queues outgoing frames for writePump, the connection's only writer.
+	send chan []byte
+
+	// qos is the client's class, which sizes send; budget holds the class's
+	// bytes per second. evicting is set, under clientsMu, once the client
+	// was picked to make room for a client of a higher class.
+	qos      *qosClass
+	budget   byteBucket
+	evicting bool
+
+	// proto is the negotiated wire protocol version and features the
+	// capabilities accepted in the handshake (proto 2 and later).
+	proto    int
+	features []string
+
+	// format is the wire format of server frames (formatJSON, or its
+	// jsonFormat for an API version, formatMsgpack, or formatCBOR). JSON
+	// frames are sent as text messages, the others as binary.
+	format string
+
+	// batch coalesces all pending frames into one array frame per write.
+	batch bool
+
+	// alerts enables alert frames.
+	alerts bool
+
+	// status enables feed status (stale/live) frames.
+	status bool
+
+	// annotations enables annotation frames.
+	annotations bool
+
+	// tenant restricts the client's frames to one tenant's edges when scoped;
+	// hub is that tenant's client limit and bandwidth quota.
+	tenant string
+	scoped bool
+	hub    *tenantHub
+
+	// resumable asks for a session the client can resume after reconnecting;
+	// session is the one it got.
+	resumable bool
+	session   *wsSession
+
+	// ackMode enables credit-based flow control: the client reports the bytes it
+	// has received and is skipped while too many bytes are unacknowledged.
+	ackMode    bool
+	sentBytes  atomic.Int64
+	ackedBytes atomic.Int64
+
+	// resync is set when broadcasts were skipped; the client gets a fresh
+	// snapshot once it has caught up.
+	resync atomic.Bool
+
+	// projection limits the summary fields and edges sent to this client (nil sends all).
+	projection atomic.Pointer[projection]
+
+	// replayStop cancels the journal replay the client asked for. Broadcasts
+	// skip the client while it is set.
+	replayStop atomic.Pointer[context.CancelFunc]
+
+	// pause holds back data frames while the client is paused.
+	pause pauseState
+}
+
+// clientMessage is a control frame sent by a WebSocket client.
+type clientMessage struct {
+	Cmd   string `json:"cmd"`
+	Bytes int64  `json:"bytes,omitempty"`
+
+	// Backlog asks a pause command to keep the frames missed while paused.
+	Backlog bool `json:"backlog,omitempty"`
+
+	Fields []string `json:"fields,omitempty"`
+	Filter string   `json:"filter,omitempty"`
+
+	// From, To, and Speed are the window and pacing of a replay command.
+	From  json.RawMessage `json:"from,omitempty"`
+	To    json.RawMessage `json:"to,omitempty"`
+	Speed *float64        `json:"speed,omitempty"`
+}
+
+func newClient(ctx context.Context, s *Server, conn *websocket.Conn, ip, addr string, q *qosClass) *client {
+	ctx, cancel := context.WithCancel(ctx)
+	return &client{
+		srv:         s,
+		id:          nextClientID.Add(1),
+		conn:        conn,
+		remoteAddr:  addr,
+		ip:          ip,
+		connectedAt: time.Now(),
+		requestID:   requestID(ctx),
+		ctx:         ctx,
+		cancel:      cancel,
+		proto:       1,
+		format:      jsonFormat(requestAPIVersion(ctx)),
+		send:        make(chan []byte, q.sendQueue),
+		qos:         q,
+		budget:      newByteBucket(q.maxRate),
+	}
+}
+
+// info describes the client for the admin API. The caller holds clientsMu.
+func (c *client) info() ClientInfo {
+	info := ClientInfo{
+		ID:          c.id,
+		RemoteAddr:  c.remoteAddr,
+		ConnectedAt: c.connectedAt,
+		RequestID:   c.requestID,
+		Proto:       c.proto,
+		Features:    c.features,
+		Format:      c.format,
+		Tenant:      c.tenant,
+		QoS:         c.qos.name,
+		Batch:       c.batch,
+		AckMode:     c.ackMode,
+		Alerts:      c.alerts,
+		Status:      c.status,
+		Session:     c.session != nil,
+		Replaying:   c.replaying(),
+		Paused:      c.pause.paused,
+		Queued:      len(c.send),
+		BytesSent:   c.sentBytes.Load(),
+	}
+	if p := c.projection.Load(); p != nil {
+		info.Fields = p.fields
+		if p.filter != nil {
+			info.Filter = p.filter.source
+		}
+	}
+	if c.ackMode {
+		info.Unacked = c.unacked()
+	}
+	return info
+}
+
+// listClients returns a description of every connected client, ordered by ID.
+func (s *Server) listClients() []ClientInfo {
+	s.clientsMu.Lock()
+	infos := make([]ClientInfo, 0, len(s.clients))
+	for c := range s.clients {
+		infos = append(infos, c.info())
+	}
+	s.clientsMu.Unlock()
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// enqueue queues a frame without blocking, reporting false if the queue is full.
+func (c *client) enqueue(payload []byte) bool {
+	select {
+	case c.send <- payload:
+		return true
+	default:
+		return false
+	}
+}
+
+// guardReads bounds what the client on conn may send: messages of at most
+// WS_READ_LIMIT bytes, and silence of at most WS_IDLE_TIMEOUT. Messages and
+// pongs, which keepAlive provokes, extend the read deadline.
+func guardReads(cfg *Config, conn *websocket.Conn) {
+	conn.SetReadLimit(int64(cfg.WSReadLimit))
+	extendReadDeadline(cfg, conn)
+	conn.SetPongHandler(func(string) error {
+		extendReadDeadline(cfg, conn)
+		return nil
+	})
+}
+
+func extendReadDeadline(cfg *Config, conn *websocket.Conn) {
+	_ = conn.SetReadDeadline(time.Now().Add(cfg.WSIdleTimeout))
+}
+
+// keepAlive pings conn every half WS_IDLE_TIMEOUT until ctx ends, so a live
+// client that has nothing to say still answers before its read deadline.
+// WriteControl may run alongside the connection's writer.
+func keepAlive(ctx context.Context, cfg *Config, conn *websocket.Conn) {
+	ticker := time.NewTicker(cfg.WSIdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(cfg.WSWriteTimeout)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readFailure names why a read from a guarded connection failed when the
+// server ended it, counting it; it returns "" when the client went away.
+func readFailure(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, websocket.ErrReadLimit):
+		wsClosedTooLarge.Add(1)
+		return "message over WS_READ_LIMIT"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		wsClosedIdle.Add(1)
+		return "idle for WS_IDLE_TIMEOUT"
+	}
+	return ""
+}
+
+// writePump writes queued frames until the send channel is closed, the
+// client's context ends, or a write fails or takes longer than
+// WS_WRITE_TIMEOUT. Closing the connection on the way out ends the read loop.
+func (c *client) writePump() {
+	defer c.conn.Close()
+
+	for {
+		var payload []byte
+		select {
+		case <-c.ctx.Done():
+			return
+		case p, ok := <-c.send:
+			if !ok {
+				return
+			}
+			payload = p
+		}
+
+		start := time.Now()
+		c.conn.SetWriteDeadline(start.Add(c.srv.config.WSWriteTimeout))
+		var err error
+		if c.batch {
+			err = c.writeBatch(payload)
+		} else {
+			err = c.writeFrame(payload)
+		}
+		observeWSWrite(time.Since(start))
+		if err != nil {
+			debugLog("Error sending message to WebSocket %s: %v", c.remoteAddr, err)
+			return
+		}
+	}
+}
+
+// messageType is the WebSocket message type for the client's wire format.
+func (c *client) messageType() int {
+	if c.format == formatMsgpack || c.format == formatCBOR {
+		return websocket.BinaryMessage
+	}
+	return websocket.TextMessage
+}
+
+func (c *client) writeFrame(payload []byte) error {
+	if err := c.conn.WriteMessage(c.messageType(), payload); err != nil {
+		return err
+	}
+	c.sentBytes.Add(int64(len(payload)))
+	c.srv.framesSent.Add(1)
+	return nil
+}
+
+// writeBatch writes first plus every frame already pending in the queue as a
+// single array frame: a JSON array, or a msgpack array of the encoded frames.
+func (c *client) writeBatch(first []byte) error {
+	pooled := payloadsPool.Get().(*[][]byte)
+	defer func() {
+		clear(*pooled)
+		*pooled = (*pooled)[:0]
+		payloadsPool.Put(pooled)
+	}()
+
+	payloads := append(*pooled, first)
+	for pending := len(c.send); pending > 0; pending-- {
+		payload, ok := <-c.send
+		if !ok {
+			break
+		}
+		payloads = append(payloads, payload)
+	}
+	*pooled = payloads
+
+	w, err := c.conn.NextWriter(c.messageType())
+	if err != nil {
+		return err
+	}
+
+	n := 0
+	write := func(b []byte) {
+		if err == nil {
+			var m int
+			m, err = w.Write(b)
+			n += m
+		}
+	}
+
+	switch c.format {
+	case formatMsgpack:
+		write(appendMsgpackHeader(nil, len(payloads), 0x90, 0xdc))
+		for _, payload := range payloads {
+			write(payload)
+		}
+	case formatCBOR:
+		write(appendCBORHead(nil, cborArray, uint64(len(payloads))))
+		for _, payload := range payloads {
+			write(payload)
+		}
+	default:
+		write([]byte{'['})
+		for i, payload := range payloads {
+			if i > 0 {
+				write([]byte{','})
+			}
+			write(payload)
+		}
+		write([]byte{']'})
+	}
+
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	c.sentBytes.Add(int64(n))
+	c.srv.framesSent.Add(int64(len(payloads)))
+	return nil
+}
+
+// allow charges n queued bytes to the client's QoS class rate and its
+// tenant's quota, reporting false when either is exhausted.
+func (c *client) allow(n int) bool {
+	if !c.budget.take(n) {
+		c.qos.throttled.Add(1)
+		return false
+	}
+	return c.hub.allow(n)
+}
+
+// unacked reports the bytes sent that the client has not acknowledged yet.
+func (c *client) unacked() int64 {
+	return c.sentBytes.Load() - c.ackedBytes.Load()
+}
+
+// stalled reports whether broadcasts to this client should be held back.
+func (c *client) stalled() bool {
+	return c.ackMode && c.unacked() > c.srv.config.WSAckWindow
+}
+
+// wants reports whether the client takes f: data frames always, alert,
+// status, and annotation frames only when it enabled them, and a scoped
+// client only its tenant's annotations and no alerts.
+func (c *client) wants(f frame) bool {
+	switch {
+	case f.Alert != nil:
+		return c.alerts && !c.scoped
+	case f.Status != nil:
+		return c.status
+	case f.Annotation != nil:
+		return c.annotations && (!c.scoped || f.Annotation.Tenant == c.tenant)
+	}
+	return true
+}
+
+// replaying reports whether the client is playing back the journal, which
+// pauses its live feed.
+func (c *client) replaying() bool {
+	return c.replayStop.Load() != nil
+}
+
+// ack records the cumulative byte count reported by the client and queues a
+// catch-up snapshot if broadcasts were skipped while it was stalled.
+func (c *client) ack(received int64) error {
+	if received > c.ackedBytes.Load() {
+		c.ackedBytes.Store(received)
+	}
+	if c.stalled() || !c.resync.CompareAndSwap(true, false) {
+		return nil
+	}
+
+	payload, err := c.srv.snapshotFrame().encode(c.format, c.projection.Load())
+	if err != nil {
+		return err
+	}
+	if !c.allow(len(payload)) || !c.enqueue(payload) {
+		c.resync.Store(true)
+		return nil
+	}
+	debugLog("Client %s caught up; sending snapshot", c.remoteAddr)
+	return nil
+}
+
+// sendError queues an error frame describing a rejected client request.
+func (c *client) sendError(message string) {
+	payload, err := marshalFrame(c.format, map[string]interface{}{
+		"type":       "error",
+		"message":    message,
+		"request_id": c.requestID,
+	})
+	if err == nil {
+		c.enqueue(payload)
+	}
+}
+
+// newProjection builds the client's projection from fields and its filter,
+// restricted to its tenant when it is scoped. Without a filter of its own,
+// the client gets the tenant's TENANT_FILTERS default.
+func (c *client) newProjection(fields []string, filterSource string) (*projection, error) {
+	return hubProjection(c.hub, c.tenant, c.scoped, fields, filterSource)
+}
+
+// hubProjection builds a subscriber's projection, falling back to the
+// hub's default filter and restricting scoped subscribers to their tenant.
+func hubProjection(hub *tenantHub, tenant string, scoped bool, fields []string, filterSource string) (*projection, error) {
+	if strings.TrimSpace(filterSource) == "" && hub != nil {
+		filterSource = hub.filter
+	}
+	p, err := newProjection(fields, filterSource)
+	if err != nil || !scoped {
+		return p, err
+	}
+	return p.restrict(tenant)
+}
+
+// subscribe replaces the client's field projection and filter and queues a
+// snapshot in the new shape.
+func (c *client) subscribe(fields []string, filterSource string) error {
+	p, err := c.newProjection(fields, filterSource)
+	if err != nil {
+		return err
+	}
+	c.projection.Store(p)
+	if c.dropBacklog() {
+		// Paused: the snapshot follows on resume.
+		return nil
+	}
+
+	payload, err := c.srv.snapshotFrame().encode(c.format, p)
+	if err != nil {
+		return err
+	}
+	if !c.enqueue(payload) {
+		c.resync.Store(true)
+	}
+	return nil
+}
+
+// disconnect closes the connection with the given close reason. The read
+// loop then fails and unregisters the client.
+func (c *client) disconnect(code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	_ = c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	_ = c.conn.Close()
+}
+
+// disconnectClients closes every client matching match with the close code
+// and reason, and reports how many were closed.
+func (s *Server) disconnectClients(match func(c *client) bool, code int, reason string) int {
+	s.clientsMu.Lock()
+	var matched []*client
+	for c := range s.clients {
+		if match(c) {
+			matched = append(matched, c)
+		}
+	}
+	s.clientsMu.Unlock()
+
+	for _, c := range matched {
+		infoLog("Disconnecting WebSocket client %s (id=%d, req=%s): %s", c.remoteAddr, c.id, c.requestID, reason)
+		c.disconnect(code, reason)
+	}
+	return len(matched)
+}
+
+// removeClient unregisters a client and stops its writePump.
+func removeClient(c *client) {
+	c.srv.clientsMu.Lock()
+	defer c.srv.clientsMu.Unlock()
+
+	if _, ok := c.srv.clients[c]; !ok {
+		return
+	}
+	delete(c.srv.clients, c)
+	close(c.send)
 }
 
 // handleMessages broadcasts updates to all connected WebSocket clients.
-// It runs continuously, sending each message from the broadcast channel to all clients.
-func handleMessages() {
-	// Read messages from the broadcast channel forever.
-	for msg := range broadcast {
-		// Send to every connected WebSocket client.
-		clientsMu.Lock()
-		for client := range clients {
-			err := client.WriteMessage(websocket.TextMessage, []byte(msg))
-			if err != nil {
-				debugLog("Error sending message to WebSocket: %v", err)
-				// Remove client if sending fails (connection broken).
-				delete(clients, client)
-				debugLog("Client disconnected: %s", client.RemoteAddr())
+// It runs until ctx ends, delivering each message from the broadcast lanes:
+// a control frame waiting is delivered before the next data frame, so a
+// burst of updates does not hold back alerts.
+// With BROADCAST_SAMPLE_EVERY, it checks its load every
+// overloadCheckInterval and thins updates while overloaded.
+// It is supervised (see supervise): after a panic it is restarted and every
+// client is resynchronized, since the frame being delivered is lost.
+func (s *Server) handleMessages(ctx context.Context) {
+	var check <-chan time.Time
+	if s.config.overloadSampling() {
+		ticker := time.NewTicker(overloadCheckInterval)
+		defer ticker.Stop()
+		check = ticker.C
+	}
+	for {
+		select {
+		case f := <-s.broadcastControl:
+			s.deliverFrame(f)
+			continue
+		default:
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case f := <-s.broadcastControl:
+			s.deliverFrame(f)
+		case f := <-s.broadcast:
+			switch {
+			case f.Type == "snapshot":
+				s.sampler.discard()
+			case f.Type == "update" && !s.sampler.admit(s, &f):
+				continue
 			}
+			s.deliverFrame(f)
+		case <-check:
+			if f, ok := s.sampler.check(s); ok {
+				s.deliverFrame(f)
+			}
+		}
+	}
+}
+
+// deliverFrame numbers f and queues it for every client, journal, stream, and
+// bridge that takes it. Clients that are stalled or whose queue is full skip
+// the message and are resynchronized with a snapshot once they can accept
+// frames again.
+func (s *Server) deliverFrame(f frame) {
+	// Frames are numbered here rather than by producers so seq order is
+	// delivery order.
+	f.Seq = s.frameSeq.Add(1)
+
+	lost := s.framesLost.Swap(false)
+	if lost {
+		// Updates were dropped before reaching the hub; nobody has them.
+		s.resyncClients(f.Seq)
+	}
+
+	msg := newFrameCache(f)
+
+	if s.journal != nil {
+		if payload, err := msg.payload(formatJSON, nil); err == nil {
+			s.journal.append(payload)
+		}
+	}
+	s.publishStreams(msg, lost)
+
+	if f.control() {
+		s.broadcastSideFrame(msg)
+	} else {
+		if nats != nil {
+			nats.publishFrame(msg)
+		}
+		s.queueUpdate(msg)
+	}
+	slo.observeFrame(time.Since(f.published))
+}
+
+// resyncClients marks every client for a snapshot and restarts the replay
+// buffer at seq, after frames were lost on the way to clients.
+func (s *Server) resyncClients(seq uint64) {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	for c := range s.clients {
+		c.resync.Store(true)
+	}
+	s.replay.reset(seq)
+}
+
+// queueUpdate queues an update or snapshot frame for every client, in the
+// client's format and projection, or a snapshot for clients due a resync.
+func (s *Server) queueUpdate(msg *frameCache) {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	s.replay.record(msg.frame)
+
+	var snapshot *frameCache
+	for c := range s.clients {
+		if c.stalled() || c.replaying() {
+			c.resync.Store(true)
+			continue
+		}
+		if c.holdBack(msg) {
+			continue
+		}
+
+		fc := msg
+		resync := c.resync.Load()
+		if resync {
+			if snapshot == nil {
+				snapshot = newFrameCache(s.snapshotFrame())
+			}
+			fc = snapshot
+		}
+
+		payload, err := fc.payload(c.format, c.projection.Load())
+		if err != nil {
+			errorLog("Error encoding %s payload: %v", fc.frame.Type, err)
+			continue
+		}
+		if payload == nil {
+			// Nothing in this update matches the client's filter.
+			continue
+		}
+		if !c.allow(len(payload)) {
+			// Over the class rate or tenant's quota: catch up with a snapshot later.
+			c.resync.Store(true)
+			continue
+		}
+
+		if !c.enqueue(payload) {
+			c.resync.Store(true)
+			debugLog("Send queue full for %s, will resync", c.remoteAddr)
+			continue
+		}
+		if resync {
+			c.resync.Store(false)
+		}
+	}
+}
+
+// broadcastSideFrame queues an alert, status, or annotation frame for every
+// client that wants it. These frames are not replaced by a resync snapshot, so a client
+// that cannot take one misses it (GET /alerts and GET /latest have the
+// current state).
+func (s *Server) broadcastSideFrame(msg *frameCache) {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	s.replay.record(msg.frame)
+	for c := range s.clients {
+		if !c.wants(msg.frame) || c.stalled() || c.replaying() {
+			continue
+		}
+		payload, err := msg.payload(c.format, nil)
+		if err != nil {
+			errorLog("Error encoding %s payload: %v", msg.frame.Type, err)
+			continue
+		}
+		if !c.enqueue(payload) {
+			c.resync.Store(true)
+			debugLog("Send queue full for %s, dropped %s frame", c.remoteAddr, msg.frame.Type)
 		}
-		clientsMu.Unlock()
 	}
 }
 
 // handleWebSocket handles WebSocket connections for real-time updates.
-func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	if s.refuseDraining(w) {
+		return
+	}
+	ip := clientIP(r)
+	tenant, scoped, ok := s.requestTenant(w, r)
+	if !ok {
+		return
+	}
+	q, ok := s.requestQoS(w, r)
+	if !ok {
+		return
+	}
+	hub := hubFor(tenant, scoped)
+	if !hub.join() {
+		debugLog("Rejected WebSocket connection from %s: tenant %s is at its client limit", ip, tenant)
+		writeError(w, unavailable.errorf("Too many clients for tenant %s", tenant))
+		return
+	}
+	defer hub.leave()
+	if !s.admitClient(q) {
+		debugLog("Rejected %s WebSocket connection from %s: WS_MAX_CLIENTS reached", q.name, ip)
+		writeError(w, unavailable.errorf("Too many clients"))
+		return
+	}
+	defer s.releaseClient(q)
+
 	// Upgrade HTTP connection to WebSocket.
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := upgrader.Upgrade(w, r, requestIDResponseHeader(r))
 	if err != nil {
 		errorLog("Error upgrading to WebSocket: %v", err)
 		return
 	}
 	defer conn.Close()
+	guardReads(s.config, conn)
 
-	// Register this client for broadcasts.
-	clientsMu.Lock()
-	clients[conn] = true
-	clientsMu.Unlock()
+	c := newClient(r.Context(), s, conn, ip, remoteAddr(r), q)
+	defer c.cancel()
+	c.tenant, c.scoped, c.hub = tenant, scoped, hub
+	c.ackMode = s.config.WSAckWindow > 0 && r.URL.Query().Get("ack") == "1"
+	c.batch = r.URL.Query().Get("batch") == "1"
+	// Alerts span every tenant, so scoped clients do not get them.
+	c.alerts = !scoped && r.URL.Query().Get("alerts") == "1"
+	c.status = r.URL.Query().Get("status") == "1"
+	c.annotations = r.URL.Query().Get("annotations") == "1"
+	c.resumable = s.config.WSReplayFrames > 0 && r.URL.Query().Get("session") != ""
+	if f := r.URL.Query().Get("format"); f == formatMsgpack || f == formatCBOR {
+		c.format = f
+	}
+	if r.URL.Query().Get("proto") != "" {
+		hello, err := negotiate(c)
+		if err != nil {
+			rejectHandshake(c, err)
+			return
+		}
+		c.enqueue(hello)
+	}
+	fields, filterSource := r.URL.Query().Get("fields"), r.URL.Query().Get("filter")
+	if fields != "" || filterSource != "" || c.scoped {
+		p, err := c.newProjection(strings.Split(fields, ","), filterSource)
+		if err != nil {
+			debugLog("Ignoring invalid subscription from %s: %v", c.remoteAddr, err)
+			c.sendError(err.Error())
+			// Fall back to the tenant alone rather than every tenant's edges.
+			p, _ = c.newProjection(nil, "")
+		}
+		c.projection.Store(p)
+	}
 
-	infoLog("WebSocket connection established: %s", conn.RemoteAddr())
+	// A resumed session replays what the client missed and registers it
+	// instead of sending a snapshot.
+	resumed := false
+	if c.resumable {
+		var found bool
+		c.session, found = s.openSession(r.URL.Query().Get("session"))
+		defer func() { c.session.detach(c.projection.Load()) }()
+		if found {
+			if fields == "" && filterSource == "" && !c.scoped {
+				c.projection.Store(c.session.savedProjection())
+			}
+			if lastSeq, err := strconv.ParseUint(r.URL.Query().Get("last_seq"), 10, 64); err == nil {
+				resumed = c.resume(lastSeq)
+			}
+			if !resumed {
+				debugLog("WebSocket client %s could not resume its session; sending snapshot", c.remoteAddr)
+			}
+		}
+		if !resumed {
+			c.sendSession(false, 0)
+		}
+	}
 
-	// 1. SEND SNAPSHOT IMMEDIATELY
-	snapshot := latestSnapshot()
+	if !resumed {
+		// 1. QUEUE SNAPSHOT IMMEDIATELY, before the client sees any update.
+		payload, err := s.snapshotFrame().encode(c.format, c.projection.Load())
+		if err != nil {
+			errorLog("Failed to encode snapshot: %v", err)
+			return
+		}
+		c.enqueue(payload)
+		if c.status {
+			status := s.currentFeedStatus()
+			if payload, err := (frame{Type: "status", Status: &status, Seq: s.frameSeq.Load()}).encode(c.format, nil); err == nil {
+				c.enqueue(payload)
+			}
+		}
+		if c.alerts {
+			for _, e := range s.currentAlerts() {
+				if payload, err := (frame{Type: "alert", Alert: &e, Seq: s.frameSeq.Load()}).encode(c.format, nil); err == nil {
+					c.enqueue(payload)
+				}
+			}
+		}
 
-	err = conn.WriteJSON(map[string]interface{}{
-		"type": "snapshot",
-		"data": snapshot,
-	})
-	if err != nil {
-		errorLog("Failed to send snapshot: %v", err)
-		clientsMu.Lock()
-		delete(clients, conn)
-		clientsMu.Unlock()
-		return
+		// Register this client for broadcasts.
+		s.clientsMu.Lock()
+		s.clients[c] = true
+		s.clientsMu.Unlock()
 	}
+	defer removeClient(c)
+	defer c.cancelReplay()
+
+	go c.writePump()
+	go keepAlive(c.ctx, s.config, conn)
 
-	// 2. Keep the connection alive
+	infoLog("WebSocket connection established: %s (id=%d, req=%s, proto=%d, qos=%s, ack=%v, batch=%v)", c.remoteAddr, c.id, c.requestID, c.proto, c.qos.name, c.ackMode, c.batch)
+
+	// 2. Keep the connection alive and handle control frames
 	for {
 		_, msg, err := conn.ReadMessage()
 		if err != nil {
-			debugLog("WebSocket connection closed: %s", conn.RemoteAddr())
-			// Remove client when it disconnects.
-			clientsMu.Lock()
-			delete(clients, conn)
-			clientsMu.Unlock()
+			if reason := readFailure(err); reason != "" {
+				infoLog("Closing WebSocket client %s (id=%d, req=%s): %s", c.remoteAddr, c.id, c.requestID, reason)
+				return
+			}
+			debugLog("WebSocket connection closed: %s (id=%d, req=%s)", c.remoteAddr, c.id, c.requestID)
 			return
 		}
-		// Currently we just log client messages.
-		debugLog("Received message from WebSocket client: %s", string(msg))
+		extendReadDeadline(s.config, conn)
+
+		var cm clientMessage
+		if err := json.Unmarshal(msg, &cm); err != nil {
+			debugLog("Received message from WebSocket client: %s", string(msg))
+			continue
+		}
+
+		switch cm.Cmd {
+		case "ack":
+			if err := c.ack(cm.Bytes); err != nil {
+				errorLog("Error encoding catch-up snapshot: %v", err)
+			}
+		case "subscribe":
+			if err := c.subscribe(cm.Fields, cm.Filter); err != nil {
+				debugLog("Rejected subscribe from %s: %v", c.remoteAddr, err)
+				c.sendError(err.Error())
+			}
+		case "replay":
+			if err := c.startReplay(cm); err != nil {
+				debugLog("Rejected replay from %s: %v", c.remoteAddr, err)
+				c.sendError(err.Error())
+			}
+		case "replay_stop":
+			if !c.cancelReplay() {
+				c.sendError("no replay running")
+			}
+		case "pause":
+			c.pauseFeed(cm.Backlog)
+		case "resume":
+			if err := c.resumeFeed(); err != nil {
+				debugLog("Rejected resume from %s: %v", c.remoteAddr, err)
+				c.sendError(err.Error())
+			}
+		default:
+			debugLog("Received message from WebSocket client: %s", string(msg))
+		}
 	}
 }
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"net/url"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"backend/testsupport"
+)
+
+// frameEdges returns the edges of a snapshot or update frame.
+func frameEdges(t *testing.T, f testsupport.Frame) map[string]interface{} {
+	t.Helper()
+	data, ok := f["data"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("%s frame without data: %v", f.Type(), f)
+	}
+	return data
+}
+
+// edgeKeys lists the edge keys of a frame, sorted.
+func edgeKeys(t *testing.T, f testsupport.Frame) []string {
+	t.Helper()
+	var keys []string
+	for key := range frameEdges(t, f) {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestHubBroadcastsUpdatesToEveryClient(t *testing.T) {
+	s := startServer(t)
+	a := dialWS(t, s, "/ws")
+	b := dialWS(t, s, "/ws?batch=1")
+	snapA := expectFrame(t, a, "snapshot")
+	expectFrame(t, b, "snapshot")
+	if n := len(frameEdges(t, snapA)); n != 0 {
+		t.Fatalf("snapshot of an empty view has %d edges", n)
+	}
+
+	ts := int(time.Now().Unix())
+	ingest(t, s, testPacket("10.0.0.1", "10.0.0.2", ts, 1, 100))
+	upA := expectFrame(t, a, "update")
+	upB := expectFrame(t, b, "update")
+
+	if upA.Seq() != upB.Seq() {
+		t.Errorf("clients got seq %d and %d for the same update", upA.Seq(), upB.Seq())
+	}
+	if upA.Seq() <= snapA.Seq() {
+		t.Errorf("update seq %d not after snapshot seq %d", upA.Seq(), snapA.Seq())
+	}
+	for _, f := range []testsupport.Frame{upA, upB} {
+		edge, _ := frameEdges(t, f)["10.0.0.1:10.0.0.2"].(map[string]interface{})
+		if edge["total_bytes"] != float64(100) {
+			t.Errorf("update edge = %v, want total_bytes 100", edge)
+		}
+	}
+
+	// A client connecting now starts from the view, not from the updates.
+	c := dialWS(t, s, "/ws")
+	if keys := edgeKeys(t, expectFrame(t, c, "snapshot")); len(keys) != 1 || keys[0] != "10.0.0.1:10.0.0.2" {
+		t.Errorf("late snapshot edges = %v", keys)
+	}
+}
+
+func TestClientFilterAndProjection(t *testing.T) {
+	s := startServer(t)
+	ts := int(time.Now().Unix())
+	ingest(t, s, testPacket("10.0.0.1", "10.0.0.2", ts, 1, 100), testPacket("10.0.0.3", "10.0.0.2", ts, 1, 5))
+
+	ws := dialWS(t, s, "/ws?fields=src,dest,total_bytes&filter="+url.QueryEscape(`src == "10.0.0.1"`))
+	snap := expectFrame(t, ws, "snapshot")
+	if keys := edgeKeys(t, snap); len(keys) != 1 || keys[0] != "10.0.0.1:10.0.0.2" {
+		t.Fatalf("filtered snapshot edges = %v", keys)
+	}
+	edge := frameEdges(t, snap)["10.0.0.1:10.0.0.2"].(map[string]interface{})
+	if len(edge) != 3 || edge["src"] != "10.0.0.1" || edge["dest"] != "10.0.0.2" || edge["total_bytes"] != float64(100) {
+		t.Fatalf("projected edge = %v, want src, dest, and total_bytes", edge)
+	}
+
+	// An update touching only filtered-out edges is not sent.
+	ingest(t, s, testPacket("10.0.0.3", "10.0.0.2", ts+1, 1, 6))
+	if err := ws.ExpectNone("update", 500*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	ingest(t, s, testPacket("10.0.0.1", "10.0.0.2", ts+1, 1, 200), testPacket("10.0.0.3", "10.0.0.2", ts+2, 1, 7))
+	if keys := edgeKeys(t, expectFrame(t, ws, "update")); len(keys) != 1 || keys[0] != "10.0.0.1:10.0.0.2" {
+		t.Fatalf("filtered update edges = %v", keys)
+	}
+
+	// subscribe replaces the filter and answers with a snapshot in the new shape.
+	if err := ws.Send(map[string]interface{}{"cmd": "subscribe", "filter": `src == "10.0.0.3"`}); err != nil {
+		t.Fatal(err)
+	}
+	snap = expectFrame(t, ws, "snapshot")
+	if keys := edgeKeys(t, snap); len(keys) != 1 || keys[0] != "10.0.0.3:10.0.0.2" {
+		t.Fatalf("resubscribed snapshot edges = %v", keys)
+	}
+	if edge := frameEdges(t, snap)["10.0.0.3:10.0.0.2"].(map[string]interface{}); edge["tcp_bytes_total"] != float64(7) {
+		t.Fatalf("resubscribed edge = %v, want every field", edge)
+	}
+
+	if err := ws.Send(map[string]interface{}{"cmd": "subscribe", "filter": "src =="}); err != nil {
+		t.Fatal(err)
+	}
+	expectFrame(t, ws, "error")
+}
+
+func TestSessionResumeReplaysMissedFrames(t *testing.T) {
+	s := startServer(t)
+	ws := dialWS(t, s, "/ws?session=1")
+	session := expectFrame(t, ws, "session")
+	token, _ := session["token"].(string)
+	if token == "" || session["resumed"] != false {
+		t.Fatalf("session frame = %v", session)
+	}
+	snap := expectFrame(t, ws, "snapshot")
+	ws.Close()
+	// The server detaches the session once it sees the close.
+	time.Sleep(200 * time.Millisecond)
+
+	ts := int(time.Now().Unix())
+	ingest(t, s, testPacket("10.0.0.1", "10.0.0.2", ts, 1, 100))
+	ingest(t, s, testPacket("10.0.0.1", "10.0.0.2", ts+1, 1, 200))
+
+	ws = dialWS(t, s, "/ws?session="+url.QueryEscape(token)+"&last_seq="+strconv.FormatUint(snap.Seq(), 10))
+	session = expectFrame(t, ws, "session")
+	if session["token"] != token || session["resumed"] != true || session["replayed"] != float64(2) {
+		t.Fatalf("resumed session frame = %v, want 2 frames replayed", session)
+	}
+	first := expectFrame(t, ws, "update")
+	second := expectFrame(t, ws, "update")
+	if second.Seq() != first.Seq()+1 {
+		t.Errorf("replayed seqs %d, %d are not consecutive", first.Seq(), second.Seq())
+	}
+	edge := frameEdges(t, second)["10.0.0.1:10.0.0.2"].(map[string]interface{})
+	if edge["total_bytes"] != float64(200) {
+		t.Errorf("last replayed edge = %v, want total_bytes 200", edge)
+	}
+	if err := ws.ExpectNone("snapshot", 300*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	// An unknown token starts over with a snapshot.
+	other := dialWS(t, s, "/ws?session=unknown&last_seq=1")
+	if f := expectFrame(t, other, "session"); f["resumed"] != false {
+		t.Fatalf("unknown session frame = %v", f)
+	}
+	expectFrame(t, other, "snapshot")
+}
+
+func TestJournalReplay(t *testing.T) {
+	s := startServer(t, "JOURNAL_DIR="+t.TempDir())
+	ws := dialWS(t, s, "/ws")
+	expectFrame(t, ws, "snapshot")
+	ts := int(time.Now().Unix())
+	ingest(t, s, testPacket("10.0.0.1", "10.0.0.2", ts, 1, 100))
+	live := expectFrame(t, ws, "update")
+	// The journal is flushed every journalFlushInterval.
+	time.Sleep(journalFlushInterval + 500*time.Millisecond)
+
+	replay := dialWS(t, s, "/replay?speed=0")
+	expectFrame(t, replay, "snapshot")
+	f := expectFrame(t, replay, "update")
+	if f.Seq() != live.Seq() {
+		t.Errorf("replayed update seq %d, want the original %d", f.Seq(), live.Seq())
+	}
+	if keys := edgeKeys(t, f); len(keys) != 1 || keys[0] != "10.0.0.1:10.0.0.2" {
+		t.Errorf("replayed update edges = %v", keys)
+	}
+	if err := replay.ExpectClose(1000, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
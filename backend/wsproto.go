@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// wsProtoVersion is the newest wire protocol the server speaks. Version 1 is
+	// the original handshake-free protocol.
+	wsProtoVersion = 2
+
+	// wsHandshakeTimeout bounds how long a proto 2 client may take to send its handshake.
+	wsHandshakeTimeout = 5 * time.Second
+)
+
+// wsFeatures are the capabilities a client may negotiate in its handshake.
+// Each enables the feature on the client and reports whether it was accepted.
+var wsFeatures = map[string]func(c *client) bool{
+	// Alerts span every tenant, so scoped clients are refused them.
+	"alerts": func(c *client) bool {
+		c.alerts = !c.scoped
+		return c.alerts
+	},
+	"status": func(c *client) bool {
+		c.status = true
+		return true
+	},
+	"annotations": func(c *client) bool {
+		c.annotations = true
+		return true
+	},
+	"ack": func(c *client) bool {
+		c.ackMode = c.srv.config.WSAckWindow > 0
+		return c.ackMode
+	},
+	"batch": func(c *client) bool {
+		c.batch = true
+		return true
+	},
+	"fields": func(c *client) bool {
+		return true
+	},
+	"filter": func(c *client) bool {
+		return true
+	},
+	"session": func(c *client) bool {
+		c.resumable = c.srv.config.WSReplayFrames > 0
+		return c.resumable
+	},
+	"replay": func(c *client) bool {
+		return c.srv.journal != nil
+	},
+	"msgpack": func(c *client) bool {
+		c.format = formatMsgpack
+		return true
+	},
+	"cbor": func(c *client) bool {
+		c.format = formatCBOR
+		return true
+	},
+}
+
+// handshake is the first frame sent by clients speaking proto 2 or later.
+type handshake struct {
+	Proto    int      `json:"proto"`
+	Features []string `json:"features"`
+}
+
+// negotiate reads the client's handshake, enables the accepted features, and
+// returns the hello frame to send back.
+func negotiate(c *client) ([]byte, error) {
+	_ = c.conn.SetReadDeadline(time.Now().Add(wsHandshakeTimeout))
+	_, msg, err := c.conn.ReadMessage()
+	if err != nil {
+		return nil, fmt.Errorf("read handshake: %w", err)
+	}
+	extendReadDeadline(c.srv.config, c.conn)
+
+	var hs handshake
+	if err := json.Unmarshal(msg, &hs); err != nil || hs.Proto < 2 {
+		return nil, fmt.Errorf("invalid handshake %q", msg)
+	}
+
+	c.proto = min(hs.Proto, wsProtoVersion)
+	c.features = []string{}
+	for _, name := range hs.Features {
+		if enable, ok := wsFeatures[name]; ok && enable(c) {
+			c.features = append(c.features, name)
+		}
+	}
+	sort.Strings(c.features)
+
+	// The hello frame is already in the negotiated format.
+	return marshalFrame(c.format, map[string]interface{}{
+		"type":       "hello",
+		"proto":      c.proto,
+		"features":   c.features,
+		"request_id": c.requestID,
+	})
+}
+
+// rejectHandshake closes a connection whose handshake could not be negotiated.
+func rejectHandshake(c *client, err error) {
+	debugLog("WebSocket handshake from %s (req=%s) failed: %v", c.remoteAddr, c.requestID, err)
+	msg := websocket.FormatCloseMessage(websocket.CloseProtocolError, "invalid handshake")
+	_ = c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+}
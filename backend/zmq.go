@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ZMTP 3.0 framing constants.
+const (
+	zmtpFlagMore    = 0x01
+	zmtpFlagLong    = 0x02
+	zmtpFlagCommand = 0x04
+
+	zmtpGreetingSize = 64
+	zmtpMaxFrame     = 16 << 20
+
+	zmqDialTimeout = 5 * time.Second
+	zmqMaxBackoff  = 30 * time.Second
+)
+
+// zmqInput receives traffic messages on a ZeroMQ SUB or PULL socket using a
+// minimal ZMTP 3.0 implementation (NULL security only). Each message's last
+// frame is a packet object or array of packets in the Packet JSON shape.
+type zmqInput struct {
+	srv        *Server
+	socketType string
+	host       string
+	bind       bool
+}
+
+func (s *Server) initZMQInput(ctx context.Context) {
+	if s.config.ZMQEndpoint == "" {
+		return
+	}
+
+	socketType := strings.ToUpper(s.config.ZMQSocket)
+	if socketType != "SUB" && socketType != "PULL" {
+		errorLog("Invalid ZMQ_SOCKET %q (want sub or pull)", s.config.ZMQSocket)
+		return
+	}
+
+	u, err := url.Parse(s.config.ZMQEndpoint)
+	if err != nil || u.Scheme != "tcp" || u.Host == "" {
+		errorLog("Invalid ZMQ_ENDPOINT %q (want tcp://host:port or tcp://*:port)", s.config.ZMQEndpoint)
+		return
+	}
+
+	in := &zmqInput{srv: s, socketType: socketType, host: u.Host}
+	if strings.HasPrefix(u.Host, "*:") {
+		in.bind = true
+		in.host = strings.TrimPrefix(u.Host, "*")
+	}
+
+	if in.bind {
+		go in.listen(ctx)
+	} else {
+		go in.connect(ctx)
+	}
+}
+
+// connect dials a bound PUB/PUSH peer, reconnecting with backoff.
+func (in *zmqInput) connect(ctx context.Context) {
+	infoLog("ZeroMQ %s input connecting to %s", in.socketType, in.host)
+
+	policy := backoff{base: time.Second, max: zmqMaxBackoff}
+	for attempt := 0; ; attempt++ {
+		dialer := net.Dialer{Timeout: zmqDialTimeout}
+		conn, err := dialer.DialContext(ctx, "tcp", in.host)
+		if err == nil {
+			attempt = 0
+			err = in.serve(ctx, conn)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		errorLog("ZeroMQ input %s: %v", in.host, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(policy.delay(attempt)):
+		}
+	}
+}
+
+// listen accepts PUB/PUSH peers that connect to us.
+func (in *zmqInput) listen(ctx context.Context) {
+	ln, err := net.Listen("tcp", in.host)
+	if err != nil {
+		errorLog("ZeroMQ input listen on %s: %v", in.host, err)
+		return
+	}
+	infoLog("ZeroMQ %s input listening on %s", in.socketType, in.host)
+
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				errorLog("ZeroMQ input accept: %v", err)
+			}
+			return
+		}
+		go func() {
+			if err := in.serve(ctx, conn); err != nil && ctx.Err() == nil {
+				debugLog("ZeroMQ peer %s: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// serve performs the ZMTP handshake and ingests messages until the peer goes away.
+func (in *zmqInput) serve(ctx context.Context, conn net.Conn) error {
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	if err := in.handshake(conn, r); err != nil {
+		return fmt.Errorf("handshake: %w", err)
+	}
+	debugLog("ZeroMQ peer %s ready", conn.RemoteAddr())
+
+	if in.socketType == "SUB" {
+		// ZMTP 3.0 subscription: a message whose body is 0x01 + prefix (empty = everything).
+		if err := writeZMTPFrame(conn, 0, []byte{1}); err != nil {
+			return err
+		}
+	}
+
+	// Results come back in submission order, so channels lines up each
+	// result with the channel of its message. It holds every message in
+	// flight: the stream's window, one being delivered, one being submitted.
+	channels := make(chan *ingestChannel, cap(decodeJobs)+2)
+	stream := newDecodeStream(func(packets []Packet, err error) {
+		ch := <-channels
+		if err != nil {
+			ch.decodeFailed(err)
+			debugLog("ZeroMQ input: skipping undecodable message: %v", err)
+			return
+		}
+		ch.decoded(len(packets))
+		in.srv.ingestPackets("zmq", packets)
+		releasePackets(packets)
+	})
+	defer stream.close()
+
+	for {
+		parts, err := readZMTPMessage(r)
+		if err != nil {
+			return err
+		}
+		if len(parts) == 0 {
+			continue
+		}
+		ch := channelFor(zmqChannel(parts))
+		ch.message(len(parts[len(parts)-1]))
+		channels <- ch
+		for _, part := range parts[:len(parts)-1] {
+			putBuffer(part)
+		}
+		stream.submit(parts[len(parts)-1])
+	}
+}
+
+func (in *zmqInput) handshake(conn net.Conn, r *bufio.Reader) error {
+	_ = conn.SetDeadline(time.Now().Add(zmqDialTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	greeting := make([]byte, zmtpGreetingSize)
+	greeting[0] = 0xff
+	greeting[9] = 0x7f
+	greeting[10] = 3 // version 3.0
+	copy(greeting[12:32], "NULL")
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+
+	peer := make([]byte, zmtpGreetingSize)
+	if _, err := io.ReadFull(r, peer); err != nil {
+		return err
+	}
+	if peer[0] != 0xff || peer[9]&0x01 != 0x01 || peer[10] < 3 {
+		return errors.New("peer does not speak ZMTP 3")
+	}
+	if mech := strings.TrimRight(string(peer[12:32]), "\x00"); mech != "NULL" {
+		return fmt.Errorf("unsupported security mechanism %q", mech)
+	}
+
+	ready := []byte{5}
+	ready = append(ready, "READY"...)
+	ready = append(ready, byte(len("Socket-Type")))
+	ready = append(ready, "Socket-Type"...)
+	ready = binary.BigEndian.AppendUint32(ready, uint32(len(in.socketType)))
+	ready = append(ready, in.socketType...)
+	if err := writeZMTPFrame(conn, zmtpFlagCommand, ready); err != nil {
+		return err
+	}
+
+	flags, body, err := readZMTPFrame(r)
+	if err != nil {
+		return err
+	}
+	if flags&zmtpFlagCommand == 0 || len(body) < 6 || string(body[1:6]) != "READY" {
+		return errors.New("expected READY command")
+	}
+	return nil
+}
+
+func writeZMTPFrame(w io.Writer, flags byte, body []byte) error {
+	var header []byte
+	if len(body) > 255 {
+		header = binary.BigEndian.AppendUint64([]byte{flags | zmtpFlagLong}, uint64(len(body)))
+	} else {
+		header = []byte{flags, byte(len(body))}
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+func readZMTPFrame(r *bufio.Reader) (byte, []byte, error) {
+	flags, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var size uint64
+	if flags&zmtpFlagLong != 0 {
+		var b [8]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(b[:])
+	} else {
+		n, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		size = uint64(n)
+	}
+	if size > zmtpMaxFrame {
+		return 0, nil, fmt.Errorf("frame of %d bytes exceeds limit", size)
+	}
+
+	// Bodies come from bufferPool; data frames go back via decodeStream.
+	body := getBuffer(int(size))
+	if _, err := io.ReadFull(r, body); err != nil {
+		putBuffer(body)
+		return 0, nil, err
+	}
+	return flags, body, nil
+}
+
+// readZMTPMessage reads one multipart message, skipping commands such as PING.
+func readZMTPMessage(r *bufio.Reader) ([][]byte, error) {
+	var parts [][]byte
+	for {
+		flags, body, err := readZMTPFrame(r)
+		if err != nil {
+			return nil, err
+		}
+		if flags&zmtpFlagCommand != 0 {
+			putBuffer(body)
+			continue
+		}
+		parts = append(parts, body)
+		if flags&zmtpFlagMore == 0 {
+			return parts, nil
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestWriteZMTPFrame(t *testing.T) {
+	var b bytes.Buffer
+	if err := writeZMTPFrame(&b, zmtpFlagMore, []byte("ab")); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0x01, 0x02, 'a', 'b'}; !bytes.Equal(b.Bytes(), want) {
+		t.Fatalf("short frame % x, want % x", b.Bytes(), want)
+	}
+
+	b.Reset()
+	long := bytes.Repeat([]byte{'x'}, 256)
+	if err := writeZMTPFrame(&b, 0, long); err != nil {
+		t.Fatal(err)
+	}
+	want := append([]byte{0x02, 0, 0, 0, 0, 0, 0, 0x01, 0x00}, long...)
+	if !bytes.Equal(b.Bytes(), want) {
+		t.Fatalf("long frame header % x, want % x", b.Bytes()[:9], want[:9])
+	}
+}
+
+func TestReadZMTPMessage(t *testing.T) {
+	stream := []byte{
+		0x01, 0x05, 't', 'o', 'p', 'i', 'c', // first part, more follow
+		0x04, 0x05, 0x04, 'P', 'I', 'N', 'G', // a command between the parts
+		0x02, 0, 0, 0, 0, 0, 0, 0, 0x02, '{', '}', // last part, long form
+		0x00, 0x01, 'x', // a second message
+	}
+	r := bufio.NewReader(bytes.NewReader(stream))
+	parts, err := readZMTPMessage(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 2 || string(parts[0]) != "topic" || string(parts[1]) != "{}" {
+		t.Fatalf("first message %q", parts)
+	}
+	if zmqChannel(parts) != "zmq:topic" {
+		t.Errorf("channel %q", zmqChannel(parts))
+	}
+	if parts, err = readZMTPMessage(r); err != nil || len(parts) != 1 || string(parts[0]) != "x" {
+		t.Fatalf("second message %q (%v)", parts, err)
+	}
+	if _, err := readZMTPMessage(r); err != io.EOF {
+		t.Fatalf("at the end of the stream: %v, want EOF", err)
+	}
+
+	oversized := binary.BigEndian.AppendUint64([]byte{zmtpFlagLong}, zmtpMaxFrame+1)
+	if _, err := readZMTPMessage(bufio.NewReader(bytes.NewReader(oversized))); err == nil || err == io.EOF {
+		t.Fatalf("oversized frame: %v, want an error", err)
+	}
+}
+
+// zmtpTestGreeting is a ZMTP 3.0 greeting with the NULL mechanism.
+func zmtpTestGreeting() []byte {
+	g := make([]byte, zmtpGreetingSize)
+	g[0], g[9], g[10], g[11] = 0xff, 0x7f, 3, 0
+	copy(g[12:], "NULL")
+	return g
+}
+
+// zmtpTestReady is the READY command of a socketType peer, framed.
+func zmtpTestReady(socketType string) []byte {
+	body := append([]byte{5}, "READY"...)
+	body = append(body, 11)
+	body = append(body, "Socket-Type"...)
+	body = binary.BigEndian.AppendUint32(body, uint32(len(socketType)))
+	body = append(body, socketType...)
+	return append([]byte{zmtpFlagCommand, byte(len(body))}, body...)
+}
+
+// acceptZMTPSubscriber plays a bound PUB socket: it accepts one SUB peer,
+// checks its greeting, READY, and subscription, and returns the connection.
+func acceptZMTPSubscriber(t *testing.T, l net.Listener) net.Conn {
+	t.Helper()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(append(zmtpTestGreeting(), zmtpTestReady("PUB")...)); err != nil {
+		t.Fatal(err)
+	}
+
+	greeting := make([]byte, zmtpGreetingSize)
+	if _, err := io.ReadFull(conn, greeting); err != nil {
+		t.Fatal(err)
+	}
+	if want := zmtpTestGreeting(); !bytes.Equal(greeting, want) {
+		t.Fatalf("greeting\n got % x\nwant % x", greeting, want)
+	}
+	want := append(zmtpTestReady("SUB"), 0x00, 0x01, 0x01) // READY, then subscribe to everything
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("READY and subscription\n got % x\nwant % x", got, want)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn
+}
+
+// TestZMQInputSubscribes runs the backend as a SUB socket connecting to a
+// PUB peer played by the test, and checks a published packet reaches the
+// view.
+func TestZMQInputSubscribes(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	s := startServer(t, "ZMQ_ENDPOINT=tcp://"+l.Addr().String(), "ZMQ_SOCKET=sub")
+
+	conn := acceptZMTPSubscriber(t, l)
+	defer conn.Close()
+
+	body, err := json.Marshal(testPacket("10.0.0.1", "10.0.0.2", int(time.Now().Unix()), 1, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg bytes.Buffer
+	writeZMTPFrame(&msg, zmtpFlagMore, []byte("lab"))
+	writeZMTPFrame(&msg, 0, body)
+	if _, err := conn.Write(msg.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		resp, err := http.Get(s.URL + "/latest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var latest struct {
+			Data map[string]PacketSummary `json:"data"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&latest)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if latest.Data["10.0.0.1:10.0.0.2"].TCPBytesTotal == 100 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("/latest after a ZeroMQ message: %v", latest.Data)
+		}
+	}
+}
+
+func TestZMQHandshakeRejectsOtherMechanisms(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		g := zmtpTestGreeting()
+		copy(g[12:32], "CURVE\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00")
+		io.ReadFull(client, make([]byte, zmtpGreetingSize))
+		client.Write(g)
+	}()
+	in := &zmqInput{socketType: "PULL"}
+	if err := in.handshake(server, bufio.NewReader(server)); err == nil {
+		t.Fatal("a CURVE peer was accepted")
+	}
+}